@@ -0,0 +1,91 @@
+package dedup
+
+const (
+	adaptInterval = 32 // Number of blocks between adjustments.
+	adaptMinShift = 2  // Largest average block size is maxSize >> adaptMinShift.
+	adaptMaxShift = 6  // Smallest average block size is maxSize >> adaptMaxShift.
+)
+
+// adaptiveState tracks the deduplication hit rate of recent blocks,
+// and adjusts the average block size of an adaptive writer.
+//
+// The block size must only depend on the input, not on how far
+// the block writer has come, so adjustments use the hit rate of
+// a fixed range of earlier blocks. Adjustment k is made when
+// (k+2)*adaptInterval blocks have been cut, and uses the blocks
+// from k*adaptInterval to (k+1)*adaptInterval, waiting for them
+// to be written if needed.
+type adaptiveState struct {
+	// Protected by the mutex of the writer.
+	hits  int   // Number of duplicate blocks.
+	total int   // Number of blocks.
+	marks []int // Value of hits after each adaptInterval blocks, not yet used.
+
+	// Only accessed by the chunker.
+	maxSize  int
+	shift    uint // Average block size is maxSize >> shift
+	cut      int  // Number of blocks cut.
+	seenHits int  // Value of hits at the end of the last range used.
+}
+
+// report will record if a block was a duplicate.
+// It is called by the block writers with the mutex of the writer held.
+func (a *adaptiveState) report(hit bool) {
+	if hit {
+		a.hits++
+	}
+	a.total++
+	if a.total%adaptInterval == 0 {
+		a.marks = append(a.marks, a.hits)
+	}
+}
+
+// update must be called by the chunker each time a block has been cut.
+// When an adjustment is due, the average block size is adjusted.
+// A low hit rate will increase the block size,
+// and a high hit rate will decrease it.
+// The hash limit for the new block size is returned.
+func (a *adaptiveState) update(w *writer) uint32 {
+	a.cut++
+	if a.cut%adaptInterval != 0 || a.cut < 2*adaptInterval {
+		return a.maxHash()
+	}
+	w.mu.Lock()
+	for len(a.marks) == 0 && w.err == nil && w.ctxErr() == nil {
+		w.cond().Wait()
+	}
+	if len(a.marks) == 0 {
+		// Failed, the block size doesn't matter.
+		w.mu.Unlock()
+		return a.maxHash()
+	}
+	hits := a.marks[0]
+	a.marks = a.marks[1:]
+	w.mu.Unlock()
+
+	rate := float64(hits-a.seenHits) / adaptInterval
+	switch {
+	case rate < 1.0/8 && a.shift > adaptMinShift:
+		a.shift--
+	case rate > 1.0/2 && a.shift < adaptMaxShift:
+		a.shift++
+	}
+	a.seenHits = hits
+	return a.maxHash()
+}
+
+// maxHash returns the hash limit for the current average block size.
+func (a *adaptiveState) maxHash() uint32 {
+	return uint32((1 << 32) / uint64(a.maxSize>>a.shift))
+}
+
+// newAdaptiveWriter returns a zpaq based writer, where the average
+// block size is adjusted based on the deduplication hit rate.
+func newAdaptiveWriter(w *writer, maxSize uint) *zpaqWriter {
+	a := &adaptiveState{maxSize: int(maxSize), shift: (adaptMinShift + adaptMaxShift) / 2}
+	w.adapt = a
+	z := newZpaqWriter(maxSize)
+	z.adapt = a
+	z.maxHash = a.maxHash()
+	return z
+}
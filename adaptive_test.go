@@ -0,0 +1,217 @@
+package dedup_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/klauspost/dedup"
+)
+
+// Returns mixed data, where the first half is unique,
+// and the second half consists of repeated sections.
+func getMixedData(n int) []byte {
+	b := getBufferSize(n).Bytes()
+	const section = 10 << 10
+	for i := n / 2; i+section <= n; i += section {
+		src := (i / section % 7) * section
+		copy(b[i:i+section], b[src:src+section])
+	}
+	return b
+}
+
+func TestAdaptiveRoundtrip(t *testing.T) {
+	const size = 64 << 10
+	b := getMixedData(10<<20 + 65)
+
+	idx := bytes.Buffer{}
+	data := bytes.Buffer{}
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeAdaptive, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("Adaptive Index size:", idx.Len())
+	t.Log("Adaptive Data size:", data.Len())
+
+	r, err := dedup.NewReader(&idx, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, out) {
+		t.Fatal("Output mismatch")
+	}
+
+	stream := bytes.Buffer{}
+	w, err = dedup.NewStreamWriter(&stream, dedup.ModeAdaptive, size, 100*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, err := dedup.NewStreamReader(&stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = ioutil.ReadAll(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, out) {
+		t.Fatal("Stream output mismatch")
+	}
+}
+
+func TestAdaptiveBlockSize(t *testing.T) {
+	const size = 64 << 10
+	// Unique data should result in bigger blocks.
+	b := getBufferSize(10 << 20).Bytes()
+	idx := bytes.Buffer{}
+	data := bytes.Buffer{}
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeAdaptive, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := dedup.NewReader(&idx, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := r.BlockSizes()
+	avg := len(b) / len(blocks)
+	t.Log("Average block size:", avg, "bytes")
+	if avg < size/8 {
+		t.Fatal("average block size did not grow on unique data, was", avg)
+	}
+	r.Close()
+}
+
+// slowWriter delays each write by a random duration.
+type slowWriter struct {
+	bytes.Buffer
+	rng *rand.Rand
+}
+
+func (s *slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(time.Duration(s.rng.Intn(100)) * time.Microsecond)
+	return s.Buffer.Write(b)
+}
+
+func TestAdaptiveDeterministic(t *testing.T) {
+	const size = 64 << 10
+	b := getMixedData(4 << 20)
+	var wantIdx, wantData bytes.Buffer
+	w, err := dedup.NewWriter(&wantIdx, &wantData, dedup.ModeAdaptive, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	// The block writer lags behind the chunker by different amounts,
+	// which must not affect the output.
+	for i := 0; i < 3; i++ {
+		var idx bytes.Buffer
+		data := &slowWriter{rng: rand.New(rand.NewSource(int64(i)))}
+		w, err := dedup.NewWriter(&idx, data, dedup.ModeAdaptive, size, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(wantIdx.Bytes(), idx.Bytes()) || !bytes.Equal(wantData.Bytes(), data.Bytes()) {
+			t.Fatal("run", i, "output mismatch")
+		}
+	}
+}
+
+// Compares adaptive blocks to small fixed and dynamic blocks on mixed data.
+func TestAdaptiveMixed(t *testing.T) {
+	b := getMixedData(10 << 20)
+	for _, test := range []struct {
+		name string
+		mode dedup.Mode
+		size uint
+	}{
+		{name: "fixed 4K", mode: dedup.ModeFixed, size: 4 << 10},
+		{name: "dynamic 16K", mode: dedup.ModeDynamic, size: 16 << 10},
+		{name: "adaptive 64K", mode: dedup.ModeAdaptive, size: 64 << 10},
+	} {
+		idx := bytes.Buffer{}
+		data := bytes.Buffer{}
+		w, err := dedup.NewWriter(&idx, &data, test.mode, test.size, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(w, bytes.NewBuffer(b))
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%s: %d blocks, index size %d, data size %d (%d%%)", test.name, w.Blocks(), idx.Len(), data.Len(), data.Len()*100/len(b))
+	}
+}
+
+// Maximum block size: 64k, mixed data.
+func BenchmarkAdaptiveWriter64K(t *testing.B) {
+	const size = 64 << 10
+	b := getMixedData(10 << 20)
+	t.ResetTimer()
+	t.SetBytes(int64(len(b)))
+	for i := 0; i < t.N; i++ {
+		w, _ := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeAdaptive, size, 0)
+		io.Copy(w, bytes.NewBuffer(b))
+		err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Index size and stored data on mixed data,
+// adaptive blocks of up to 64K compared to fixed 4K blocks.
+func BenchmarkAdaptiveRatio64K(t *testing.B) {
+	b := getMixedData(10 << 20)
+	var idxSize, dataSize [2]int
+	t.ResetTimer()
+	t.SetBytes(int64(len(b)))
+	for i := 0; i < t.N; i++ {
+		for j, mode := range []dedup.Mode{dedup.ModeFixed, dedup.ModeAdaptive} {
+			size := uint(4 << 10)
+			if mode == dedup.ModeAdaptive {
+				size = 64 << 10
+			}
+			var idx, data bytes.Buffer
+			w, _ := dedup.NewWriter(&idx, &data, mode, size, 0)
+			io.Copy(w, bytes.NewBuffer(b))
+			err := w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			idxSize[j], dataSize[j] = idx.Len(), data.Len()
+		}
+	}
+	t.ReportMetric(float64(idxSize[0]), "fixed-index-bytes")
+	t.ReportMetric(float64(idxSize[1]), "adaptive-index-bytes")
+	t.ReportMetric(float64(dataSize[0])*100/float64(len(b)), "%fixed-data")
+	t.ReportMetric(float64(dataSize[1])*100/float64(len(b)), "%adaptive-data")
+}
@@ -0,0 +1,131 @@
+package dedup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// columnTrailerSize is the size of the trailer of a columnar block stream.
+const columnTrailerSize = 16
+
+// ErrNotColumnar is returned by ReadColumns if the block stream
+// doesn't contain valid columns.
+var ErrNotColumnar = errors.New("dedup: block stream has no valid columns")
+
+// NewColumnarWriter will create a deduplicator that writes the hash and the length
+// of each unique block in separate columns at the end of the block stream.
+//
+// The block data is written like NewWriter does, so the output can be decoded
+// by NewReader, NewSeekReader and NewReaderAt. When the writer is closed,
+// the hashes of all unique blocks are written together, followed by all lengths,
+// and a trailer with the size of the columns.
+// The index is flagged, so readers can tell the columns are present.
+//
+// The columns can be read with ReadColumns without reading any block data,
+// which makes scanning block metadata cheap. The tradeoff is that the
+// columns are only available when the stream is complete, and must be
+// located from the end of the block stream, so the block stream must be seekable.
+// The hashes and lengths are kept in memory until the writer is closed.
+//
+// WithDeltaEncoding is not supported.
+// The returned writer must be closed to flush the remaining data.
+func NewColumnarWriter(index io.Writer, blocks io.Writer, mode Mode, maxSize, maxMemory uint, opts ...Option) (Writer, error) {
+	opts = append(opts[:len(opts):len(opts)], withColumns)
+	return newIndexWriter(index, blocks, nil, mode, maxSize, maxMemory, opts)
+}
+
+// withColumns will enable columns on a writer.
+// It must be applied after all other options.
+func withColumns(w *writer) error {
+	if w.delta != nil {
+		return errors.New("dedup: delta blocks not supported by columnar writer")
+	}
+	w.cols = &columns{}
+	w.flags |= flagColumnar
+	return nil
+}
+
+// columns collects the columns of unique blocks.
+type columns struct {
+	hashes  bytes.Buffer
+	lengths bytes.Buffer
+	n       uint64
+}
+
+// add will add a unique block to the columns.
+func (c *columns) add(h [HashSize]byte, length int) {
+	var tmp [binary.MaxVarintLen64]byte
+	c.hashes.Write(h[:])
+	c.lengths.Write(tmp[:binary.PutUvarint(tmp[:], uint64(length))])
+	c.n++
+}
+
+// bytes returns the columns followed by the trailer.
+func (c *columns) bytes() []byte {
+	size := c.hashes.Len() + c.lengths.Len()
+	out := make([]byte, 0, size+columnTrailerSize)
+	out = append(out, c.hashes.Bytes()...)
+	out = append(out, c.lengths.Bytes()...)
+	var trailer [columnTrailerSize]byte
+	binary.LittleEndian.PutUint64(trailer[:8], c.n)
+	binary.LittleEndian.PutUint64(trailer[8:], uint64(size))
+	return append(out, trailer[:]...)
+}
+
+// Columns contains the hash and stored length of each unique block
+// of a block stream written by NewColumnarWriter, in the order they are stored.
+type Columns struct {
+	Hashes  [][HashSize]byte
+	Lengths []int
+}
+
+// ReadColumns will read the columns from the end of a block stream
+// written by NewColumnarWriter. Block data is not read.
+//
+// The offset of a block in the block stream is the sum of
+// the lengths of the blocks before it.
+// If the stream doesn't end with valid columns, ErrNotColumnar is returned.
+func ReadColumns(blocks io.ReadSeeker) (*Columns, error) {
+	end, err := blocks.Seek(-columnTrailerSize, io.SeekEnd)
+	if err != nil {
+		return nil, ErrNotColumnar
+	}
+	var trailer [columnTrailerSize]byte
+	if _, err := io.ReadFull(blocks, trailer[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint64(trailer[:8])
+	size := binary.LittleEndian.Uint64(trailer[8:])
+	// Each block uses at least one byte for the length.
+	if size > uint64(end) || n > size/(HashSize+1) {
+		return nil, ErrNotColumnar
+	}
+	if _, err := blocks.Seek(end-int64(size), io.SeekStart); err != nil {
+		return nil, err
+	}
+	rd := bufio.NewReader(io.LimitReader(blocks, int64(size)))
+	c := &Columns{
+		Hashes:  make([][HashSize]byte, n),
+		Lengths: make([]int, n),
+	}
+	for i := range c.Hashes {
+		if _, err := io.ReadFull(rd, c.Hashes[i][:]); err != nil {
+			return nil, ErrNotColumnar
+		}
+	}
+	for i := range c.Lengths {
+		l, err := binary.ReadUvarint(rd)
+		if err != nil || l > uint64(end) {
+			return nil, ErrNotColumnar
+		}
+		c.Lengths[i] = int(l)
+	}
+	if _, err := rd.ReadByte(); err != io.EOF {
+		return nil, fmt.Errorf("%v: data after lengths", ErrNotColumnar)
+	}
+	return c, nil
+}
@@ -0,0 +1,93 @@
+package dedup_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestColumnarWriter(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(4<<20 + 100).Bytes()
+	// Create some duplicates
+	copy(b[2<<20:], b[:1<<20])
+
+	var idx, data bytes.Buffer
+	w, err := dedup.NewColumnarWriter(&idx, &data, dedup.ModeDynamic, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+
+	cols, err := dedup.ReadColumns(bytes.NewReader(data.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cols.Hashes) != w.Stats().NewBlocks || len(cols.Lengths) != len(cols.Hashes) {
+		t.Fatalf("expected %d blocks, got %d hashes and %d lengths", w.Stats().NewBlocks, len(cols.Hashes), len(cols.Lengths))
+	}
+	// The columns must describe the block data.
+	blocks := data.Bytes()
+	for i, l := range cols.Lengths {
+		if sha1.Sum(blocks[:l]) != cols.Hashes[i] {
+			t.Fatalf("block %d: hash mismatch", i)
+		}
+		blocks = blocks[l:]
+	}
+	if len(blocks) >= data.Len()/100 {
+		t.Fatalf("columns too big: %d bytes", len(blocks))
+	}
+
+	// The output must decode as a normal stream.
+	r, err := dedup.NewReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, out) {
+		t.Fatal("Output mismatch")
+	}
+	r.Close()
+	ra, err := dedup.NewReaderAt(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = make([]byte, 1000)
+	if _, err := ra.ReadAt(out, 3<<20); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b[3<<20:3<<20+1000], out) {
+		t.Fatal("ReadAt output mismatch")
+	}
+}
+
+func TestColumnarWriterErrors(t *testing.T) {
+	var idx, data bytes.Buffer
+	_, err := dedup.NewColumnarWriter(&idx, &data, dedup.ModeFixed, 1024, 0, dedup.WithDeltaEncoding(0.5))
+	if err == nil {
+		t.Fatal("expected error with delta encoding")
+	}
+
+	// Streams without columns must be rejected.
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, 1024, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, getBufferSize(100<<10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.ReadColumns(bytes.NewReader(data.Bytes())); err != dedup.ErrNotColumnar {
+		t.Fatal("expected ErrNotColumnar, got", err)
+	}
+	if _, err := dedup.ReadColumns(bytes.NewReader(nil)); err != dedup.ErrNotColumnar {
+		t.Fatal("expected ErrNotColumnar, got", err)
+	}
+}
@@ -0,0 +1,240 @@
+package dedup
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+// compareChunk is the size of the chunks compared by StreamsEqual.
+const compareChunk = 64 << 10
+
+// CompareMethod is the method used by CompareStreams to compare two streams.
+type CompareMethod int
+
+const (
+	// CompareEncoded means the encoded streams were compared.
+	// This is only done if both streams implement io.Seeker.
+	// If the encoded streams are identical, one stream is decoded to validate it,
+	// but the block content is not compared.
+	CompareEncoded CompareMethod = iota + 1
+
+	// CompareBlocks means both streams were decoded, the blocks of the streams
+	// had the same sizes, and the decoded blocks were compared one by one.
+	CompareBlocks
+
+	// CompareContent means the block sizes of the streams differ, for instance
+	// because they were written with different block sizes, so the decoded
+	// content was compared from the first block with a different size.
+	CompareContent
+)
+
+// String returns the name of the method.
+func (m CompareMethod) String() string {
+	switch m {
+	case CompareEncoded:
+		return "encoded"
+	case CompareBlocks:
+		return "blocks"
+	case CompareContent:
+		return "content"
+	}
+	return "unknown"
+}
+
+// StreamsEqual returns whether two single streams, as written by NewStreamWriter,
+// contain identical content.
+// The cheapest available method is used, as described by CompareStreams.
+func StreamsEqual(a, b io.Reader) (bool, error) {
+	equal, _, err := CompareStreams(a, b)
+	return equal, err
+}
+
+// CompareStreams returns whether two single streams, as written by NewStreamWriter,
+// contain identical content, and the method that was used to compare them.
+//
+// The streams do not store a hash of the content or of the blocks,
+// so the content can only be compared without decoding both streams
+// if the encoded streams are identical:
+// If both streams implement io.Seeker, the encoded streams are compared first.
+// Streams written with the same parameters and content are identical, and are
+// then reported as equal after decoding only one of them to validate it.
+// Otherwise the streams are seeked back to where they started.
+//
+// In all other cases both streams are fully decoded, unless a difference is found.
+// The decoded blocks are compared one by one while they have the same sizes.
+// From the first block with a different size, the remaining content
+// is compared instead. Comparing stops at the first difference,
+// and no more content than needed to decode the streams is kept in memory.
+func CompareStreams(a, b io.Reader) (equal bool, method CompareMethod, err error) {
+	as, aok := a.(io.ReadSeeker)
+	bs, bok := b.(io.ReadSeeker)
+	if aok && bok {
+		aStart, err := as.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return false, 0, err
+		}
+		bStart, err := bs.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return false, 0, err
+		}
+		same, err := readersEqual(as, bs)
+		if err != nil {
+			return false, 0, err
+		}
+		if _, err := as.Seek(aStart, io.SeekStart); err != nil {
+			return false, 0, err
+		}
+		if same {
+			// The content is identical, but must be a valid stream.
+			if err := validateStream(as); err != nil {
+				return false, CompareEncoded, err
+			}
+			return true, CompareEncoded, nil
+		}
+		if _, err := bs.Seek(bStart, io.SeekStart); err != nil {
+			return false, 0, err
+		}
+	}
+	ra, err := NewStreamReader(a)
+	if err != nil {
+		return false, 0, err
+	}
+	defer ra.Close()
+	rb, err := NewStreamReader(b)
+	if err != nil {
+		return false, 0, err
+	}
+	defer rb.Close()
+	ba := &blockIter{f: ra.(*streamReader)}
+	bb := &blockIter{f: rb.(*streamReader)}
+	for {
+		da, err := ba.next()
+		if err != nil {
+			return false, CompareBlocks, err
+		}
+		db, err := bb.next()
+		if err != nil {
+			return false, CompareBlocks, err
+		}
+		if da == nil || db == nil {
+			return da == nil && db == nil, CompareBlocks, nil
+		}
+		if len(da.data) != len(db.data) {
+			equal, err := blocksEqual(ba, bb, da.data, db.data)
+			return equal, CompareContent, err
+		}
+		if !bytes.Equal(da.data, db.data) {
+			return false, CompareBlocks, nil
+		}
+	}
+}
+
+// validateStream will decode the stream in r and return any error.
+func validateStream(r io.Reader) error {
+	sr, err := NewStreamReader(r)
+	if err != nil {
+		return err
+	}
+	defer sr.Close()
+	_, err = io.Copy(ioutil.Discard, sr)
+	return err
+}
+
+// blockIter returns the non-empty blocks of a stream reader.
+type blockIter struct {
+	f *streamReader
+}
+
+// next returns the next non-empty block, or nil at the end of the stream.
+func (it *blockIter) next() (*rblock, error) {
+	for {
+		b, ok := <-it.f.ready
+		if !ok {
+			return nil, nil
+		}
+		if b.err != nil {
+			return nil, b.err
+		}
+		if len(b.data) > 0 {
+			return b, nil
+		}
+	}
+}
+
+// blocksEqual compares the remaining content of a and b,
+// where the current blocks contain curA and curB.
+func blocksEqual(a, b *blockIter, curA, curB []byte) (bool, error) {
+	for {
+		n := len(curA)
+		if len(curB) < n {
+			n = len(curB)
+		}
+		if !bytes.Equal(curA[:n], curB[:n]) {
+			return false, nil
+		}
+		curA, curB = curA[n:], curB[n:]
+		if len(curA) == 0 {
+			next, err := a.next()
+			if err != nil {
+				return false, err
+			}
+			if next != nil {
+				curA = next.data
+			}
+		}
+		if len(curB) == 0 {
+			next, err := b.next()
+			if err != nil {
+				return false, err
+			}
+			if next != nil {
+				curB = next.data
+			}
+		}
+		if len(curA) == 0 || len(curB) == 0 {
+			return len(curA) == len(curB), nil
+		}
+	}
+}
+
+// readersEqual returns whether a and b return the same data.
+// Reading stops at the first difference.
+func readersEqual(a, b io.Reader) (bool, error) {
+	bufA := make([]byte, compareChunk)
+	bufB := make([]byte, compareChunk)
+	for {
+		na, err := readChunk(a, bufA)
+		if err != nil {
+			return false, err
+		}
+		nb, err := readChunk(b, bufB)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if na < len(bufA) {
+			// Both ended, since the reads were equal.
+			return true, nil
+		}
+	}
+}
+
+// readChunk will fill buf from r, unless r ends first.
+// Reaching the end of r is not an error.
+func readChunk(r io.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,78 @@
+package dedup_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestStreamsEqual(t *testing.T) {
+	b := getBufferSize(1<<20 + 100).Bytes()
+	encode := func(in []byte, size uint, opts ...dedup.Option) []byte {
+		var buf bytes.Buffer
+		w, err := dedup.NewStreamWriter(&buf, dedup.ModeDynamic, size, 100*size, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(in)); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	// Create some duplicates
+	copy(b[512<<10:], b[:256<<10])
+	changed := append([]byte{}, b...)
+	changed[len(changed)-1]++
+
+	a := encode(b, 16<<10)
+	tests := []struct {
+		name   string
+		b      []byte
+		want   bool
+		method dedup.CompareMethod // Method used without seeking.
+	}{
+		{name: "identical", b: encode(b, 16<<10), want: true, method: dedup.CompareBlocks},
+		{name: "block size", b: encode(b, 4<<10), want: true, method: dedup.CompareContent},
+		{name: "changed", b: encode(changed, 16<<10), want: false, method: dedup.CompareBlocks},
+		{name: "byte window", b: encode(b, 16<<10, dedup.WithByteWindow(1<<20)), want: true, method: dedup.CompareBlocks},
+		{name: "shorter", b: encode(b[:len(b)-1], 16<<10), want: false, method: dedup.CompareContent},
+	}
+	for _, test := range tests {
+		// Test both with and without seeking.
+		got, method, err := dedup.CompareStreams(bytes.NewReader(a), bytes.NewReader(test.b))
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		want := test.method
+		if bytes.Equal(a, test.b) {
+			want = dedup.CompareEncoded
+		}
+		if got != test.want || method != want {
+			t.Errorf("%s: expected %v using %v, got %v using %v", test.name, test.want, want, got, method)
+		}
+		got, method, err = dedup.CompareStreams(bytes.NewBuffer(a), bytes.NewBuffer(test.b))
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if got != test.want || method != test.method {
+			t.Errorf("%s, no seeking: expected %v using %v, got %v using %v", test.name, test.want, test.method, got, method)
+		}
+	}
+
+	// Truncated streams must return an error.
+	_, err := dedup.StreamsEqual(bytes.NewBuffer(a), bytes.NewBuffer(a[:len(a)/2]))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+	// Also when identical encoded streams are compared.
+	_, err = dedup.StreamsEqual(bytes.NewReader(a[:len(a)/2]), bytes.NewReader(a[:len(a)/2]))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+	garbage := []byte("not a stream")
+	if _, err = dedup.StreamsEqual(bytes.NewReader(garbage), bytes.NewReader(garbage)); err == nil {
+		t.Fatal("expected error on invalid stream")
+	}
+}
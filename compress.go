@@ -0,0 +1,143 @@
+package dedup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// A BlockCodec compresses the blocks written to a compressed block sink,
+// see WithCompressedBlockSink and WithCompressedBlocks.
+//
+// A BlockCodec must be safe for concurrent use.
+type BlockCodec interface {
+	// Compress appends the compressed form of src to dst and returns the result.
+	Compress(dst, src []byte) ([]byte, error)
+
+	// Decompress returns the content of the compressed block src,
+	// which must be size bytes. An error must be returned if the
+	// decompressed content has a different size.
+	Decompress(src []byte, size int) ([]byte, error)
+}
+
+// NewFlateCodec returns a codec compressing blocks with DEFLATE
+// at the given level, as accepted by compress/flate.
+func NewFlateCodec(level int) (BlockCodec, error) {
+	if _, err := flate.NewWriter(ioutil.Discard, level); err != nil {
+		return nil, err
+	}
+	return &flateCodec{level: level}, nil
+}
+
+// flateCodec compresses blocks with compress/flate.
+type flateCodec struct {
+	level   int
+	writers sync.Pool
+}
+
+func (c *flateCodec) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	fw, ok := c.writers.Get().(*flate.Writer)
+	if ok {
+		fw.Reset(buf)
+	} else {
+		var err error
+		if fw, err = flate.NewWriter(buf, c.level); err != nil {
+			return nil, err
+		}
+	}
+	defer c.writers.Put(fw)
+	if _, err := fw.Write(src); err != nil {
+		return nil, err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *flateCodec) Decompress(src []byte, size int) ([]byte, error) {
+	fr := flate.NewReader(bytes.NewReader(src))
+	defer fr.Close()
+	dst := make([]byte, size+1)
+	n, err := io.ReadFull(fr, dst)
+	if err != io.ErrUnexpectedEOF && err != io.EOF {
+		if err == nil {
+			err = errors.New("dedup: compressed block larger than expected")
+		}
+		return nil, err
+	}
+	if n != size {
+		return nil, fmt.Errorf("dedup: compressed block size %d, expected %d", n, size)
+	}
+	return dst[:n], nil
+}
+
+// blockSink writes the compressed form of each block written to the block stream.
+type blockSink struct {
+	w     io.Writer
+	codec BlockCodec
+	buf   []byte
+}
+
+// record returns the record of a block in the sink.
+// The returned slice is only valid until the next call.
+func (s *blockSink) record(b []byte) ([]byte, error) {
+	var hdr [binary.MaxVarintLen64]byte
+	c, err := s.codec.Compress(s.buf[:0], b)
+	if err != nil {
+		return nil, err
+	}
+	s.buf = c
+	n := binary.PutUvarint(hdr[:], uint64(len(c)))
+	rec := make([]byte, 0, n+len(c))
+	return append(append(rec, hdr[:n]...), c...), nil
+}
+
+// add will write the record of a block to the sink.
+func (s *blockSink) add(b []byte) error {
+	rec, err := s.record(b)
+	if err != nil {
+		return err
+	}
+	n, err := s.w.Write(rec)
+	if err == nil && n != len(rec) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// compressedReader reads blocks from a compressed block sink.
+type compressedReader struct {
+	r     *bufio.Reader
+	codec BlockCodec
+}
+
+// readBlock will read and decompress the next block,
+// which must be n bytes.
+func (c *compressedReader) readBlock(n int) ([]byte, error) {
+	size, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if size > uint64(n)+maxCompressionOverhead(n) {
+		return nil, fmt.Errorf("dedup: invalid compressed block size %d", size)
+	}
+	src, err := readBlock(c.r, int(size))
+	if err != nil {
+		return nil, err
+	}
+	return c.codec.Decompress(src, n)
+}
+
+// maxCompressionOverhead returns the maximum size increase
+// accepted for a compressed block of n bytes.
+func maxCompressionOverhead(n int) uint64 {
+	return uint64(n/8 + 1024)
+}
@@ -0,0 +1,80 @@
+package dedup_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestCompressedBlockSink(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(512<<10 + 100).Bytes()
+	// Make the input compressible.
+	for i := range b {
+		b[i] &= 7
+	}
+	// Create some duplicates and similar blocks.
+	copy(b[256<<10:], b[:128<<10])
+	for i := 256 << 10; i < 384<<10; i += 1000 {
+		b[i]++
+	}
+	codec, err := dedup.NewFlateCodec(flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, delta := range []float64{0, 0.2} {
+		var idx, data, sink bytes.Buffer
+		opts := []dedup.Option{dedup.WithCompressedBlockSink(&sink, codec)}
+		if delta > 0 {
+			opts = append(opts, dedup.WithDeltaEncoding(delta))
+		}
+		w, err := dedup.NewWriter(&idx, &data, dedup.ModeDynamic, size, 0, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+			t.Fatal(err)
+		}
+		if sink.Len() == 0 || sink.Len() >= data.Len() {
+			t.Fatalf("sink is %d bytes, block stream %d bytes", sink.Len(), data.Len())
+		}
+		// Both block streams can be used.
+		for _, blocks := range []*bytes.Buffer{&data, &sink} {
+			var ropts []dedup.ReaderOption
+			if blocks == &sink {
+				ropts = append(ropts, dedup.WithCompressedBlocks(codec))
+			}
+			r, err := dedup.NewReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(blocks.Bytes()), ropts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, b) {
+				t.Fatal("content mismatch, compressed:", blocks == &sink)
+			}
+		}
+		// A truncated sink is detected.
+		r, err := dedup.NewReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(sink.Bytes()[:sink.Len()-10]), dedup.WithCompressedBlocks(codec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Fatal("expected error reading truncated sink")
+		}
+	}
+
+	// Only index writers are supported.
+	opt := dedup.WithCompressedBlockSink(ioutil.Discard, codec)
+	if _, err := dedup.NewStreamWriter(ioutil.Discard, dedup.ModeFixed, size, 16*size, opt); err == nil {
+		t.Fatal("expected error from stream writer")
+	}
+	if _, err := dedup.NewStreamReader(bytes.NewReader(nil), dedup.WithCompressedBlocks(codec)); err == nil {
+		t.Fatal("expected error from stream reader")
+	}
+}
@@ -0,0 +1,195 @@
+package dedup
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// configVersion is the version of the embedded configuration.
+const configVersion = 1
+
+// maxConfigSize is the maximum size of an embedded configuration.
+const maxConfigSize = 64 << 10
+
+// ErrNoConfig is returned by EmbeddedConfig if the stream
+// was written without WithEmbeddedConfig.
+var ErrNoConfig = errors.New("dedup: no embedded configuration")
+
+// Config describes the effective configuration of a writer,
+// as embedded in the stream header by WithEmbeddedConfig.
+//
+// Only settings that affect the output are included.
+// Encryption keys are never included.
+type Config struct {
+	Version   int  `json:"version"`
+	Mode      Mode `json:"mode"`
+	MaxSize   uint `json:"maxSize"`
+	MaxMemory uint `json:"maxMemory"`
+
+	// Hash is the name of the block hash, as returned by HashID.String,
+	// followed by "-length" if the length was included in the hash with WithLengthInHash.
+	Hash string `json:"hash"`
+
+	ExplicitLengths  bool    `json:"explicitLengths,omitempty"`
+	DeltaThreshold   float64 `json:"deltaThreshold,omitempty"`
+	ByteWindow       int64   `json:"byteWindow,omitempty"`
+	Shards           int     `json:"shards,omitempty"`
+	Columnar         bool    `json:"columnar,omitempty"`
+	FixedRecords     bool    `json:"fixedRecords,omitempty"`
+	MinDistance      int     `json:"minDistance,omitempty"`
+	EvictionFraction float64 `json:"evictionFraction"`
+	NoDedup          bool    `json:"noDedup,omitempty"`
+	BlockNumberBase  int     `json:"blockNumberBase"`
+	AutoMode         float64 `json:"autoMode,omitempty"`
+	BlockLimit       int     `json:"blockLimit,omitempty"`
+	UniqueLimit      int     `json:"uniqueLimit,omitempty"`
+	SplitLarge       bool    `json:"splitLarge,omitempty"`
+	Encrypted        bool    `json:"encrypted,omitempty"`
+	EmptyMarkers     bool    `json:"emptyMarkers,omitempty"`
+	SizeHistogram    bool    `json:"sizeHistogram,omitempty"`
+	HashedTail       bool    `json:"hashedTail,omitempty"`
+}
+
+// Options returns the options that will create a writer with this configuration,
+// when given to the constructor with Mode, MaxSize and MaxMemory.
+//
+// Sharded and columnar writers must be created with NewShardedWriter and
+// NewColumnarWriter, and encryption requires the key, so these are not included.
+// Block hashes unknown to this package are not included either.
+func (c Config) Options() []Option {
+	opts := []Option{
+		WithLengthInHash(strings.HasSuffix(c.Hash, "-length")),
+		WithExplicitLengths(c.ExplicitLengths),
+		WithFixedIndexRecords(c.FixedRecords),
+		WithDeduplication(!c.NoDedup),
+		WithSplitLargeChunks(c.SplitLarge),
+		WithMinReferenceDistance(c.MinDistance),
+		WithBlockLimit(c.BlockLimit),
+		WithUniqueBlockLimit(c.UniqueLimit),
+		WithEmptyMarkers(c.EmptyMarkers),
+		WithSizeHistogram(c.SizeHistogram),
+		WithHashedTail(c.HashedTail),
+	}
+	if id, ok := hashByName(strings.TrimSuffix(c.Hash, "-length")); ok && id != HashSHA1 {
+		opts = append(opts, WithBlockHash(id))
+	}
+	if c.DeltaThreshold > 0 {
+		opts = append(opts, WithDeltaEncoding(c.DeltaThreshold))
+	}
+	if c.ByteWindow > 0 {
+		opts = append(opts, WithByteWindow(c.ByteWindow))
+	}
+	if c.EvictionFraction > 0 {
+		opts = append(opts, WithEvictionFraction(c.EvictionFraction))
+	}
+	if c.BlockNumberBase > 0 {
+		opts = append(opts, WithBlockNumberBase(c.BlockNumberBase))
+	}
+	if c.AutoMode > 0 {
+		opts = append(opts, WithAutoMode(c.AutoMode))
+	}
+	return opts
+}
+
+// setConfig will record the effective configuration, if WithEmbeddedConfig is used.
+// This must be called when all options have been applied,
+// but before the header is written.
+func (w *writer) setConfig(mode Mode, maxMemory uint) {
+	if w.config == nil {
+		return
+	}
+	c := Config{
+		Version:          configVersion,
+		Mode:             mode,
+		MaxSize:          uint(w.maxSize),
+		MaxMemory:        maxMemory,
+		Hash:             HashID((w.flags & flagHashMask) >> 8).String(),
+		ExplicitLengths:  w.flags&flagExplicitLengths != 0,
+		Shards:           len(w.shards),
+		Columnar:         w.cols != nil,
+		FixedRecords:     w.flags&flagFixedRecords != 0,
+		MinDistance:      w.minDist,
+		EvictionFraction: w.evictFrac,
+		NoDedup:          w.noDedup,
+		BlockNumberBase:  w.base,
+		AutoMode:         w.ent.auto,
+		BlockLimit:       w.limit,
+		UniqueLimit:      w.maxUnique,
+		SplitLarge:       w.splitBig,
+		Encrypted:        w.crypt != nil && w.crypt.key != nil,
+		EmptyMarkers:     w.flags&flagEmptyMarkers != 0,
+		SizeHistogram:    w.sizes != nil,
+		HashedTail:       w.fullTail,
+	}
+	if w.flags&flagLengthHash != 0 {
+		c.Hash += "-length"
+	}
+	if c.EvictionFraction == 0 {
+		c.EvictionFraction = 0.25
+	}
+	if w.delta != nil {
+		c.DeltaThreshold = w.delta.threshold
+	}
+	if w.window != nil {
+		c.ByteWindow = w.window.size
+	}
+	*w.config = c
+	w.flags |= flagConfig
+}
+
+// appendConfig will append the size and content of the embedded configuration to dst.
+func (w *writer) appendConfig(dst []byte) ([]byte, error) {
+	b, err := json.Marshal(w.config)
+	if err != nil {
+		return nil, err
+	}
+	n := binary.PutUvarint(w.vari64, uint64(len(b)))
+	dst = append(dst, w.vari64[:n]...)
+	return append(dst, b...), nil
+}
+
+// readConfig will read an embedded configuration, if the flag is set.
+func (f *streamReader) readConfig(rd io.ByteReader) error {
+	if f.flags&flagConfig == 0 {
+		return nil
+	}
+	size, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if size > maxConfigSize {
+		return fmt.Errorf("dedup: embedded configuration too large: %d bytes", size)
+	}
+	f.config = make([]byte, size)
+	for i := range f.config {
+		if f.config[i], err = rd.ReadByte(); err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+	return nil
+}
+
+// EmbeddedConfig returns the configuration embedded by WithEmbeddedConfig.
+// ErrNoConfig is returned if the stream has no embedded configuration.
+func (f *streamReader) EmbeddedConfig() (Config, error) {
+	return parseConfig(f.config)
+}
+
+// parseConfig will decode an embedded configuration.
+func parseConfig(b []byte) (Config, error) {
+	var c Config
+	if b == nil {
+		return c, ErrNoConfig
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return Config{}, fmt.Errorf("dedup: invalid embedded configuration: %v", err)
+	}
+	if c.Version != configVersion {
+		return Config{}, fmt.Errorf("dedup: unknown embedded configuration version %d", c.Version)
+	}
+	return c, nil
+}
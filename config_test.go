@@ -0,0 +1,119 @@
+package dedup_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestEmbeddedConfig(t *testing.T) {
+	const size = 4 << 10
+	b := getVersionedDocuments(64<<10, 8, 3)
+
+	var idx, data bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeDynamic, size, 100*size,
+		dedup.WithEmbeddedConfig(true),
+		dedup.WithLengthInHash(true),
+		dedup.WithDeltaEncoding(0.5),
+		dedup.WithMinReferenceDistance(2),
+		dedup.WithBlockNumberBase(10),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := dedup.NewReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, out) {
+		t.Fatal("Output mismatch")
+	}
+	c, err := r.EmbeddedConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if c.Version != 1 || c.Mode != dedup.ModeDynamic || c.MaxSize != size || c.MaxMemory != 100*size {
+		t.Fatalf("unexpected config %+v", c)
+	}
+	if c.Hash != "sha1-length" || c.DeltaThreshold != 0.5 || c.MinDistance != 2 || c.BlockNumberBase != 10 {
+		t.Fatalf("unexpected config %+v", c)
+	}
+
+	// A writer created from the configuration must produce identical output.
+	var idx2, data2 bytes.Buffer
+	opts := append(c.Options(), dedup.WithEmbeddedConfig(true))
+	w, err = dedup.NewWriter(&idx2, &data2, c.Mode, c.MaxSize, c.MaxMemory, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(idx.Bytes(), idx2.Bytes()) || !bytes.Equal(data.Bytes(), data2.Bytes()) {
+		t.Fatal("output of reconstructed writer differs")
+	}
+
+	var dump bytes.Buffer
+	if err := dedup.DumpIndex(bytes.NewReader(idx.Bytes()), &dump); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dump.String(), `configuration {"version":1`) {
+		t.Fatal("configuration not dumped:", dump.String()[:200])
+	}
+}
+
+func TestEmbeddedConfigStream(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(256 << 10).Bytes()
+	for _, embed := range []bool{false, true} {
+		var buf bytes.Buffer
+		w, err := dedup.NewStreamWriter(&buf, dedup.ModeFixed, size, 10*size, dedup.WithEmbeddedConfig(embed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+			t.Fatal(err)
+		}
+		r, err := dedup.NewStreamReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, out) {
+			t.Fatal("Output mismatch")
+		}
+		c, err := r.EmbeddedConfig()
+		if !embed {
+			if err != dedup.ErrNoConfig {
+				t.Fatal("expected ErrNoConfig, got", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Mode != dedup.ModeFixed || c.MaxMemory != 10*size || c.Hash != "sha1" {
+			t.Fatalf("unexpected config %+v", c)
+		}
+	}
+
+	_, err := dedup.NewSplitter(make(chan dedup.Fragment), dedup.ModeFixed, size, dedup.WithEmbeddedConfig(true))
+	if err == nil {
+		t.Fatal("expected error from splitter")
+	}
+}
@@ -0,0 +1,114 @@
+package dedup
+
+import (
+	"context"
+	"io"
+)
+
+// NewWriterContext will create a deduplicator like NewWriter,
+// which is stopped when ctx is cancelled.
+// See WithContext for details.
+func NewWriterContext(ctx context.Context, index, blocks io.Writer, mode Mode, maxSize, maxMemory uint, opts ...Option) (Writer, error) {
+	return NewWriter(index, blocks, mode, maxSize, maxMemory, append([]Option{WithContext(ctx)}, opts...)...)
+}
+
+// NewStreamWriterContext will create a deduplicator like NewStreamWriter,
+// which is stopped when ctx is cancelled.
+// See WithContext for details.
+func NewStreamWriterContext(ctx context.Context, out io.Writer, mode Mode, maxSize, maxMemory uint, opts ...Option) (Writer, error) {
+	return NewStreamWriter(out, mode, maxSize, maxMemory, append([]Option{WithContext(ctx)}, opts...)...)
+}
+
+// ctxErr returns the error of the context of the writer, if it has one.
+func (w *writer) ctxErr() error {
+	if w.ctx == nil {
+		return nil
+	}
+	return w.ctx.Err()
+}
+
+// ctxDone returns the done channel of the context of the writer.
+// If the writer has no context, nil is returned, which is never ready.
+func (w *writer) ctxDone() <-chan struct{} {
+	if w.ctx == nil {
+		return nil
+	}
+	return w.ctx.Done()
+}
+
+// cancel will set the error of the writer to the error of its context,
+// unless another error has already occurred.
+func (w *writer) cancel() {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = w.ctx.Err()
+	}
+	w.cond().Broadcast()
+	w.mu.Unlock()
+}
+
+// watchContext will cancel the writer when its context is done,
+// so calls waiting for blocks to be processed return.
+// It must be called when the writer has been created.
+func (w *writer) watchContext() {
+	if w.ctx == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-w.ctx.Done():
+			w.cancel()
+		case <-w.exited:
+		}
+	}()
+}
+
+// send will pass b to the goroutine writing blocks,
+// or process it directly with WithSingleThread.
+// If the context of the writer is cancelled, b is discarded.
+func (w *writer) send(b *block) {
+	if w.ctxErr() != nil {
+		return
+	}
+	if w.single {
+		w.processBlock(b)
+		return
+	}
+	select {
+	case w.write <- b:
+	case <-w.ctxDone():
+	}
+}
+
+// next returns the next block to write.
+// nil is returned when the writer has been closed,
+// or its context has been cancelled.
+func (w *writer) next() *block {
+	select {
+	case b := <-w.write:
+		return b
+	case <-w.ctxDone():
+		w.cancel()
+		return nil
+	}
+}
+
+// stopInput will close the channels to the goroutines processing blocks,
+// so they exit when the blocks sent have been processed.
+// With WithSingleThread all blocks have been processed,
+// so the writer exits immediately.
+func (w *writer) stopInput() {
+	if w.stopped {
+		return
+	}
+	w.stopped = true
+	close(w.input)
+	for _, in := range w.inputs {
+		close(in)
+	}
+	close(w.write)
+	if w.single && w.process != nil {
+		w.process = nil
+		w.writerDone()
+	}
+}
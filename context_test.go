@@ -0,0 +1,108 @@
+package dedup_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/klauspost/dedup"
+)
+
+// stallWriter blocks all writes until release is closed.
+type stallWriter struct {
+	release chan struct{}
+}
+
+func (s stallWriter) Write(b []byte) (int, error) {
+	<-s.release
+	return len(b), nil
+}
+
+func TestWriterContext(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(1 << 20).Bytes()
+	var want, got bytes.Buffer
+	w, err := dedup.NewStreamWriter(&want, dedup.ModeDynamic, size, 16*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	// A context that isn't cancelled doesn't change the output.
+	w, err = dedup.NewStreamWriterContext(context.Background(), &got, dedup.ModeDynamic, size, 16*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want.Bytes(), got.Bytes()) {
+		t.Fatal("output mismatch")
+	}
+
+	_, err = dedup.NewWriterContext(nil, &got, &got, dedup.ModeFixed, size, 0)
+	if err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+}
+
+func TestWriterContextCancel(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(8 << 20).Bytes()
+	for _, mode := range []dedup.Mode{dedup.ModeFixed, dedup.ModeDynamic} {
+		stall := stallWriter{release: make(chan struct{})}
+		ctx, cancel := context.WithCancel(context.Background())
+		var idx bytes.Buffer
+		w, err := dedup.NewWriterContext(ctx, &idx, stall, mode, size, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.AfterFunc(50*time.Millisecond, cancel)
+		// The output is stalled, so the write can only return when cancelled.
+		n, err := w.Write(b)
+		if err != context.Canceled {
+			t.Fatal("expected context.Canceled, got", err)
+		}
+		if n > len(b) {
+			t.Fatal("wrote", n, "bytes")
+		}
+		if _, err := w.Write(b[:100]); err != context.Canceled {
+			t.Fatal("expected context.Canceled, got", err)
+		}
+		if err := w.Sync(); err != context.Canceled {
+			t.Fatal("expected context.Canceled, got", err)
+		}
+		if err := w.Close(); err != context.Canceled {
+			t.Fatal("expected context.Canceled, got", err)
+		}
+		if err := w.Close(); err != context.Canceled {
+			t.Fatal("expected context.Canceled, got", err)
+		}
+		close(stall.release)
+	}
+}
+
+func TestWriterContextCancelled(t *testing.T) {
+	const size = 4 << 10
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var idx, data bytes.Buffer
+	w, err := dedup.NewWriterContext(ctx, &idx, &data, dedup.ModeFixed, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, size)); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+	if err := w.WriteChunk(make([]byte, 100)); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+	if err := w.Close(); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+	if data.Len() != 0 {
+		t.Fatal("blocks written after cancel")
+	}
+}
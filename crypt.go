@@ -0,0 +1,495 @@
+package dedup
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// EncryptionScheme is the authenticated encryption used by WithEncryption.
+type EncryptionScheme uint8
+
+const (
+	// EncryptAESGCM encrypts with AES-GCM.
+	// The key must be 16, 24 or 32 bytes for AES-128, AES-192 or AES-256.
+	EncryptAESGCM EncryptionScheme = 1
+)
+
+const (
+	// encChunkSize is the size of the plaintext of each encrypted chunk.
+	encChunkSize = 64 << 10
+
+	// encPrefixSize is the size of the random nonce prefix of a stream.
+	encPrefixSize = 7
+
+	// encHeaderSize is the size of the header of an encrypted stream:
+	// magic, scheme and nonce prefix.
+	encHeaderSize = len(encMagic) + 1 + encPrefixSize
+)
+
+// encMagic starts all encrypted streams.
+const encMagic = "\xddENC"
+
+// ErrDecryption is returned if encrypted data cannot be authenticated,
+// because the key is wrong or the data has been modified.
+var ErrDecryption = errors.New("dedup: decryption failed")
+
+// newAEAD returns the cipher of scheme with the supplied key.
+func newAEAD(key []byte, scheme EncryptionScheme) (cipher.AEAD, error) {
+	switch scheme {
+	case EncryptAESGCM:
+		b, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, ErrInvalidOption
+		}
+		return cipher.NewGCM(b)
+	default:
+		return nil, fmt.Errorf("dedup: unknown encryption scheme %d", scheme)
+	}
+}
+
+// chunkNonce returns the nonce of chunk n of a stream with the header hdr.
+// The nonce is the prefix of the stream, the chunk number as a 32 bit
+// big endian value and a byte that is 1 for the last chunk.
+func chunkNonce(hdr []byte, n uint32, last bool) []byte {
+	var nonce [encPrefixSize + 5]byte
+	copy(nonce[:], hdr[len(encMagic)+1:])
+	binary.BigEndian.PutUint32(nonce[encPrefixSize:], n)
+	if last {
+		nonce[encPrefixSize+4] = 1
+	}
+	return nonce[:]
+}
+
+// encryption contains the settings given by WithEncryption.
+type encryption struct {
+	key        []byte
+	scheme     EncryptionScheme
+	plainIndex bool // Don't encrypt the index of NewWriter.
+	writers    []*encryptWriter
+}
+
+// encryptOutputs will insert encryption between the writer and its outputs,
+// if encryption is enabled. If index is set, the index output is always encrypted,
+// otherwise unless WithIndexEncryption(false) is used.
+// This must be called when all options have been applied,
+// but before the header is written.
+func (w *writer) encryptOutputs(index bool) error {
+	if w.crypt == nil || w.crypt.key == nil {
+		return nil
+	}
+	if w.cont {
+		return errors.New("dedup: encryption not supported with continuation")
+	}
+	var err error
+	plain := !index && w.crypt.plainIndex
+	if !plain {
+		if w.idx, err = w.encryptOutput(w.idx); err != nil {
+			return err
+		}
+	}
+	if w.blks, err = w.encryptOutput(w.blks); err != nil {
+		return err
+	}
+	for i := range w.shards {
+		if w.shards[i], err = w.encryptOutput(w.shards[i]); err != nil {
+			return err
+		}
+	}
+	if w.sink != nil {
+		if w.sink.w, err = w.encryptOutput(w.sink.w); err != nil {
+			return err
+		}
+	}
+	if w.verify != nil {
+		w.verify.key, w.verify.plain = w.crypt.key, plain
+	}
+	return nil
+}
+
+// encryptOutput returns out wrapped by an encrypting writer.
+func (w *writer) encryptOutput(out io.Writer) (io.Writer, error) {
+	if out == nil {
+		return nil, nil
+	}
+	aead, err := newAEAD(w.crypt.key, w.crypt.scheme)
+	if err != nil {
+		return nil, err
+	}
+	e := &encryptWriter{w: out, aead: aead, buf: make([]byte, 0, encChunkSize)}
+	copy(e.hdr[:], encMagic)
+	e.hdr[len(encMagic)] = byte(w.crypt.scheme)
+	if _, err := io.ReadFull(rand.Reader, e.hdr[len(encMagic)+1:]); err != nil {
+		return nil, err
+	}
+	w.crypt.writers = append(w.crypt.writers, e)
+	return e, nil
+}
+
+// closeEncryption will write the last chunk of all encrypted outputs.
+func (w *writer) closeEncryption() error {
+	if w.crypt == nil {
+		return nil
+	}
+	for _, e := range w.crypt.writers {
+		if err := e.close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptWriter encrypts data written to it in chunks.
+// The last chunk is written when close is called.
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	hdr     [encHeaderSize]byte
+	started bool   // The header has been written.
+	closed  bool   // The last chunk has been written.
+	n       uint32 // Number of the next chunk.
+	buf     []byte // Plaintext of the next chunk.
+	out     []byte
+}
+
+func (e *encryptWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		// Only seal full chunks when more data arrives,
+		// since the last chunk is sealed differently.
+		if len(e.buf) == encChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := encChunkSize - len(e.buf)
+		if n > len(b) {
+			n = len(b)
+		}
+		e.buf = append(e.buf, b[:n]...)
+		b = b[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// seal will encrypt and write the buffered chunk.
+func (e *encryptWriter) seal(last bool) error {
+	if !e.started {
+		if _, err := e.w.Write(e.hdr[:]); err != nil {
+			return err
+		}
+		e.started = true
+	}
+	if e.n == 1<<32-1 && !last {
+		return errors.New("dedup: encrypted stream too large")
+	}
+	e.out = e.aead.Seal(e.out[:0], chunkNonce(e.hdr[:], e.n, last), e.buf, e.hdr[:])
+	n, err := e.w.Write(e.out)
+	if err != nil {
+		return err
+	}
+	if n != len(e.out) {
+		return io.ErrShortWrite
+	}
+	e.n++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// close will write the last chunk.
+func (e *encryptWriter) close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(true)
+}
+
+// Sync will sync the underlying writer, if it supports it.
+// Up to one chunk of data is buffered until the writer is closed.
+func (e *encryptWriter) Sync() error {
+	if s, ok := e.w.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// WithDecryption will decrypt streams encrypted by a writer
+// with the WithEncryption option, using the supplied key.
+// All input must be encrypted when this option is used,
+// otherwise ErrNotEncrypted is returned, so unauthenticated
+// content is never accepted. Use WithPlaintextIndex to read
+// an index written with WithIndexEncryption(false).
+//
+// This option applies to NewReader, NewStreamReader, NewSeekReader,
+// NewReaderAt and NewShardedReader.
+func WithDecryption(key []byte) ReaderOption {
+	key = append([]byte(nil), key...)
+	return func(o *readerOptions) error {
+		if len(key) == 0 {
+			return ErrInvalidOption
+		}
+		o.key = key
+		return nil
+	}
+}
+
+// WithPlaintextIndex will allow an unencrypted index when WithDecryption is used,
+// as written by a writer with WithIndexEncryption(false).
+// The block data must still be encrypted.
+// The index is not authenticated, so it should come from a trusted source.
+func WithPlaintextIndex() ReaderOption {
+	return func(o *readerOptions) error {
+		o.plainIndex = true
+		return nil
+	}
+}
+
+// ErrNotEncrypted is returned if a key is given,
+// but the input isn't encrypted.
+var ErrNotEncrypted = errors.New("dedup: input not encrypted")
+
+// decrypt returns a reader of the decrypted content of r, if a key is set.
+// If r is not encrypted, ErrNotEncrypted is returned if required is set,
+// otherwise r is read as is.
+func (o *readerOptions) decrypt(r io.Reader, required bool) (io.Reader, error) {
+	if o.key == nil {
+		return r, nil
+	}
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(encMagic)); string(magic) != encMagic {
+		if required {
+			return nil, ErrNotEncrypted
+		}
+		return br, nil
+	}
+	d := &decryptReader{r: br}
+	if _, err := io.ReadFull(br, d.hdr[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return d, d.init(o.key)
+}
+
+// decryptSeeker returns a decrypting io.ReadSeeker of the block data in r,
+// if a key is set.
+func (o *readerOptions) decryptSeeker(r io.ReadSeeker) (io.ReadSeeker, error) {
+	if o.key == nil {
+		return r, nil
+	}
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	d := &decryptReader{r: r, seeker: r, base: start}
+	n, err := io.ReadFull(r, d.hdr[:])
+	if n < len(encMagic) || string(d.hdr[:len(encMagic)]) != encMagic {
+		return nil, ErrNotEncrypted
+	}
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return d, d.init(o.key)
+}
+
+// decryptReaderAt returns a decrypting io.ReaderAt of the block data in r,
+// if a key is set.
+func (o *readerOptions) decryptReaderAt(r io.ReaderAt) (io.ReaderAt, error) {
+	if o.key == nil {
+		return r, nil
+	}
+	d := &decryptReader{at: r}
+	n, err := r.ReadAt(d.hdr[:], 0)
+	if n < len(encMagic) || string(d.hdr[:len(encMagic)]) != encMagic {
+		return nil, ErrNotEncrypted
+	}
+	if n < len(d.hdr) {
+		return nil, unexpectedEOF(err)
+	}
+	return d, d.init(o.key)
+}
+
+// decryptReader decrypts a stream written by an encryptWriter.
+// Read is supported if r is set, Seek if seeker is set,
+// and ReadAt if at is set.
+type decryptReader struct {
+	r      io.Reader
+	seeker io.Seeker
+	at     io.ReaderAt
+	base   int64 // Offset of the header in seeker.
+	aead   cipher.AEAD
+	hdr    [encHeaderSize]byte
+
+	n      uint32 // Number of the next chunk.
+	plain  []byte // Remaining plaintext of the current chunk.
+	skip   int    // Bytes to skip in the next chunk after a seek.
+	pos    int64  // Position in the plaintext.
+	done   bool   // The last chunk has been read.
+	seeked bool   // Seek has been called.
+	ct     []byte
+	pt     []byte
+}
+
+// init will create the cipher given by the header.
+func (d *decryptReader) init(key []byte) error {
+	var err error
+	d.aead, err = newAEAD(key, EncryptionScheme(d.hdr[len(encMagic)]))
+	return err
+}
+
+// chunkSize returns the size of an encrypted chunk.
+func (d *decryptReader) chunkSize() int {
+	return encChunkSize + d.aead.Overhead()
+}
+
+// open will decrypt chunk n, which is the last chunk if short is set.
+// Full chunks may also be the last chunk.
+// dst must not overlap ct, since a failed attempt overwrites dst.
+func (d *decryptReader) open(dst, ct []byte, n uint32, short bool) (plain []byte, last bool, err error) {
+	if !short {
+		plain, err = d.aead.Open(dst, chunkNonce(d.hdr[:], n, false), ct, d.hdr[:])
+		if err == nil {
+			return plain, false, nil
+		}
+	}
+	plain, err = d.aead.Open(dst, chunkNonce(d.hdr[:], n, true), ct, d.hdr[:])
+	if err != nil {
+		return nil, false, ErrDecryption
+	}
+	return plain, true, nil
+}
+
+// next will read and decrypt the next chunk.
+func (d *decryptReader) next() error {
+	if d.ct == nil {
+		d.ct = make([]byte, d.chunkSize())
+		d.pt = make([]byte, encChunkSize)
+	}
+	n, err := io.ReadFull(d.r, d.ct)
+	switch err {
+	case nil:
+	case io.ErrUnexpectedEOF:
+	case io.EOF:
+		if d.seeked && d.n > 0 {
+			// Seeked to the end of a stream ending with a full chunk.
+			d.done = true
+			return nil
+		}
+		// The last chunk is missing.
+		return io.ErrUnexpectedEOF
+	default:
+		return err
+	}
+	plain, last, err := d.open(d.pt[:0], d.ct[:n], d.n, n < len(d.ct))
+	if err != nil {
+		return err
+	}
+	d.n++
+	d.done = last
+	if d.skip > len(plain) {
+		d.skip = len(plain)
+	}
+	d.plain = plain[d.skip:]
+	d.skip = 0
+	return nil
+}
+
+func (d *decryptReader) Read(b []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, d.plain)
+	d.plain = d.plain[n:]
+	d.pos += int64(n)
+	return n, nil
+}
+
+// Seek will set the position in the plaintext.
+// The chunk containing the position is read by the next Read.
+func (d *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		end, err := d.seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		size := end - d.base - int64(len(d.hdr))
+		chunks := (size + int64(d.chunkSize()) - 1) / int64(d.chunkSize())
+		offset += size - chunks*int64(d.aead.Overhead())
+	default:
+		return 0, errors.New("dedup: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("dedup: negative position")
+	}
+	chunk := offset / encChunkSize
+	if chunk >= 1<<32 {
+		return 0, errors.New("dedup: position out of range")
+	}
+	_, err := d.seeker.Seek(d.base+int64(len(d.hdr))+chunk*int64(d.chunkSize()), io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	d.n = uint32(chunk)
+	d.skip = int(offset % encChunkSize)
+	d.plain = nil
+	d.done = false
+	d.seeked = true
+	d.pos = offset
+	return offset, nil
+}
+
+// ReadAt will read len(b) bytes of plaintext starting at offset off.
+// It is safe for concurrent use if the underlying io.ReaderAt is.
+func (d *decryptReader) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("dedup: negative offset")
+	}
+	ct := make([]byte, d.chunkSize())
+	pt := make([]byte, encChunkSize)
+	read := 0
+	for read < len(b) {
+		chunk := off / encChunkSize
+		if chunk >= 1<<32 {
+			return read, io.EOF
+		}
+		n, err := d.at.ReadAt(ct, int64(len(d.hdr))+chunk*int64(len(ct)))
+		if n == 0 {
+			if err == nil || err == io.EOF {
+				err = io.EOF
+			}
+			return read, err
+		}
+		if err != nil && err != io.EOF {
+			return read, err
+		}
+		plain, last, err := d.open(pt[:0], ct[:n], uint32(chunk), n < len(ct))
+		if err != nil {
+			return read, err
+		}
+		skip := int(off % encChunkSize)
+		if skip >= len(plain) {
+			return read, io.EOF
+		}
+		c := copy(b[read:], plain[skip:])
+		read += c
+		off += int64(c)
+		if last && read < len(b) && skip+c == len(plain) {
+			return read, io.EOF
+		}
+	}
+	return read, nil
+}
@@ -0,0 +1,263 @@
+package dedup_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestEncryption(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(1<<20 + 100).Bytes()
+	// Create some duplicates
+	copy(b[512<<10:], b[:256<<10])
+
+	for _, encIndex := range []bool{false, true} {
+		idx, data := &bytes.Buffer{}, &bytes.Buffer{}
+		w, err := dedup.NewWriter(idx, data, dedup.ModeFixed, size, 0, dedup.WithEncryption(testKey, dedup.EncryptAESGCM), dedup.WithIndexEncryption(encIndex), dedup.WithSelfVerify(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data.Bytes(), b[:64]) {
+			t.Fatal("block data not encrypted")
+		}
+		if data.Len() >= len(b) {
+			t.Fatal("expected deduplication, got", data.Len(), "bytes")
+		}
+
+		// Without the key the content cannot be read.
+		r, err := dedup.NewReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()))
+		if err == nil {
+			var out []byte
+			out, err = ioutil.ReadAll(r)
+			r.Close()
+			if bytes.Equal(b, out) {
+				t.Fatal("content decoded without key")
+			}
+		} else if !encIndex {
+			t.Fatal(err)
+		}
+
+		// An unencrypted index must be allowed explicitly.
+		_, err = dedup.NewReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()), dedup.WithDecryption(testKey))
+		if encIndex && err != nil {
+			t.Fatal(err)
+		}
+		if !encIndex && err != dedup.ErrNotEncrypted {
+			t.Fatal("expected ErrNotEncrypted, got", err)
+		}
+
+		opt := []dedup.ReaderOption{dedup.WithDecryption(testKey)}
+		if !encIndex {
+			opt = append(opt, dedup.WithPlaintextIndex())
+		}
+		r, err = dedup.NewReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()), opt...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, out) {
+			t.Fatal("Output mismatch")
+		}
+		r.Close()
+
+		r, err = dedup.NewSeekReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()), opt...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err = ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, out) {
+			t.Fatal("Seek reader output mismatch")
+		}
+		r.Close()
+
+		ra, err := dedup.NewReaderAt(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()), opt...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 100<<10)
+		if _, err := ra.ReadAt(got, 600<<10); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b[600<<10:700<<10], got) {
+			t.Fatal("ReadAt output mismatch")
+		}
+	}
+}
+
+func TestEncryptionFullLastChunk(t *testing.T) {
+	// 64 unique blocks of 4KiB, so the block data ends with a full chunk.
+	const size = 4 << 10
+	b := getBufferSize(64 * size).Bytes()
+	for i := 0; i < 64; i++ {
+		b[i*size] = byte(i)
+	}
+	var idx, data bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0, dedup.WithEncryption(testKey, dedup.EncryptAESGCM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	if want := 12 + 4*(64<<10+16); data.Len() != want {
+		t.Fatalf("expected %d bytes of block data, got %d", want, data.Len())
+	}
+	r, err := dedup.NewReader(&idx, &data, dedup.WithDecryption(testKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, out) {
+		t.Fatal("Output mismatch")
+	}
+	r.Close()
+}
+
+func TestEncryptionStream(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(1<<20 + 100).Bytes()
+	copy(b[512<<10:], b[:256<<10])
+
+	var buf bytes.Buffer
+	w, err := dedup.NewStreamWriter(&buf, dedup.ModeDynamic, size, 100*size, dedup.WithEncryption(testKey, dedup.EncryptAESGCM), dedup.WithSelfVerify(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	enc := buf.Bytes()
+
+	r, err := dedup.NewStreamReader(bytes.NewReader(enc), dedup.WithDecryption(testKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, out) {
+		t.Fatal("Output mismatch")
+	}
+	r.Close()
+
+	// Wrong key
+	wrong := append([]byte{}, testKey...)
+	wrong[0]++
+	_, err = readStream(enc, dedup.WithDecryption(wrong))
+	if err != dedup.ErrDecryption {
+		t.Fatal("expected ErrDecryption, got", err)
+	}
+
+	// Modified data
+	mod := append([]byte{}, enc...)
+	mod[len(mod)/2]++
+	_, err = readStream(mod, dedup.WithDecryption(testKey))
+	if err != dedup.ErrDecryption {
+		t.Fatal("expected ErrDecryption, got", err)
+	}
+
+	// Unencrypted input is not accepted when a key is given.
+	var plain bytes.Buffer
+	w, err = dedup.NewStreamWriter(&plain, dedup.ModeDynamic, size, 100*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = readStream(plain.Bytes(), dedup.WithDecryption(testKey))
+	if err != dedup.ErrNotEncrypted {
+		t.Fatal("expected ErrNotEncrypted, got", err)
+	}
+
+	// The key is copied by the option.
+	key := append([]byte{}, testKey...)
+	opt := dedup.WithDecryption(key)
+	key[0]++
+	if _, err := readStream(enc, opt); err != nil {
+		t.Fatal(err)
+	}
+
+	// Truncated at a chunk boundary, so the last chunk is missing.
+	const chunk = 64<<10 + 16
+	_, err = readStream(enc[:12+2*chunk], dedup.WithDecryption(testKey))
+	if err == nil {
+		t.Fatal("expected error on truncated stream")
+	}
+}
+
+// readStream will decode a stream and return the content.
+func readStream(b []byte, opts ...dedup.ReaderOption) ([]byte, error) {
+	r, err := dedup.NewStreamReader(bytes.NewReader(b), opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func TestEncryptionSharded(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(1<<20 + 100).Bytes()
+	copy(b[512<<10:], b[:256<<10])
+
+	var idx bytes.Buffer
+	shards := []*bytes.Buffer{{}, {}, {}}
+	outs := []io.Writer{shards[0], shards[1], shards[2]}
+	w, err := dedup.NewShardedWriter(&idx, outs, dedup.ModeFixed, size, 0, dedup.WithEncryption(testKey, dedup.EncryptAESGCM), dedup.WithIndexEncryption(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	ins := []io.Reader{shards[0], shards[1], shards[2]}
+	r, err := dedup.NewShardedReader(&idx, ins, dedup.WithDecryption(testKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, out) {
+		t.Fatal("Output mismatch")
+	}
+	r.Close()
+}
+
+func TestEncryptionOptions(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := dedup.NewStreamWriter(&buf, dedup.ModeFixed, 1024, 1<<20, dedup.WithEncryption([]byte("short"), dedup.EncryptAESGCM))
+	if err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+	_, err = dedup.NewStreamWriter(&buf, dedup.ModeFixed, 1024, 1<<20, dedup.WithEncryption(testKey, dedup.EncryptAESGCM), dedup.WithContinuation(true))
+	if err == nil {
+		t.Fatal("expected error with continuation")
+	}
+	frags := make(chan dedup.Fragment)
+	_, err = dedup.NewSplitter(frags, dedup.ModeFixed, 1024, dedup.WithEncryption(testKey, dedup.EncryptAESGCM))
+	if err == nil {
+		t.Fatal("expected error from splitter")
+	}
+}
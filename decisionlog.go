@@ -0,0 +1,177 @@
+package dedup
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// decisionLogVersion is the version of the decision log format.
+const decisionLogVersion = 1
+
+// DecisionKind is the way a block was stored.
+type DecisionKind uint8
+
+const (
+	// DecisionNew indicates a block stored as a new block.
+	DecisionNew DecisionKind = iota
+
+	// DecisionRef indicates a block stored as a reference to a previous block.
+	DecisionRef
+
+	// DecisionDelta indicates a block stored as a delta of a previous block.
+	DecisionDelta
+)
+
+// decisionIndexed is set in the kind byte of a record
+// if the block was added to the index.
+const decisionIndexed = 1 << 7
+
+// Decision describes how a single block was deduplicated.
+type Decision struct {
+	Block int            // Number of the block.
+	Hash  [HashSize]byte // Hash of the block.
+	Kind  DecisionKind   // How the block was stored.
+
+	// Offset is the number of blocks back to the referenced block
+	// for references, or to the base block for deltas.
+	// Splitters don't keep block numbers, so references from splitters have offset 0.
+	Offset int
+
+	// Indexed is true if the block was added to the index,
+	// so later blocks with the same hash could reference it.
+	// Blocks matching a recent block when WithMinReferenceDistance is used
+	// and the last block of a stream are not added.
+	Indexed bool
+}
+
+// ErrNotSeedable is returned by ReplayDecisionLog if the writer
+// cannot be seeded.
+var ErrNotSeedable = errors.New("dedup: only unused splitters and blocks only writers can be seeded")
+
+// logDecision will write a record of how block n with hash h was stored
+// to the decision log. Nothing is written if the log isn't enabled.
+//
+// If ok is set the block is a reference to block match.
+// If base is not 0, the block is a delta of block base.
+func (w *writer) logDecision(n int, h [HashSize]byte, ok bool, match, base int, indexed bool) error {
+	if w.dlog == nil {
+		return nil
+	}
+	d := Decision{Block: n, Hash: h, Kind: DecisionNew, Indexed: indexed}
+	switch {
+	case ok:
+		d.Kind = DecisionRef
+		if match > 0 {
+			d.Offset = n - match
+		}
+	case base > 0:
+		d.Kind = DecisionDelta
+		d.Offset = n - base
+	}
+	var tmp [binary.MaxVarintLen64*3 + HashSize + 1]byte
+	i := 0
+	if !w.dlogHdr {
+		i += binary.PutUvarint(tmp[i:], decisionLogVersion)
+		w.dlogHdr = true
+	}
+	i += binary.PutUvarint(tmp[i:], uint64(d.Block))
+	i += copy(tmp[i:], d.Hash[:])
+	kind := byte(d.Kind)
+	if d.Indexed {
+		kind |= decisionIndexed
+	}
+	tmp[i] = kind
+	i++
+	i += binary.PutUvarint(tmp[i:], uint64(d.Offset))
+	_, err := w.dlog.Write(tmp[:i])
+	return err
+}
+
+// ReadDecisionLog will read a decision log written by a writer
+// with the WithDecisionLog option.
+//
+// fn is called with each decision, in the order the blocks were processed.
+// If fn returns an error, reading stops and the error is returned.
+func ReadDecisionLog(r io.Reader, fn func(d Decision) error) error {
+	br := bufio.NewReader(r)
+	v, err := binary.ReadUvarint(br)
+	if err == io.EOF {
+		// No blocks were logged.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if v != decisionLogVersion {
+		return fmt.Errorf("dedup: unknown decision log version %d", v)
+	}
+	for {
+		n, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		d := Decision{Block: int(n)}
+		if _, err := io.ReadFull(br, d.Hash[:]); err != nil {
+			return unexpectedEOF(err)
+		}
+		kind, err := br.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		d.Indexed = kind&decisionIndexed != 0
+		d.Kind = DecisionKind(kind &^ decisionIndexed)
+		if d.Kind > DecisionDelta {
+			return fmt.Errorf("dedup: unknown decision %d for block %d", d.Kind, n)
+		}
+		offset, err := binary.ReadUvarint(br)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		d.Offset = int(offset)
+		if err := fn(d); err != nil {
+			return err
+		}
+	}
+}
+
+// ReplayDecisionLog will add the blocks in a decision log to the index of w,
+// so blocks that were added to the index when the log was written
+// are treated as duplicates by w.
+// The number of replayed decisions is returned. Decisions of blocks
+// that were not added to the index are skipped.
+//
+// Since the output of other writers references blocks by their position
+// in the output, only writers without backreferences can be seeded:
+// writers created by NewSplitter and NewBlocksOnlyWriter.
+// For instance a blocks only writer storing blocks in a content addressed store
+// can be seeded with the log of previous writers, so blocks already
+// in the store are not written again.
+//
+// The log must be replayed before any data is written to w,
+// otherwise ErrNotSeedable is returned.
+func ReplayDecisionLog(log io.Reader, w Writer) (int, error) {
+	iw, ok := w.(*writer)
+	if !ok || iw.close != nil || iw.Blocks() != 0 {
+		return 0, ErrNotSeedable
+	}
+	n := 0
+	err := ReadDecisionLog(log, func(d Decision) error {
+		if !d.Indexed {
+			return nil
+		}
+		if iw.frags != nil {
+			// Splitters don't store block numbers.
+			d.Block = 0
+		}
+		iw.setIndex(d.Hash, d.Block)
+		n++
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,120 @@
+package dedup_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestDecisionLog(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(1<<20 + 100).Bytes()
+	// Create some duplicates
+	copy(b[512<<10:], b[:256<<10])
+
+	var log bytes.Buffer
+	w, err := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeDynamic, size, 0, dedup.WithDecisionLog(&log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	hashes := make(map[int][dedup.HashSize]byte)
+	var decisions, refs int
+	err = dedup.ReadDecisionLog(bytes.NewReader(log.Bytes()), func(d dedup.Decision) error {
+		decisions++
+		if d.Block != decisions {
+			t.Fatalf("expected block %d, got %d", decisions, d.Block)
+		}
+		hashes[d.Block] = d.Hash
+		if d.Kind == dedup.DecisionRef {
+			refs++
+			if hashes[d.Block-d.Offset] != d.Hash {
+				t.Fatalf("block %d: reference to block with other hash", d.Block)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := w.Stats()
+	if decisions != s.Blocks || refs != s.Blocks-s.NewBlocks || refs == 0 {
+		t.Fatalf("expected %d decisions with %d references, got %d and %d", s.Blocks, s.Blocks-s.NewBlocks, decisions, refs)
+	}
+
+	// A blocks only writer seeded with the log only stores the last block,
+	// which was not indexed.
+	stored := 0
+	onBlock := func(hash [dedup.HashSize]byte, size int) error {
+		stored++
+		return nil
+	}
+	w, err = dedup.NewBlocksOnlyWriter(ioutil.Discard, dedup.ModeDynamic, size, onBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := dedup.ReplayDecisionLog(bytes.NewReader(log.Bytes()), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last block of the indexed stream is never indexed.
+	if n != s.Blocks-1 {
+		t.Fatalf("expected %d replayed decisions, got %d", s.Blocks-1, n)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 1 {
+		t.Fatalf("expected 1 stored block, got %d", stored)
+	}
+
+	// Seeded splitters mark known fragments as not new.
+	out := make(chan dedup.Fragment, 10)
+	sp, err := dedup.NewSplitter(out, dedup.ModeDynamic, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.ReplayDecisionLog(bytes.NewReader(log.Bytes()), sp); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan int)
+	go func() {
+		isNew := 0
+		for f := range out {
+			if f.New {
+				isNew++
+			}
+		}
+		done <- isNew
+	}()
+	if _, err := io.Copy(sp, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if isNew := <-done; isNew != 1 {
+		t.Fatalf("expected 1 new fragment, got %d", isNew)
+	}
+
+	// Writers with backreferences cannot be seeded.
+	w, err = dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeDynamic, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.ReplayDecisionLog(bytes.NewReader(log.Bytes()), w); err != dedup.ErrNotSeedable {
+		t.Fatal("expected ErrNotSeedable, got", err)
+	}
+	w.Close()
+
+	// Unknown versions are rejected.
+	bad := append([]byte{2}, log.Bytes()[1:]...)
+	if err := dedup.ReadDecisionLog(bytes.NewReader(bad), func(dedup.Decision) error { return nil }); err == nil {
+		t.Fatal("expected error on unknown version")
+	}
+}
@@ -0,0 +1,312 @@
+package dedup
+
+import (
+	"errors"
+	"io"
+	"math"
+)
+
+// Format flags.
+// These are stored in the header of format 3 and 4 streams.
+const (
+	// flagDelta indicates that the stream may contain delta blocks.
+	flagDelta = 1 << 0
+
+	// flagExplicitLengths indicates that block lengths are stored directly,
+	// and not as the difference to the maximum block size.
+	flagExplicitLengths = 1 << 1
+
+	// flagLengthHash indicates that block hashes include the block length.
+	// This does not affect decoding.
+	flagLengthHash = 1 << 2
+
+	// flagByteWindow indicates that the maximum backreference length
+	// in the header of format 4 is a number of bytes instead of blocks.
+	flagByteWindow = 1 << 3
+
+	// flagSharded indicates that blocks are stored in several block streams.
+	// The number of shards is stored after the flags, and the shard of
+	// each block is stored after its length (format 3 only).
+	flagSharded = 1 << 4
+
+	// flagColumnar indicates that the block stream ends with columns
+	// containing the hash and length of each unique block.
+	// This does not affect decoding.
+	flagColumnar = 1 << 5
+
+	// flagFixedRecords indicates that each block is stored as a fixed
+	// size record in the index (format 3 only).
+	flagFixedRecords = 1 << 6
+
+	// flagConfig indicates that the header ends with the
+	// configuration of the writer.
+	flagConfig = 1 << 7
+
+	// flagHashMask contains the HashID of the block hash.
+	// The hash does not affect decoding, so streams with
+	// unknown hash IDs can be decoded, but not verified.
+	flagHashMask = 0xff << 8
+
+	// flagEmptyMarkers indicates that empty blocks, except the last block,
+	// are markers inserted by Split and should be reported by readers.
+	flagEmptyMarkers = 1 << 16
+
+	// flagSizeHistogram indicates that the index ends with
+	// a histogram of the block sizes (format 3 only).
+	flagSizeHistogram = 1 << 17
+
+	// knownFlags contains all flags understood by this package.
+	knownFlags = flagDelta | flagExplicitLengths | flagLengthHash | flagByteWindow | flagSharded | flagColumnar | flagFixedRecords | flagConfig | flagEmptyMarkers | flagSizeHistogram
+)
+
+// deltaMarker is the index value indicating a delta block.
+const deltaMarker = math.MaxUint64 - 1
+
+const (
+	sketchSize    = 8    // Number of MinHash values per block
+	featureSize   = 64   // Size of the sub-chunks that are hashed.
+	deltaWindow   = 1024 // Maximum number of blocks kept for delta encoding.
+	minDeltaSaved = 64   // Minimum number of bytes a delta must save.
+	maxDeltaDepth = 8    // Maximum number of delta blocks decoded to get a block.
+)
+
+// sketchSeeds are the permutations used for the MinHash sketch.
+var sketchSeeds = [sketchSize]uint64{
+	0x9e3779b97f4a7c15, 0xbf58476d1ce4e5b9, 0x94d049bb133111eb, 0x2545f4914f6cdd1d,
+	0x7fb5d329728ea185, 0x81dadef4bc2dd44d, 0xd6e8feb86659fd93, 0xa0761d6478bd642f,
+}
+
+// sketch is a MinHash sketch of a block.
+type sketch [sketchSize]uint64
+
+// newSketch returns the MinHash sketch of the supplied data.
+// The data is split into sub-chunks of featureSize,
+// and the minimum permutated hash of each sub-chunk is kept.
+func newSketch(b []byte) sketch {
+	var s sketch
+	for i := range s {
+		s[i] = math.MaxUint64
+	}
+	for len(b) > 0 {
+		n := featureSize
+		if n > len(b) {
+			n = len(b)
+		}
+		// FNV-1a
+		h := uint64(14695981039346656037)
+		for _, c := range b[:n] {
+			h ^= uint64(c)
+			h *= 1099511628211
+		}
+		b = b[n:]
+		for i, seed := range sketchSeeds {
+			// splitmix64 finalizer
+			v := h ^ seed
+			v = (v ^ (v >> 30)) * 0xbf58476d1ce4e5b9
+			v = (v ^ (v >> 27)) * 0x94d049bb133111eb
+			v ^= v >> 31
+			if v < s[i] {
+				s[i] = v
+			}
+		}
+	}
+	return s
+}
+
+// deltaBlock is a block kept for delta encoding.
+type deltaBlock struct {
+	data   []byte
+	sketch sketch
+	depth  int // Number of delta blocks in the chain ending with this block.
+}
+
+// deltaEncoder keeps recently written blocks and their
+// sketches, so similar blocks can be located.
+type deltaEncoder struct {
+	threshold float64
+	blocks    map[int]*deltaBlock        // Block number -> block
+	index     [sketchSize]map[uint64]int // Sketch value -> latest block number
+	order     []int                      // Block numbers in the order they were added
+}
+
+func newDeltaEncoder(threshold float64) *deltaEncoder {
+	d := &deltaEncoder{
+		threshold: threshold,
+		blocks:    make(map[int]*deltaBlock),
+	}
+	for i := range d.index {
+		d.index[i] = make(map[uint64]int)
+	}
+	return d
+}
+
+// find returns the number of the most similar block.
+// Blocks further than maxDist back are ignored, unless maxDist is 0.
+func (d *deltaEncoder) find(s sketch, n, maxDist int) (int, bool) {
+	best, bestScore := 0, 0
+	for i, v := range s {
+		c, ok := d.index[i][v]
+		if !ok || c == best {
+			continue
+		}
+		if maxDist > 0 && n-c > maxDist {
+			continue
+		}
+		score := 0
+		for j, v2 := range d.blocks[c].sketch {
+			if v2 == s[j] {
+				score++
+			}
+		}
+		if score > bestScore {
+			best, bestScore = c, score
+		}
+	}
+	if bestScore == 0 || float64(bestScore)/sketchSize < d.threshold {
+		return 0, false
+	}
+	return best, true
+}
+
+// add a block to the encoder and evict the oldest block if needed.
+func (d *deltaEncoder) add(n int, data []byte, s sketch, depth, window int) {
+	b := &deltaBlock{data: make([]byte, len(data)), sketch: s, depth: depth}
+	copy(b.data, data)
+	d.blocks[n] = b
+	for i, v := range s {
+		d.index[i][v] = n
+	}
+	d.order = append(d.order, n)
+	for len(d.blocks) > window {
+		old := d.order[0]
+		d.order = d.order[1:]
+		b, ok := d.blocks[old]
+		if !ok {
+			// Moved by touch
+			continue
+		}
+		for i, v := range b.sketch {
+			if d.index[i][v] == old {
+				delete(d.index[i], v)
+			}
+		}
+		delete(d.blocks, old)
+	}
+}
+
+// touch will move a retained block to a new block number,
+// since it has been seen again.
+// This keeps blocks that are repeated within the window.
+func (d *deltaEncoder) touch(old, n int) {
+	b, ok := d.blocks[old]
+	if !ok {
+		return
+	}
+	delete(d.blocks, old)
+	d.blocks[n] = b
+	for i, v := range b.sketch {
+		if d.index[i][v] == old {
+			d.index[i][v] = n
+		}
+	}
+	d.order = append(d.order, n)
+
+	// Remove moved entries once in a while.
+	if len(d.order) > 4*deltaWindow {
+		order := d.order[:0]
+		for _, v := range d.order {
+			if _, ok := d.blocks[v]; ok {
+				order = append(order, v)
+			}
+		}
+		d.order = order
+	}
+}
+
+// commonPrefixSuffix returns the length of the common prefix and suffix
+// of a and b. The prefix and suffix will not overlap in either.
+func commonPrefixSuffix(a, b []byte) (prefix, suffix int) {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for prefix < n && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for suffix < n-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	return prefix, suffix
+}
+
+// writeDelta will attempt to write b as a delta block.
+// The remaining literal data is written to data,
+// and shard is stored in the index if it is not negative.
+// The number of the base block is returned. If 0 is returned,
+// nothing was written and the block must be written as a new block.
+// The block is always retained for future delta blocks.
+// Bases are only used if the chain of delta blocks to decode
+// stays within maxDeltaDepth, so decoding a block is cheap
+// for readers that don't read the blocks in order.
+func (w *writer) writeDelta(b *block, data io.Writer, shard int) (int, error) {
+	d := w.delta
+	window := deltaWindow
+	if w.maxBlocks > 0 && w.maxBlocks < window {
+		window = w.maxBlocks
+	}
+	s := newSketch(b.data)
+	base, ok := d.find(s, b.N, window)
+	if ok && !w.inWindow(base, b.N) {
+		ok = false
+	}
+	if ok && d.blocks[base].depth >= maxDeltaDepth {
+		ok = false
+	}
+	var prefix, suffix int
+	if ok {
+		prefix, suffix = commonPrefixSuffix(d.blocks[base].data, b.data)
+	}
+	if !ok || prefix+suffix < minDeltaSaved {
+		d.add(b.N, b.data, s, 0, window)
+		return 0, nil
+	}
+	d.add(b.N, b.data, s, d.blocks[base].depth+1, window)
+	lit := b.data[prefix : len(b.data)-suffix]
+	for _, v := range []uint64{deltaMarker, uint64(b.N - base), uint64(prefix), uint64(suffix), w.lengthValue(len(lit))} {
+		if err := w.putUint64(v); err != nil {
+			return 0, err
+		}
+	}
+	if err := w.putShard(shard); err != nil {
+		return 0, err
+	}
+	n, err := data.Write(lit)
+	if err != nil {
+		return 0, err
+	}
+	if n != len(lit) {
+		return 0, errors.New("error: short write on delta")
+	}
+	if w.pos != nil {
+		w.pos.skip(n)
+	}
+	if w.sink != nil {
+		if err := w.sink.add(lit); err != nil {
+			return 0, err
+		}
+	}
+	return base, nil
+}
+
+// applyDelta will reconstruct a delta block from the base block,
+// using the prefix and suffix of the base and the literal data.
+func applyDelta(base, lit []byte, prefix, suffix int) ([]byte, error) {
+	if prefix+suffix > len(base) {
+		return nil, errors.New("delta exceeds base block")
+	}
+	dst := make([]byte, 0, prefix+len(lit)+suffix)
+	dst = append(dst, base[:prefix]...)
+	dst = append(dst, lit...)
+	dst = append(dst, base[len(base)-suffix:]...)
+	return dst, nil
+}
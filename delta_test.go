@@ -0,0 +1,348 @@
+package dedup_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+// Returns a deterministic set of document versions.
+// Each version is a copy of the previous, with small edits.
+func getVersionedDocuments(size, versions, edits int) []byte {
+	b := getBufferSize(size).Bytes()
+	rng := rand.New(rand.NewSource(1))
+	out := make([]byte, 0, size*versions)
+	out = append(out, b...)
+	for i := 1; i < versions; i++ {
+		for j := 0; j < edits; j++ {
+			b[rng.Intn(len(b))] = byte(rng.Intn(256))
+		}
+		out = append(out, b...)
+	}
+	return out
+}
+
+func TestDeltaWriter(t *testing.T) {
+	const size = 4 << 10
+	b := getVersionedDocuments(1<<20, 10, 50)
+
+	var sizes [2]int
+	for i, opts := range [][]dedup.Option{nil, {dedup.WithDeltaEncoding(0.5)}} {
+		idx := bytes.Buffer{}
+		data := bytes.Buffer{}
+		w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(w, bytes.NewBuffer(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[i] = idx.Len() + data.Len()
+	}
+	t.Log("Input size:", len(b))
+	t.Log("Output size without delta:", sizes[0])
+	t.Log("Output size with delta:", sizes[1])
+	if sizes[1] >= sizes[0]/2 {
+		t.Fatal("delta encoding did not reduce size sufficiently")
+	}
+}
+
+func TestDeltaRoundtrip(t *testing.T) {
+	const size = 4 << 10
+	b := getVersionedDocuments(1<<20, 5, 100)
+	b = append(b, getBufferSize(65).Bytes()...)
+
+	for _, mode := range []dedup.Mode{dedup.ModeFixed, dedup.ModeDynamic} {
+		idx := bytes.Buffer{}
+		data := bytes.Buffer{}
+		w, err := dedup.NewWriter(&idx, &data, mode, size, 0, dedup.WithDeltaEncoding(0.25))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(w, bytes.NewBuffer(b))
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := dedup.NewReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, out) {
+			t.Fatal("Output mismatch, mode", mode)
+		}
+		blocks := r.BlockSizes()
+		total := 0
+		for _, v := range blocks {
+			total += v
+		}
+		if total != len(b) {
+			t.Fatalf("Block sizes mismatch, expected %d, got %d", len(b), total)
+		}
+		r.Close()
+
+		r, err = dedup.NewSeekReader(&idx, bytes.NewReader(data.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err = ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, out) {
+			t.Fatal("Seek output mismatch, mode", mode)
+		}
+		r.Close()
+	}
+}
+
+// countReaderAt counts the bytes read from a bytes.Reader with ReadAt.
+type countReaderAt struct {
+	*bytes.Reader
+	n int64
+}
+
+func (c *countReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	n, err := c.Reader.ReadAt(b, off)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func TestDeltaChain(t *testing.T) {
+	// Each block is a small edit of the previous block,
+	// so every block can be delta encoded from the previous.
+	const size = 4 << 10
+	const blocks = 3000
+	blk := getBufferSize(size).Bytes()
+	rng := rand.New(rand.NewSource(1))
+	b := make([]byte, 0, size*blocks)
+	for i := 0; i < blocks; i++ {
+		blk[size/4+rng.Intn(size/2)] = byte(i)
+		b = append(b, blk...)
+	}
+	var idx, data bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0, dedup.WithDeltaEncoding(0.1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	if data.Len() > len(b)/4 {
+		t.Fatal("blocks were not delta encoded, got", data.Len(), "bytes")
+	}
+
+	// Blocks are rarely read more than once.
+	in := &countSeeker{Reader: bytes.NewReader(data.Bytes())}
+	r, err := dedup.NewSeekReader(bytes.NewReader(idx.Bytes()), in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if !bytes.Equal(b, out) {
+		t.Fatal("Seek output mismatch")
+	}
+	if in.n > 2*int64(data.Len()) {
+		t.Fatal("read", in.n, "bytes of", data.Len())
+	}
+
+	// Random access only decodes a short chain of bases.
+	at := &countReaderAt{Reader: bytes.NewReader(data.Bytes())}
+	ra, err := dedup.NewReaderAt(bytes.NewReader(idx.Bytes()), at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, size)
+	if _, err := ra.ReadAt(got, int64(len(b)-size)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b[len(b)-size:], got) {
+		t.Fatal("ReadAt output mismatch")
+	}
+	if at.n > 10*size {
+		t.Fatal("read", at.n, "bytes to decode one block")
+	}
+}
+
+// deltaIndex returns an index with delta encoding of fixed size blocks.
+// The index contains the given number of new blocks, followed by
+// a delta block for each offset in deltas. All blocks are empty.
+func deltaIndex(blocks int, deltas []uint64) []byte {
+	const size = 1024
+	var b []byte
+	put := func(v ...uint64) {
+		for _, v := range v {
+			var tmp [binary.MaxVarintLen64]byte
+			b = append(b, tmp[:binary.PutUvarint(tmp[:], v)]...)
+		}
+	}
+	// Format 3 with the delta flag.
+	put(3, size, 1)
+	for i := 0; i < blocks; i++ {
+		put(0, size)
+	}
+	for _, offset := range deltas {
+		put(math.MaxUint64-1, offset, 0, 0, size)
+	}
+	put(math.MaxUint64, size, 0)
+	return b
+}
+
+func TestDeltaMalformedIndex(t *testing.T) {
+	chain := func(n int) []uint64 {
+		d := make([]uint64, n)
+		for i := range d {
+			d[i] = 1
+		}
+		return d
+	}
+	// Two interleaved chains, so the base is never the previous block.
+	alternating := make([]uint64, 20)
+	for i := range alternating {
+		alternating[i] = 2
+	}
+	tests := []struct {
+		name  string
+		index []byte
+		valid bool
+	}{
+		{name: "max-depth", index: deltaIndex(1, chain(8)), valid: true},
+		{name: "too-deep", index: deltaIndex(1, chain(9))},
+		{name: "alternating", index: deltaIndex(2, alternating)},
+		{name: "max-offset", index: deltaIndex(1024, []uint64{1024}), valid: true},
+		{name: "offset-too-far", index: deltaIndex(1025, []uint64{1025})},
+		{name: "offset-before-start", index: deltaIndex(1, []uint64{2})},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := dedup.NewReader(bytes.NewReader(test.index), bytes.NewReader(nil))
+			if err == nil {
+				_, err = ioutil.ReadAll(r)
+				r.Close()
+			}
+			if test.valid != (err == nil) {
+				t.Fatal("NewReader: unexpected error state:", err)
+			}
+			s, err := dedup.NewSeekReader(bytes.NewReader(test.index), bytes.NewReader(nil))
+			if err == nil {
+				_, err = ioutil.ReadAll(s)
+				s.Close()
+			}
+			if test.valid != (err == nil) {
+				t.Fatal("NewSeekReader: unexpected error state:", err)
+			}
+			_, err = dedup.NewReaderAt(bytes.NewReader(test.index), bytes.NewReader(nil))
+			if test.valid != (err == nil) {
+				t.Fatal("NewReaderAt: unexpected error state:", err)
+			}
+		})
+	}
+}
+
+func TestDeltaStreamRoundtrip(t *testing.T) {
+	const size = 4 << 10
+	b := getVersionedDocuments(1<<20, 5, 100)
+	b = append(b, getBufferSize(65).Bytes()...)
+
+	data := bytes.Buffer{}
+	w, err := dedup.NewStreamWriter(&data, dedup.ModeFixed, size, 300*size, dedup.WithDeltaEncoding(0.25))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("Input size:", len(b), "Output size:", data.Len())
+
+	r, err := dedup.NewStreamReader(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, out) {
+		t.Fatal("Output mismatch")
+	}
+	r.Close()
+}
+
+func TestDeltaInvalidThreshold(t *testing.T) {
+	for _, v := range []float64{0, -1, 1.5} {
+		_, err := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, 4<<10, 0, dedup.WithDeltaEncoding(v))
+		if err != dedup.ErrInvalidOption {
+			t.Fatalf("threshold %v: expected ErrInvalidOption, got %v", v, err)
+		}
+	}
+	_, err := dedup.NewSplitter(make(chan dedup.Fragment), dedup.ModeFixed, 4<<10, dedup.WithDeltaEncoding(0.5))
+	if err == nil {
+		t.Fatal("expected error from splitter")
+	}
+}
+
+// Versioned documents, 4K blocks with delta encoding.
+func BenchmarkDeltaWriter4K(t *testing.B) {
+	const size = 4 << 10
+	b := getVersionedDocuments(1<<20, 10, 50)
+	t.ResetTimer()
+	t.SetBytes(int64(len(b)))
+	for i := 0; i < t.N; i++ {
+		w, _ := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.WithDeltaEncoding(0.5))
+		io.Copy(w, bytes.NewBuffer(b))
+		err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Versioned documents, 4K blocks, compared to the same writer without delta encoding.
+func BenchmarkDeltaRatio4K(t *testing.B) {
+	const size = 4 << 10
+	b := getVersionedDocuments(1<<20, 10, 50)
+	var plain, delta int
+	t.ResetTimer()
+	t.SetBytes(int64(len(b)))
+	for i := 0; i < t.N; i++ {
+		for _, opts := range [][]dedup.Option{nil, {dedup.WithDeltaEncoding(0.5)}} {
+			var idx, data bytes.Buffer
+			w, _ := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0, opts...)
+			io.Copy(w, bytes.NewBuffer(b))
+			err := w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts == nil {
+				plain = idx.Len() + data.Len()
+			} else {
+				delta = idx.Len() + data.Len()
+			}
+		}
+	}
+	t.ReportMetric(float64(plain)*100/float64(len(b)), "%plain")
+	t.ReportMetric(float64(delta)*100/float64(len(b)), "%delta")
+}
@@ -0,0 +1,253 @@
+package dedup
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// DumpIndex will write a human readable description of an index stream to w.
+//
+// Each record is printed on a separate line, prefixed by the
+// byte offset of the record in the input.
+// For indexed streams (NewWriter), only the index stream should be supplied.
+// For single streams (NewStreamWriter), the block data is skipped.
+// Concatenated single streams are dumped in sequence.
+//
+// Dumping stops at the first error, which is returned.
+// Records up to the error will have been written to w.
+func DumpIndex(r io.Reader, w io.Writer) error {
+	cr := &countingReader{r: bufio.NewReader(r)}
+	for {
+		more, err := dumpStream(cr, w)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// dumpStream will dump a single stream.
+// If another stream may follow, true is returned.
+func dumpStream(cr *countingReader, w io.Writer) (bool, error) {
+	var hdr streamReader
+	pos := cr.n
+	format, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprintf(w, "%d: format %d\n", pos, format)
+	stream := format == 2 || format == 4
+	if format < 1 || format > 4 {
+		return false, ErrUnknownFormat
+	}
+
+	pos = cr.n
+	size, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprintf(w, "%d: max block size %d\n", pos, size)
+	if size < MinBlockSize {
+		return false, ErrSizeTooSmall
+	}
+	if size > MaxBlockSize {
+		return false, ErrSizeTooLarge
+	}
+	hdr.size = int(size)
+
+	if stream {
+		pos = cr.n
+		hdr.maxLength, err = binary.ReadUvarint(cr)
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(w, "%d: max backreference length %d\n", pos, hdr.maxLength)
+	}
+	if format >= 3 {
+		pos = cr.n
+		err = hdr.readFlags(cr)
+		fmt.Fprintf(w, "%d: flags 0x%x\n", pos, hdr.flags)
+		if err != nil {
+			return false, err
+		}
+		if !hdr.HashVerifiable() {
+			fmt.Fprintf(w, "%d: unavailable block hash %v, hashes cannot be verified\n", pos, hdr.hashID())
+		}
+	}
+	shards := uint64(0)
+	if hdr.flags&flagSharded != 0 {
+		if stream {
+			return false, errors.New("single streams cannot be sharded")
+		}
+		pos = cr.n
+		shards, err = binary.ReadUvarint(cr)
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(w, "%d: shards %d\n", pos, shards)
+		if shards == 0 || shards > maxShards {
+			return false, fmt.Errorf("invalid number of shards: %d", shards)
+		}
+	}
+	if hdr.flags&flagConfig != 0 {
+		pos = cr.n
+		if err := hdr.readConfig(cr); err != nil {
+			return false, err
+		}
+		fmt.Fprintf(w, "%d: configuration %s\n", pos, hdr.config)
+	}
+	if hdr.flags&flagFixedRecords != 0 {
+		if stream {
+			return false, errors.New("single streams cannot have fixed index records")
+		}
+		if err := dumpRecords(w, cr, hdr.size); err != nil {
+			return false, err
+		}
+		return false, dumpHistogram(w, cr, hdr.flags)
+	}
+	// Data offset in each block stream.
+	dataOffset := make([]int64, 1)
+	if shards > 0 {
+		dataOffset = make([]int64, shards)
+	}
+	// shard will read the shard of a block, if sharded,
+	// and return it along with a description.
+	shard := func() (uint64, string, error) {
+		if shards == 0 {
+			return 0, "", nil
+		}
+		s, err := binary.ReadUvarint(cr)
+		if err != nil {
+			return 0, "", err
+		}
+		if s >= shards {
+			return 0, "", fmt.Errorf("invalid shard %d, index has %d shards", s, shards)
+		}
+		return s, fmt.Sprintf(", shard %d", s), nil
+	}
+
+	// skip will skip the data of a block in single streams.
+	skip := func(n int) error {
+		if !stream || n == 0 {
+			return nil
+		}
+		_, err := io.CopyN(ioutil.Discard, cr, int64(n))
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	for i := 1; ; i++ {
+		pos = cr.n
+		offset, err := binary.ReadUvarint(cr)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case offset == 0 || offset == math.MaxUint64:
+			v, err := binary.ReadUvarint(cr)
+			if err != nil {
+				return false, err
+			}
+			n, ok := hdr.blockSize(v)
+			if !ok {
+				return false, fmt.Errorf("invalid size for block %d, %d > %d", i, v, size)
+			}
+			s, sh, err := shard()
+			if err != nil {
+				return false, err
+			}
+			if offset == 0 {
+				fmt.Fprintf(w, "%d: block %d: new block, size %d, data offset %d%s\n", pos, i, n, dataOffset[s], sh)
+			} else {
+				fmt.Fprintf(w, "%d: block %d: last block, size %d, data offset %d%s\n", pos, i, n, dataOffset[s], sh)
+			}
+			if err := skip(n); err != nil {
+				return false, err
+			}
+			dataOffset[s] += int64(n)
+			if offset == 0 {
+				continue
+			}
+			pos = cr.n
+			cont, err := binary.ReadUvarint(cr)
+			if err != nil {
+				return false, err
+			}
+			fmt.Fprintf(w, "%d: end of stream, continuation %d\n", pos, cont)
+			if !stream {
+				return false, dumpHistogram(w, cr, hdr.flags)
+			}
+			if _, err := cr.r.Peek(1); err == io.EOF {
+				if cont != 0 {
+					return false, io.ErrUnexpectedEOF
+				}
+				return false, nil
+			}
+			return true, nil
+		case offset == deltaMarker && hdr.flags&flagDelta != 0:
+			var v [4]uint64
+			for j := range v {
+				v[j], err = binary.ReadUvarint(cr)
+				if err != nil {
+					return false, err
+				}
+			}
+			n, ok := hdr.blockSize(v[3])
+			if !ok {
+				return false, fmt.Errorf("invalid size for delta block %d, %d > %d", i, v[3], size)
+			}
+			s, sh, err := shard()
+			if err != nil {
+				return false, err
+			}
+			fmt.Fprintf(w, "%d: block %d: delta of block %d, prefix %d, suffix %d, literal size %d, data offset %d%s\n",
+				pos, i, i-int(v[0]), v[1], v[2], n, dataOffset[s], sh)
+			if err := skip(n); err != nil {
+				return false, err
+			}
+			dataOffset[s] += int64(n)
+		default:
+			fmt.Fprintf(w, "%d: block %d: backreference offset %d (block %d)\n", pos, i, offset, i-int(offset))
+		}
+	}
+}
+
+// dumpHistogram will dump the block size histogram at the end of an index, if any.
+func dumpHistogram(w io.Writer, cr *countingReader, flags uint64) error {
+	if flags&flagSizeHistogram == 0 {
+		return nil
+	}
+	pos := cr.n
+	h, err := readHistogram(cr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%d: block size histogram %v\n", pos, h)
+	return nil
+}
+
+// countingReader keeps track of the number of bytes read.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,68 @@
+package dedup_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestDumpIndex(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(1<<20 + 100).Bytes()
+	// Make the second half a copy of the first.
+	copy(b[512<<10:], b[:512<<10])
+
+	idx := bytes.Buffer{}
+	data := bytes.Buffer{}
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := bytes.Buffer{}
+	err = dedup.DumpIndex(&idx, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := out.String()
+	for _, want := range []string{"0: format 1\n", "max block size 65536\n", "new block", "backreference offset 8", "last block, size 100", "end of stream"} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("dump did not contain %q", want)
+		}
+	}
+
+	stream := bytes.Buffer{}
+	w, err = dedup.NewStreamWriter(&stream, dedup.ModeFixed, size, 10*size, dedup.WithExplicitLengths(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	err = dedup.DumpIndex(&stream, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump = out.String()
+	for _, want := range []string{"0: format 4\n", "max backreference length 10\n", "flags 0x2\n", "backreference offset 8", "last block, size 100", "end of stream"} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("dump did not contain %q", want)
+		}
+	}
+
+	// Truncated input should return an error.
+	err = dedup.DumpIndex(bytes.NewReader(stream.Bytes()[:stream.Len()/2]), &out)
+	if err == nil {
+		t.Fatal("expected error on truncated stream")
+	}
+}
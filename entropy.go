@@ -0,0 +1,83 @@
+package dedup
+
+import (
+	"math"
+)
+
+// entropySample is the number of bytes at the start of the input
+// used to estimate the entropy.
+const entropySample = 64 << 10
+
+// entropySampler estimates the entropy of the start of the input
+// from a histogram of byte values, like the entropy based splitter.
+type entropySampler struct {
+	hist [256]int
+	n    int
+	auto float64 // Threshold set by WithAutoMode. 0 if disabled.
+}
+
+// add will add b to the histogram until the sample is complete.
+// It returns true when the sample was completed.
+func (e *entropySampler) add(b []byte) bool {
+	if e.n == entropySample {
+		return false
+	}
+	if len(b) > entropySample-e.n {
+		b = b[:entropySample-e.n]
+	}
+	for _, v := range b {
+		e.hist[v]++
+	}
+	e.n += len(b)
+	return e.n == entropySample
+}
+
+// entropy returns the entropy of the sample in bits per byte.
+func (e *entropySampler) entropy() float64 {
+	return histogramEntropy(e.hist[:], e.n)
+}
+
+// histogramEntropy returns the Shannon entropy in bits per byte
+// of n bytes with the given histogram.
+func histogramEntropy(hist []int, n int) float64 {
+	if n == 0 {
+		return 0
+	}
+	var bits float64
+	for _, c := range hist {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / float64(n)
+		bits -= p * math.Log2(p)
+	}
+	return bits
+}
+
+// sampleInput will add accepted input to the entropy sample.
+// When the sample is complete and the entropy is above the WithAutoMode
+// threshold, the writer switches to fixed blocks of the maximum size.
+// The current block is continued, so previous blocks are unaffected.
+func (w *writer) sampleInput(b []byte) {
+	// n is only changed by the goroutine calling Write.
+	if w.ent.n == entropySample {
+		return
+	}
+	w.mu.Lock()
+	done := w.ent.add(b)
+	auto := done && w.ent.auto > 0 && w.ent.entropy() >= w.ent.auto
+	w.mu.Unlock()
+	if auto {
+		fw := &fixedWriter{}
+		w.writer = fw.write
+		w.split = fw.split
+		w.reset = fw.reset
+	}
+}
+
+// InputEntropy returns the estimated entropy of the input in bits per byte.
+func (w *writer) InputEntropy() float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.ent.entropy()
+}
@@ -0,0 +1,80 @@
+package dedup_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+// splitFragments will split b with a dynamic splitter
+// and return the fragments and the entropy estimate.
+func splitFragments(t *testing.T, b []byte, opts ...dedup.Option) ([]dedup.Fragment, float64) {
+	out := make(chan dedup.Fragment, 10)
+	w, err := dedup.NewSplitter(out, dedup.ModeDynamic, 16<<10, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frags []dedup.Fragment
+	done := make(chan struct{})
+	go func() {
+		for f := range out {
+			frags = append(frags, f)
+		}
+		close(done)
+	}()
+	if _, err := w.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	got, err := dedup.ReassembleFragments(frags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, got) {
+		t.Fatal("Output mismatch")
+	}
+	return frags, w.InputEntropy()
+}
+
+func TestAutoMode(t *testing.T) {
+	random := getBufferSize(1 << 20).Bytes()
+	dynamic, e := splitFragments(t, random)
+	if e < 7.9 || e > 8 {
+		t.Fatal("unexpected entropy of random input:", e)
+	}
+	auto, e2 := splitFragments(t, random, dedup.WithAutoMode(7.5))
+	if e != e2 {
+		t.Fatal("entropy mismatch", e, e2)
+	}
+	// Fragments starting after the first 64KiB have the maximum size.
+	offset := 0
+	for i, f := range auto {
+		if offset >= 64<<10 && i < len(auto)-1 && len(f.Payload) != 16<<10 {
+			t.Fatalf("fragment %d at offset %d has size %d", i, offset, len(f.Payload))
+		}
+		offset += len(f.Payload)
+	}
+	if len(auto) >= len(dynamic) {
+		t.Fatalf("expected fewer fragments, got %d, %d without auto mode", len(auto), len(dynamic))
+	}
+	t.Log("Fragments:", len(dynamic), "Auto:", len(auto))
+
+	text := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog, ", 1<<20/45))
+	dynamic, e = splitFragments(t, text)
+	if e > 5 {
+		t.Fatal("unexpected entropy of text:", e)
+	}
+	auto, _ = splitFragments(t, text, dedup.WithAutoMode(7.5))
+	if len(auto) != len(dynamic) {
+		t.Fatalf("mode changed on text, got %d fragments, expected %d", len(auto), len(dynamic))
+	}
+
+	if _, err := dedup.NewSplitter(make(chan dedup.Fragment), dedup.ModeDynamic, 16<<10, dedup.WithAutoMode(9)); err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+}
@@ -0,0 +1,161 @@
+package dedup
+
+import (
+	"math"
+)
+
+// gear contains the random values added to the rolling hash for each byte.
+// The values are generated by SplitMix64 from a fixed seed,
+// since they affect the block boundaries.
+var gear = func() (t [256]uint64) {
+	s := uint64(0x6465647570)
+	for i := range t {
+		s += 0x9e3779b97f4a7c15
+		z := s
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return t
+}()
+
+// fastCDCWriter splits blocks using FastCDC.
+//
+// A gear hash is updated with a shift and an addition for each byte,
+// so only the last 64 bytes affect the hash.
+// Boundaries are found with normalized chunking:
+// before the average block size a boundary is 4 times less likely,
+// and after it 4 times more likely than the average,
+// which narrows the distribution of block sizes.
+type fastCDCWriter struct {
+	h           uint64 // rolling hash for finding fragment boundaries
+	maxFragment int
+	minFragment int
+	avgFragment int
+	maxSmall    uint64 // Hash limit before the average size.
+	maxLarge    uint64 // Hash limit after the average size.
+}
+
+// Split blocks. Typically block size will be maxSize / 4
+// Minimum block size is maxSize/64.
+//
+// The break point is content dependent.
+// Any insertions, deletions, or edits that occur before the start of the 64 byte dependency window
+// don't affect the break point.
+func newFastCDCWriter(maxSize uint) *fastCDCWriter {
+	avg := int(maxSize / 4)
+	return &fastCDCWriter{
+		maxFragment: int(maxSize),
+		minFragment: int(maxSize / 64),
+		avgFragment: avg,
+		maxSmall:    math.MaxUint64 / uint64(avg*4),
+		maxLarge:    math.MaxUint64 / uint64(avg/4),
+	}
+}
+
+func (f *fastCDCWriter) write(w *writer, b []byte) (int, error) {
+	h := f.h
+	off := w.off
+	inLen := len(b)
+	for len(b) > 0 {
+		// Limit the input to the end of the maximum fragment,
+		// so only the hash must be checked for each byte.
+		in := b
+		if len(in) > f.maxFragment-off {
+			in = in[:f.maxFragment-off]
+		}
+		// Bytes before the minimum fragment size cannot end the block,
+		// and only the last 64 of them affect the hash.
+		n := clampInt(f.minFragment-off-1, 0, len(in))
+		for _, c := range in[clampInt(n-64, 0, n):n] {
+			h = h<<1 + gear[c]
+		}
+		content := false
+		avg := clampInt(f.avgFragment-off, n, len(in))
+		for _, c := range in[n:avg] {
+			h = h<<1 + gear[c]
+			n++
+			if h < f.maxSmall {
+				content = true
+				break
+			}
+		}
+		if !content && n == avg {
+			for _, c := range in[n:] {
+				h = h<<1 + gear[c]
+				n++
+				if h < f.maxLarge {
+					content = true
+					break
+				}
+			}
+		}
+		copy(w.cur[off:], in[:n])
+		off += n
+		b = b[n:]
+
+		// At a break point? Send it off!
+		if content || off >= f.maxFragment {
+			blk := w.buffer()
+			// Swap block with current
+			w.cur, blk.data = blk.data[:w.maxSize], w.cur[:off]
+			blk.cut, blk.boundary = CutMaxSize, uint32(h>>32)
+			if content {
+				blk.cut = CutContent
+			}
+			w.mu.Lock()
+			blk.N = w.nblocks
+			w.nblocks++
+			w.mu.Unlock()
+
+			w.hashBlock(blk)
+			w.send(blk)
+			off = 0
+			h = 0
+			if w.blockLimitReached() {
+				w.off, f.h = 0, 0
+				return inLen - len(b), ErrBlockLimitReached
+			}
+		}
+	}
+	w.off = off
+	f.h = h
+	w.hashCur(off)
+	return inLen, nil
+}
+
+// Split content, so a new block begins with next write
+func (f *fastCDCWriter) split(w *writer) {
+	if w.off == 0 {
+		return
+	}
+	b := w.buffer()
+	// Swap block with current
+	w.cur, b.data = b.data[:w.maxSize], w.cur[:w.off]
+	b.cut, b.boundary = w.splitReason(), uint32(f.h>>32)
+	w.mu.Lock()
+	b.N = w.nblocks
+	w.nblocks++
+	w.mu.Unlock()
+
+	w.hashBlock(b)
+	w.send(b)
+	w.off = 0
+	f.h = 0
+}
+
+// Reset the rolling hash.
+func (f *fastCDCWriter) reset() {
+	f.h = 0
+}
+
+// clampInt returns v limited to the range lo to hi.
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
@@ -0,0 +1,112 @@
+package dedup_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestFastCDC(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(4 << 20).Bytes()
+
+	var idx, data bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeDynamicFastCDC, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	r, err := dedup.NewReader(&idx, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if !bytes.Equal(b, out) {
+		t.Fatal("output mismatch")
+	}
+
+	var stream bytes.Buffer
+	w, err = dedup.NewStreamWriter(&stream, dedup.ModeDynamicFastCDC, size, 8*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	sr, err := dedup.NewStreamReader(&stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = ioutil.ReadAll(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr.Close()
+	if !bytes.Equal(b, out) {
+		t.Fatal("stream output mismatch")
+	}
+
+	// Insert some bytes at the start, so fixed blocks would not match.
+	shifted := append([]byte("shifted"), b...)
+	ch := make(chan dedup.Fragment, 10)
+	w, err = dedup.NewSplitter(ch, dedup.ModeDynamicFastCDC, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		w.Write(b)
+		w.Split()
+		w.Write(shifted)
+		w.Close()
+	}()
+	var frags, total int
+	for f := range ch {
+		frags++
+		total += len(f.Payload)
+		if len(f.Payload) > size {
+			t.Fatal("fragment too large:", len(f.Payload))
+		}
+		if len(f.Payload) < size/64 && f.Cut == dedup.CutContent {
+			t.Fatal("fragment too small:", len(f.Payload))
+		}
+	}
+	if total != len(b)+len(shifted) {
+		t.Fatal("got", total, "bytes, expected", len(b)+len(shifted))
+	}
+	avg := total / frags
+	if avg < size/8 || avg > size/2 {
+		t.Fatal("unexpected average block size", avg)
+	}
+	st := w.Stats()
+	if st.Ratio() > 0.6 {
+		t.Fatalf("shifted content was not deduplicated, %+v", st)
+	}
+}
+
+func BenchmarkFastCDCWriter64K(t *testing.B) {
+	const totalinput = 10 << 20
+	input := getBufferSize(totalinput)
+
+	const size = 64 << 10
+	b := input.Bytes()
+	t.ResetTimer()
+	t.SetBytes(totalinput)
+	for i := 0; i < t.N; i++ {
+		input = bytes.NewBuffer(b)
+		w, _ := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeDynamicFastCDC, size, 0)
+		io.Copy(w, input)
+		err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
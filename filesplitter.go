@@ -52,13 +52,13 @@ func (z *zpaqWriter) writeFile(w *writer, b []byte) (int, error) {
 
 		// Filled the buffer? Send it off!
 		if w.off >= z.minFragment && (z.h < z.maxHash || split || w.off >= z.maxFragment) {
-			b := <-w.buffers
+			b := w.buffer()
 			// Swap block with current
 			w.cur, b.data = b.data[:w.maxSize], w.cur[:w.off]
 			b.N = w.nblocks
 
-			w.input <- b
-			w.write <- b
+			w.hashBlock(b)
+			w.send(b)
 			w.nblocks++
 			w.off = 0
 			z.h = 0
@@ -90,13 +90,13 @@ func fileSplitOnly(w *writer, b []byte) (int, error) {
 
 		// Filled the buffer? Send it off!
 		if split || w.off >= w.maxSize {
-			b := <-w.buffers
+			b := w.buffer()
 			// Swap block with current
 			w.cur, b.data = b.data[:w.maxSize], w.cur[:w.off]
 			b.N = w.nblocks
 
-			w.input <- b
-			w.write <- b
+			w.hashBlock(b)
+			w.send(b)
 			w.nblocks++
 			w.off = 0
 		}
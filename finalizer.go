@@ -0,0 +1,36 @@
+package dedup
+
+import "io"
+
+// A Finalizer receives the complete output of a writer when it is closed.
+//
+// For writers created by NewWriter, index and blocks contain the index and block streams.
+// For writers created by NewStreamWriter, index contains the stream and blocks is nil.
+// The readers are only valid until the Finalizer returns.
+type Finalizer func(index, blocks io.Reader) error
+
+// finalizer buffers the output of a writer until it is closed.
+type finalizer struct {
+	fn   Finalizer
+	idx  *SpillBuffer
+	blks *SpillBuffer
+}
+
+// finalize will send the buffered output to the finalizer
+// and release the buffers.
+func (f *finalizer) finalize() error {
+	defer f.cleanup()
+	var blks io.Reader
+	if f.blks != nil {
+		blks = f.blks.Reader()
+	}
+	return f.fn(f.idx.Reader(), blks)
+}
+
+// cleanup will remove temporary files.
+func (f *finalizer) cleanup() {
+	f.idx.Close()
+	if f.blks != nil {
+		f.blks.Close()
+	}
+}
@@ -0,0 +1,87 @@
+package dedup_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestFinalizer(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(1<<20 + 100).Bytes()
+
+	// Spill sizes for all in memory, and spill to disk.
+	for _, spill := range []int64{0, 100 << 10} {
+		var gotIdx, gotData []byte
+		calls := 0
+		fn := func(index, blocks io.Reader) error {
+			calls++
+			var err error
+			gotIdx, err = ioutil.ReadAll(index)
+			if err != nil {
+				return err
+			}
+			gotData, err = ioutil.ReadAll(blocks)
+			return err
+		}
+		w, err := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.WithFinalizer(fn, spill), dedup.WithSelfVerify(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(w, bytes.NewBuffer(b))
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		if calls != 1 {
+			t.Fatalf("expected finalizer to be called once, was called %d times", calls)
+		}
+		r, err := dedup.NewReader(bytes.NewReader(gotIdx), bytes.NewReader(gotData))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, got) {
+			t.Fatal("output mismatch, spill size", spill)
+		}
+	}
+
+	// Single stream, with finalizer error.
+	errTest := errors.New("test error")
+	var stream []byte
+	fn := func(index, blocks io.Reader) error {
+		if blocks != nil {
+			t.Error("expected nil blocks for stream")
+		}
+		stream, _ = ioutil.ReadAll(index)
+		return errTest
+	}
+	w, err := dedup.NewStreamWriter(ioutil.Discard, dedup.ModeFixed, size, 10*size, dedup.WithFinalizer(fn, 10<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != errTest {
+		t.Fatal("expected test error, got", err)
+	}
+	r, err := dedup.NewStreamReader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, got) {
+		t.Fatal("stream output mismatch")
+	}
+}
@@ -0,0 +1,171 @@
+package dedup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Fixed index record types, stored in the top two bits of a record.
+const (
+	recordNew  = 0 << 62 // New block, the value is the block length.
+	recordRef  = 2 << 62 // Backreference, the value is the offset.
+	recordLast = 3 << 62 // Last block, the value is the block length.
+
+	recordTypeMask  = 3 << 62
+	recordValueMask = 1<<62 - 1
+
+	// recordSize is the size of a fixed index record.
+	recordSize = 8
+)
+
+// checkFixedRecords will check that fixed index records can be used by w.
+func (w *writer) checkFixedRecords() error {
+	if w.flags&flagFixedRecords == 0 {
+		return nil
+	}
+	if w.delta != nil {
+		return errors.New("dedup: delta blocks not supported with fixed index records")
+	}
+	if w.shards != nil {
+		return errors.New("dedup: sharding not supported with fixed index records")
+	}
+	return nil
+}
+
+// putRecord will write a fixed index record with type t and value v.
+func (w *writer) putRecord(t, v uint64) error {
+	var rec [recordSize]byte
+	binary.LittleEndian.PutUint64(rec[:], t|v)
+	n, err := w.idx.Write(rec[:])
+	if err != nil {
+		return err
+	}
+	if n != len(rec) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// putNew will write the index entry of a new block of length n.
+func (w *writer) putNew(n, shard int) error {
+	if w.flags&flagFixedRecords != 0 {
+		return w.putRecord(recordNew, uint64(n))
+	}
+	if err := w.putUint64(0); err != nil {
+		return err
+	}
+	if err := w.putLength(n); err != nil {
+		return err
+	}
+	return w.putShard(shard)
+}
+
+// putRef will write the index entry of a reference to the block offset blocks back.
+func (w *writer) putRef(offset int) error {
+	if w.flags&flagFixedRecords != 0 {
+		return w.putRecord(recordRef, uint64(offset))
+	}
+	return w.putUint64(uint64(offset))
+}
+
+// appendLast will append the index entry of the last block of length n to buf.
+func (w *writer) appendLast(buf *bytes.Buffer, n, shard int) {
+	if w.flags&flagFixedRecords != 0 {
+		var rec [recordSize]byte
+		binary.LittleEndian.PutUint64(rec[:], recordLast|uint64(n))
+		buf.Write(rec[:])
+		return
+	}
+	w.appendUint64(buf, uint64(math.MaxUint64))
+	w.appendUint64(buf, w.lengthValue(n))
+	if shard >= 0 {
+		w.appendUint64(buf, uint64(shard))
+	}
+	w.appendUint64(buf, 0) // Stream continuation possibility, should be 0.
+}
+
+// readRecord will read a fixed index record
+// and return the type and value.
+func readRecord(idx io.ByteReader) (t, v uint64, err error) {
+	for i := uint(0); i < recordSize; i++ {
+		b, err := idx.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, 0, err
+		}
+		v |= uint64(b) << (8 * i)
+	}
+	return v & recordTypeMask, v & recordValueMask, nil
+}
+
+// readRecords will read fixed index records,
+// until the record of the last block has been read.
+func (f *reader) readRecords(idx io.ByteReader) error {
+	var foffset int64
+	// Insert empty block 0
+	f.blocks = append(f.blocks, nil)
+	for i := 1; ; i++ {
+		t, v, err := readRecord(idx)
+		if err != nil {
+			return err
+		}
+		switch t {
+		case recordNew:
+			if v > uint64(f.size) {
+				return fmt.Errorf("invalid size for block %d, %d > %d", i, v, f.size)
+			}
+			f.blocks = append(f.blocks, &rblock{first: i, last: i, readData: int(v), offset: foffset, marker: f.isMarker(int(v))})
+			foffset += int64(v)
+		case recordLast:
+			if v > uint64(f.size) {
+				return fmt.Errorf("invalid size for block %d, %d > %d", i, v, f.size)
+			}
+			f.blocks = append(f.blocks, &rblock{readData: int(v), offset: foffset})
+			return nil
+		case recordRef:
+			pos := len(f.blocks) - int(v)
+			if v == 0 || pos <= 0 {
+				return fmt.Errorf("invalid offset encountered at block %d, offset was %d", i, v)
+			}
+			org := f.blocks[pos]
+			org.last = i
+			f.blocks = append(f.blocks, org)
+		default:
+			return fmt.Errorf("invalid record type at block %d", i)
+		}
+	}
+}
+
+// dumpRecords will write a description of fixed index records to w.
+func dumpRecords(w io.Writer, cr *countingReader, size int) error {
+	var dataOffset int64
+	for i := 1; ; i++ {
+		pos := cr.n
+		t, v, err := readRecord(cr)
+		if err != nil {
+			return err
+		}
+		switch t {
+		case recordNew, recordLast:
+			if v > uint64(size) {
+				return fmt.Errorf("invalid size for block %d, %d > %d", i, v, size)
+			}
+			if t == recordLast {
+				fmt.Fprintf(w, "%d: block %d: last block, size %d, data offset %d\n", pos, i, v, dataOffset)
+				return nil
+			}
+			fmt.Fprintf(w, "%d: block %d: new block, size %d, data offset %d\n", pos, i, v, dataOffset)
+			dataOffset += int64(v)
+		case recordRef:
+			fmt.Fprintf(w, "%d: block %d: backreference offset %d (block %d)\n", pos, i, v, i-int(v))
+		default:
+			return fmt.Errorf("invalid record type at block %d", i)
+		}
+	}
+}
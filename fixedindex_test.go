@@ -0,0 +1,129 @@
+package dedup_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestFixedIndexRecords(t *testing.T) {
+	const size = 16 << 10
+	b := getBufferSize(4<<20 + 100).Bytes()
+	// Create some duplicates
+	copy(b[2<<20:], b[:1<<20])
+
+	var idx, data bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeDynamic, size, 0, dedup.WithFixedIndexRecords(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	hdr := len(w.Header())
+	if want := hdr + 8*w.Stats().Blocks; idx.Len() != want {
+		t.Fatalf("expected index size %d, got %d", want, idx.Len())
+	}
+	// The record of the last block can be located directly.
+	last := binary.LittleEndian.Uint64(idx.Bytes()[idx.Len()-8:])
+	if last>>62 != 3 {
+		t.Fatalf("unexpected last record 0x%x", last)
+	}
+
+	r, err := dedup.NewReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, out) {
+		t.Fatal("Output mismatch")
+	}
+	r.Close()
+
+	ra, err := dedup.NewReaderAt(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = make([]byte, 1000)
+	if _, err := ra.ReadAt(out, 3<<20); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b[3<<20:3<<20+1000], out) {
+		t.Fatal("ReadAt output mismatch")
+	}
+
+	var dump bytes.Buffer
+	if err := dedup.DumpIndex(bytes.NewReader(idx.Bytes()), &dump); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dump.String(), "backreference") || !strings.Contains(dump.String(), "last block") {
+		t.Fatalf("unexpected dump:\n%s", dump.String())
+	}
+
+	// A truncated index must be rejected.
+	_, err = dedup.NewReader(bytes.NewReader(idx.Bytes()[:idx.Len()-4]), bytes.NewReader(data.Bytes()))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+}
+
+func TestFixedIndexRecordsUnsupported(t *testing.T) {
+	var idx, data bytes.Buffer
+	opt := dedup.WithFixedIndexRecords(true)
+	if _, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, 1024, 0, opt, dedup.WithDeltaEncoding(0.5)); err == nil {
+		t.Fatal("expected error with delta encoding")
+	}
+	if _, err := dedup.NewStreamWriter(&idx, dedup.ModeFixed, 1024, 10*1024, opt); err == nil {
+		t.Fatal("expected error with stream writer")
+	}
+	if _, err := dedup.NewShardedWriter(&idx, []io.Writer{&data}, dedup.ModeFixed, 1024, 0, opt); err == nil {
+		t.Fatal("expected error with sharded writer")
+	}
+}
+
+func benchmarkSeekLatency(t *testing.B, opts ...dedup.Option) {
+	const size = 4 << 10
+	b := getVersionedDocuments(1<<20, 8, 50)
+	var idx, data bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeDynamic, size, 0, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(0))
+	buf := make([]byte, 1<<10)
+	t.ReportAllocs()
+	t.ResetTimer()
+	for i := 0; i < t.N; i++ {
+		// Open the stream and read a single range.
+		r, err := dedup.NewReaderAt(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = r.ReadAt(buf, rng.Int63n(int64(len(b)-len(buf))))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Open and read a random 1K range of versioned documents, variable length index.
+func BenchmarkSeekLatencyVarint(t *testing.B) {
+	benchmarkSeekLatency(t)
+}
+
+// Open and read a random 1K range of versioned documents, fixed index records.
+func BenchmarkSeekLatencyFixed(t *testing.B) {
+	benchmarkSeekLatency(t, dedup.WithFixedIndexRecords(true))
+}
@@ -0,0 +1,159 @@
+package dedup
+
+import (
+	hasher "crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// ReassembleFragments will return the original data of the supplied fragments,
+// as returned by NewSplitter.
+//
+// The fragments can be supplied in any order, and will be
+// concatenated in the order of their sequence number (N).
+// An error is returned if any fragment is missing or duplicated.
+// Since the number of fragments isn't known, missing fragments
+// at the end of the sequence cannot be detected.
+func ReassembleFragments(frags []Fragment) ([]byte, error) {
+	ordered := make([]*Fragment, len(frags))
+	size := 0
+	for i := range frags {
+		f := &frags[i]
+		if f.N >= uint(len(frags)) {
+			// There is a gap before this, which is reported below.
+			continue
+		}
+		if ordered[f.N] != nil {
+			return nil, fmt.Errorf("dedup: duplicate fragment %d", f.N)
+		}
+		ordered[f.N] = f
+		size += len(f.Payload)
+	}
+	for n, f := range ordered {
+		if f == nil {
+			return nil, fmt.Errorf("dedup: missing fragment %d", n)
+		}
+	}
+	dst := make([]byte, 0, size)
+	for _, f := range ordered {
+		dst = append(dst, f.Payload...)
+	}
+	return dst, nil
+}
+
+// DecodeFragments will decode the supplied index and data stream,
+// and send the content of each block as a Fragment on the fragments channel.
+// The channel is closed when decoding ends, also if an error occurs.
+//
+// This is compatible content from the NewWriter function.
+//
+// The hash of each fragment is calculated as by the writer, so it matches
+// the hash a splitter would return for the block.
+// Fragments are numbered from 0, and New is true for the first occurrence
+// of each hash. Since the hashes of all blocks are kept to detect this,
+// memory use grows with the number of unique blocks.
+// Cut and Boundary are not stored in the stream and are always 0.
+//
+// If the stream uses a block hash not known by this package,
+// ErrUnknownHash is returned and no fragments are sent.
+//
+// The function returns when all fragments have been sent,
+// so the channel must be read by another goroutine.
+func DecodeFragments(index, blocks io.Reader, fragments chan<- Fragment) error {
+	defer close(fragments)
+	r, err := NewReader(index, blocks)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f := r.(*reader)
+	hf := f.hashFunc()
+	if hf == nil {
+		return ErrUnknownHash
+	}
+	return f.forEachBlock(newFragmentDecoder(f.flags, hf(), fragments))
+}
+
+// DecodeStreamFragments will decode the supplied data stream,
+// and send the content of each block as a Fragment on the fragments channel,
+// like DecodeFragments.
+//
+// This is compatible content from the NewStreamWriter function.
+func DecodeStreamFragments(in io.Reader, fragments chan<- Fragment) error {
+	defer close(fragments)
+	r, err := NewStreamReader(in)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f := r.(*streamReader)
+	hf := f.hashFunc()
+	if hf == nil {
+		return ErrUnknownHash
+	}
+	return f.forEachBlock(newFragmentDecoder(f.flags, hf(), fragments))
+}
+
+// newFragmentDecoder returns a function that sends decoded blocks
+// as fragments, for a stream with the supplied format flags and block hash.
+func newFragmentDecoder(flags uint64, h hash.Hash, fragments chan<- Fragment) func(data []byte) error {
+	seen := make(map[[HashSize]byte]struct{})
+	n := uint(0)
+	return func(data []byte) error {
+		var f Fragment
+		h.Reset()
+		if flags&flagLengthHash != 0 {
+			var length [8]byte
+			binary.LittleEndian.PutUint64(length[:], uint64(len(data)))
+			h.Write(length[:])
+		}
+		h.Write(data)
+		sumHash(h, &f.Hash)
+		if _, ok := seen[f.Hash]; !ok {
+			seen[f.Hash] = struct{}{}
+			f.New = true
+		}
+		f.N = n
+		f.Payload = make([]byte, len(data))
+		copy(f.Payload, data)
+		fragments <- f
+		n++
+		return nil
+	}
+}
+
+// fileState keeps track of the fragments of the current file
+// for WithFileDuplicates.
+type fileState struct {
+	h     hash.Hash
+	frags int
+	dup   bool
+}
+
+// add will add a fragment with hash h to the file.
+func (f *fileState) add(h [HashSize]byte, isNew bool) {
+	if f.h == nil {
+		f.h = hasher.New()
+	}
+	if f.frags == 0 {
+		f.h.Reset()
+		f.dup = true
+	}
+	f.h.Write(h[:])
+	f.frags++
+	f.dup = f.dup && !isNew
+}
+
+// end will report the current file to fn and start a new file.
+// Files without fragments are not reported.
+func (f *fileState) end(fn func(hash [HashSize]byte, duplicate bool)) {
+	if f.frags == 0 {
+		return
+	}
+	var sum [HashSize]byte
+	f.h.Sum(sum[:0])
+	fn(sum, f.dup)
+	f.frags = 0
+}
@@ -0,0 +1,465 @@
+package dedup_test
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestReassembleFragments(t *testing.T) {
+	const totalinput = 1<<20 + 65
+	b := getBufferSize(totalinput).Bytes()
+
+	out := make(chan dedup.Fragment, 10)
+	w, err := dedup.NewSplitter(out, dedup.ModeDynamic, 16<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frags []dedup.Fragment
+	done := make(chan struct{})
+	go func() {
+		for f := range out {
+			frags = append(frags, f)
+		}
+		close(done)
+	}()
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if len(frags) < 2 {
+		t.Fatal("expected more than one fragment, got", len(frags))
+	}
+
+	// Reverse the order
+	for i, j := 0, len(frags)-1; i < j; i, j = i+1, j-1 {
+		frags[i], frags[j] = frags[j], frags[i]
+	}
+	got, err := dedup.ReassembleFragments(frags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, got) {
+		t.Fatal("Output mismatch")
+	}
+
+	// Missing fragment
+	missing := append([]dedup.Fragment{}, frags[:len(frags)/2]...)
+	missing = append(missing, frags[len(frags)/2+1:]...)
+	_, err = dedup.ReassembleFragments(missing)
+	if err == nil {
+		t.Fatal("expected error on missing fragment")
+	}
+	t.Log("Missing:", err)
+
+	// Duplicate fragment
+	dup := append([]dedup.Fragment{}, frags...)
+	dup[0] = dup[1]
+	_, err = dedup.ReassembleFragments(dup)
+	if err == nil {
+		t.Fatal("expected error on duplicate fragment")
+	}
+	t.Log("Duplicate:", err)
+
+	// No fragments
+	got, err = dedup.ReassembleFragments(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatal("expected no data, got", len(got))
+	}
+}
+
+func TestSharedChannel(t *testing.T) {
+	const splitters = 4
+	inputs := make([][]byte, splitters)
+	for i := range inputs {
+		inputs[i] = getBufferSize(1<<20 + i*1000).Bytes()
+	}
+
+	out := make(chan dedup.Fragment, 10)
+	frags := make([][]dedup.Fragment, splitters)
+	done := make(chan struct{})
+	go func() {
+		for f := range out {
+			frags[f.Source] = append(frags[f.Source], f)
+		}
+		close(done)
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, splitters)
+	for i := range inputs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w, err := dedup.NewSplitter(out, dedup.ModeDynamic, 16<<10, dedup.WithSharedChannel(i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			io.Copy(w, bytes.NewBuffer(inputs[i]))
+			errs <- w.Close()
+		}(i)
+	}
+	wg.Wait()
+	close(out)
+	<-done
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := range inputs {
+		got, err := dedup.ReassembleFragments(frags[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(inputs[i], got) {
+			t.Fatal("Output mismatch on source", i)
+		}
+	}
+}
+
+func TestSplitterStats(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(10 << 20).Bytes()
+	// Second half is a copy of the first.
+	copy(b[5<<20:], b[:5<<20])
+
+	out := make(chan dedup.Fragment)
+	w, err := dedup.NewSplitter(out, dedup.ModeFixed, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		io.Copy(w, bytes.NewBuffer(b))
+		w.Close()
+	}()
+	var want dedup.Stats
+	var run int
+	var runBytes, dupBytes int64
+	dups := 0
+	for f := range out {
+		want.Blocks++
+		want.Bytes += int64(len(f.Payload))
+		if f.New {
+			want.NewBlocks++
+			want.NewBytes += int64(len(f.Payload))
+			run, runBytes = 0, 0
+		} else {
+			dups++
+			dupBytes += int64(len(f.Payload))
+			run++
+			runBytes += int64(len(f.Payload))
+			if run > want.LongestDupRun {
+				want.LongestDupRun, want.LongestDupBytes = run, runBytes
+				want.LongestDupStart = want.Blocks - run + 1
+			}
+		}
+		// Stats are updated before the fragment is sent.
+		got := w.Stats()
+		if got.Blocks < want.Blocks || got.NewBlocks < want.NewBlocks {
+			t.Fatalf("stats behind, got %+v, want at least %+v", got, want)
+		}
+	}
+	got := w.Stats()
+	want.Stalls = got.Stalls
+	if got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if got.Ratio() != 0.5 {
+		t.Fatal("expected ratio 0.5, got", got.Ratio())
+	}
+	if got.DuplicateBlocks() != dups || got.DuplicateBytes() != dupBytes {
+		t.Fatalf("got %d duplicates of %d bytes, want %d of %d bytes", got.DuplicateBlocks(), got.DuplicateBytes(), dups, dupBytes)
+	}
+}
+
+func TestSplitterSendTimeout(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(1 << 20).Bytes()
+
+	// Unbuffered channel without a consumer.
+	out := make(chan dedup.Fragment)
+	w, err := dedup.NewSplitter(out, dedup.ModeFixed, size, dedup.WithSendTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.Copy(w, bytes.NewBuffer(b))
+	if err != nil && err != dedup.ErrFragmentTimeout {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != dedup.ErrFragmentTimeout {
+		t.Fatal("expected ErrFragmentTimeout, got", err)
+	}
+	// Channel should be closed.
+	for range out {
+	}
+	if w.Stats().Stalls == 0 {
+		t.Fatal("expected stalls to be counted")
+	}
+
+	_, err = dedup.NewSplitter(out, dedup.ModeFixed, size, dedup.WithSendTimeout(-1))
+	if err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+}
+
+func TestFragmentCutReason(t *testing.T) {
+	const size = 16 << 10
+	b := getBufferSize(1<<20 + 65).Bytes()
+	for _, mode := range []dedup.Mode{dedup.ModeFixed, dedup.ModeDynamic, dedup.ModeDynamicEntropy} {
+		out := make(chan dedup.Fragment, 10)
+		w, err := dedup.NewSplitter(out, mode, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			w.Write(b[:len(b)/2])
+			w.Split()
+			w.Write(b[len(b)/2:])
+			w.Close()
+		}()
+		var frags []dedup.Fragment
+		reasons := make(map[dedup.CutReason]int)
+		for f := range out {
+			frags = append(frags, f)
+			reasons[f.Cut]++
+		}
+		if reasons[dedup.CutSplit] != 1 {
+			t.Errorf("mode %d: expected 1 split, got %d", mode, reasons[dedup.CutSplit])
+		}
+		if last := frags[len(frags)-1]; last.Cut != dedup.CutEOF {
+			t.Errorf("mode %d: expected last fragment to be cut by EOF, got %d", mode, last.Cut)
+		}
+		if reasons[dedup.CutEOF] != 1 {
+			t.Errorf("mode %d: expected 1 EOF, got %d", mode, reasons[dedup.CutEOF])
+		}
+		for _, f := range frags {
+			if f.Cut == dedup.CutMaxSize && len(f.Payload) != size {
+				t.Errorf("mode %d: max size fragment with size %d", mode, len(f.Payload))
+			}
+			if mode == dedup.ModeFixed && f.Boundary != 0 {
+				t.Errorf("mode %d: expected no boundary hash, got %d", mode, f.Boundary)
+			}
+		}
+		if mode == dedup.ModeFixed && reasons[dedup.CutContent] != 0 {
+			t.Errorf("mode %d: unexpected content cuts", mode)
+		}
+		if mode != dedup.ModeFixed && reasons[dedup.CutContent] == 0 {
+			t.Errorf("mode %d: expected content cuts", mode)
+		}
+		t.Logf("mode %d: %v", mode, reasons)
+	}
+}
+
+func TestFileDuplicates(t *testing.T) {
+	const size = 4 << 10
+	file := getBufferSize(10*size + 100).Bytes()
+	other := getBufferSize(3 * size).Bytes()
+	other[0]++
+
+	type result struct {
+		hash [dedup.HashSize]byte
+		dup  bool
+	}
+	var results []result
+	var wg sync.WaitGroup
+	opt := dedup.WithFileDuplicates(func(h [dedup.HashSize]byte, dup bool) {
+		results = append(results, result{hash: h, dup: dup})
+	})
+	frags := make(chan dedup.Fragment, 100)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range frags {
+		}
+	}()
+	w, err := dedup.NewSplitter(frags, dedup.ModeFixed, size, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The empty file is not reported, and the last file ends on Close.
+	for _, in := range [][]byte{file, other, file, nil} {
+		w.Write(in)
+		w.Split()
+	}
+	w.Write(other)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	want := []bool{false, false, true, true}
+	if len(results) != len(want) {
+		t.Fatalf("expected %d files, got %d", len(want), len(results))
+	}
+	for i, r := range results {
+		if r.dup != want[i] {
+			t.Errorf("file %d: expected duplicate %v, got %v", i, want[i], r.dup)
+		}
+	}
+	if results[0].hash != results[2].hash || results[1].hash != results[3].hash {
+		t.Error("identical files have different hashes")
+	}
+	if results[0].hash == results[1].hash {
+		t.Error("different files have identical hashes")
+	}
+}
+
+func TestSplitterIndexCapacity(t *testing.T) {
+	b := getBufferSize(1<<20 + 100).Bytes()
+	// Create some duplicates
+	copy(b[512<<10:], b[:256<<10])
+
+	split := func(opts ...dedup.Option) (frags []dedup.Fragment, entries int) {
+		out := make(chan dedup.Fragment, 10)
+		w, err := dedup.NewSplitter(out, dedup.ModeFixed, 4<<10, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		go func() {
+			for f := range out {
+				frags = append(frags, f)
+			}
+			close(done)
+		}()
+		if _, err := io.Copy(w, bytes.NewBuffer(b)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		w.ForEachIndexEntry(func([dedup.HashSize]byte, int) bool {
+			entries++
+			return true
+		})
+		return frags, entries
+	}
+
+	want, wantEntries := split()
+	got, entries := split(dedup.WithIndexCapacity(1000))
+	if len(got) != len(want) || entries != wantEntries {
+		t.Fatalf("expected %d fragments and %d entries, got %d and %d", len(want), wantEntries, len(got), entries)
+	}
+	for i := range got {
+		if got[i].Hash != want[i].Hash || got[i].New != want[i].New {
+			t.Fatalf("fragment %d mismatch", i)
+		}
+	}
+
+	// Without deduplication the index must stay empty.
+	got, entries = split(dedup.WithDeduplication(false), dedup.WithIndexCapacity(1000))
+	if entries != 0 {
+		t.Fatal("expected empty index, got", entries)
+	}
+	for i := range got {
+		if !got[i].New {
+			t.Fatalf("fragment %d not new", i)
+		}
+	}
+
+	if _, err := dedup.NewSplitter(make(chan dedup.Fragment), dedup.ModeFixed, 1024, dedup.WithIndexCapacity(-1)); err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+}
+
+func TestDecodeFragments(t *testing.T) {
+	const size = 16 << 10
+	b := getBufferSize(1<<20 + 100).Bytes()
+	// Create some duplicates
+	copy(b[512<<10:], b[:256<<10])
+
+	collect := func(fn func(chan<- dedup.Fragment) error) ([]dedup.Fragment, error) {
+		out := make(chan dedup.Fragment, 10)
+		var frags []dedup.Fragment
+		done := make(chan struct{})
+		go func() {
+			for f := range out {
+				frags = append(frags, f)
+			}
+			close(done)
+		}()
+		err := fn(out)
+		<-done
+		return frags, err
+	}
+
+	for _, opts := range [][]dedup.Option{nil, {dedup.WithLengthInHash(true)}} {
+		want, err := collect(func(out chan<- dedup.Fragment) error {
+			w, err := dedup.NewSplitter(out, dedup.ModeDynamic, size, opts...)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(w, bytes.NewBuffer(b))
+			if err != nil {
+				return err
+			}
+			return w.Close()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var idx, data, stream bytes.Buffer
+		w, err := dedup.NewWriter(&idx, &data, dedup.ModeDynamic, size, 0, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+			t.Fatal(err)
+		}
+		w, err = dedup.NewStreamWriter(&stream, dedup.ModeDynamic, size, 100*size, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+			t.Fatal(err)
+		}
+
+		indexed, err := collect(func(out chan<- dedup.Fragment) error {
+			return dedup.DecodeFragments(&idx, &data, out)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamed, err := collect(func(out chan<- dedup.Fragment) error {
+			return dedup.DecodeStreamFragments(&stream, out)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, got := range [][]dedup.Fragment{indexed, streamed} {
+			if len(got) != len(want) {
+				t.Fatalf("expected %d fragments, got %d", len(want), len(got))
+			}
+			for i := range got {
+				g, w := got[i], want[i]
+				if g.N != w.N || g.Hash != w.Hash || g.New != w.New || !bytes.Equal(g.Payload, w.Payload) {
+					t.Fatalf("fragment %d mismatch", i)
+				}
+			}
+		}
+	}
+
+	// Errors are returned after the channel is closed.
+	_, err := collect(func(out chan<- dedup.Fragment) error {
+		return dedup.DecodeStreamFragments(bytes.NewBuffer([]byte{2, 1}), out)
+	})
+	if err == nil {
+		t.Fatal("expected error on truncated stream")
+	}
+}
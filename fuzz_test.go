@@ -0,0 +1,46 @@
+package dedup_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+// FuzzDecodeStream checks that decoding arbitrary single streams
+// returns errors instead of panicking.
+// Run with go test -fuzz FuzzDecodeStream
+func FuzzDecodeStream(f *testing.F) {
+	// Keep inputs small, so the fuzzer can mutate them efficiently.
+	const size = 512
+	b := getVersionedDocuments(4<<10, 3, 10)
+	for _, opts := range [][]dedup.Option{nil, {dedup.WithDeltaEncoding(0.5)}, {dedup.WithByteWindow(8 * size), dedup.WithExplicitLengths(true)}} {
+		var buf bytes.Buffer
+		w, err := dedup.NewStreamWriter(&buf, dedup.ModeDynamic, size, 16*size, opts...)
+		if err != nil {
+			f.Fatal(err)
+		}
+		io.Copy(w, bytes.NewBuffer(b))
+		err = w.Close()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		total := 0
+		dedup.DecodeStream(bytes.NewReader(data), func(b []byte) error {
+			total += len(b)
+			return nil
+		})
+		r, err := dedup.NewStreamReader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		ioutil.ReadAll(r)
+		r.Close()
+		dedup.DumpIndex(bytes.NewReader(data), ioutil.Discard)
+	})
+}
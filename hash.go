@@ -0,0 +1,138 @@
+package dedup
+
+import (
+	hasher "crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+)
+
+// A HashID identifies a hash function that can be used for block hashes.
+// The ID is stored in the stream header, so readers can verify block hashes
+// if the hash function is available.
+type HashID uint8
+
+const (
+	// HashSHA1 is SHA-1, which is the default block hash.
+	HashSHA1 HashID = iota
+	// HashSHA256 is SHA-256, implemented by crypto/sha256.
+	HashSHA256
+	// HashSHA512_256 is SHA-512/256, implemented by crypto/sha512.
+	HashSHA512_256
+	// HashBLAKE2b256 is BLAKE2b with a 256 bit digest.
+	// It must be registered with RegisterHash before it can be used.
+	HashBLAKE2b256
+	// HashXXH64 is the 64 bit xxHash.
+	// The digest is shorter than HashSize, so it is too weak to identify
+	// duplicate blocks and writers refuse it. Readers can verify block hashes
+	// of streams using it, if it is registered with RegisterHash.
+	HashXXH64
+	maxHash
+)
+
+// hashes contains the name, digest size and implementation of each hash ID.
+// Implementations of hashes that are not part of the standard library
+// are added by RegisterHash.
+var hashes = [maxHash]struct {
+	name string
+	size int
+	fn   func() hash.Hash
+}{
+	HashSHA1:       {name: "sha1", size: hasher.Size, fn: hasher.New},
+	HashSHA256:     {name: "sha256", size: sha256.Size, fn: sha256.New},
+	HashSHA512_256: {name: "sha512-256", size: sha512.Size256, fn: sha512.New512_256},
+	HashBLAKE2b256: {name: "blake2b-256", size: 32},
+	HashXXH64:      {name: "xxh64", size: 8},
+}
+
+// RegisterHash will register the implementation of the hash with the given ID.
+// This is needed for hashes that are not part of the standard library,
+// like HashBLAKE2b256 and HashXXH64, and is intended to be called
+// from an init function, since registrations are not synchronized.
+// RegisterHash panics if id is unknown, or if the size of the hash
+// doesn't match the hash identified by id.
+func RegisterHash(id HashID, fn func() hash.Hash) {
+	if id >= maxHash {
+		panic("dedup: RegisterHash of unknown hash ID")
+	}
+	if fn == nil || fn().Size() != hashes[id].size {
+		panic(fmt.Sprintf("dedup: RegisterHash of %v with wrong digest size", id))
+	}
+	hashes[id].fn = fn
+}
+
+// Available returns true if the hash is known and has an implementation,
+// so it can be used by writers and verified by readers.
+func (id HashID) Available() bool {
+	return id < maxHash && hashes[id].fn != nil
+}
+
+// New returns a new hash.Hash calculating the hash.
+// New panics if the hash is not available.
+func (id HashID) New() hash.Hash {
+	if !id.Available() {
+		panic(fmt.Sprintf("dedup: requested hash %v is unavailable", id))
+	}
+	return hashes[id].fn()
+}
+
+// String returns the name of the hash, or "hash-<id>" for unknown IDs.
+func (id HashID) String() string {
+	if id < maxHash {
+		return hashes[id].name
+	}
+	return fmt.Sprintf("hash-%d", uint8(id))
+}
+
+// dedupKey returns true if the digest of the hash is at least HashSize bytes,
+// so it can be used to identify duplicate blocks.
+func (id HashID) dedupKey() bool {
+	return id < maxHash && hashes[id].size >= HashSize
+}
+
+// hashByName returns the ID of the hash with the supplied name.
+func hashByName(name string) (HashID, bool) {
+	for id := range hashes {
+		if hashes[id].name == name {
+			return HashID(id), true
+		}
+	}
+	return 0, false
+}
+
+// sumHash will store the hash of h in dst.
+// Hashes longer than HashSize are truncated to their first HashSize bytes,
+// and shorter hashes are padded with zeros.
+// Writers only use hashes of at least HashSize bytes, see dedupKey.
+func sumHash(h hash.Hash, dst *[HashSize]byte) {
+	if h.Size() == HashSize {
+		h.Sum(dst[:0])
+		return
+	}
+	*dst = [HashSize]byte{}
+	copy(dst[:], h.Sum(nil))
+}
+
+// newHash returns a new block hash of the writer.
+func (w *writer) newHash() hash.Hash {
+	if w.hashFn == nil {
+		return hasher.New()
+	}
+	return w.hashFn()
+}
+
+// hashID returns the ID of the block hash of the stream.
+func (f *streamReader) hashID() HashID {
+	return HashID((f.flags & flagHashMask) >> 8)
+}
+
+// hashFunc returns the block hash function of the stream,
+// or nil if it is unknown or not available.
+func (f *streamReader) hashFunc() func() hash.Hash {
+	id := f.hashID()
+	if !id.Available() {
+		return nil
+	}
+	return hashes[id].fn
+}
@@ -0,0 +1,155 @@
+package dedup_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"hash/fnv"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestBlockHash(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(256<<10 + 100).Bytes()
+	// Create some duplicates
+	copy(b[128<<10:], b[:64<<10])
+
+	var idx, data bytes.Buffer
+	w, err := dedup.NewWriterHash(&idx, &data, dedup.ModeFixed, size, 0, dedup.HashSHA256, dedup.WithMerkleTree(false), dedup.WithContentHash(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	if w.Stats().NewBlocks == w.Stats().Blocks {
+		t.Fatal("expected duplicates")
+	}
+	sum := sha256.Sum256(b)
+	if got := w.ContentHash(); !bytes.Equal(got[:], sum[:dedup.HashSize]) {
+		t.Fatal("content hash mismatch")
+	}
+	root := w.MerkleRoot()
+
+	r, err := dedup.NewReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.HashVerifiable() {
+		t.Fatal("expected known hash")
+	}
+	if err := r.VerifyMerkleRoot(root); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if !bytes.Equal(b, out) {
+		t.Fatal("output mismatch")
+	}
+
+	// Decoded fragments are hashed with the block hash of the stream.
+	ch := make(chan dedup.Fragment, 100)
+	go func() {
+		if err := dedup.DecodeFragments(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()), ch); err != nil {
+			t.Error(err)
+		}
+	}()
+	for f := range ch {
+		sum := sha256.Sum256(f.Payload)
+		if !bytes.Equal(f.Hash[:], sum[:dedup.HashSize]) {
+			t.Fatalf("fragment %d: hash mismatch", f.N)
+		}
+	}
+
+	// Hashes without an implementation cannot be used.
+	_, err = dedup.NewWriterHash(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.HashBLAKE2b256)
+	if err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+	_, err = dedup.NewWriterHash(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.HashID(200))
+	if err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+}
+
+func TestBlockHashSplitter(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(64 << 10).Bytes()
+	for _, id := range []dedup.HashID{dedup.HashSHA1, dedup.HashSHA256, dedup.HashSHA512_256} {
+		ch := make(chan dedup.Fragment, 100)
+		w, err := dedup.NewSplitterHash(ch, dedup.ModeFixed, size, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+			t.Fatal(err)
+		}
+		for f := range ch {
+			d := id.New()
+			d.Write(f.Payload)
+			var want [dedup.HashSize]byte
+			copy(want[:], d.Sum(nil))
+			if f.Hash != want {
+				t.Fatalf("%v fragment %d: hash mismatch", id, f.N)
+			}
+		}
+	}
+}
+
+func TestRegisterHash(t *testing.T) {
+	mustPanic := func(id dedup.HashID, fn func() hash.Hash) {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("%v: expected panic", id)
+			}
+		}()
+		dedup.RegisterHash(id, fn)
+	}
+	mustPanic(dedup.HashID(200), sha256.New)
+	mustPanic(dedup.HashXXH64, sha256.New)
+	mustPanic(dedup.HashBLAKE2b256, nil)
+
+	// FNV-1a stands in for xxHash, which has the same digest size.
+	dedup.RegisterHash(dedup.HashXXH64, func() hash.Hash { return fnv.New64a() })
+	if !dedup.HashXXH64.Available() {
+		t.Fatal("expected hash to be available")
+	}
+	// The digest is too short to identify duplicate blocks.
+	_, err := dedup.NewSplitterHash(make(chan dedup.Fragment), dedup.ModeFixed, 4<<10, dedup.HashXXH64)
+	if err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+	if got := dedup.HashID(200).String(); got != "hash-200" {
+		t.Fatal("unexpected name", got)
+	}
+}
+
+func TestBlockHashSHA1(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(64 << 10).Bytes()
+	var want, got bytes.Buffer
+	w, err := dedup.NewStreamWriter(&want, dedup.ModeFixed, size, 8*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	// Giving SHA-1 explicitly produces the default output.
+	w, err = dedup.NewStreamWriterHash(&got, dedup.ModeFixed, size, 8*size, dedup.HashSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want.Bytes(), got.Bytes()) {
+		t.Fatal("output mismatch")
+	}
+}
@@ -0,0 +1,90 @@
+package dedup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// maxHistogramBuckets is the number of buckets needed for blocks of MaxBlockSize.
+const maxHistogramBuckets = 32
+
+// ErrNoHistogram is returned by SizeHistogram if the index
+// was written without WithSizeHistogram.
+var ErrNoHistogram = errors.New("dedup: no block size histogram")
+
+// SizeHistogram is a histogram of block sizes, as stored by WithSizeHistogram.
+//
+// Element 0 is the number of empty blocks. Element i > 0 is the number of blocks
+// with a size of at least 1<<(i-1) bytes and less than 1<<i bytes.
+// Buckets after the bucket of the largest block are not included.
+type SizeHistogram []int64
+
+// add will count a block of size n.
+func (h *SizeHistogram) add(n int) {
+	b := bits.Len(uint(n))
+	for len(*h) <= b {
+		*h = append(*h, 0)
+	}
+	(*h)[b]++
+}
+
+// Blocks returns the number of blocks in the histogram.
+func (h SizeHistogram) Blocks() int64 {
+	var n int64
+	for _, v := range h {
+		n += v
+	}
+	return n
+}
+
+// appendHistogram will append the number of buckets
+// and the count of each bucket to buf.
+func (w *writer) appendHistogram(buf *bytes.Buffer) {
+	w.appendUint64(buf, uint64(len(*w.sizes)))
+	for _, v := range *w.sizes {
+		w.appendUint64(buf, uint64(v))
+	}
+}
+
+// readHistogram will read the block size histogram, if the flag is set.
+func (f *reader) readHistogram(idx io.ByteReader) error {
+	if f.flags&flagSizeHistogram == 0 {
+		return nil
+	}
+	h, err := readHistogram(idx)
+	f.hist = h
+	return err
+}
+
+// readHistogram will read a block size histogram from idx.
+func readHistogram(idx io.ByteReader) (SizeHistogram, error) {
+	n, err := binary.ReadUvarint(idx)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if n > maxHistogramBuckets {
+		return nil, fmt.Errorf("dedup: invalid block size histogram with %d buckets", n)
+	}
+	h := make(SizeHistogram, n)
+	for i := range h {
+		v, err := binary.ReadUvarint(idx)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		h[i] = int64(v)
+	}
+	return h, nil
+}
+
+// SizeHistogram returns the block size histogram stored by WithSizeHistogram.
+// ErrNoHistogram is returned if the index has no histogram.
+func (f *reader) SizeHistogram() (SizeHistogram, error) {
+	if f.flags&flagSizeHistogram == 0 {
+		return nil, ErrNoHistogram
+	}
+	return append(SizeHistogram{}, f.hist...), nil
+}
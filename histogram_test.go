@@ -0,0 +1,97 @@
+package dedup_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/bits"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestSizeHistogram(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(1<<20 + 100).Bytes()
+	// Create some duplicates
+	copy(b[512<<10:], b[:256<<10])
+	for _, fixed := range []bool{false, true} {
+		var idx, data bytes.Buffer
+		w, err := dedup.NewWriter(&idx, &data, dedup.ModeDynamic, size, 0,
+			dedup.WithSizeHistogram(true), dedup.WithFixedIndexRecords(fixed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+			t.Fatal(err)
+		}
+		r, err := dedup.NewReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := r.SizeHistogram()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Compare to the block sizes in the index.
+		var want dedup.SizeHistogram
+		for _, n := range r.BlockSizes() {
+			if n == 0 {
+				// The empty last block is not counted.
+				continue
+			}
+			i := bits.Len(uint(n))
+			for len(want) <= i {
+				want = append(want, 0)
+			}
+			want[i]++
+		}
+		if len(h) != len(want) || len(h) != 14 {
+			t.Fatalf("got %v, want %v", h, want)
+		}
+		for i := range h {
+			if h[i] != want[i] {
+				t.Fatalf("got %v, want %v", h, want)
+			}
+		}
+		if h.Blocks() != int64(w.Stats().Blocks) {
+			t.Fatal("expected", w.Stats().Blocks, "blocks, got", h.Blocks())
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		if !bytes.Equal(b, out) {
+			t.Fatal("Output mismatch")
+		}
+
+		var dump bytes.Buffer
+		if err := dedup.DumpIndex(bytes.NewReader(idx.Bytes()), &dump); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(dump.String(), "block size histogram [") {
+			t.Fatal("histogram not dumped")
+		}
+	}
+
+	var idx, data bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	r, err := dedup.NewReader(&idx, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.SizeHistogram(); err != dedup.ErrNoHistogram {
+		t.Fatal("expected ErrNoHistogram, got", err)
+	}
+	if _, err := dedup.NewStreamWriter(ioutil.Discard, dedup.ModeFixed, size, 0, dedup.WithSizeHistogram(true)); err == nil {
+		t.Fatal("expected error from stream writer")
+	}
+}
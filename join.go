@@ -0,0 +1,252 @@
+package dedup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// joinChunkSize is the maximum size of a single frame of joined streams.
+const joinChunkSize = 64 << 10
+
+// ErrInvalidFrame is returned by SplitStreams readers
+// if the joined stream is malformed.
+var ErrInvalidFrame = errors.New("dedup: invalid frame in joined stream")
+
+// Stream identifiers of joined stream frames.
+const (
+	joinIndex  = 0
+	joinBlocks = 1
+)
+
+// JoinStreams will interleave an index and a block stream into a single stream,
+// which can be separated again by SplitStreams.
+//
+// This allows the output of NewWriter to be sent through a single pipe.
+// Both inputs are read concurrently as data becomes available,
+// so the inputs can be the read ends of pipes written by the same writer.
+// At most a few frames of 64KB are buffered for each input.
+//
+// Each frame is stored as a uvarint with the size of the frame shifted
+// up by one and the stream identifier (0 for index, 1 for blocks) in the lowest bit,
+// followed by the frame data. A frame with size 0 marks the end of a stream.
+//
+// Close must be called to release resources if the output isn't read to the end.
+func JoinStreams(index, blocks io.Reader) io.ReadCloser {
+	j := &joiner{
+		frames: make(chan joinFrame, 4),
+		closed: make(chan struct{}),
+	}
+	j.wg.Add(2)
+	go j.read(joinIndex, index)
+	go j.read(joinBlocks, blocks)
+	go func() {
+		j.wg.Wait()
+		close(j.frames)
+	}()
+	return j
+}
+
+type joiner struct {
+	frames chan joinFrame
+	closed chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+	cur    []byte
+	err    error
+}
+
+// joinFrame contains a frame or a read error.
+type joinFrame struct {
+	data []byte
+	err  error
+}
+
+// read will read from in and send frames identified by id.
+func (j *joiner) read(id uint64, in io.Reader) {
+	defer j.wg.Done()
+	for {
+		buf := make([]byte, binary.MaxVarintLen64+joinChunkSize)
+		n, err := in.Read(buf[binary.MaxVarintLen64:])
+		if n > 0 {
+			if !j.send(joinFrame{data: frame(buf, id, n)}) {
+				return
+			}
+		}
+		if err == io.EOF {
+			j.send(joinFrame{data: frame(buf, id, 0)})
+			return
+		}
+		if err != nil {
+			j.send(joinFrame{err: err})
+			return
+		}
+	}
+}
+
+// frame will put the header of a frame of size n before
+// the frame data in buf and return the frame.
+func frame(buf []byte, id uint64, n int) []byte {
+	var hdr [binary.MaxVarintLen64]byte
+	l := binary.PutUvarint(hdr[:], uint64(n)<<1|id)
+	start := binary.MaxVarintLen64 - l
+	copy(buf[start:], hdr[:l])
+	return buf[start : binary.MaxVarintLen64+n]
+}
+
+// send will send a frame, unless the joiner has been closed.
+func (j *joiner) send(f joinFrame) bool {
+	select {
+	case j.frames <- f:
+		return true
+	case <-j.closed:
+		return false
+	}
+}
+
+// Read will read joined frames.
+func (j *joiner) Read(b []byte) (int, error) {
+	if j.err != nil {
+		return 0, j.err
+	}
+	for len(j.cur) == 0 {
+		f, ok := <-j.frames
+		if !ok {
+			return 0, io.EOF
+		}
+		if f.err != nil {
+			j.err = f.err
+			j.Close()
+			return 0, j.err
+		}
+		j.cur = f.data
+	}
+	n := copy(b, j.cur)
+	j.cur = j.cur[n:]
+	return n, nil
+}
+
+// Close will stop reading the inputs.
+// The inputs are not closed.
+func (j *joiner) Close() error {
+	j.once.Do(func() { close(j.closed) })
+	return nil
+}
+
+// SplitStreams will separate a stream created by JoinStreams
+// into the index and block streams.
+//
+// The streams can be read in any order. Data for the stream that
+// isn't being read is buffered in memory until it is read, without limit.
+// This is needed by NewReader, which reads the complete index before reading any blocks,
+// so all block data sent before the end of the index is buffered.
+// Use SplitStreamsLimit to limit the memory used when both streams
+// are read concurrently, for instance by NewSeekReader on buffered blocks.
+//
+// The two readers can be read from separate goroutines.
+func SplitStreams(in io.Reader) (index, blocks io.Reader) {
+	return SplitStreamsLimit(in, 0)
+}
+
+// SplitStreamsLimit will separate a stream created by JoinStreams like SplitStreams,
+// but buffer at most limit bytes for the stream that isn't being read.
+// When the buffer of the other stream is full, reads wait until it has been
+// read from another goroutine, so the two streams must be read concurrently.
+// At least one frame of up to 64KB is always buffered.
+// If limit is 0 or less, the buffers are unlimited.
+//
+// Note that NewReader will wait forever if the limit is less
+// than the size of the block data sent before the end of the index.
+func SplitStreamsLimit(in io.Reader, limit int) (index, blocks io.Reader) {
+	s := &streamSplitter{in: bufio.NewReader(in), limit: limit}
+	s.cond = sync.NewCond(&s.mu)
+	return &splitStream{s: s, id: joinIndex}, &splitStream{s: s, id: joinBlocks}
+}
+
+type streamSplitter struct {
+	mu    sync.Mutex
+	cond  *sync.Cond // Signalled when a buffer has been read or an error occurred.
+	in    *bufio.Reader
+	buf   [2]bytes.Buffer
+	done  [2]bool
+	err   error
+	limit int // Maximum buffered bytes per stream, 0 if unlimited.
+
+	// Header of a frame that has been read,
+	// but not yet copied to the buffer of its stream.
+	pending bool
+	nextID  uint64
+	nextN   int
+}
+
+type splitStream struct {
+	s  *streamSplitter
+	id uint64
+}
+
+// Read will read from the stream,
+// reading frames from the input until data is available.
+func (r *splitStream) Read(b []byte) (int, error) {
+	s := r.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.buf[r.id].Len() == 0 {
+		if s.done[r.id] {
+			return 0, io.EOF
+		}
+		if s.err != nil {
+			return 0, s.err
+		}
+		if err := s.readFrame(r.id); err != nil {
+			s.err = err
+			s.cond.Broadcast()
+		}
+	}
+	n, err := s.buf[r.id].Read(b)
+	s.cond.Broadcast()
+	return n, err
+}
+
+// readFrame will read a single frame from the input
+// into the buffer of its stream.
+// If the frame belongs to the other stream and its buffer is full,
+// readFrame waits until the buffer has been read and returns without
+// reading the frame.
+func (s *streamSplitter) readFrame(id uint64) error {
+	if !s.pending {
+		hdr, err := binary.ReadUvarint(s.in)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		next, n := hdr&1, hdr>>1
+		if s.done[next] {
+			return fmt.Errorf("%w: data after end of stream %d", ErrInvalidFrame, next)
+		}
+		if n > joinChunkSize {
+			return fmt.Errorf("%w: frame size %d exceeds %d", ErrInvalidFrame, n, joinChunkSize)
+		}
+		s.pending, s.nextID, s.nextN = true, next, int(n)
+	}
+	next := s.nextID
+	if next != id && s.limit > 0 && s.buf[next].Len() > 0 && s.buf[next].Len()+s.nextN > s.limit {
+		s.cond.Wait()
+		return nil
+	}
+	s.pending = false
+	if s.nextN == 0 {
+		s.done[next] = true
+		return nil
+	}
+	_, err := io.CopyN(&s.buf[next], s.in, int64(s.nextN))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,168 @@
+package dedup_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestJoinStreams(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(10<<20 + 65).Bytes()
+	// Create some duplicates
+	copy(b[5<<20:], b[:1<<20])
+
+	// Write through pipes, so both streams are produced concurrently.
+	idxR, idxW := io.Pipe()
+	blkR, blkW := io.Pipe()
+	go func() {
+		w, err := dedup.NewWriter(idxW, blkW, dedup.ModeDynamic, size, 0)
+		if err == nil {
+			_, err = io.Copy(w, bytes.NewBuffer(b))
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		idxW.CloseWithError(err)
+		blkW.CloseWithError(err)
+	}()
+
+	joined := dedup.JoinStreams(idxR, blkR)
+	defer joined.Close()
+
+	// Pipe the joined stream.
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := io.Copy(pw, joined)
+		pw.CloseWithError(err)
+	}()
+
+	idx, blocks := dedup.SplitStreams(pr)
+	r, err := dedup.NewReader(idx, blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, out) {
+		t.Fatal("Output mismatch")
+	}
+	r.Close()
+}
+
+func TestJoinStreamsError(t *testing.T) {
+	want := errors.New("test error")
+	joined := dedup.JoinStreams(bytes.NewBufferString("index"), io.MultiReader(bytes.NewBufferString("blocks"), &errReader{err: want}))
+	defer joined.Close()
+	all, err := ioutil.ReadAll(joined)
+	if err != want {
+		t.Fatal("expected error, got", err)
+	}
+
+	// Data before the error must be delivered.
+	_, blocks := dedup.SplitStreams(bytes.NewReader(all))
+	got, err := ioutil.ReadAll(blocks)
+	if err != io.ErrUnexpectedEOF || string(got) != "blocks" {
+		t.Fatalf("unexpected result %q, %v", got, err)
+	}
+
+	// Read the streams in reverse order
+	var buf bytes.Buffer
+	w := dedup.JoinStreams(bytes.NewBufferString("index"), bytes.NewBufferString("blocks"))
+	io.Copy(&buf, w)
+	idx, blocks := dedup.SplitStreams(&buf)
+	got, err = ioutil.ReadAll(blocks)
+	if err != nil || string(got) != "blocks" {
+		t.Fatalf("unexpected result %q, %v", got, err)
+	}
+	got, err = ioutil.ReadAll(idx)
+	if err != nil || string(got) != "index" {
+		t.Fatalf("unexpected result %q, %v", got, err)
+	}
+
+	// Truncated frame
+	idx, _ = dedup.SplitStreams(bytes.NewReader([]byte{10, 'a', 'b'}))
+	_, err = ioutil.ReadAll(idx)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+
+	// Data after the end of the blocks.
+	idx, _ = dedup.SplitStreams(bytes.NewReader([]byte{1, 3, 'a'}))
+	_, err = ioutil.ReadAll(idx)
+	if !errors.Is(err, dedup.ErrInvalidFrame) {
+		t.Fatal("expected ErrInvalidFrame, got", err)
+	}
+}
+
+func TestSplitStreamsLimit(t *testing.T) {
+	const limit = 128 << 10
+	index := getBufferSize(1 << 20).Bytes()
+	blocks := getBufferSize(4<<20 + 1).Bytes()
+	// Send all blocks before the index.
+	var buf bytes.Buffer
+	for _, stream := range []struct {
+		id   uint64
+		data []byte
+	}{{id: 1, data: blocks}, {id: 0, data: index}} {
+		data := stream.data
+		var hdr [binary.MaxVarintLen64]byte
+		for len(data) > 0 {
+			n := 64 << 10
+			if n > len(data) {
+				n = len(data)
+			}
+			buf.Write(hdr[:binary.PutUvarint(hdr[:], uint64(n)<<1|stream.id)])
+			buf.Write(data[:n])
+			data = data[n:]
+		}
+		buf.Write(hdr[:binary.PutUvarint(hdr[:], stream.id)])
+	}
+
+	idx, blk := dedup.SplitStreamsLimit(&buf, limit)
+	type result struct {
+		b   []byte
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		b, err := ioutil.ReadAll(idx)
+		done <- result{b: b, err: err}
+	}()
+	// The index cannot be read to the end while the block data is buffered.
+	select {
+	case <-done:
+		t.Fatal("index read without reading blocks")
+	case <-time.After(50 * time.Millisecond):
+	}
+	got, err := ioutil.ReadAll(blk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(blocks, got) {
+		t.Fatal("blocks mismatch")
+	}
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if !bytes.Equal(index, res.b) {
+		t.Fatal("index mismatch")
+	}
+}
+
+type errReader struct {
+	err error
+}
+
+func (e *errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
@@ -0,0 +1,55 @@
+package dedup
+
+import (
+	"bufio"
+	"io"
+)
+
+// Archive is an index and block stream pair, as written by NewWriter.
+type Archive struct {
+	Index  io.Reader
+	Blocks io.Reader
+}
+
+// Merge will decode each archive in order and write the content to w,
+// then close w.
+// Since all content goes through the same writer, blocks that are shared
+// between archives are only stored once, if they are within the
+// backreference distance of w.
+//
+// The space saved is returned. This is the size of the block data read
+// from the archives minus the size of the new blocks written to w.
+// It may be negative if w is configured with a smaller maximum memory
+// or a different block size than the archives.
+//
+// If an archive cannot be decoded or writing fails, the error is returned
+// and w is closed with CloseWithError, like Pack.
+func Merge(w Writer, archives ...Archive) (saved int64, err error) {
+	var in int64
+	for _, a := range archives {
+		n, err := mergeArchive(w, a)
+		in += n
+		if err != nil {
+			w.CloseWithError(err)
+			return 0, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	return in - w.Stats().NewBytes, nil
+}
+
+// mergeArchive will copy the content of a to w
+// and return the size of the block data read.
+func mergeArchive(w Writer, a Archive) (int64, error) {
+	blocks := &countingReader{r: bufio.NewReader(a.Blocks)}
+	r, err := NewReader(a.Index, blocks)
+	if err != nil {
+		return 0, err
+	}
+	_, err = io.Copy(w, r)
+	// Close waits for the block reader to exit.
+	r.Close()
+	return blocks.n, err
+}
@@ -0,0 +1,67 @@
+package dedup_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestMerge(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(3 << 20).Bytes()
+	// The archives share the middle megabyte.
+	inputs := [][]byte{b[:2<<20], b[1<<20:]}
+	var archives []dedup.Archive
+	var want []byte
+	for _, in := range inputs {
+		var idx, data bytes.Buffer
+		w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(in)); err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, dedup.Archive{Index: &idx, Blocks: &data})
+		want = append(want, in...)
+	}
+
+	var idx, data bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := dedup.Merge(w, archives...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != 1<<20 {
+		t.Errorf("expected %d bytes saved, got %d", 1<<20, saved)
+	}
+	r, err := dedup.NewReader(&idx, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, out) {
+		t.Fatal("Output mismatch")
+	}
+	r.Close()
+
+	// An invalid archive must fail the merge.
+	idx.Reset()
+	data.Reset()
+	w, err = dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dedup.Merge(w, dedup.Archive{Index: bytes.NewBuffer([]byte{1, 2, 3}), Blocks: &bytes.Buffer{}})
+	if err == nil {
+		t.Fatal("expected error on invalid archive")
+	}
+}
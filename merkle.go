@@ -0,0 +1,260 @@
+package dedup
+
+import (
+	hasher "crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"sync"
+)
+
+// ErrNoMerkleProofs is returned by InclusionProof if the writer
+// does not keep the nodes of the Merkle tree.
+var ErrNoMerkleProofs = errors.New("dedup: Merkle tree nodes not kept, see WithMerkleTree")
+
+// ErrMerkleMismatch is returned at the end of the stream if the decoded blocks
+// do not match the root given to VerifyMerkleRoot.
+var ErrMerkleMismatch = errors.New("dedup: decoded blocks do not match Merkle root")
+
+// MerkleProof proves that a block is included in a Merkle tree.
+//
+// The leaves of the tree are the hashes of all blocks in the order they were written,
+// including duplicate blocks. Each internal node is the hash of the byte 1 followed
+// by the left and right child. If a level has an odd number of nodes, the last node
+// is moved to the next level unchanged.
+type MerkleProof struct {
+	// Leaf is the position of the block in the tree. The first block is 0.
+	Leaf int
+
+	// Leaves is the number of leaves in the tree.
+	Leaves int
+
+	// Hashes contains the siblings of the path from the leaf to the root,
+	// starting with the sibling of the leaf.
+	Hashes [][HashSize]byte
+}
+
+// Verify returns whether the proof shows that a block with the hash blockHash
+// is included in the tree with the given root.
+func (p MerkleProof) Verify(root, blockHash [HashSize]byte) bool {
+	if p.Leaf < 0 || p.Leaf >= p.Leaves {
+		return false
+	}
+	h := blockHash
+	hashes := p.Hashes
+	for i, n := p.Leaf, p.Leaves; n > 1; i, n = i/2, (n+1)/2 {
+		if i^1 >= n {
+			// No sibling, the node is moved up.
+			continue
+		}
+		if len(hashes) == 0 {
+			return false
+		}
+		if i&1 == 0 {
+			h = merkleNode(h, hashes[0])
+		} else {
+			h = merkleNode(hashes[0], h)
+		}
+		hashes = hashes[1:]
+	}
+	return len(hashes) == 0 && h == root
+}
+
+// merkleNode returns the hash of an internal node with the children l and r.
+func merkleNode(l, r [hasher.Size]byte) (h [hasher.Size]byte) {
+	d := hasher.New()
+	d.Write([]byte{1})
+	d.Write(l[:])
+	d.Write(r[:])
+	d.Sum(h[:0])
+	return h
+}
+
+// merkleTree calculates the root of a Merkle tree as leaves are added.
+type merkleTree struct {
+	mu sync.Mutex
+	n  int
+
+	// Roots of complete subtrees, where stack[i] has 2^i leaves if bit i of n is set.
+	stack [][hasher.Size]byte
+
+	// All levels of the tree, levels[0] being the leaves, if kept.
+	levels [][][hasher.Size]byte
+	keep   bool
+}
+
+// add will add a leaf to the tree.
+func (m *merkleTree) add(h [hasher.Size]byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.keep {
+		m.addLevel(0, h)
+	}
+	// Merge complete subtrees of the same size.
+	for i := 0; m.n&(1<<uint(i)) != 0; i++ {
+		h = merkleNode(m.stack[i], h)
+	}
+	for i := range m.stack {
+		if m.n&(1<<uint(i)) != 0 {
+			continue
+		}
+		m.stack[i] = h
+		m.n++
+		return
+	}
+	m.stack = append(m.stack, h)
+	m.n++
+}
+
+// addLevel will append h to level l of the kept nodes,
+// and add its parent when the pair is complete.
+func (m *merkleTree) addLevel(l int, h [hasher.Size]byte) {
+	if l == len(m.levels) {
+		m.levels = append(m.levels, nil)
+	}
+	m.levels[l] = append(m.levels[l], h)
+	if n := len(m.levels[l]); n%2 == 0 {
+		m.addLevel(l+1, merkleNode(m.levels[l][n-2], h))
+	}
+}
+
+// root returns the root of the tree.
+// Incomplete subtrees are combined from the smallest, which moves
+// unpaired nodes up the tree unchanged.
+func (m *merkleTree) root() (h [hasher.Size]byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	first := true
+	for i := range m.stack {
+		if m.n&(1<<uint(i)) == 0 {
+			continue
+		}
+		if first {
+			h = m.stack[i]
+			first = false
+			continue
+		}
+		h = merkleNode(m.stack[i], h)
+	}
+	return h
+}
+
+// proof returns the inclusion proof of leaf i.
+func (m *merkleTree) proof(i int) (MerkleProof, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.keep {
+		return MerkleProof{}, ErrNoMerkleProofs
+	}
+	if i < 0 || i >= m.n {
+		return MerkleProof{}, fmt.Errorf("dedup: block %d not in Merkle tree with %d blocks", i, m.n)
+	}
+	p := MerkleProof{Leaf: i, Leaves: m.n}
+	// Kept levels only contain complete pairs, so incomplete
+	// parts of a level are calculated from the level below.
+	level := m.levels[0]
+	for l := 0; len(level) > 1; l++ {
+		if i^1 < len(level) {
+			p.Hashes = append(p.Hashes, level[i^1])
+		}
+		next := m.levelAbove(l, level)
+		level, i = next, i/2
+	}
+	return p, nil
+}
+
+// levelAbove returns the complete level above level l, which contains nodes.
+func (m *merkleTree) levelAbove(l int, nodes [][hasher.Size]byte) [][hasher.Size]byte {
+	var next [][hasher.Size]byte
+	if l+1 < len(m.levels) {
+		next = m.levels[l+1]
+	}
+	want := (len(nodes) + 1) / 2
+	if len(next) == want {
+		return next
+	}
+	next = append([][hasher.Size]byte{}, next...)
+	for j := len(next); j < want; j++ {
+		if 2*j+1 < len(nodes) {
+			next = append(next, merkleNode(nodes[2*j], nodes[2*j+1]))
+		} else {
+			next = append(next, nodes[2*j])
+		}
+	}
+	return next
+}
+
+// MerkleRoot returns the root of the Merkle tree of the blocks written.
+func (w *writer) MerkleRoot() (h [HashSize]byte) {
+	if w.merkle != nil {
+		h = w.merkle.root()
+	}
+	return h
+}
+
+// InclusionProof returns the proof that block blockNum is included in the Merkle tree.
+func (w *writer) InclusionProof(blockNum int) (MerkleProof, error) {
+	if w.merkle == nil {
+		return MerkleProof{}, ErrNoMerkleProofs
+	}
+	return w.merkle.proof(blockNum - w.base)
+}
+
+// addLeaf will add a block hash to the Merkle tree, if enabled.
+func (w *writer) addLeaf(h [hasher.Size]byte) {
+	if w.merkle != nil {
+		w.merkle.add(h)
+	}
+}
+
+// merkleVerifier calculates the Merkle tree of decoded blocks
+// and compares it to the expected root.
+type merkleVerifier struct {
+	tree       merkleTree
+	root       [hasher.Size]byte
+	lengthHash bool      // Block hashes include the length.
+	h          hash.Hash // Block hash of the stream.
+}
+
+// add will add a decoded block to the tree.
+// Empty blocks are skipped unless they are markers,
+// since the writer doesn't hash an empty last block.
+func (m *merkleVerifier) add(data []byte, marker bool) {
+	if m == nil || (len(data) == 0 && !marker) {
+		return
+	}
+	h := m.h
+	h.Reset()
+	if m.lengthHash {
+		var length [8]byte
+		binary.LittleEndian.PutUint64(length[:], uint64(len(data)))
+		h.Write(length[:])
+	}
+	h.Write(data)
+	var sum [hasher.Size]byte
+	sumHash(h, &sum)
+	m.tree.add(sum)
+}
+
+// end returns ErrMerkleMismatch if the blocks added
+// do not match the expected root.
+func (m *merkleVerifier) end() error {
+	if m != nil && m.tree.root() != m.root {
+		return ErrMerkleMismatch
+	}
+	return nil
+}
+
+// VerifyMerkleRoot will verify that the decoded blocks match root.
+func (f *streamReader) VerifyMerkleRoot(root [HashSize]byte) error {
+	hf := f.hashFunc()
+	if hf == nil {
+		return ErrUnknownHash
+	}
+	if f.curBlock != 0 || len(f.curData) > 0 {
+		return errors.New("dedup: VerifyMerkleRoot called after reading started")
+	}
+	f.merkle = &merkleVerifier{root: root, lengthHash: f.flags&flagLengthHash != 0, h: hf()}
+	return nil
+}
@@ -0,0 +1,219 @@
+package dedup_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+// merkleRoot calculates the root of a Merkle tree level by level.
+func merkleRoot(level [][dedup.HashSize]byte) [dedup.HashSize]byte {
+	for len(level) > 1 {
+		var next [][dedup.HashSize]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			var h [dedup.HashSize]byte
+			d := sha1.New()
+			d.Write([]byte{1})
+			d.Write(level[i][:])
+			d.Write(level[i+1][:])
+			d.Sum(h[:0])
+			next = append(next, h)
+		}
+		level = next
+	}
+	return level[0]
+}
+
+func TestMerkleTree(t *testing.T) {
+	const size = 4 << 10
+	for _, n := range []int{1, 2, 3, 7, 64, 100} {
+		b := getBufferSize(n*size - 10).Bytes()
+		// Create some duplicates
+		if n > 4 {
+			copy(b[2*size:], b[:2*size])
+		}
+		var leaves [][dedup.HashSize]byte
+		for i := 0; i < len(b); i += size {
+			end := i + size
+			if end > len(b) {
+				end = len(b)
+			}
+			leaves = append(leaves, sha1.Sum(b[i:end]))
+		}
+		want := merkleRoot(leaves)
+
+		var idx, data bytes.Buffer
+		w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0, dedup.WithMerkleTree(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+			t.Fatal(err)
+		}
+		if got := w.MerkleRoot(); got != want {
+			t.Fatalf("%d blocks: root mismatch, got %x, want %x", n, got, want)
+		}
+		for i, leaf := range leaves {
+			p, err := w.InclusionProof(i + 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !p.Verify(want, leaf) {
+				t.Fatalf("%d blocks: proof of block %d not verified", n, i+1)
+			}
+			if n > 1 && p.Verify(want, leaves[(i+1)%n]) && leaves[(i+1)%n] != leaf {
+				t.Fatalf("%d blocks: proof of block %d verified wrong hash", n, i+1)
+			}
+		}
+		if _, err := w.InclusionProof(len(leaves) + 1); err == nil {
+			t.Fatal("expected error for block after the last")
+		}
+
+		// The splitter must give the same root.
+		out := make(chan dedup.Fragment, 10)
+		s, err := dedup.NewSplitter(out, dedup.ModeFixed, size, dedup.WithMerkleTree(false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for range out {
+			}
+		}()
+		if _, err := io.Copy(s, bytes.NewBuffer(b)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := s.MerkleRoot(); got != want {
+			t.Fatalf("%d blocks: splitter root mismatch, got %x, want %x", n, got, want)
+		}
+		if _, err := s.InclusionProof(1); err != dedup.ErrNoMerkleProofs {
+			t.Fatal("expected ErrNoMerkleProofs, got", err)
+		}
+	}
+}
+
+func TestMerkleProofTampered(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(20 * size).Bytes()
+	var idx, data bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0, dedup.WithMerkleTree(true), dedup.WithBlockNumberBase(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	root := w.MerkleRoot()
+	leaf := sha1.Sum(b[5*size : 6*size])
+	p, err := w.InclusionProof(105)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Verify(root, leaf) {
+		t.Fatal("proof not verified")
+	}
+	p.Hashes[1][0]++
+	if p.Verify(root, leaf) {
+		t.Fatal("tampered proof verified")
+	}
+	p.Hashes[1][0]--
+	p.Leaf++
+	if p.Verify(root, leaf) {
+		t.Fatal("proof verified at wrong position")
+	}
+}
+
+func TestVerifyMerkleRoot(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(256<<10 + 100).Bytes()
+	// Create some duplicates
+	copy(b[128<<10:], b[:64<<10])
+	for _, stream := range []bool{false, true} {
+		for _, lengthHash := range []bool{false, true} {
+			var idx, data bytes.Buffer
+			opts := []dedup.Option{dedup.WithMerkleTree(false), dedup.WithLengthInHash(lengthHash)}
+			var w dedup.Writer
+			var err error
+			if stream {
+				w, err = dedup.NewStreamWriter(&data, dedup.ModeDynamic, size, 10*size, opts...)
+			} else {
+				w, err = dedup.NewWriter(&idx, &data, dedup.ModeDynamic, size, 0, opts...)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+				t.Fatal(err)
+			}
+			root := w.MerkleRoot()
+
+			read := func(data []byte, root [dedup.HashSize]byte) error {
+				var r dedup.Reader
+				var err error
+				if stream {
+					r, err = dedup.NewStreamReader(bytes.NewReader(data))
+				} else {
+					r, err = dedup.NewReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data))
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer r.Close()
+				if err := r.VerifyMerkleRoot(root); err != nil {
+					t.Fatal(err)
+				}
+				_, err = io.Copy(ioutil.Discard, r)
+				return err
+			}
+			if err := read(data.Bytes(), root); err != nil {
+				t.Fatal(stream, lengthHash, err)
+			}
+			wrong := root
+			wrong[0]++
+			if err := read(data.Bytes(), wrong); err != dedup.ErrMerkleMismatch {
+				t.Fatal("expected ErrMerkleMismatch, got", err)
+			}
+			if stream {
+				// Tampering may also change the block definitions.
+				continue
+			}
+			// Tamper with block data.
+			tampered := append([]byte{}, data.Bytes()...)
+			tampered[len(tampered)/2]++
+			if err := read(tampered, root); err != dedup.ErrMerkleMismatch {
+				t.Fatal("expected ErrMerkleMismatch, got", err)
+			}
+		}
+	}
+
+	// Must be called before reading.
+	var idx, data bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0, dedup.WithMerkleTree(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	r, err := dedup.NewReader(&idx, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.VerifyMerkleRoot(w.MerkleRoot()); err == nil {
+		t.Fatal("expected error after reading started")
+	}
+}
@@ -0,0 +1,83 @@
+package dedup
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxMetadataSize is the maximum size of metadata for a single block.
+const maxMetadataSize = 1 << 20
+
+// ErrMetadataTooLarge is returned if the metadata of a block exceeds 1MB.
+var ErrMetadataTooLarge = errors.New("dedup: block metadata too large")
+
+// writeMeta will write the metadata of block n to the metadata stream.
+// Nothing is written if metadata isn't enabled or the metadata is empty.
+//
+// Each record is the block number, followed by the size of the metadata
+// and the metadata itself.
+func (w *writer) writeMeta(n int) error {
+	if w.meta == nil {
+		return nil
+	}
+	m := w.metaFn(n)
+	if len(m) == 0 {
+		return nil
+	}
+	if len(m) > maxMetadataSize {
+		return ErrMetadataTooLarge
+	}
+	var tmp [2 * binary.MaxVarintLen64]byte
+	i := binary.PutUvarint(tmp[:], uint64(n))
+	i += binary.PutUvarint(tmp[i:], uint64(len(m)))
+	if _, err := w.meta.Write(tmp[:i]); err != nil {
+		return err
+	}
+	_, err := w.meta.Write(m)
+	return err
+}
+
+// ReadBlockMetadata will read a metadata stream written by a writer
+// with the WithBlockMetadata option.
+//
+// fn is called with the block number and metadata of each block,
+// in the order the blocks were written.
+// If fn returns an error, reading stops and the error is returned.
+func ReadBlockMetadata(r io.Reader, fn func(blockNum int, meta []byte) error) error {
+	br := bufio.NewReader(r)
+	for {
+		n, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		size, err := binary.ReadUvarint(br)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if size > maxMetadataSize {
+			return fmt.Errorf("dedup: metadata of block %d too large: %d bytes", n, size)
+		}
+		m := make([]byte, size)
+		_, err = io.ReadFull(br, m)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if err := fn(int(n), m); err != nil {
+			return err
+		}
+	}
+}
+
+// unexpectedEOF converts io.EOF to io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,65 @@
+package dedup_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestBlockMetadata(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(10<<20 + 100).Bytes()
+	// Second half is a copy of the first.
+	copy(b[5<<20:], b[:5<<20])
+
+	meta := bytes.Buffer{}
+	fn := func(n int) []byte {
+		return []byte(fmt.Sprint("block ", n))
+	}
+	for _, stream := range []bool{false, true} {
+		meta.Reset()
+		var w dedup.Writer
+		var err error
+		if stream {
+			w, err = dedup.NewStreamWriter(&bytes.Buffer{}, dedup.ModeFixed, size, 200*size, dedup.WithBlockMetadata(&meta, fn))
+		} else {
+			w, err = dedup.NewWriter(&bytes.Buffer{}, &bytes.Buffer{}, dedup.ModeFixed, size, 0, dedup.WithBlockMetadata(&meta, fn))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(w, bytes.NewBuffer(b))
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		err = dedup.ReadBlockMetadata(&meta, func(n int, m []byte) error {
+			if string(m) != string(fn(n)) {
+				t.Fatalf("block %d: unexpected metadata %q", n, m)
+			}
+			got = append(got, n)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Only the first half and the final block are unique.
+		want := (5<<20)/size + 1
+		if len(got) != want {
+			t.Fatalf("expected metadata for %d blocks, got %d", want, len(got))
+		}
+		if got[0] != 1 || got[len(got)-1] != (10<<20)/size+1 {
+			t.Fatal("unexpected block numbers", got[0], got[len(got)-1])
+		}
+	}
+
+	// Truncated metadata should return an error.
+	err := dedup.ReadBlockMetadata(bytes.NewReader([]byte{1, 10, 'a'}), func(int, []byte) error { return nil })
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+}
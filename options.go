@@ -0,0 +1,1233 @@
+package dedup
+
+import (
+	"context"
+	hasher "crypto/sha1"
+	"errors"
+	"hash"
+	"io"
+	"time"
+)
+
+// Option can be supplied to the writer constructors to adjust the behaviour
+// of the returned Writer.
+// Options are applied in order before any output is written.
+type Option func(*writer) error
+
+// applyOptions will apply the supplied options to the writer
+// and return the first error encountered.
+func (w *writer) applyOptions(opts []Option) error {
+	for _, opt := range opts {
+		if err := opt(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrInvalidOption is returned if an option is given an invalid value.
+var ErrInvalidOption = errors.New("dedup: invalid option value")
+
+// WithDeltaEncoding will enable delta encoding of blocks.
+//
+// When a block has not been seen before, but a similar block was
+// encountered recently, the block is stored as a delta of the similar block.
+// Only the bytes that differ between the start and the end of the blocks are stored.
+//
+// Similarity is estimated using a MinHash sketch of the block.
+// The threshold is the fraction of the sketch that must match for a block to
+// be considered similar, and must be > 0 and <= 1.
+// A lower threshold will attempt more deltas.
+//
+// A delta block can be the base of another delta block, but chains are limited
+// to 8 delta blocks, so random access only decodes a few blocks.
+// The encoder will keep up to 1024 recent blocks in memory, limited by the
+// maximum memory given to the writer.
+// The stream will only be readable by a reader that supports delta encoding.
+//
+// This option is not supported by NewSplitter.
+func WithDeltaEncoding(threshold float64) Option {
+	return func(w *writer) error {
+		if !(threshold > 0 && threshold <= 1) {
+			return ErrInvalidOption
+		}
+		w.delta = newDeltaEncoder(threshold)
+		w.flags |= flagDelta
+		return nil
+	}
+}
+
+// WithBlockNumberBase will set the number of the first block.
+// By default the first block is 1.
+//
+// This can be used to make block numbers unique across several writers,
+// for instance when the output is sharded.
+// Backreferences in the output are relative to the current block,
+// so the base does not affect the output stream.
+// The base does not affect the sequence numbers of fragments returned by NewSplitter.
+//
+// The base must be at least 1.
+func WithBlockNumberBase(n int) Option {
+	return func(w *writer) error {
+		if n < 1 {
+			return ErrInvalidOption
+		}
+		w.nblocks = n
+		w.base = n
+		return nil
+	}
+}
+
+// WithSelfVerify will make the writer verify its own output.
+//
+// All input and output is kept in memory, and when the writer is closed
+// the output is decoded and compared to the input.
+// If the output doesn't match the input an error is returned by Close.
+//
+// This is intended for debugging and should not be used in production,
+// since it is slow and uses a lot of memory.
+//
+// This option is not supported by NewSplitter.
+func WithSelfVerify(enabled bool) Option {
+	return func(w *writer) error {
+		if !enabled {
+			w.verify = nil
+			return nil
+		}
+		w.verify = newSelfVerifier(w)
+		return nil
+	}
+}
+
+// WithSharedChannel allows several splitters to send fragments to the same channel.
+//
+// The splitter will not close the fragment channel when it is closed,
+// so the caller must close the channel when all splitters have been closed.
+// All fragments will have their Source set to the supplied value,
+// so fragments from different splitters can be told apart.
+// Sequence numbers and detection of new fragments are per splitter.
+//
+// This option only applies to NewSplitter.
+func WithSharedChannel(source int) Option {
+	return func(w *writer) error {
+		w.shared = true
+		w.source = source
+		return nil
+	}
+}
+
+// WithBlockLimit will stop the writer after n blocks have been written.
+//
+// When the limit is reached, Write will return ErrBlockLimitReached,
+// along with the number of bytes that were accepted.
+// The writer can still be closed, and the output will contain the
+// data that was accepted.
+//
+// Setting n to 0 means there is no limit.
+func WithBlockLimit(n int) Option {
+	return func(w *writer) error {
+		if n < 0 {
+			return ErrInvalidOption
+		}
+		w.limit = n
+		return nil
+	}
+}
+
+// WithUniqueBlockLimit will limit the number of unique blocks
+// the writer will accept to n.
+//
+// This bounds the memory used by the index, regardless of the input.
+// Blocks that are duplicates of earlier blocks do not count towards the limit.
+// When the limit is exceeded, writes and Close will return ErrTooManyUniqueBlocks,
+// and the output will be incomplete.
+//
+// Setting n to 0 means there is no limit.
+func WithUniqueBlockLimit(n int) Option {
+	return func(w *writer) error {
+		if n < 0 {
+			return ErrInvalidOption
+		}
+		w.maxUnique = n
+		return nil
+	}
+}
+
+// WithExplicitLengths will store the length of blocks directly in the index,
+// instead of the difference to the maximum block size.
+//
+// This makes the stored lengths independent of the maximum block size,
+// and stores short blocks more compactly.
+// The stream will only be readable by a reader that supports explicit lengths.
+func WithExplicitLengths(enabled bool) Option {
+	return func(w *writer) error {
+		if enabled {
+			w.flags |= flagExplicitLengths
+		} else {
+			w.flags &^= flagExplicitLengths
+		}
+		return nil
+	}
+}
+
+// WithSendTimeout will set the maximum time a splitter will wait for
+// the fragment channel to accept a fragment.
+//
+// If the timeout is exceeded, the fragment is dropped and Write and Close
+// will return ErrFragmentTimeout. All following fragments are dropped,
+// so the writer will not block on the channel again.
+//
+// Setting d to 0 means the splitter will wait indefinitely, which is the default.
+// Use Stats to monitor how often the channel was full.
+//
+// This option only applies to NewSplitter.
+func WithSendTimeout(d time.Duration) Option {
+	return func(w *writer) error {
+		if d < 0 {
+			return ErrInvalidOption
+		}
+		w.timeout = d
+		return nil
+	}
+}
+
+// WithLengthInHash will include the length of each block in its hash.
+//
+// The hash is computed over the block length as a 64 bit little endian value,
+// followed by the block data. This makes blocks of different lengths
+// hash differently, regardless of their content.
+// This also applies to the Hash of fragments returned by NewSplitter.
+//
+// The option is recorded in the stream header, so the stream will
+// only be readable by a reader that supports it.
+func WithLengthInHash(enabled bool) Option {
+	return func(w *writer) error {
+		if enabled {
+			w.flags |= flagLengthHash
+		} else {
+			w.flags &^= flagLengthHash
+		}
+		return nil
+	}
+}
+
+// WithContinuation will mark the end of the stream as being followed by another stream.
+//
+// NewStreamReader will always attempt to continue decoding streams
+// that are concatenated, but with this option the reader will return
+// an error if the following stream is missing.
+//
+// This option only applies to NewStreamWriter.
+func WithContinuation(enabled bool) Option {
+	return func(w *writer) error {
+		w.cont = enabled
+		return nil
+	}
+}
+
+// WithByteWindow will limit backreferences to blocks within the
+// last n bytes of blocks, instead of limiting by the number of blocks.
+//
+// With variable block sizes this gives a more accurate bound on the
+// memory needed by the decoder, since it depends on the size of the
+// retained blocks, not their number.
+// The window replaces the limit given by maxMemory.
+//
+// For streams created by NewStreamWriter, the window is stored in the header,
+// and the stream will only be readable by a reader that supports it.
+// The window must be at least the maximum block size.
+//
+// This option does not apply to NewSplitter.
+func WithByteWindow(n int64) Option {
+	return func(w *writer) error {
+		if n < int64(w.maxSize) {
+			return ErrInvalidOption
+		}
+		w.window = newByteWindow(n)
+		w.maxBlocks = 0
+		return nil
+	}
+}
+
+// WithWriteChunkSize will split calls to Write larger than n bytes
+// into parts of at most n bytes.
+//
+// Between each part the writer will yield the processor,
+// so other goroutines, for instance other writers, get a chance to run.
+// This keeps latency predictable when some callers do very large writes.
+// Errors that occur while writing are returned after the current part,
+// along with the number of bytes that were accepted.
+//
+// Setting n to 0 means writes are not split, which is the default.
+func WithWriteChunkSize(n int) Option {
+	return func(w *writer) error {
+		if n < 0 {
+			return ErrInvalidOption
+		}
+		w.chunkSize = n
+		return nil
+	}
+}
+
+// ReaderOption can be supplied to reader constructors that accept options.
+type ReaderOption func(*readerOptions) error
+
+// readerOptions contains the settings given by reader options.
+type readerOptions struct {
+	blockCache int        // Number of blocks to cache.
+	readahead  int64      // Maximum bytes to decode ahead.
+	aheadSet   bool       // readahead has been set.
+	key        []byte     // Decryption key, if set.
+	plainIndex bool       // Allow an unencrypted index with a key.
+	maxOutput  int64      // Maximum decoded size, 0 if unlimited.
+	codec      BlockCodec // Codec of compressed blocks, if set.
+}
+
+// defaultReadahead is the number of blocks decoded ahead by default.
+const defaultReadahead = 8
+
+// readaheadBlocks returns the number of blocks of the given size
+// that may be decoded ahead.
+func (o *readerOptions) readaheadBlocks(size int) int {
+	if !o.aheadSet || size <= 0 {
+		return defaultReadahead
+	}
+	n := o.readahead / int64(size)
+	if n > defaultReadahead {
+		return defaultReadahead
+	}
+	return int(n)
+}
+
+// apply will apply the supplied options
+// and return the first error encountered.
+func (o *readerOptions) apply(opts []ReaderOption) error {
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithBlockCache will keep up to n recently used blocks in memory.
+//
+// This speeds up reading ranges that share blocks,
+// for instance nearby ranges with backreferences to the same blocks.
+// Setting n to 0 disables the cache, which is the default.
+//
+// This option applies to NewReaderAt.
+func WithBlockCache(n int) ReaderOption {
+	return func(o *readerOptions) error {
+		if n < 0 {
+			return ErrInvalidOption
+		}
+		o.blockCache = n
+		return nil
+	}
+}
+
+// WithMaxReadahead will limit the amount of data decoded ahead
+// of what has been read to approximately n bytes.
+//
+// The limit is converted to a number of blocks of the maximum block size
+// of the stream, rounded down. NewSeekReader uses the size of the largest
+// block in the index instead, since block sizes are known up front. By default up to 8 blocks are decoded ahead,
+// and the limit cannot raise this.
+// Setting n to 0 will only decode the next block once the previous
+// has been handed over to the reader.
+//
+// This option applies to NewReader, NewStreamReader and NewSeekReader.
+func WithMaxReadahead(n int64) ReaderOption {
+	return func(o *readerOptions) error {
+		if n < 0 {
+			return ErrInvalidOption
+		}
+		o.readahead = n
+		o.aheadSet = true
+		return nil
+	}
+}
+
+// WithMaxOutput will limit the total size of the decoded output to n bytes.
+// This protects against streams that decode to a huge amount of data,
+// for instance by repeating backreferences to large blocks.
+//
+// For indexed streams the decoded size is known from the index,
+// so ErrOutputTooLarge is returned when the reader is created.
+// For single streams the size is checked as blocks are decoded, and reads
+// return ErrOutputTooLarge when the next block would exceed the limit.
+// Setting n to 0 disables the limit, which is the default.
+//
+// This option applies to NewReader, NewStreamReader, NewSeekReader and NewReaderAt.
+func WithMaxOutput(n int64) ReaderOption {
+	return func(o *readerOptions) error {
+		if n < 0 {
+			return ErrInvalidOption
+		}
+		o.maxOutput = n
+		return nil
+	}
+}
+
+// WithCompressedBlocks will make NewReader and NewShardedReader read the blocks
+// from a compressed block sink written by WithCompressedBlockSink,
+// instead of the uncompressed block stream.
+// codec must be able to decompress the blocks written by the codec given to the writer.
+// Other readers return an error if this option is used.
+func WithCompressedBlocks(codec BlockCodec) ReaderOption {
+	return func(o *readerOptions) error {
+		if codec == nil {
+			return ErrInvalidOption
+		}
+		o.codec = codec
+		return nil
+	}
+}
+
+// WithSplitLargeChunks will make WriteChunk split chunks that are bigger
+// than the maximum block size into blocks of the maximum block size,
+// with the remainder as the last block.
+//
+// By default WriteChunk returns ErrChunkTooLarge for such chunks.
+func WithSplitLargeChunks(enabled bool) Option {
+	return func(w *writer) error {
+		w.splitBig = enabled
+		return nil
+	}
+}
+
+// WithSharedPool will make the writer take block buffers from a shared pool.
+// Buffers are only held while blocks are processed, so many writers
+// can share the memory used for buffers.
+//
+// The pool must be created for the same maximum block size as the writer,
+// otherwise ErrPoolSizeMismatch is returned.
+func WithSharedPool(p *BufferPool) Option {
+	return func(w *writer) error {
+		if p == nil {
+			return ErrInvalidOption
+		}
+		if p.size != w.maxSize {
+			return ErrPoolSizeMismatch
+		}
+		w.pool = p
+		return nil
+	}
+}
+
+// WithHasherPool will make the writer hash blocks using the goroutines of
+// a shared pool, instead of starting its own hashing goroutines.
+// The pool must not be closed before the writer.
+func WithHasherPool(p *HasherPool) Option {
+	return func(w *writer) error {
+		if p == nil {
+			return ErrInvalidOption
+		}
+		w.hashers = p
+		return nil
+	}
+}
+
+// WithDeduplication can be used to disable deduplication.
+//
+// When disabled, all blocks are stored as new blocks, and no backreferences
+// or delta blocks are written. Blocks are split the same way and the output
+// format is unchanged, so the output can be compared with deduplicated output
+// to measure the savings of deduplication.
+// Splitters will mark all fragments as new.
+//
+// Deduplication is enabled by default.
+func WithDeduplication(enabled bool) Option {
+	return func(w *writer) error {
+		w.noDedup = !enabled
+		return nil
+	}
+}
+
+// WithMinReferenceDistance will prevent references to blocks
+// less than n blocks before the current block.
+// A block matching a more recent block is stored as a new block,
+// so backreferences will never point to the immediately preceding blocks.
+// Blocks stored this way are not referenced by later blocks,
+// which will reference the earlier block instead.
+//
+// This reduces the deduplication ratio for input with short range repeats.
+// For instance in a run of identical blocks only every n'th block can be stored as a reference.
+// Setting n to 0 or 1 allows all references, which is the default.
+//
+// This option does not apply to NewSplitter and NewBlocksOnlyWriter.
+func WithMinReferenceDistance(n int) Option {
+	return func(w *writer) error {
+		if n < 0 {
+			return ErrInvalidOption
+		}
+		w.minDist = n
+		return nil
+	}
+}
+
+// WithDedupPredicate will call fn before a block is stored as a reference
+// to a previous block with the same content.
+// If fn returns false, the block is stored as a new block instead,
+// and later blocks can reference it. Delta encoding is not used for the block.
+//
+// fn is called with the hash and number of the block.
+// Forcing blocks to be stored reduces the deduplication ratio, but guarantees
+// that the content of the block can be read from the block data directly.
+//
+// fn is called from the goroutine writing blocks, and should return quickly.
+// This option does not apply to NewSplitter and NewBlocksOnlyWriter.
+func WithDedupPredicate(fn func(hash [HashSize]byte, blockNum int) bool) Option {
+	return func(w *writer) error {
+		w.dedupFn = fn
+		return nil
+	}
+}
+
+// WithSimilarity will add each new block to s, after checking if
+// a similar block has been added before.
+// The number of similar blocks is returned by Stats.
+//
+// The writer only uses s for analysis, so the output is not affected.
+// s is called from the goroutine writing blocks.
+// This option does not apply to NewSplitter and NewBlocksOnlyWriter.
+func WithSimilarity(s Similarity) Option {
+	return func(w *writer) error {
+		w.similar = s
+		return nil
+	}
+}
+
+// WithFixedIndexRecords will store each block as a fixed size record
+// of 8 bytes in the index, instead of variable length values.
+//
+// The record of the n'th block is stored at len(Header()) + (n-1)*8 in the index,
+// so the index can be memory mapped and records located without
+// reading the preceding records. This makes the index larger.
+// The record format is described in FORMAT.md.
+//
+// The option is recorded in the stream header, so the stream will
+// only be readable by a reader that supports it.
+// This option only applies to NewWriter and NewColumnarWriter,
+// and cannot be combined with WithDeltaEncoding.
+func WithFixedIndexRecords(enabled bool) Option {
+	return func(w *writer) error {
+		if enabled {
+			w.flags |= flagFixedRecords
+		} else {
+			w.flags &^= flagFixedRecords
+		}
+		return nil
+	}
+}
+
+// WithExpectedSize will give the writer a hint of the total size of the input.
+// The hint is used to report progress with WithProgressPercent.
+// The input may be bigger or smaller than the hint.
+//
+// Setting n to 0 means the size is unknown, which is the default.
+func WithExpectedSize(n int64) Option {
+	return func(w *writer) error {
+		if n < 0 {
+			return ErrInvalidOption
+		}
+		w.expected = n
+		return nil
+	}
+}
+
+// WithProgressPercent will call fn with the fraction of the input
+// that has been processed, each time a block has been processed.
+//
+// The fraction is the size of the processed blocks divided by
+// the size given to WithExpectedSize, and is capped at 1
+// if the input is bigger than expected.
+// If no expected size is given, fn is not called.
+//
+// fn is called from the goroutine writing blocks, and should return quickly.
+func WithProgressPercent(fn func(fraction float64)) Option {
+	return func(w *writer) error {
+		w.progress = fn
+		return nil
+	}
+}
+
+// WithIndexCapacity will allocate room for n entries in the index
+// of unique block hashes before any input is written.
+// When the number of unique blocks is known to be large, this avoids
+// stalls while the index grows, for instance when splitting huge files.
+// If the writer has a backreference limit, n is capped at the limit.
+//
+// Splitters with deduplication disabled by WithDeduplication
+// do not add any entries to the index.
+//
+// Setting n to 0 will let the index grow as needed, which is the default.
+func WithIndexCapacity(n int) Option {
+	return func(w *writer) error {
+		if n < 0 {
+			return ErrInvalidOption
+		}
+		if w.maxBlocks > 0 && n > w.maxBlocks+1 {
+			n = w.maxBlocks + 1
+		}
+		index := make(map[[hasher.Size]byte]int, n)
+		for h, v := range w.index {
+			index[h] = v
+		}
+		w.index = index
+		return nil
+	}
+}
+
+// WithMerkleTree will calculate the root of a Merkle tree over the hashes
+// of all blocks, which is available through MerkleRoot.
+// The tree is described by MerkleProof.
+//
+// If proofs is true, the nodes of the tree are kept in memory,
+// so InclusionProof can prove that a block is part of the tree.
+// This uses about 2*HashSize bytes of memory per block.
+// Otherwise only the root is calculated, which needs very little memory.
+//
+// The output is not affected, so the root must be stored separately.
+// Readers can verify the decoded content against the root with VerifyMerkleRoot.
+func WithMerkleTree(proofs bool) Option {
+	return func(w *writer) error {
+		w.merkle = &merkleTree{keep: proofs}
+		return nil
+	}
+}
+
+// WithEvictionFraction will set the fraction of the maximum number of blocks
+// that are evicted from the index when it overflows.
+// The entries that were last seen the longest time ago are evicted.
+//
+// A smaller fraction retains more blocks that can be referenced,
+// but evicts more often. A bigger fraction evicts less often,
+// but reduces the number of blocks that can be referenced after an eviction.
+// f must be above 0 and below 1. The default is 0.25.
+// At least one block is evicted, even if the fraction rounds down to 0 blocks.
+//
+// This option only applies to NewWriter, NewColumnarWriter and NewShardedWriter
+// with a maximum memory set.
+func WithEvictionFraction(f float64) Option {
+	return func(w *writer) error {
+		if !(f > 0 && f < 1) {
+			return ErrInvalidOption
+		}
+		w.evictFrac = f
+		return nil
+	}
+}
+
+// WithWriteRetry will retry writes to the index and block outputs that fail
+// with an error accepted by the policy, instead of failing the writer.
+// Writes are retried up to the number of retries in the policy,
+// with a wait that doubles for each retry.
+// If the write still fails, the error is returned as usual.
+//
+// Only the remaining bytes are written again, so outputs
+// must keep the bytes they accepted before failing.
+// This option does not apply to NewSplitter.
+func WithWriteRetry(policy RetryPolicy) Option {
+	return func(w *writer) error {
+		if policy.Retries < 0 || policy.Backoff < 0 || policy.Retryable == nil {
+			return ErrInvalidOption
+		}
+		w.retry = &policy
+		w.idx = w.retryOutput(w.idx)
+		w.blks = w.retryOutput(w.blks)
+		return nil
+	}
+}
+
+// WithDecisionLog will write a record of how each block was stored to log.
+// Each record contains the block number, hash, whether the block was
+// stored as a new block, a reference or a delta, and the offset to the
+// referenced block. Use ReadDecisionLog to read the log.
+//
+// The log can be replayed with ReplayDecisionLog to seed the index
+// of another writer, which is faster than decoding the output again.
+// The log format is versioned, and nothing is written if no blocks are written.
+func WithDecisionLog(log io.Writer) Option {
+	return func(w *writer) error {
+		if log == nil {
+			return ErrInvalidOption
+		}
+		w.dlog = log
+		return nil
+	}
+}
+
+// Preset is a named combination of writer options, see WithPreset.
+type Preset int
+
+const (
+	// PresetThroughput favors total throughput over the latency of single writes.
+	// The pipeline is kept as deep as memory reasonably allows,
+	// so hashing goroutines are rarely starved or blocked on the output.
+	//
+	// It sets:
+	//   - WithConcurrency(0): one hashing goroutine per core.
+	//   - WithBufferMultiplier: 4 times the default number of block buffers
+	//     per hashing goroutine, which is about 1MB of buffers per goroutine.
+	//   - WithWriteChunkSize(0): writes are not split.
+	//   - WithEvictionFraction(0.5): evictions from the index are rare.
+	PresetThroughput Preset = iota + 1
+
+	// PresetLatency favors predictable latency over total throughput.
+	// The pipeline is kept as shallow as possible, so written data
+	// reaches the output soon, and no single call does a lot of work.
+	//
+	// It sets:
+	//   - WithConcurrency(0): one hashing goroutine per core.
+	//   - WithBufferMultiplier(2): two block buffers per hashing goroutine,
+	//     the smallest number that keeps all goroutines busy.
+	//   - WithWriteChunkSize(256 << 10): writes are split into parts of 256KB,
+	//     so other goroutines can run between them.
+	//   - WithEvictionFraction(0.125): each eviction from the index is short.
+	//
+	// The writer has no timed flushing. Data that doesn't complete a block
+	// is held until more data is written, or Split, Sync or Close is called.
+	PresetLatency
+)
+
+// WithPreset will apply the options of a preset.
+// Options given after the preset override the settings of the preset,
+// and the preset overrides the options given before it.
+func WithPreset(p Preset) Option {
+	return func(w *writer) error {
+		var opts []Option
+		switch p {
+		case PresetThroughput:
+			opts = []Option{
+				WithConcurrency(0),
+				WithBufferMultiplier(4 * bufferMultiplier(w.maxSize)),
+				WithWriteChunkSize(0),
+				WithEvictionFraction(0.5),
+			}
+		case PresetLatency:
+			opts = []Option{
+				WithConcurrency(0),
+				WithBufferMultiplier(2),
+				WithWriteChunkSize(256 << 10),
+				WithEvictionFraction(0.125),
+			}
+		default:
+			return ErrInvalidOption
+		}
+		return w.applyOptions(opts)
+	}
+}
+
+// WithBufferMultiplier will set the number of block buffers
+// per hashing goroutine to n.
+// The buffers limit how many blocks can be waiting to be hashed
+// or written, so this sets the depth of the pipeline of the writer.
+//
+// More buffers keep the hashing goroutines busy when the output is slow
+// at times, but use more memory and delay the output of written data.
+// By default 256KB of buffers are used per goroutine, with at least 2 buffers.
+// Each buffer is the maximum block size.
+// Setting n to 0 uses the default.
+func WithBufferMultiplier(n int) Option {
+	return func(w *writer) error {
+		if n < 0 {
+			return ErrInvalidOption
+		}
+		w.bufmul = n
+		return nil
+	}
+}
+
+// WithEncryption will encrypt the output with the supplied key.
+//
+// The output is split into chunks of 64KiB that are encrypted and
+// authenticated separately, so it can be written and read as a stream.
+// Blocks are hashed before they are encrypted, so deduplication is not affected.
+// The key is not stored in the output and must be given to the reader
+// with WithDecryption.
+//
+// The block data and index of NewWriter and NewShardedWriter, the block data
+// of NewBlocksOnlyWriter and the single stream of NewStreamWriter are encrypted.
+// Use WithIndexEncryption(false) to leave the index unencrypted.
+// Offsets returned by Header and similar functions refer to the unencrypted output.
+//
+// This option is not supported by NewSplitter or with WithContinuation.
+func WithEncryption(key []byte, scheme EncryptionScheme) Option {
+	key = append([]byte(nil), key...)
+	return func(w *writer) error {
+		if _, err := newAEAD(key, scheme); err != nil {
+			return err
+		}
+		if w.crypt == nil {
+			w.crypt = &encryption{}
+		}
+		w.crypt.key = key
+		w.crypt.scheme = scheme
+		return nil
+	}
+}
+
+// WithIndexEncryption controls whether the index of NewWriter
+// and NewShardedWriter is encrypted when WithEncryption is used.
+// The index is encrypted by default. An unencrypted index can be
+// inspected without the key, but it is not authenticated,
+// so readers must allow it with WithPlaintextIndex.
+func WithIndexEncryption(enabled bool) Option {
+	return func(w *writer) error {
+		if w.crypt == nil {
+			w.crypt = &encryption{}
+		}
+		w.crypt.plainIndex = !enabled
+		return nil
+	}
+}
+
+// WithAutoMode will switch to fixed blocks of the maximum block size if
+// the estimated entropy of the first 64KiB of input is at least threshold bits per byte.
+//
+// Input with high entropy, like compressed or encrypted data, rarely
+// deduplicates with small dynamic blocks, so this avoids the overhead
+// of many index entries. A threshold of 7.5 is a reasonable choice.
+// Blocks cut before the switch are unaffected.
+// Use InputEntropy to read the estimate.
+func WithAutoMode(threshold float64) Option {
+	return func(w *writer) error {
+		if threshold <= 0 || threshold > 8 {
+			return ErrInvalidOption
+		}
+		w.ent.auto = threshold
+		return nil
+	}
+}
+
+// WithRunObserver will call fn each time the writer switches between
+// runs of new and duplicate blocks, with the kind and number of blocks in the run.
+// The last run is reported when the writer is closed.
+// Delta blocks are counted as new blocks.
+//
+// This is cheaper to consume than observing every block,
+// and gives an overview of which parts of the input deduplicate.
+// fn is called from the goroutine writing blocks, and should return quickly.
+func WithRunObserver(fn func(kind RunKind, length int)) Option {
+	return func(w *writer) error {
+		if fn == nil {
+			w.runs = nil
+			return nil
+		}
+		w.runs = &runTracker{fn: fn}
+		return nil
+	}
+}
+
+// WithStatsInterval will send a snapshot of the statistics to ch
+// each time another n bytes of blocks have been processed,
+// and a final snapshot when the writer is closed.
+//
+// Sending a snapshot never blocks the writer. If ch is full, the snapshot is dropped,
+// and the number of dropped snapshots is reported in the next snapshot.
+// ch is not closed by the writer.
+func WithStatsInterval(n int64, ch chan<- StatsSnapshot) Option {
+	return func(w *writer) error {
+		if n <= 0 || ch == nil {
+			return ErrInvalidOption
+		}
+		w.snaps = &statsInterval{every: n, next: n, ch: ch, last: time.Now()}
+		return nil
+	}
+}
+
+// WithIncrementalHash will hash blocks while the data is copied into
+// the current block, instead of hashing complete blocks on separate goroutines.
+//
+// This avoids reading each block a second time, after it may have been
+// evicted from the CPU cache, which can reduce memory bandwidth with large blocks.
+// However, hashing is then done by the goroutine calling Write,
+// so it doesn't use more than one core.
+// The output is identical with and without this option.
+// It has no effect when WithLengthInHash is used, since the length
+// must be hashed before the content.
+func WithIncrementalHash(enabled bool) Option {
+	return func(w *writer) error {
+		w.inc = nil
+		if enabled {
+			w.inc = &incHasher{h: w.newHash()}
+		}
+		return nil
+	}
+}
+
+// WithEmbeddedConfig will store the effective configuration of the writer
+// in the header, so the stream can be processed again with identical parameters.
+// The configuration can be read with EmbeddedConfig on the reader,
+// and Config.Options returns the options to create an identical writer.
+//
+// The configuration is a versioned JSON record of the mode, block size,
+// memory limit, hash and the options affecting the output.
+// This option is not supported by NewSplitter and NewBlocksOnlyWriter,
+// since they don't write a header.
+func WithEmbeddedConfig(enabled bool) Option {
+	return func(w *writer) error {
+		w.config = nil
+		if enabled {
+			w.config = &Config{}
+		}
+		return nil
+	}
+}
+
+// WithEmptyMarkers will make Split write an empty marker block,
+// if no content has been written since the last split.
+// This can be used to preserve message boundaries, also of empty messages.
+// Write each message, call Split to end the content if any was written,
+// and call Split again to write the marker.
+//
+// Markers are returned as empty blocks by ReadBlock and Decode,
+// but are not visible to Read and WriteTo.
+// The option is recorded in the stream header, so the stream will
+// only be readable by a reader that supports it.
+// This option is not supported by NewSplitter and NewBlocksOnlyWriter.
+func WithEmptyMarkers(enabled bool) Option {
+	return func(w *writer) error {
+		if enabled {
+			w.flags |= flagEmptyMarkers
+		} else {
+			w.flags &^= flagEmptyMarkers
+		}
+		return nil
+	}
+}
+
+// WithSizeHistogram will store a histogram of the block sizes at the end of the index,
+// so the distribution of block sizes can be read with SizeHistogram on the reader
+// without reading the block data. See SizeHistogram for the buckets.
+//
+// The option is recorded in the stream header, so the stream will
+// only be readable by a reader that supports it.
+// This option only applies to NewWriter, NewShardedWriter and NewColumnarWriter.
+func WithSizeHistogram(enabled bool) Option {
+	return func(w *writer) error {
+		w.sizes = nil
+		w.flags &^= flagSizeHistogram
+		if enabled {
+			w.sizes = &SizeHistogram{}
+			w.flags |= flagSizeHistogram
+		}
+		return nil
+	}
+}
+
+// WithBlockPositions will call fn for each new block written to the block stream,
+// with the block number, the hash, the offset of the block in the block stream and its length.
+// This can be used to build an index for fetching single blocks directly
+// from the block stream, for instance in a content addressed store.
+//
+// Offsets refer to the block stream before encryption.
+// Literal data of delta blocks is included in the offsets, but not reported.
+// The remaining data is reported when the writer is closed.
+// fn is called from the goroutine writing blocks, and should return quickly.
+// This option only applies to NewWriter, NewColumnarWriter and NewBlocksOnlyWriter.
+func WithBlockPositions(fn func(blockNum int, hash [HashSize]byte, offset int64, length int)) Option {
+	return func(w *writer) error {
+		w.pos = nil
+		if fn != nil {
+			w.pos = &blockPositions{fn: fn}
+		}
+		return nil
+	}
+}
+
+// WithPipelineShards will split the hashing pipeline of the writer into n pipelines,
+// each with its own input channel and share of the hashing goroutines.
+// Blocks are distributed between the pipelines by block number.
+//
+// With many cores, and on multi-socket machines in particular, a single channel
+// shared by all hashing goroutines can become contended, and moves blocks
+// between cores more than needed. Separate pipelines reduce this contention.
+// Blocks are still deduplicated and written in order, so the output is unaffected.
+// The Go scheduler doesn't bind goroutines to NUMA nodes, so the gain depends on the machine
+// and should be measured. A value of 1 uses a single pipeline, which is the default.
+// This option has no effect with WithHasherPool or WithIncrementalHash.
+func WithPipelineShards(n int) Option {
+	return func(w *writer) error {
+		if n < 1 {
+			return ErrInvalidOption
+		}
+		w.pipes = n
+		return nil
+	}
+}
+
+// WithHashedTail will make Close end the remaining data as a regular block,
+// instead of storing it directly in the last block of the stream.
+//
+// By default the remaining data is not hashed or added to the index, so it is
+// never deduplicated and is not returned by ForEachIndexEntry. With this option
+// it is handled like all other blocks, so its hash can be recorded and matched
+// by a later writer, for instance when appending to a stream.
+// The last block of the stream is then empty, which all readers support.
+// Splitters and NewBlocksOnlyWriter always handle the remaining data as a regular block.
+func WithHashedTail(enabled bool) Option {
+	return func(w *writer) error {
+		w.fullTail = enabled
+		return nil
+	}
+}
+
+// WithCompressedBlockSink will write the compressed form of the block data
+// to sink, in addition to the uncompressed block stream.
+// Each time data is written to the block stream, the same data is compressed
+// with codec and written to sink, prefixed by the compressed size.
+// See FORMAT.md for a description of the sink.
+//
+// The sink can be used instead of the block stream by readers created with
+// WithCompressedBlocks, so the raw or the compressed form can be stored
+// or discarded independently.
+// Blocks are compressed by the goroutine writing blocks,
+// so a slow codec will limit the speed of the writer.
+// This option only applies to NewWriter and NewColumnarWriter.
+func WithCompressedBlockSink(sink io.Writer, codec BlockCodec) Option {
+	return func(w *writer) error {
+		if sink == nil || codec == nil {
+			return ErrInvalidOption
+		}
+		w.sink = &blockSink{w: sink, codec: codec}
+		return nil
+	}
+}
+
+// WithBlockHash will hash blocks with the hash identified by id instead of SHA-1.
+// The hash is used to deduplicate blocks, so it should have a low probability of collisions.
+// ErrInvalidOption is returned if the hash is not available, see RegisterHash,
+// or if its digest is shorter than HashSize bytes, like HashXXH64,
+// since short digests are likely to make different blocks look like duplicates.
+//
+// Longer digests are truncated to their first HashSize bytes. This is the form
+// used for deduplication and reported by the writer, for instance by
+// Fragment.Hash, ContentHash and MerkleRoot, so for hashes like SHA-256
+// the reported hashes are not the standard digests, but prefixes of them.
+// Merkle tree nodes are still hashed with SHA-1.
+//
+// The ID of the hash is stored in the stream header. Streams can be decoded
+// without the hash, but readers only verify block hashes if it is available.
+func WithBlockHash(id HashID) Option {
+	return func(w *writer) error {
+		if !id.Available() || !id.dedupKey() {
+			return ErrInvalidOption
+		}
+		w.hashFn = hashes[id].fn
+		w.flags &^= flagHashMask
+		w.flags |= uint64(id) << 8
+		if w.inc != nil {
+			w.inc.h = w.newHash()
+		}
+		if w.content != nil {
+			w.content = w.newHash()
+		}
+		return nil
+	}
+}
+
+// WithContext will stop the writer when ctx is cancelled.
+//
+// When ctx is cancelled, Write, WriteChunk and Sync return the error of ctx,
+// and the remaining input of a Write in progress is discarded.
+// The goroutines writing blocks stop before their next block,
+// even if the output is stalled, and blocks that have not been written are discarded.
+// Close returns the error of ctx without writing the end of the stream,
+// and stops the goroutines hashing blocks, so Close should still be called.
+// A cancelled stream is incomplete and should be discarded.
+func WithContext(ctx context.Context) Option {
+	return func(w *writer) error {
+		if ctx == nil {
+			return ErrInvalidOption
+		}
+		w.ctx = ctx
+		return nil
+	}
+}
+
+// WithImportIndex will read an index written by ExportIndex,
+// so blocks seen by a previous writer are treated as duplicates.
+// This can be used for incremental backups to a content addressed store,
+// where only blocks that have not been stored before should be written.
+//
+// The block numbers continue after the last block of the exported writer,
+// so the imported block numbers stay valid, and WithBlockNumberBase should not be used.
+// Both writers must use the same block hash.
+//
+// Backreferences can only refer to blocks in the same stream, so this option is only
+// supported by NewBlocksOnlyWriter and NewSplitter, which have no backreference limit.
+// All imported entries are kept, and since no entries are evicted, memory use
+// grows with the number of unique blocks across all sessions.
+// Writers with a backreference limit evict the oldest blocks from their index,
+// so indexes exported from them only contain the most recent blocks.
+func WithImportIndex(r io.Reader) Option {
+	return func(w *writer) error {
+		if r == nil {
+			return ErrInvalidOption
+		}
+		return w.readIndex(r)
+	}
+}
+
+// WithConcurrency will limit the number of goroutines hashing blocks to n,
+// and the number of block buffers to what n goroutines need.
+// By default one goroutine per core is used, as given by runtime.GOMAXPROCS.
+// This reduces the memory used by writers of small streams on machines with many cores.
+//
+// If n is 1, blocks are hashed by the goroutine calling Write,
+// so only the goroutine writing the output runs in the background.
+// Values larger than the number of cores have no effect.
+// Setting n to 0 uses the default.
+// The number of goroutines is not affected when WithHasherPool is used.
+func WithConcurrency(n int) Option {
+	return func(w *writer) error {
+		if n < 0 {
+			return ErrInvalidOption
+		}
+		w.procs = n
+		return nil
+	}
+}
+
+// WithSingleThread will process all blocks in the goroutine calling Write,
+// Split, Sync and Close, so the writer starts no goroutines of its own.
+// Blocks are hashed and written before the call returns,
+// so no input channel or extra block buffers are needed.
+//
+// Since blocks are processed in the order they are cut, as they are by
+// the concurrent writer, the output is identical to that of a writer
+// without this option. This makes it suitable for reproducible builds
+// and for debugging.
+//
+// WithHasherPool, WithConcurrency and WithPipelineShards have no effect.
+// WithContext still starts a goroutine watching the context.
+// While the writer is paused, calls that complete a block wait for Resume.
+func WithSingleThread() Option {
+	return func(w *writer) error {
+		w.single = true
+		return nil
+	}
+}
+
+// WithEvictionObserver will call fn each time entries are evicted from
+// the index, because they can no longer be referenced.
+//
+// fn is called with the number of evicted entries, the cutoff block number
+// and the time the eviction took. Entries last seen before the cutoff block
+// have been evicted. An eviction may remove no entries.
+// Frequent evictions of many entries may indicate that the maximum memory
+// is too small for the repetition distance of the input.
+//
+// fn is called from the goroutine writing blocks, and should return quickly.
+func WithEvictionObserver(fn func(evicted, cutoff int, dur time.Duration)) Option {
+	return func(w *writer) error {
+		w.onEvict = fn
+		return nil
+	}
+}
+
+// WithFileDuplicates will report whether each file written to a splitter
+// only consisted of fragments that had been seen before.
+//
+// A file ends when Split or Close is called. After the last fragment of the
+// file has been sent, fn is called with the hash of the file and whether
+// none of its fragments were new. Files without data are not reported.
+// The hash of a file is the SHA-1 hash of the hashes of its fragments,
+// so identical files have the same hash when they are split the same way.
+// In ModeFixed identical files are always split the same way. In the dynamic
+// modes split points also depend on previous content, so the first fragments
+// of an identical file may differ, and the file is not reported as a duplicate.
+//
+// fn is called from the goroutine sending fragments, and should return quickly.
+// This option only applies to NewSplitter.
+func WithFileDuplicates(fn func(hash [HashSize]byte, duplicate bool)) Option {
+	return func(w *writer) error {
+		w.onFile = fn
+		return nil
+	}
+}
+
+// WithBlockMetadata will write metadata for each unique block to meta.
+//
+// fn is called with the block number of each block that is stored
+// in the output, and the returned metadata is written to meta.
+// If fn returns no data, nothing is written for the block.
+// Metadata of a single block must be at most 1MB.
+// Use ReadBlockMetadata to read the metadata stream.
+//
+// Block numbers start at 1, unless changed with WithBlockNumberBase.
+// fn is called from a single goroutine.
+//
+// This option does not apply to NewSplitter.
+func WithBlockMetadata(meta io.Writer, fn func(blockNum int) []byte) Option {
+	return func(w *writer) error {
+		if meta == nil || fn == nil {
+			return ErrInvalidOption
+		}
+		w.meta = meta
+		w.metaFn = fn
+		return nil
+	}
+}
+
+// WithFinalizer will buffer all output and send it to fn when the writer is closed.
+//
+// This is useful for outputs that only accept complete objects,
+// like object storage. The writers given to the constructor are not used,
+// but the block writer given to NewWriter must not be nil.
+// If fn returns an error, it is returned by Close.
+//
+// All output is kept in memory, until a stream exceeds spillSize bytes,
+// after which it is written to a temporary file, which is removed when fn returns.
+// Setting spillSize to 0 keeps all output in memory.
+//
+// This option does not apply to NewSplitter.
+func WithFinalizer(fn Finalizer, spillSize int64) Option {
+	return func(w *writer) error {
+		if fn == nil || spillSize < 0 {
+			return ErrInvalidOption
+		}
+		f := &finalizer{fn: fn, idx: &SpillBuffer{limit: spillSize}}
+		w.idx = f.idx
+		if w.blks != nil {
+			f.blks = &SpillBuffer{limit: spillSize}
+			w.blks = f.blks
+		}
+		w.final = f
+		if w.verify != nil {
+			// Verify the buffered output.
+			w.verify = newSelfVerifier(w)
+		}
+		return nil
+	}
+}
+
+// WithContentHash will calculate a hash of all input, which is available
+// through ContentHash. The same hash function as for blocks is used.
+//
+// This can be used to detect if identical content has already been stored,
+// regardless of how it was split into blocks.
+func WithContentHash(enabled bool) Option {
+	return func(w *writer) error {
+		w.content = nil
+		if enabled {
+			w.content = w.newHash()
+		}
+		return nil
+	}
+}
+
+// NewContentHash returns a hash.Hash that calculates the same hash
+// as a writer created with WithContentHash returns from ContentHash.
+//
+// This can be used to calculate the identity of content without
+// deduplicating it, for instance to check if it has already been stored.
+// Sum will append HashSize bytes.
+//
+// Writers using WithBlockHash calculate the content hash with their block hash instead.
+func NewContentHash() hash.Hash {
+	return hasher.New()
+}
@@ -0,0 +1,20 @@
+package dedup
+
+import "io"
+
+// Pack will copy all data from r to w, and close w when r returns io.EOF.
+// The number of bytes read from r is returned.
+//
+// This ensures the final block is flushed and the output is complete
+// when the input has been read.
+// If reading from r or writing to w fails, the error is returned
+// and w is closed with CloseWithError, so a failed input is never
+// mistaken for a complete stream. The output must be discarded in that case.
+func Pack(w Writer, r io.Reader) (int64, error) {
+	n, err := io.Copy(w, r)
+	if err != nil {
+		w.CloseWithError(err)
+		return n, err
+	}
+	return n, w.Close()
+}
@@ -0,0 +1,87 @@
+package dedup_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestPack(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(1<<20 + 65).Bytes()
+
+	var stream bytes.Buffer
+	w, err := dedup.NewStreamWriter(&stream, dedup.ModeDynamic, size, 10*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := dedup.Pack(w, bytes.NewBuffer(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(b)) {
+		t.Fatal("expected", len(b), "bytes, got", n)
+	}
+	r, err := dedup.NewStreamReader(&stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, out) {
+		t.Fatal("Output mismatch")
+	}
+
+	// A read error must not produce a complete stream.
+	want := errors.New("read error")
+	stream.Reset()
+	w, err = dedup.NewStreamWriter(&stream, dedup.ModeDynamic, size, 10*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dedup.Pack(w, io.MultiReader(bytes.NewBuffer(b), &errReader{err: want}))
+	if err != want {
+		t.Fatal("expected read error, got", err)
+	}
+	r, err = dedup.NewStreamReader(&stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(r)
+	if err == nil {
+		t.Fatal("expected incomplete stream")
+	}
+}
+
+func TestCloseWithError(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(1 << 20).Bytes()
+	want := errors.New("input error")
+	var stream bytes.Buffer
+	w, err := dedup.NewStreamWriter(&stream, dedup.ModeFixed, size, 10*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CloseWithError(want); err != want {
+		t.Fatal("expected input error, got", err)
+	}
+	if _, err := w.Write(b); err != want {
+		t.Fatal("expected input error, got", err)
+	}
+	r, err := dedup.NewStreamReader(&stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadAll(r); err == nil {
+		t.Fatal("expected incomplete stream")
+	}
+}
@@ -0,0 +1,110 @@
+package dedup
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// exportVersion is the version of exported indexes.
+const exportVersion = 1
+
+// importedIndex describes an index imported by WithImportIndex.
+type importedIndex struct {
+	hash uint64 // Format flags affecting the block hash.
+}
+
+// hashFlags returns the format flags that affect the block hashes.
+func (w *writer) hashFlags() uint64 {
+	return w.flags & (flagHashMask | flagLengthHash)
+}
+
+// ExportIndex will write the hashes and block numbers of the index
+// of the writer to out, so a later writer can continue deduplicating
+// against the blocks with WithImportIndex.
+//
+// The export contains the entries in the index when it is called,
+// so it should be called when the writer has been closed.
+// Entries evicted because of the backreference limit are not included.
+func (w *writer) ExportIndex(out io.Writer) error {
+	w.mu.Lock()
+	next := w.nblocks
+	w.mu.Unlock()
+	bw := bufio.NewWriter(out)
+	var tmp [binary.MaxVarintLen64]byte
+	put := func(v uint64) {
+		n := binary.PutUvarint(tmp[:], v)
+		bw.Write(tmp[:n])
+	}
+	w.idxMu.Lock()
+	put(exportVersion)
+	put(w.hashFlags())
+	put(uint64(next))
+	put(uint64(len(w.index)))
+	for h, n := range w.index {
+		bw.Write(h[:])
+		put(uint64(n))
+	}
+	w.idxMu.Unlock()
+	return bw.Flush()
+}
+
+// readIndex will add the entries of an index written by ExportIndex to the index,
+// and continue the block numbers after the exported writer.
+func (w *writer) readIndex(in io.Reader) error {
+	br := bufio.NewReader(in)
+	var err error
+	get := func() uint64 {
+		if err != nil {
+			return 0
+		}
+		var v uint64
+		v, err = binary.ReadUvarint(br)
+		return v
+	}
+	version, hash, next, entries := get(), get(), get(), get()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if version != exportVersion {
+		return fmt.Errorf("dedup: unknown index export version %d", version)
+	}
+	if next < 1 || next > math.MaxInt32 {
+		return errors.New("dedup: invalid block number in index export")
+	}
+	if w.imported != nil && w.imported.hash != hash {
+		return errors.New("dedup: imported indexes use different block hashes")
+	}
+	for i := uint64(0); i < entries; i++ {
+		var h [HashSize]byte
+		if _, err := io.ReadFull(br, h[:]); err != nil {
+			return unexpectedEOF(err)
+		}
+		n := get()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if n >= next {
+			return errors.New("dedup: invalid block number in index export")
+		}
+		w.index[h] = int(n)
+	}
+	w.imported = &importedIndex{hash: hash}
+	if int(next) > w.nblocks {
+		w.nblocks = int(next)
+		w.base = int(next)
+	}
+	return nil
+}
+
+// checkImport returns an error if an index has been imported,
+// but the writer uses another block hash than the exported writer.
+func (w *writer) checkImport() error {
+	if w.imported != nil && w.imported.hash != w.hashFlags() {
+		return errors.New("dedup: imported index uses a different block hash")
+	}
+	return nil
+}
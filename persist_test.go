@@ -0,0 +1,97 @@
+package dedup_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestImportIndex(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(256 << 10).Bytes()
+	first, second := b[:128<<10], b
+
+	// store will write the unique blocks of in,
+	// and return the written block numbers.
+	store := func(in []byte, opts ...dedup.Option) (dedup.Writer, int) {
+		written := 0
+		w, err := dedup.NewBlocksOnlyWriter(ioutil.Discard, dedup.ModeFixed, size, func(hash [dedup.HashSize]byte, size int) error {
+			written++
+			return nil
+		}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(in)); err != nil {
+			t.Fatal(err)
+		}
+		return w, written
+	}
+	w, n := store(first)
+	if n != len(first)/size {
+		t.Fatal("expected", len(first)/size, "blocks, got", n)
+	}
+	var export bytes.Buffer
+	if err := w.ExportIndex(&export); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the blocks not stored by the first writer are new.
+	w, n = store(second, dedup.WithImportIndex(bytes.NewReader(export.Bytes())))
+	if n != (len(second)-len(first))/size {
+		t.Fatal("expected", (len(second)-len(first))/size, "blocks, got", n)
+	}
+	// Block numbers continue after the first writer.
+	min := len(first) / size
+	later := 0
+	w.ForEachIndexEntry(func(hash [dedup.HashSize]byte, blockNum int) bool {
+		if blockNum > min {
+			later++
+		}
+		return true
+	})
+	if later != n {
+		t.Fatal("expected", n, "entries after the imported blocks, got", later)
+	}
+	st := w.Stats()
+	if st.LongestDupStart != min+1 {
+		t.Fatal("expected duplicates to start at block", min+1, "got", st.LongestDupStart)
+	}
+
+	// Splitters report the imported blocks as duplicates.
+	ch := make(chan dedup.Fragment, len(second)/size+1)
+	s, err := dedup.NewSplitter(ch, dedup.ModeFixed, size, dedup.WithImportIndex(bytes.NewReader(export.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(s, bytes.NewBuffer(second)); err != nil {
+		t.Fatal(err)
+	}
+	for f := range ch {
+		if want := int(f.N) >= len(first)/size; f.New != want {
+			t.Fatalf("fragment %d: got new %v, want %v", f.N, f.New, want)
+		}
+	}
+
+	// The block hash must match.
+	_, err = dedup.NewBlocksOnlyWriter(ioutil.Discard, dedup.ModeFixed, size, func([dedup.HashSize]byte, int) error { return nil },
+		dedup.WithImportIndex(bytes.NewReader(export.Bytes())), dedup.WithBlockHash(dedup.HashSHA256))
+	if err == nil {
+		t.Fatal("expected error for different block hash")
+	}
+	// Backreferences cannot refer to other streams.
+	_, err = dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.WithImportIndex(bytes.NewReader(export.Bytes())))
+	if err == nil {
+		t.Fatal("expected error from index writer")
+	}
+	_, err = dedup.NewStreamWriter(ioutil.Discard, dedup.ModeFixed, size, 8*size, dedup.WithImportIndex(bytes.NewReader(export.Bytes())))
+	if err == nil {
+		t.Fatal("expected error from stream writer")
+	}
+	_, err = dedup.NewSplitter(ch, dedup.ModeFixed, size, dedup.WithImportIndex(bytes.NewReader(export.Bytes()[:export.Len()-1])))
+	if err == nil {
+		t.Fatal("expected error from truncated export")
+	}
+}
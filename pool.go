@@ -0,0 +1,192 @@
+package dedup
+
+import (
+	hasher "crypto/sha1"
+	"errors"
+	"hash"
+	"runtime"
+	"sync"
+)
+
+// A BufferPool is a pool of block buffers that can be shared by
+// writers with the same maximum block size.
+//
+// By default each writer allocates buffers for all blocks it can have
+// in flight when it is created, and keeps them until it is garbage collected.
+// Writers using a shared pool only hold buffers while blocks are being
+// processed, and return them to the pool afterwards.
+// This reduces the memory used by many concurrent writers that are mostly idle.
+//
+// A BufferPool is safe for concurrent use.
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// ErrPoolSizeMismatch is returned by WithSharedPool if the block size of the pool
+// doesn't match the maximum block size of the writer.
+var ErrPoolSizeMismatch = errors.New("dedup: buffer pool block size does not match writer")
+
+// NewBufferPool returns a pool of buffers for writers with the given maximum block size.
+func NewBufferPool(maxSize uint) (*BufferPool, error) {
+	if maxSize < MinBlockSize {
+		return nil, ErrSizeTooSmall
+	}
+	if maxSize > MaxBlockSize {
+		return nil, ErrSizeTooLarge
+	}
+	return &BufferPool{size: int(maxSize)}, nil
+}
+
+// get returns a buffer of the block size.
+func (p *BufferPool) get() []byte {
+	if b, ok := p.pool.Get().(*[]byte); ok {
+		return *b
+	}
+	return make([]byte, p.size)
+}
+
+// put will return a buffer to the pool.
+func (p *BufferPool) put(b []byte) {
+	if cap(b) != p.size {
+		return
+	}
+	b = b[:p.size]
+	p.pool.Put(&b)
+}
+
+// newBlock returns a new block for the writer.
+// When a shared pool is used, the data is assigned
+// when the block is taken into use.
+func (w *writer) newBlock() *block {
+	b := &block{hashDone: make(chan error, 1)}
+	if w.pool == nil {
+		b.data = make([]byte, w.maxSize)
+	}
+	return b
+}
+
+// buffer returns a block that can be filled with data.
+// If the context of the writer is cancelled while waiting,
+// a spare block is returned, which will be discarded by send.
+func (w *writer) buffer() *block {
+	var b *block
+	select {
+	case b = <-w.buffers:
+	case <-w.ctxDone():
+		if w.spare == nil {
+			w.spare = w.newBlock()
+		}
+		b = w.spare
+	}
+	if b.data == nil {
+		b.data = w.pool.get()
+	}
+	return b
+}
+
+// A HasherPool is a fixed number of goroutines that hash blocks
+// for writers created with WithHasherPool.
+//
+// By default each writer starts a hashing goroutine per core when it is created,
+// which stay until the writer is closed. Writers using a shared pool don't
+// start any hashing goroutines, so the hashing work of all writers is bounded
+// by the size of the pool, and idle writers don't hold goroutines.
+//
+// A HasherPool is safe for concurrent use.
+type HasherPool struct {
+	jobs chan hashJob
+	once sync.Once
+}
+
+// hashJob is a block to be hashed by a HasherPool.
+type hashJob struct {
+	b       *block
+	length  bool             // Include the length in the hash.
+	newHash func() hash.Hash // Block hash of the writer, SHA-1 if nil.
+}
+
+// NewHasherPool starts a pool with the given number of hashing goroutines.
+// If workers is 0, a goroutine per core is started.
+// The pool must be closed with Close when it is no longer used.
+func NewHasherPool(workers int) (*HasherPool, error) {
+	if workers < 0 {
+		return nil, ErrInvalidOption
+	}
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	p := &HasherPool{jobs: make(chan hashJob, workers*4)}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p, nil
+}
+
+// Close will stop the goroutines of the pool.
+// All writers using the pool must be closed first.
+func (p *HasherPool) Close() {
+	p.once.Do(func() { close(p.jobs) })
+}
+
+// work will hash blocks until the pool is closed.
+func (p *HasherPool) work() {
+	h := hasher.New()
+	for j := range p.jobs {
+		if j.newHash != nil {
+			sumBlock(j.newHash(), j.b, j.length)
+		} else {
+			sumBlock(h, j.b, j.length)
+		}
+		j.b.hashDone <- nil
+	}
+}
+
+// concurrency returns the number of hashing goroutines to use,
+// when n is the number of cores.
+func (w *writer) concurrency(n int) int {
+	if w.single {
+		return 1
+	}
+	if w.procs > 0 && w.procs < n {
+		return w.procs
+	}
+	return n
+}
+
+// startHashers will start n goroutines hashing blocks of the writer,
+// unless a shared hasher pool is used.
+// If WithConcurrency is 1 or WithSingleThread is used,
+// blocks are hashed by the goroutine writing them.
+// If the writer has several pipelines, the goroutines are divided
+// between them, with at least one goroutine per pipeline.
+func (w *writer) startHashers(n int) {
+	if w.single {
+		w.direct = w.newHash()
+		return
+	}
+	if w.hashers != nil {
+		return
+	}
+	if w.procs == 1 && w.pipes <= 1 {
+		// Hash blocks in the goroutine writing them.
+		w.direct = w.newHash()
+		return
+	}
+	if w.pipes <= 1 {
+		for i := 0; i < n; i++ {
+			go w.hasher(w.input)
+		}
+		return
+	}
+	w.inputs = make([]chan *block, w.pipes)
+	for i := range w.inputs {
+		w.inputs[i] = make(chan *block, cap(w.input)/w.pipes+1)
+	}
+	if n < w.pipes {
+		n = w.pipes
+	}
+	for i := 0; i < n; i++ {
+		go w.hasher(w.inputs[i%w.pipes])
+	}
+}
@@ -0,0 +1,172 @@
+package dedup_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestSharedPool(t *testing.T) {
+	const size = 4 << 10
+	pool, err := dedup.NewBufferPool(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dedup.NewStreamWriter(ioutil.Discard, dedup.ModeFixed, 2*size, 10*size, dedup.WithSharedPool(pool))
+	if err != dedup.ErrPoolSizeMismatch {
+		t.Fatal("expected ErrPoolSizeMismatch, got", err)
+	}
+	_, err = dedup.NewBufferPool(dedup.MinBlockSize - 1)
+	if err != dedup.ErrSizeTooSmall {
+		t.Fatal("expected ErrSizeTooSmall, got", err)
+	}
+
+	modes := []dedup.Mode{dedup.ModeFixed, dedup.ModeDynamic, dedup.ModeDynamicEntropy, dedup.ModeAdaptive, dedup.ModeDynamicFastCDC}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b := getBufferSize(256<<10 + i).Bytes()
+			// Create some duplicates
+			copy(b[128<<10:], b[:64<<10])
+			mode := modes[i%len(modes)]
+			var idx, data bytes.Buffer
+			w, err := dedup.NewWriter(&idx, &data, mode, size, 0, dedup.WithSharedPool(pool))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(w, bytes.NewBuffer(b[:1000]))
+			w.WriteChunk(b[1000:2000])
+			io.Copy(w, bytes.NewBuffer(b[2000:]))
+			if err := w.Close(); err != nil {
+				t.Error(err)
+				return
+			}
+			r, err := dedup.NewReader(&idx, &data)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			out, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(b, out) {
+				t.Error("Output mismatch, mode", mode)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Benchmark 1000 concurrent writers, each writing 1MB.
+func BenchmarkSharedPool1000Writers(b *testing.B) {
+	pool, err := dedup.NewBufferPool(64 << 10)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkConcurrentWriters(b, 1000, dedup.WithSharedPool(pool))
+}
+
+// Benchmark 1000 concurrent writers, each writing 1MB,
+// each with their own buffers.
+func BenchmarkNoPool1000Writers(b *testing.B) {
+	benchmarkConcurrentWriters(b, 1000)
+}
+
+func benchmarkConcurrentWriters(b *testing.B, n int, opts ...dedup.Option) {
+	input := getBufferSize(1 << 20).Bytes()
+	b.SetBytes(int64(n * len(input)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for j := 0; j < n; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w, err := dedup.NewStreamWriter(ioutil.Discard, dedup.ModeFixed, 64<<10, 1<<20, opts...)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				w.Write(input)
+				w.Close()
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func TestHasherPool(t *testing.T) {
+	const size = 4 << 10
+	if _, err := dedup.NewHasherPool(-1); err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+	pool, err := dedup.NewHasherPool(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b := getBufferSize(256<<10 + i).Bytes()
+			// Create some duplicates
+			copy(b[128<<10:], b[:64<<10])
+			lengthHash := dedup.WithLengthInHash(i%2 == 0)
+			var idx, data, idx2, data2 bytes.Buffer
+			w, err := dedup.NewWriter(&idx, &data, dedup.ModeDynamic, size, 0, lengthHash, dedup.WithHasherPool(pool))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			w2, err := dedup.NewWriter(&idx2, &data2, dedup.ModeDynamic, size, 0, lengthHash)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for _, w := range []dedup.Writer{w, w2} {
+				io.Copy(w, bytes.NewBuffer(b))
+				if err := w.Close(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			if !bytes.Equal(idx.Bytes(), idx2.Bytes()) || !bytes.Equal(data.Bytes(), data2.Bytes()) {
+				t.Error("output mismatch")
+			}
+			if s := w.Stats(); s.NewBlocks == s.Blocks {
+				t.Error("expected duplicates")
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Benchmark 1000 concurrent writers, each writing 1MB,
+// each with a hashing goroutine per core.
+func BenchmarkOwnHashers1000Writers(b *testing.B) {
+	benchmarkConcurrentWriters(b, 1000)
+}
+
+// Benchmark 1000 concurrent writers, each writing 1MB,
+// sharing a hashing goroutine per core.
+func BenchmarkHasherPool1000Writers(b *testing.B) {
+	pool, err := dedup.NewHasherPool(0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer pool.Close()
+	benchmarkConcurrentWriters(b, 1000, dedup.WithHasherPool(pool))
+}
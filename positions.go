@@ -0,0 +1,18 @@
+package dedup
+
+// blockPositions tracks the offset of each block written to the block stream.
+type blockPositions struct {
+	fn  func(blockNum int, hash [HashSize]byte, offset int64, length int)
+	off int64 // Bytes written to the block stream.
+}
+
+// add will report a block of n bytes written at the current offset.
+func (p *blockPositions) add(blockNum int, h [HashSize]byte, n int) {
+	p.fn(blockNum, h, p.off, n)
+	p.off += int64(n)
+}
+
+// skip will advance the offset by n bytes without reporting a block.
+func (p *blockPositions) skip(n int) {
+	p.off += int64(n)
+}
@@ -2,6 +2,7 @@ package dedup
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -17,8 +18,51 @@ type Reader interface {
 
 	io.WriterTo
 
+	// ReadBlock will read the next block into p and return the size of the block.
+	// This avoids splitting blocks between reads, so each block is copied once.
+	// If the previous call was a Read ending inside a block, the rest of that block is returned.
+	// Empty blocks are skipped, and io.EOF is returned at the end of the stream.
+	// Markers written with WithEmptyMarkers are returned as empty blocks.
+	// If p is smaller than the block, io.ErrShortBuffer is returned and nothing is read,
+	// so p should be at least MaxBlockSize bytes.
+	ReadBlock(p []byte) (n int, err error)
+
 	// MaxMem returns the *maximum* memory required to decode the stream.
 	MaxMem() int
+
+	// MaxBlockSize returns the maximum block size of the stream,
+	// as stored in the stream header.
+	MaxBlockSize() int
+
+	// EmbeddedConfig returns the configuration of the writer,
+	// if it was embedded in the header with WithEmbeddedConfig.
+	// Otherwise ErrNoConfig is returned.
+	EmbeddedConfig() (Config, error)
+
+	// HashVerifiable returns false if the stream uses a block hash
+	// that is unknown or not available, see RegisterHash. The content can still be decoded,
+	// but functions that depend on block hashes return ErrUnknownHash.
+	HashVerifiable() bool
+
+	// MaxBackrefBlocks returns the maximum backreference distance in blocks,
+	// as stored in the stream header.
+	// Indexed streams and streams limited by WithByteWindow do not store this,
+	// so 0 is returned for these.
+	MaxBackrefBlocks() int
+
+	// VerifyMerkleRoot will make the reader calculate the Merkle tree
+	// of the decoded blocks, as described by MerkleProof, and compare
+	// it to root, which can be obtained from MerkleRoot on the writer.
+	// It must be called before reading starts.
+	//
+	// Blocks are returned before the stream has been verified.
+	// If the root doesn't match, ErrMerkleMismatch is returned
+	// at the end of the stream instead of io.EOF, and all content
+	// read from the stream should be discarded.
+	// Concatenated streams are verified as a single tree,
+	// so they will only match if they were written by a single writer.
+	// ErrUnknownHash is returned if the block hash of the stream is unknown.
+	VerifyMerkleRoot(root [HashSize]byte) error
 }
 
 // IndexedReader gives access to internal information on
@@ -29,16 +73,28 @@ type IndexedReader interface {
 	// Blocksizes will return the sizes of each block.
 	// Will be available if an index was provided.
 	BlockSizes() []int
+
+	// SizeHistogram returns the histogram of block sizes,
+	// if it was stored in the index with WithSizeHistogram.
+	// Otherwise ErrNoHistogram is returned.
+	SizeHistogram() (SizeHistogram, error)
 }
 
 type reader struct {
 	streamReader
 	blocks []*rblock
+	shards int           // Number of block streams, if sharded.
+	hist   SizeHistogram // Block size histogram, if stored.
+	codec  BlockCodec    // Codec of compressed block streams, if set.
 }
 
 type streamReader struct {
 	size         int
-	maxLength    uint64 // Maxmimum backreference count
+	maxLength    uint64          // Maxmimum backreference count
+	flags        uint64          // Format flags
+	config       []byte          // Embedded configuration, if any.
+	maxOutput    int64           // Maximum decoded size, 0 if unlimited.
+	merkle       *merkleVerifier // Verifies the decoded blocks, if set.
 	curBlock     int
 	curData      []byte
 	ready        chan *rblock
@@ -50,10 +106,21 @@ type streamReader struct {
 type rblock struct {
 	data     []byte
 	readData int
-	first    int   // Index of first occurrence
-	last     int   // Index of last occurrence
-	offset   int64 // Expected offset in data file (format 1)
-	err      error // Read error?
+	first    int     // Index of first occurrence
+	last     int     // Index of last occurrence
+	offset   int64   // Expected offset in data file (format 1)
+	err      error   // Read error?
+	base     *rblock // Base block of a delta block (format 3)
+	depth    int     // Number of delta blocks in the chain ending with this block
+	prefix   int     // Bytes copied from the start of the base block
+	suffix   int     // Bytes copied from the end of the base block
+	shard    int     // Block stream containing the data
+	marker   bool    // Empty marker block, see WithEmptyMarkers
+}
+
+// size returns the decoded size of the block.
+func (r *rblock) size() int {
+	return r.prefix + r.readData + r.suffix
 }
 
 func (r *rblock) String() string {
@@ -65,19 +132,42 @@ func (r *rblock) String() string {
 
 var ErrUnknownFormat = errors.New("unknown index format")
 
+// ErrUnknownHash is returned if block hashes are needed,
+// but the stream uses a hash that is unknown or not available.
+// The content of the stream can still be decoded.
+var ErrUnknownHash = errors.New("dedup: unknown block hash, cannot verify")
+
+// ErrOutputTooLarge is returned if the decoded size of a stream
+// exceeds the limit set by WithMaxOutput.
+var ErrOutputTooLarge = errors.New("dedup: decoded output exceeds limit")
+
 // NewReader returns a reader that will decode the supplied index and data stream.
 //
 // This is compatible content from the NewWriter function.
 // The function will decode the index before returning.
 //
+// WithMaxReadahead can be used to limit the number of blocks decoded ahead.
+//
 // When you are done with the Reader, use Close to release resources.
-func NewReader(index io.Reader, blocks io.Reader) (IndexedReader, error) {
+func NewReader(index io.Reader, blocks io.Reader, opts ...ReaderOption) (IndexedReader, error) {
+	return newIndexReader(index, []io.Reader{blocks}, opts)
+}
+
+// newIndexReader will create a reader for NewReader and NewShardedReader.
+func newIndexReader(index io.Reader, blocks []io.Reader, opts []ReaderOption) (IndexedReader, error) {
+	var o readerOptions
+	if err := o.apply(opts); err != nil {
+		return nil, err
+	}
 	f := &reader{streamReader: streamReader{
-		ready:        make(chan *rblock, 8), // Read up to 8 blocks ahead
 		closeReader:  make(chan struct{}, 0),
 		readerClosed: make(chan struct{}, 0),
 		curBlock:     0,
 	}}
+	index, err := o.decrypt(index, !o.plainIndex)
+	if err != nil {
+		return nil, err
+	}
 	idx := bufio.NewReader(index)
 	format, err := binary.ReadUvarint(idx)
 	if err != nil {
@@ -85,28 +175,58 @@ func NewReader(index io.Reader, blocks io.Reader) (IndexedReader, error) {
 	}
 
 	switch format {
-	case 1:
-		err = f.readFormat1(idx)
+	case 1, 3:
+		err = f.readFormat1(idx, format == 3)
 	default:
 		err = ErrUnknownFormat
 	}
+	if err == nil {
+		err = f.checkOutput(o.maxOutput)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f.shardCount() != len(blocks) {
+		return nil, ErrShardCount
+	}
+	for i := range blocks {
+		if blocks[i], err = o.decrypt(blocks[i], true); err != nil {
+			return nil, err
+		}
+	}
+	f.codec = o.codec
+	f.ready = make(chan *rblock, o.readaheadBlocks(f.size))
 	go f.blockReader(blocks)
 
-	return f, err
+	return f, nil
 }
 
 // NewStreamReader returns a reader that will decode the supplied data stream.
 //
 // This is compatible content from the NewStreamWriter function.
 //
+// WithMaxReadahead can be used to limit the number of blocks decoded ahead.
+// Blocks that can be referenced by backreferences are kept
+// in memory regardless of this setting.
+//
 // When you are done with the Reader, use Close to release resources.
-func NewStreamReader(in io.Reader) (Reader, error) {
+func NewStreamReader(in io.Reader, opts ...ReaderOption) (Reader, error) {
+	var o readerOptions
+	if err := o.apply(opts); err != nil {
+		return nil, err
+	}
+	if o.codec != nil {
+		return nil, errors.New("dedup: compressed blocks not supported by stream reader")
+	}
 	f := &streamReader{
-		ready:        make(chan *rblock, 8), // Read up to 8 blocks ahead
 		closeReader:  make(chan struct{}, 0),
 		readerClosed: make(chan struct{}, 0),
 		curBlock:     0,
 	}
+	in, err := o.decrypt(in, true)
+	if err != nil {
+		return nil, err
+	}
 	br := bufio.NewReader(in)
 	format, err := binary.ReadUvarint(br)
 	if err != nil {
@@ -114,8 +234,8 @@ func NewStreamReader(in io.Reader) (Reader, error) {
 	}
 
 	switch format {
-	case 2:
-		err = f.readFormat2(br)
+	case 2, 4:
+		err = f.readFormat2(br, format == 4)
 		if err != nil {
 			return nil, err
 		}
@@ -123,6 +243,8 @@ func NewStreamReader(in io.Reader) (Reader, error) {
 		return nil, ErrUnknownFormat
 	}
 
+	f.maxOutput = o.maxOutput
+	f.ready = make(chan *rblock, o.readaheadBlocks(f.size))
 	go f.streamReader(br)
 
 	return f, nil
@@ -135,15 +257,26 @@ func NewStreamReader(in io.Reader) (Reader, error) {
 // No blocks will be kept in memory, but the block data input must be seekable.
 // The function will decode the index before returning.
 //
+// WithMaxReadahead can be used to limit the number of blocks read ahead.
+//
 // When you are done with the Reader, use Close to release resources.
-func NewSeekReader(index io.Reader, blocks io.ReadSeeker) (IndexedReader, error) {
+func NewSeekReader(index io.Reader, blocks io.ReadSeeker, opts ...ReaderOption) (IndexedReader, error) {
+	var o readerOptions
+	if err := o.apply(opts); err != nil {
+		return nil, err
+	}
+	if o.codec != nil {
+		return nil, errors.New("dedup: compressed blocks not supported by seek reader")
+	}
 	f := &reader{streamReader: streamReader{
-		ready:        make(chan *rblock, 8), // Read up to 8 blocks ahead
 		closeReader:  make(chan struct{}, 0),
 		readerClosed: make(chan struct{}, 0),
 		curBlock:     0,
-		maxLength:    8, // We have 8 blocks readahead.
 	}}
+	index, err := o.decrypt(index, !o.plainIndex)
+	if err != nil {
+		return nil, err
+	}
 	idx := bufio.NewReader(index)
 	format, err := binary.ReadUvarint(idx)
 	if err != nil {
@@ -151,30 +284,90 @@ func NewSeekReader(index io.Reader, blocks io.ReadSeeker) (IndexedReader, error)
 	}
 
 	switch format {
-	case 1:
-		err = f.readFormat1(idx)
+	case 1, 3:
+		err = f.readFormat1(idx, format == 3)
 	default:
 		err = ErrUnknownFormat
 	}
+	if err == nil {
+		err = f.checkOutput(o.maxOutput)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f.shardCount() != 1 {
+		return nil, ErrShardCount
+	}
+	if blocks, err = o.decryptSeeker(blocks); err != nil {
+		return nil, err
+	}
 
+	// Block lengths are known from the index, so the readahead
+	// is based on the largest block, not the maximum block size.
+	ahead := o.readaheadBlocks(f.largestBlock())
+	f.ready = make(chan *rblock, ahead)
+	// Only blocks read ahead are kept in memory.
+	f.maxLength = uint64(ahead)
+	if ahead == 0 {
+		f.maxLength = 1
+	}
 	go f.seekReader(blocks)
 
-	return f, err
+	return f, nil
 }
 
-// readFormat1 will read the index of format 1
+// readFormat1 will read the index of format 1 and 3
 // and prepare decoding
-func (f *reader) readFormat1(idx io.ByteReader) error {
+func (f *reader) readFormat1(idx io.ByteReader, flagged bool) error {
 	size, err := binary.ReadUvarint(idx)
 	if err != nil {
 		return err
 	}
+	if size < MinBlockSize {
+		return ErrSizeTooSmall
+	}
+	if size > MaxBlockSize {
+		return ErrSizeTooLarge
+	}
 	f.size = int(size)
+	if flagged {
+		err = f.readFlags(idx)
+		if err != nil {
+			return err
+		}
+	}
+	if f.flags&flagSharded != 0 {
+		n, err := binary.ReadUvarint(idx)
+		if err != nil {
+			return err
+		}
+		if n == 0 || n > maxShards {
+			return fmt.Errorf("invalid number of shards: %d", n)
+		}
+		f.shards = int(n)
+	}
+	if err := f.readConfig(idx); err != nil {
+		return err
+	}
+	if f.flags&flagFixedRecords != 0 {
+		err = f.readRecords(idx)
+	} else {
+		err = f.readBlocks(idx)
+	}
+	if err != nil {
+		return err
+	}
+	return f.readHistogram(idx)
+}
 
+// readBlocks will read the index entries of all blocks,
+// until the entry of the last block has been read.
+func (f *reader) readBlocks(idx io.ByteReader) error {
 	// Insert empty block 0
 	f.blocks = append(f.blocks, nil)
 	i := 0
-	var foffset int64
+	// Offset in each block stream.
+	foffset := make([]int64, f.shardCount())
 	// Read blocks
 	for {
 		i++
@@ -189,22 +382,31 @@ func (f *reader) readFormat1(idx io.ByteReader) error {
 			if err != nil {
 				return err
 			}
-			if r > size {
-				return fmt.Errorf("invalid size for block %d, %d > %d", i, r, size)
+			n, ok := f.blockSize(r)
+			if !ok {
+				return fmt.Errorf("invalid size for block %d, %d > %d", i, r, f.size)
 			}
-			f.blocks = append(f.blocks, &rblock{first: i, last: i, readData: int(size - r), offset: foffset})
-			foffset += int64(size - r)
+			shard, err := f.readShard(idx)
+			if err != nil {
+				return err
+			}
+			f.blocks = append(f.blocks, &rblock{first: i, last: i, readData: n, offset: foffset[shard], shard: shard, marker: f.isMarker(n)})
+			foffset[shard] += int64(n)
 		// Last block
 		case math.MaxUint64:
 			r, err := binary.ReadUvarint(idx)
 			if err != nil {
 				return err
 			}
-			if r > size {
-				return fmt.Errorf("invalid size for block %d, %d > %d", i, r, size)
+			n, ok := f.blockSize(r)
+			if !ok {
+				return fmt.Errorf("invalid size for block %d, %d > %d", i, r, f.size)
+			}
+			shard, err := f.readShard(idx)
+			if err != nil {
+				return err
 			}
-			f.blocks = append(f.blocks, &rblock{readData: int(size - r), offset: foffset})
-			foffset += int64(size - r)
+			f.blocks = append(f.blocks, &rblock{readData: n, offset: foffset[shard], shard: shard})
 			// Continuation should be 0
 			r, err = binary.ReadUvarint(idx)
 			if err != nil {
@@ -214,6 +416,23 @@ func (f *reader) readFormat1(idx io.ByteReader) error {
 				return fmt.Errorf("invalid continuation, should be 0, was %d", r)
 			}
 			return nil
+		// Delta block
+		case deltaMarker:
+			if f.flags&flagDelta == 0 {
+				return fmt.Errorf("unexpected delta block %d", i)
+			}
+			org, d, err := f.readDelta(idx, i)
+			if err != nil {
+				return err
+			}
+			d.shard, err = f.readShard(idx)
+			if err != nil {
+				return err
+			}
+			d.offset = foffset[d.shard]
+			foffset[d.shard] += int64(d.readData)
+			org.last = i
+			f.blocks = append(f.blocks, d)
 		// Deduplicated block
 		default:
 			pos := len(f.blocks) - int(offset)
@@ -228,9 +447,118 @@ func (f *reader) readFormat1(idx io.ByteReader) error {
 	}
 }
 
-// readFormat2 will read the header data of format 2
+// checkOutput will return ErrOutputTooLarge if the decoded
+// size of the blocks in the index exceeds max.
+func (f *reader) checkOutput(max int64) error {
+	if max <= 0 {
+		return nil
+	}
+	var n int64
+	for _, b := range f.blocks[1:] {
+		n += int64(b.size())
+		if n > max {
+			return ErrOutputTooLarge
+		}
+	}
+	return nil
+}
+
+// maxShards is the maximum number of shards accepted by readers.
+const maxShards = 1 << 16
+
+// shardCount returns the number of block streams of the index.
+func (f *reader) shardCount() int {
+	if f.shards == 0 {
+		return 1
+	}
+	return f.shards
+}
+
+// readShard will read the shard of a block, if the index is sharded.
+func (f *reader) readShard(idx io.ByteReader) (int, error) {
+	if f.shards == 0 {
+		return 0, nil
+	}
+	v, err := binary.ReadUvarint(idx)
+	if err != nil {
+		return 0, err
+	}
+	if v >= uint64(f.shards) {
+		return 0, fmt.Errorf("invalid shard %d, index has %d shards", v, f.shards)
+	}
+	return int(v), nil
+}
+
+// readDelta will read the definition of delta block i.
+// The base block is returned along with the delta block.
+// Chains of delta blocks longer than maxDeltaDepth are rejected,
+// so decoding a single block never reads more than a few blocks.
+func (f *reader) readDelta(idx io.ByteReader, i int) (base, delta *rblock, err error) {
+	var v [4]uint64
+	for j := range v {
+		v[j], err = binary.ReadUvarint(idx)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	offset, prefix, suffix, r := v[0], v[1], v[2], v[3]
+	// Writers never use bases further back than deltaWindow.
+	if offset == 0 || offset > deltaWindow || int(offset) >= len(f.blocks) {
+		return nil, nil, fmt.Errorf("invalid delta offset encountered at block %d, offset was %d", i, offset)
+	}
+	size := uint64(f.size)
+	base = f.blocks[len(f.blocks)-int(offset)]
+	if base.depth >= maxDeltaDepth {
+		return nil, nil, fmt.Errorf("delta chain too deep at block %d", i)
+	}
+	n, ok := f.blockSize(r)
+	if !ok || prefix > size || suffix > size ||
+		prefix+suffix > uint64(base.size()) || prefix+suffix+uint64(n) > size {
+		return nil, nil, fmt.Errorf("invalid size for delta block %d", i)
+	}
+	delta = &rblock{first: i, last: i, readData: n, base: base, depth: base.depth + 1, prefix: int(prefix), suffix: int(suffix)}
+	return base, delta, nil
+}
+
+// blockSize returns the size of a block from the stored length value.
+// false is returned if the value is invalid.
+func (f *streamReader) blockSize(v uint64) (int, bool) {
+	if v > uint64(f.size) {
+		return 0, false
+	}
+	if f.flags&flagExplicitLengths != 0 {
+		return int(v), true
+	}
+	return f.size - int(v), true
+}
+
+// isMarker returns true if a block of size n is an empty marker.
+func (f *streamReader) isMarker(n int) bool {
+	return n == 0 && f.flags&flagEmptyMarkers != 0
+}
+
+// HashVerifiable returns false if the block hash of the stream is unknown or not available.
+func (f *streamReader) HashVerifiable() bool {
+	return f.hashFunc() != nil
+}
+
+// readFlags will read the format flags
+// and check if they are supported.
+func (f *streamReader) readFlags(rd io.ByteReader) error {
+	flags, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return err
+	}
+	if flags&^(knownFlags|flagHashMask) != 0 {
+		return fmt.Errorf("unknown format flags: 0x%x", flags&^(knownFlags|flagHashMask))
+	}
+	f.flags = flags
+	return nil
+}
+
+// readFormat2 will read the header data of format 2 and 4
 // and stop at the first block.
-func (f *streamReader) readFormat2(rd io.ByteReader) error {
+func (f *streamReader) readFormat2(rd io.ByteReader, flagged bool) error {
 	size, err := binary.ReadUvarint(rd)
 	if err != nil {
 		return err
@@ -238,6 +566,9 @@ func (f *streamReader) readFormat2(rd io.ByteReader) error {
 	if size < MinBlockSize {
 		return ErrSizeTooSmall
 	}
+	if size > MaxBlockSize {
+		return ErrSizeTooLarge
+	}
 	f.size = int(size)
 
 	maxLength, err := binary.ReadUvarint(rd)
@@ -248,7 +579,18 @@ func (f *streamReader) readFormat2(rd io.ByteReader) error {
 		return ErrMaxMemoryTooSmall
 	}
 	f.maxLength = maxLength
-	return nil
+	if flagged {
+		if err := f.readFlags(rd); err != nil {
+			return err
+		}
+		if f.flags&flagSharded != 0 {
+			return errors.New("single streams cannot be sharded")
+		}
+		if f.flags&flagFixedRecords != 0 {
+			return errors.New("single streams cannot have fixed index records")
+		}
+	}
+	return f.readConfig(rd)
 }
 
 // Read will read from the input stream and return the
@@ -261,16 +603,17 @@ func (f *streamReader) Read(b []byte) (int, error) {
 			f.curBlock++
 			next, ok := <-f.ready
 			if !ok {
+				if err := f.merkle.end(); err != nil {
+					return read, err
+				}
 				return read, io.EOF
 			}
 			if next.err != nil {
 				return read, next.err
 			}
+			f.merkle.add(next.data, next.marker)
 			f.curData = next.data
-			// We don't want to keep it, if this is the last block
-			if f.curBlock == next.last {
-				next.data = nil
-			}
+			f.release(next)
 			if len(f.curData) == 0 {
 				continue
 			}
@@ -291,18 +634,16 @@ func (f *streamReader) WriteTo(w io.Writer) (int64, error) {
 	for {
 		next, ok := <-f.ready
 		if !ok {
-			return written, io.EOF
+			// Like io.Copy, reaching the end is not an error.
+			return written, f.merkle.end()
 		}
 		if next.err != nil {
 			return written, next.err
 		}
+		f.merkle.add(next.data, next.marker)
 		f.curBlock++
 		f.curData = next.data
-
-		// We don't want to keep it, if this is the last block
-		if f.curBlock == next.last {
-			next.data = nil
-		}
+		f.release(next)
 		n, err := w.Write(f.curData)
 		written += int64(n)
 		if err != nil {
@@ -311,9 +652,131 @@ func (f *streamReader) WriteTo(w io.Writer) (int64, error) {
 	}
 }
 
+// ReadBlock will read the rest of the current block into p,
+// or the next block if the current block has been read.
+func (f *streamReader) ReadBlock(p []byte) (int, error) {
+	for len(f.curData) == 0 {
+		next, ok := <-f.ready
+		if !ok {
+			if err := f.merkle.end(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		if next.err != nil {
+			return 0, next.err
+		}
+		f.merkle.add(next.data, next.marker)
+		f.curBlock++
+		f.curData = next.data
+		f.release(next)
+		if next.marker {
+			return 0, nil
+		}
+	}
+	if len(p) < len(f.curData) {
+		return 0, io.ErrShortBuffer
+	}
+	n := copy(p, f.curData)
+	f.curData = nil
+	return n, nil
+}
+
+// release will release the memory of the block, and the base
+// of a delta block, if this is the last time they are used.
+func (f *streamReader) release(b *rblock) {
+	// We don't want to keep it, if this is the last block
+	if f.curBlock == b.last {
+		b.data = nil
+	}
+	if b.base != nil && f.curBlock == b.base.last {
+		b.base.data = nil
+	}
+}
+
+// Decode will decode the supplied index and data stream,
+// and call onBlock with the content of each block in order.
+//
+// This is compatible content from the NewWriter function.
+//
+// The data supplied to onBlock may be referenced by later blocks,
+// so it must not be modified, and should be copied if it is retained.
+// If onBlock returns an error, decoding is stopped and the error is returned.
+func Decode(index, blocks io.Reader, onBlock func(data []byte) error) error {
+	r, err := NewReader(index, blocks)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return r.(*reader).forEachBlock(onBlock)
+}
+
+// DecodeStream will decode the supplied data stream,
+// and call onBlock with the content of each block in order.
+//
+// This is compatible content from the NewStreamWriter function.
+//
+// The data supplied to onBlock may be referenced by later blocks,
+// so it must not be modified, and should be copied if it is retained.
+// If onBlock returns an error, decoding is stopped and the error is returned.
+func DecodeStream(in io.Reader, onBlock func(data []byte) error) error {
+	r, err := NewStreamReader(in)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return r.(*streamReader).forEachBlock(onBlock)
+}
+
+// forEachBlock will call fn for each remaining block in the stream.
+// Empty blocks are skipped.
+func (f *streamReader) forEachBlock(fn func(data []byte) error) error {
+	for {
+		next, ok := <-f.ready
+		if !ok {
+			return f.merkle.end()
+		}
+		if next.err != nil {
+			return next.err
+		}
+		f.merkle.add(next.data, next.marker)
+		f.curBlock++
+		data := next.data
+		f.release(next)
+		if len(data) == 0 && !next.marker {
+			continue
+		}
+		if err := fn(data); err != nil {
+			return err
+		}
+	}
+}
+
+// MaxBlockSize returns the maximum block size of the stream.
+func (f *streamReader) MaxBlockSize() int {
+	return f.size
+}
+
+// MaxBackrefBlocks returns the maximum backreference distance of the stream.
+func (f *streamReader) MaxBackrefBlocks() int {
+	if f.flags&flagByteWindow != 0 {
+		return 0
+	}
+	return int(f.maxLength)
+}
+
+// MaxBackrefBlocks returns 0, since indexed streams
+// do not store the maximum backreference distance.
+func (f *reader) MaxBackrefBlocks() int {
+	return 0
+}
+
 // MaxMem returns the estimated maximum RAM usage needed to
 // unpack this content.
 func (f *streamReader) MaxMem() int {
+	if f.flags&flagByteWindow != 0 {
+		return int(f.maxLength) + f.size
+	}
 	if f.maxLength > 0 {
 		return int(f.maxLength) * f.size
 	}
@@ -329,14 +792,14 @@ func (f *reader) MaxMem() int {
 	for {
 		b := f.blocks[i]
 		if b.first == i {
-			curUse += b.readData
+			curUse += b.size()
 		}
 		if curUse > maxUse {
 			maxUse = curUse
 		}
 
 		if b.last == i {
-			curUse -= b.readData
+			curUse -= b.size()
 		}
 
 		i++
@@ -348,6 +811,17 @@ func (f *reader) MaxMem() int {
 	return maxUse
 }
 
+// largestBlock returns the size of the largest block in the stream.
+func (f *reader) largestBlock() int {
+	max := 0
+	for i := 1; i < len(f.blocks); i++ {
+		if n := f.blocks[i].size(); n > max {
+			max = n
+		}
+	}
+	return max
+}
+
 func (f *reader) BlockSizes() []int {
 	if len(f.blocks) < 2 {
 		return nil
@@ -355,7 +829,7 @@ func (f *reader) BlockSizes() []int {
 
 	ret := make([]int, len(f.blocks)-1)
 	for i, bl := range f.blocks[1:] {
-		ret[i] = bl.readData
+		ret[i] = bl.size()
 	}
 	return ret
 }
@@ -364,24 +838,32 @@ func (f *reader) BlockSizes() []int {
 // to the ready channel.
 // The function will return if the stream is finished,
 // or an error occurs
-func (f *reader) blockReader(in io.Reader) {
+func (f *reader) blockReader(in []io.Reader) {
 	defer close(f.readerClosed)
 	defer close(f.ready)
 
+	var comp []*compressedReader
+	if f.codec != nil {
+		for _, r := range in {
+			comp = append(comp, &compressedReader{r: bufio.NewReader(r), codec: f.codec})
+		}
+	}
+
 	i := 1 // Current block
 	totalRead := 0
 	for {
 		b := f.blocks[i]
 		// Read it?
-		if len(b.data) != b.readData {
-			b.data = make([]byte, b.readData)
-			n, err := io.ReadFull(in, b.data)
-			if err != nil {
-				b.err = err
-			} else if n != b.readData {
-				b.err = io.ErrUnexpectedEOF
+		if len(b.data) != b.size() {
+			if comp != nil {
+				b.data, b.err = comp[b.shard].readBlock(b.readData)
+			} else {
+				b.data, b.err = readBlock(in[b.shard], b.readData)
+			}
+			totalRead += len(b.data)
+			if b.err == nil && b.base != nil {
+				b.data, b.err = applyDelta(b.base.data, b.data, b.prefix, b.suffix)
 			}
-			totalRead += n
 		}
 		// Send or close
 		select {
@@ -410,14 +892,44 @@ func (f *streamReader) streamReader(stream *bufio.Reader) {
 	defer close(f.ready)
 
 	totalRead := 0
+	// Size of the decoded output.
+	var output int64
 
-	// Create backreference buffers
-	blocks := make([][]byte, f.maxLength)
-	for i := range blocks {
-		blocks[i] = make([]byte, f.size)
-	}
+	// Parameters of the current stream.
+	// When streams are concatenated, this is replaced for each stream.
+	hdr := f
 
+	// Backreference buffers.
+	// If the stream has a byte window, win is used instead of blocks.
+	var blocks [][]byte
+	var win *byteWindow
+	reset := func() {
+		blocks, win = nil, nil
+		if hdr.flags&flagByteWindow != 0 {
+			win = newByteWindow(int64(hdr.maxLength))
+			return
+		}
+		// The buffer grows as blocks are added,
+		// so a large maxLength doesn't allocate memory up front.
+		blocks = make([][]byte, 0, 16)
+	}
+	reset()
 	i := uint64(1) // Current block
+
+	// get returns block pos, if it can be referenced from the current block.
+	get := func(pos uint64) ([]byte, bool) {
+		if pos == 0 || pos >= i {
+			return nil, false
+		}
+		if win != nil {
+			return win.get(int(pos))
+		}
+		if i-pos > hdr.maxLength {
+			return nil, false
+		}
+		return blocks[pos%hdr.maxLength], true
+	}
+
 	for {
 		b := &rblock{}
 		lastBlock := false
@@ -425,7 +937,8 @@ func (f *streamReader) streamReader(stream *bufio.Reader) {
 		b.err = func() error {
 			offset, err := binary.ReadUvarint(stream)
 			if err != nil {
-				return err
+				// The stream must end with a last block.
+				return unexpectedEOF(err)
 			}
 			// Read it?
 			if offset == 0 || offset == math.MaxUint64 {
@@ -433,50 +946,80 @@ func (f *streamReader) streamReader(stream *bufio.Reader) {
 				if err != nil {
 					return err
 				}
-				size := f.size - int(s)
-				if offset == math.MaxUint64 && size == 0 {
+				size, ok := hdr.blockSize(s)
+				if ok && offset == math.MaxUint64 && size == 0 {
 					lastBlock = true
 					return nil
 				}
-				if size > f.size || size <= 0 {
-					return fmt.Errorf("invalid size encountered at block %d, size was %d", i, size)
+				if !ok || (size <= 0 && !hdr.isMarker(size)) {
+					return fmt.Errorf("invalid size encountered at block %d, size was %d", i, s)
 				}
-				b.data = make([]byte, size)
-				n, err := io.ReadFull(stream, b.data)
+				b.data, err = readBlock(stream, size)
 				if err != nil {
 					return err
-				} else if n != len(b.data) {
-					return io.ErrUnexpectedEOF
 				}
-				totalRead += n
+				totalRead += len(b.data)
 				if offset == math.MaxUint64 {
 					lastBlock = true
 				}
-			} else {
-				if offset > f.maxLength {
-					return fmt.Errorf("invalid offset encountered at block %d, offset was %d", i, offset)
+			} else if offset == deltaMarker && hdr.flags&flagDelta != 0 {
+				var v [4]uint64
+				for j := range v {
+					v[j], err = binary.ReadUvarint(stream)
+					if err != nil {
+						return err
+					}
+				}
+				offset, prefix, suffix, s := v[0], v[1], v[2], v[3]
+				base, ok := get(i - offset)
+				if !ok {
+					return fmt.Errorf("invalid delta offset encountered at block %d, offset was %d", i, offset)
 				}
-				pos := i - offset
-				if pos <= 0 {
+				max := uint64(hdr.size)
+				size, ok := hdr.blockSize(s)
+				if !ok || prefix > max || suffix > max || prefix+suffix+uint64(size) > max {
+					return fmt.Errorf("invalid size encountered at delta block %d", i)
+				}
+				lit, err := readBlock(stream, size)
+				if err != nil {
+					return err
+				}
+				totalRead += len(lit)
+				b.data, err = applyDelta(base, lit, int(prefix), int(suffix))
+				if err != nil {
+					return err
+				}
+			} else {
+				src, ok := get(i - offset)
+				if !ok {
 					return fmt.Errorf("invalid offset encountered at block %d, offset was %d", i, offset)
 				}
-				src := blocks[pos%f.maxLength]
 				b.data = src
 			}
+			b.marker = !lastBlock && hdr.isMarker(len(b.data))
 
-			blocks[i%f.maxLength] = b.data
+			if win != nil {
+				win.add(int(i), len(b.data), b.data)
+			} else {
+				pos := i % hdr.maxLength
+				if pos >= uint64(len(blocks)) {
+					blocks = append(blocks, make([][]byte, pos-uint64(len(blocks))+1)...)
+				}
+				blocks[pos] = b.data
+			}
 			return nil
 		}()
-		// Read continuation
-		if lastBlock {
-			r, err := binary.ReadUvarint(stream)
-			if err != nil {
-				b.err = err
-			}
-			if r != 0 {
-				b.err = fmt.Errorf("invalid continuation, should be 0, was %d", r)
+		if b.err == nil && f.maxOutput > 0 {
+			output += int64(len(b.data))
+			if output > f.maxOutput {
+				b.data, b.err = nil, ErrOutputTooLarge
 			}
 		}
+		// Read continuation
+		var next *streamReader
+		if lastBlock && b.err == nil {
+			next, b.err = readContinuation(stream)
+		}
 
 		// Send or close
 		select {
@@ -485,13 +1028,57 @@ func (f *streamReader) streamReader(stream *bufio.Reader) {
 		case f.ready <- b:
 		}
 		// Exit because of an error
-		if b.err != nil || lastBlock {
+		if b.err != nil || (lastBlock && next == nil) {
 			return
 		}
+		if lastBlock {
+			// Start decoding the next stream.
+			hdr = next
+			i = 1
+			reset()
+			continue
+		}
 		i++
 	}
 }
 
+// readContinuation will read the stream continuation value
+// and the header of the following stream, if any.
+// If no stream follows, nil is returned.
+// A stream may follow a continuation value of 0, which allows
+// independently written streams to be concatenated.
+// A continuation value of 1 indicates that another stream must follow.
+func readContinuation(stream *bufio.Reader) (*streamReader, error) {
+	r, err := binary.ReadUvarint(stream)
+	if err != nil {
+		return nil, err
+	}
+	if r > 1 {
+		return nil, fmt.Errorf("invalid continuation, should be 0 or 1, was %d", r)
+	}
+	if _, err := stream.Peek(1); err == io.EOF {
+		if r == 1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, nil
+	}
+	format, err := binary.ReadUvarint(stream)
+	if err != nil {
+		return nil, err
+	}
+	next := &streamReader{}
+	switch format {
+	case 2, 4:
+		err = next.readFormat2(stream, format == 4)
+	default:
+		err = ErrUnknownFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
 // seekReader will read format 1 blocks and deliver them
 // to the ready channel.
 // The function will return if the stream is finished,
@@ -502,30 +1089,15 @@ func (f *reader) seekReader(in io.ReadSeeker) {
 
 	i := 1 // Current block
 	var foffset int64
+	var last lastBlock
 	for {
 		// Copy b, we are modifying it.
 		b := *f.blocks[i]
-
-		// Seek to offset if needed, and
-		if b.offset != foffset {
-			_, err := in.Seek(b.offset, 0)
-			if err != nil {
-				b.err = err
-			}
-		}
-		if b.err == nil {
-			b.data = make([]byte, b.readData)
-			n, err := io.ReadFull(in, b.data)
-			if err != nil {
-				b.err = err
-			} else if n != b.readData {
-				b.err = io.ErrUnexpectedEOF
-			}
-			foffset = b.offset + int64(n)
-		}
+		b.data, b.err = seekBlock(in, f.blocks[i], &foffset, &last)
 
 		// Always release the memory of this block
 		b.last = i
+		b.base = nil
 
 		// Send or close
 		select {
@@ -545,6 +1117,52 @@ func (f *reader) seekReader(in io.ReadSeeker) {
 	}
 }
 
+// lastBlock is the most recently decoded block.
+// It is kept since it is often the base of the next delta block.
+type lastBlock struct {
+	b    *rblock
+	data []byte
+}
+
+// seekBlock will read the content of a single block from in.
+// The base of delta blocks will be read first, unless it is last.
+// foffset must contain the current offset of in,
+// and will be updated. last is updated to b.
+func seekBlock(in io.ReadSeeker, b *rblock, foffset *int64, last *lastBlock) ([]byte, error) {
+	var base []byte
+	if b.base != nil {
+		if last.b == b.base {
+			base = last.data
+		} else {
+			var err error
+			base, err = seekBlock(in, b.base, foffset, last)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	// Seek to offset if needed
+	if b.offset != *foffset {
+		_, err := in.Seek(b.offset, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	data, err := readBlock(in, b.readData)
+	if err != nil {
+		return nil, err
+	}
+	*foffset = b.offset + int64(len(data))
+	if b.base != nil {
+		data, err = applyDelta(base, data, b.prefix, b.suffix)
+		if err != nil {
+			return nil, err
+		}
+	}
+	last.b, last.data = b, data
+	return data, nil
+}
+
 // Close the reader and shut down the running goroutines.
 func (f *streamReader) Close() error {
 	select {
@@ -554,3 +1172,29 @@ func (f *streamReader) Close() error {
 	}
 	return nil
 }
+
+// readBlock will read n bytes from r.
+// Memory for large blocks is allocated as data is read,
+// so an invalid size in the stream will not cause a large allocation.
+func readBlock(r io.Reader, n int) ([]byte, error) {
+	if n <= 1<<20 {
+		data := make([]byte, n)
+		_, err := io.ReadFull(r, data)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	var buf bytes.Buffer
+	m, err := io.CopyN(&buf, r, int64(n))
+	if m != int64(n) && (err == nil || err == io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -2,8 +2,12 @@ package dedup_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"io"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"io/ioutil"
 
@@ -305,6 +309,757 @@ func TestReaderWriteTo(t *testing.T) {
 	}
 }
 
+func TestEmptyInput(t *testing.T) {
+	const size = 4 << 10
+	for _, mode := range []dedup.Mode{dedup.ModeFixed, dedup.ModeDynamic, dedup.ModeDynamicEntropy, dedup.ModeAdaptive, dedup.ModeDynamicFastCDC} {
+		idx := bytes.Buffer{}
+		data := bytes.Buffer{}
+		w, err := dedup.NewWriter(&idx, &data, mode, size, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data.Len() != 0 {
+			t.Fatal("expected no data, got", data.Len())
+		}
+		if w.Blocks() != 0 {
+			t.Fatal("expected no blocks, got", w.Blocks())
+		}
+
+		r, err := dedup.NewReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != 0 {
+			t.Fatal("expected no output, got", len(out))
+		}
+		if r.MaxMem() != 0 {
+			t.Fatal("expected no memory use, got", r.MaxMem())
+		}
+		r.Close()
+
+		r, err = dedup.NewSeekReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err = ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != 0 {
+			t.Fatal("expected no output, got", len(out))
+		}
+		r.Close()
+
+		stream := bytes.Buffer{}
+		w, err = dedup.NewStreamWriter(&stream, mode, size, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sr, err := dedup.NewStreamReader(&stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err = ioutil.ReadAll(sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != 0 {
+			t.Fatal("expected no output, got", len(out))
+		}
+		sr.Close()
+
+		frags := make(chan dedup.Fragment)
+		w, err = dedup.NewSplitter(frags, mode, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go w.Close()
+		for f := range frags {
+			t.Fatal("unexpected fragment", f.N)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(10<<20 + 65).Bytes()
+	for i := 0; i < 50; i++ {
+		copy(b[(10+i)*size:(11+i)*size], b[(i%10)*size:(i%10+1)*size])
+	}
+
+	idx := bytes.Buffer{}
+	data := bytes.Buffer{}
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeDynamic, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := bytes.Buffer{}
+	w, err = dedup.NewStreamWriter(&stream, dedup.ModeDynamic, size, 100*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := bytes.Buffer{}
+	blocks := 0
+	err = dedup.Decode(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()), func(data []byte) error {
+		if len(data) > size {
+			t.Fatal("block too big", len(data))
+		}
+		blocks++
+		out.Write(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, out.Bytes()) {
+		t.Fatal("Output mismatch")
+	}
+	t.Log("Decoded", blocks, "blocks")
+
+	out.Reset()
+	err = dedup.DecodeStream(bytes.NewReader(stream.Bytes()), func(data []byte) error {
+		out.Write(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, out.Bytes()) {
+		t.Fatal("Stream output mismatch")
+	}
+
+	// Abort after 10 blocks
+	errAbort := errors.New("abort")
+	n := 0
+	err = dedup.Decode(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()), func(data []byte) error {
+		n++
+		if n == 10 {
+			return errAbort
+		}
+		return nil
+	})
+	if err != errAbort {
+		t.Fatal("expected abort error, got", err)
+	}
+	if n != 10 {
+		t.Fatal("expected 10 blocks, got", n)
+	}
+}
+
+func TestExplicitLengths(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(10<<20 + 65).Bytes()
+	for i := 0; i < 50; i++ {
+		copy(b[(10+i)*size:(11+i)*size], b[(i%10)*size:(i%10+1)*size])
+	}
+
+	for _, mode := range []dedup.Mode{dedup.ModeFixed, dedup.ModeDynamic} {
+		idx := bytes.Buffer{}
+		data := bytes.Buffer{}
+		w, err := dedup.NewWriter(&idx, &data, mode, size, 0, dedup.WithExplicitLengths(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(w, bytes.NewBuffer(b))
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Log("Index size:", idx.Len())
+
+		r, err := dedup.NewSeekReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, out) {
+			t.Fatal("Output mismatch")
+		}
+
+		stream := bytes.Buffer{}
+		w, err = dedup.NewStreamWriter(&stream, mode, size, 100*size, dedup.WithExplicitLengths(true), dedup.WithDeltaEncoding(0.5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(w, bytes.NewBuffer(b))
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sr, err := dedup.NewStreamReader(&stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err = ioutil.ReadAll(sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, out) {
+			t.Fatal("Stream output mismatch")
+		}
+	}
+}
+
+func TestReaderParameters(t *testing.T) {
+	const size = 64 << 10
+	const maxBlocks = 10
+	data := bytes.Buffer{}
+	w, err := dedup.NewStreamWriter(&data, dedup.ModeFixed, size, maxBlocks*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, getBufferSize(1<<20))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := dedup.NewStreamReader(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got := r.MaxBlockSize(); got != size {
+		t.Fatalf("max block size, expected %d, got %d", size, got)
+	}
+	if got := r.MaxBackrefBlocks(); got != maxBlocks {
+		t.Fatalf("max backref blocks, expected %d, got %d", maxBlocks, got)
+	}
+
+	// The stream reader may still be reading data.
+	idx := bytes.Buffer{}
+	blocks := bytes.Buffer{}
+	w, err = dedup.NewWriter(&idx, &blocks, dedup.ModeFixed, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, getBufferSize(1<<20))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir, err := dedup.NewReader(&idx, &blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ir.Close()
+	if got := ir.MaxBlockSize(); got != size {
+		t.Fatalf("max block size, expected %d, got %d", size, got)
+	}
+	if got := ir.MaxBackrefBlocks(); got != 0 {
+		t.Fatalf("max backref blocks, expected 0, got %d", got)
+	}
+}
+
+func TestConcatenatedStreams(t *testing.T) {
+	const size = 64 << 10
+	var want []byte
+	out := bytes.Buffer{}
+	for i := 0; i < 3; i++ {
+		b := getBufferSize(1<<20 + i*1000).Bytes()
+		want = append(want, b...)
+		// Use different parameters for each stream.
+		w, err := dedup.NewStreamWriter(&out, dedup.ModeFixed, uint(size<<uint(i)), uint(10*size), dedup.WithContinuation(i < 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(w, bytes.NewBuffer(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream := out.Bytes()
+	r, err := dedup.NewStreamReader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if !bytes.Equal(want, got) {
+		t.Fatal("output mismatch")
+	}
+
+	// Streams without continuation can also be joined.
+	single := bytes.Buffer{}
+	w, err := dedup.NewStreamWriter(&single, dedup.ModeFixed, size, 10*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(want[:1<<20]))
+	w.Close()
+	joined := append(append([]byte{}, single.Bytes()...), single.Bytes()...)
+	r, err = dedup.NewStreamReader(bytes.NewReader(joined))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if !bytes.Equal(append(want[:1<<20:1<<20], want[:1<<20]...), got) {
+		t.Fatal("joined output mismatch")
+	}
+
+	// A missing stream after continuation should fail.
+	single.Reset()
+	w, err = dedup.NewStreamWriter(&single, dedup.ModeFixed, size, 10*size, dedup.WithContinuation(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(want[:1<<20]))
+	w.Close()
+	r, err = dedup.NewStreamReader(&single)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(r)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+	r.Close()
+}
+
+// atomicCountReader counts the bytes read from r.
+type atomicCountReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *atomicCountReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func TestMaxReadahead(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(4 << 20).Bytes()
+	var stream, idx, data bytes.Buffer
+	w, err := dedup.NewStreamWriter(&stream, dedup.ModeFixed, size, 10*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w, err = dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// readAhead returns the number of bytes read from the input
+	// after reading a single byte from the reader.
+	readAhead := func(opts ...dedup.ReaderOption) int64 {
+		in := &atomicCountReader{r: bytes.NewReader(stream.Bytes())}
+		r, err := dedup.NewStreamReader(in, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		var tmp [1]byte
+		if _, err := r.Read(tmp[:]); err != nil {
+			t.Fatal(err)
+		}
+		// Allow the decoder to read ahead.
+		time.Sleep(50 * time.Millisecond)
+		return atomic.LoadInt64(&in.n)
+	}
+	// Current block, one waiting to be sent, and one read buffer.
+	if n := readAhead(dedup.WithMaxReadahead(0)); n > 3*size {
+		t.Errorf("read %d bytes ahead with no readahead", n)
+	}
+	if n := readAhead(dedup.WithMaxReadahead(2 * size)); n > 5*size {
+		t.Errorf("read %d bytes ahead with 2 blocks readahead", n)
+	}
+	t.Log("Default readahead:", readAhead())
+
+	_, err = dedup.NewStreamReader(bytes.NewReader(stream.Bytes()), dedup.WithMaxReadahead(-1))
+	if err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+
+	// Output must be unaffected.
+	opt := dedup.WithMaxReadahead(size)
+	readers := map[string]func() (dedup.Reader, error){
+		"stream": func() (dedup.Reader, error) {
+			return dedup.NewStreamReader(bytes.NewReader(stream.Bytes()), opt)
+		},
+		"indexed": func() (dedup.Reader, error) {
+			return dedup.NewReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()), opt)
+		},
+		"seek": func() (dedup.Reader, error) {
+			return dedup.NewSeekReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()), opt)
+		},
+	}
+	for name, fn := range readers {
+		r, err := fn()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !bytes.Equal(b, out) {
+			t.Fatal(name, "output mismatch")
+		}
+		r.Close()
+	}
+}
+
+// countSeeker counts the bytes read from a bytes.Reader.
+type countSeeker struct {
+	*bytes.Reader
+	n int64
+}
+
+func (c *countSeeker) Read(b []byte) (int, error) {
+	n, err := c.Reader.Read(b)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func TestSeekReaderSmallBlocks(t *testing.T) {
+	const maxSize = 4 << 20
+	const size = 4 << 10
+	b := getBufferSize(100 * size).Bytes()
+	var idx, data bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, maxSize, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(b); i += size {
+		w.Write(b[i : i+size])
+		w.Split()
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The readahead is based on the block sizes, not maxSize.
+	in := &countSeeker{Reader: bytes.NewReader(data.Bytes())}
+	r, err := dedup.NewSeekReader(bytes.NewReader(idx.Bytes()), in, dedup.WithMaxReadahead(4*size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var tmp [1]byte
+	if _, err := r.Read(tmp[:]); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && atomic.LoadInt64(&in.n) < 4*size; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&in.n); n < 4*size || n > 7*size {
+		t.Errorf("read %d bytes ahead, expected about 4 blocks of %d bytes", n, size)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b[1:], out) {
+		t.Fatal("output mismatch")
+	}
+}
+
+func TestReadBlock(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(1<<20 + 100).Bytes()
+	// Create some duplicates
+	copy(b[512<<10:], b[:256<<10])
+	var stream bytes.Buffer
+	w, err := dedup.NewStreamWriter(&stream, dedup.ModeDynamic, size, 64*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := dedup.NewStreamReader(bytes.NewReader(stream.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// Start with a Read ending inside a block.
+	got := make([]byte, 100)
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+	small := make([]byte, 1)
+	if _, err := r.ReadBlock(small); err != io.ErrShortBuffer {
+		t.Fatal("expected io.ErrShortBuffer, got", err)
+	}
+	buf := make([]byte, r.MaxBlockSize())
+	for {
+		n, err := r.ReadBlock(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 || n > size {
+			t.Fatal("unexpected block size", n)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(b, got) {
+		t.Fatal("Output mismatch")
+	}
+}
+
+func TestUnknownHash(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(256 << 10).Bytes()
+	// Create some duplicates
+	copy(b[128<<10:], b[:64<<10])
+	var stream bytes.Buffer
+	w, err := dedup.NewStreamWriter(&stream, dedup.ModeFixed, size, 16*size, dedup.WithLengthInHash(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := w.Header()
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	// Replace the flags at the end of the header with an unknown hash ID.
+	if hdr[len(hdr)-1] != 0x4 {
+		t.Fatalf("unexpected flags 0x%x", hdr[len(hdr)-1])
+	}
+	withFlags := func(flags uint64) []byte {
+		var tmp [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(tmp[:], flags)
+		b := append([]byte{}, hdr[:len(hdr)-1]...)
+		b = append(b, tmp[:n]...)
+		return append(b, stream.Bytes()[len(hdr):]...)
+	}
+	future := withFlags(0xff04)
+
+	r, err := dedup.NewStreamReader(bytes.NewReader(future))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.HashVerifiable() {
+		t.Fatal("expected hash to be unverifiable")
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if !bytes.Equal(b, out) {
+		t.Fatal("Output mismatch")
+	}
+
+	frags := make(chan dedup.Fragment)
+	err = dedup.DecodeStreamFragments(bytes.NewReader(future), frags)
+	if err != dedup.ErrUnknownHash {
+		t.Fatal("expected ErrUnknownHash, got", err)
+	}
+	if _, ok := <-frags; ok {
+		t.Fatal("expected no fragments")
+	}
+
+	var dump bytes.Buffer
+	if err := dedup.DumpIndex(bytes.NewReader(future), &dump); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(dump.Bytes(), []byte("unavailable block hash hash-255")) {
+		t.Fatal("unknown hash not dumped")
+	}
+
+	// Other unknown flags must still be rejected.
+	if _, err := dedup.NewStreamReader(bytes.NewReader(withFlags(1<<20 | 0x4))); err == nil {
+		t.Fatal("expected error on unknown flags")
+	}
+
+	r, err = dedup.NewStreamReader(bytes.NewReader(stream.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if !r.HashVerifiable() {
+		t.Fatal("expected SHA-1 hash to be verifiable")
+	}
+}
+
+func TestMaxOutput(t *testing.T) {
+	const size = 4 << 10
+	// A small stream with a large output.
+	b := bytes.Repeat(getBufferSize(size).Bytes(), 1000)
+	var idx, data, stream bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	w, err = dedup.NewStreamWriter(&stream, dedup.ModeFixed, size, 10*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	const limit = 1 << 20
+
+	r, err := dedup.NewStreamReader(bytes.NewReader(stream.Bytes()), dedup.WithMaxOutput(limit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != dedup.ErrOutputTooLarge {
+		t.Fatal("expected ErrOutputTooLarge, got", err)
+	}
+	r.Close()
+	if len(out) != limit || !bytes.Equal(out, b[:limit]) {
+		t.Fatal("unexpected output size", len(out))
+	}
+
+	if _, err := dedup.NewReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()), dedup.WithMaxOutput(limit)); err != dedup.ErrOutputTooLarge {
+		t.Fatal("expected ErrOutputTooLarge, got", err)
+	}
+	if _, err := dedup.NewSeekReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()), dedup.WithMaxOutput(limit)); err != dedup.ErrOutputTooLarge {
+		t.Fatal("expected ErrOutputTooLarge, got", err)
+	}
+	if _, err := dedup.NewReaderAt(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()), dedup.WithMaxOutput(limit)); err != dedup.ErrOutputTooLarge {
+		t.Fatal("expected ErrOutputTooLarge, got", err)
+	}
+
+	// Streams within the limit are decoded.
+	r, err = dedup.NewStreamReader(bytes.NewReader(stream.Bytes()), dedup.WithMaxOutput(int64(len(b))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if !bytes.Equal(b, out) {
+		t.Fatal("Output mismatch")
+	}
+	ir, err := dedup.NewReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()), dedup.WithMaxOutput(int64(len(b))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir.Close()
+
+	if _, err := dedup.NewStreamReader(bytes.NewReader(stream.Bytes()), dedup.WithMaxOutput(-1)); err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+}
+
+func TestDecodeExactMultiple(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(64 * size).Bytes()
+	var idx, data, stream bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w, err = dedup.NewStreamWriter(&stream, dedup.ModeFixed, size, 64*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The empty last block must not be delivered.
+	var got []byte
+	onBlock := func(data []byte) error {
+		if len(data) != size {
+			t.Errorf("unexpected block size %d", len(data))
+		}
+		got = append(got, data...)
+		return nil
+	}
+	if err := dedup.Decode(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()), onBlock); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, got) {
+		t.Fatal("Decode output mismatch")
+	}
+	got = got[:0]
+	if err := dedup.DecodeStream(bytes.NewReader(stream.Bytes()), onBlock); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, got) {
+		t.Fatal("DecodeStream output mismatch")
+	}
+
+	sr, err := dedup.NewSeekReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, out) {
+		t.Fatal("NewSeekReader output mismatch")
+	}
+	sr.Close()
+	ra, err := dedup.NewReaderAt(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra.Size() != int64(len(b)) {
+		t.Fatalf("expected size %d, got %d", len(b), ra.Size())
+	}
+	var tmp [1]byte
+	if n, err := ra.ReadAt(tmp[:], int64(len(b))); n != 0 || err != io.EOF {
+		t.Fatalf("expected io.EOF at end, got %d, %v", n, err)
+	}
+}
+
 // Indexed stream, 10MB input, 64K blocks
 func BenchmarkReader64K(t *testing.B) {
 	idx := &bytes.Buffer{}
@@ -709,3 +1464,69 @@ func ExampleNewStreamReader() {
 	// Returned data length: 50000
 	// Everything zero: true
 }
+
+// readBlockStream returns a stream with 4K blocks of 10MB data.
+func readBlockStream(t *testing.B) []byte {
+	const size = 4 << 10
+	b := getBufferSize(10 << 20).Bytes()
+	// Create some duplicates
+	copy(b[5<<20:], b[:2<<20])
+	var data bytes.Buffer
+	w, err := dedup.NewStreamWriter(&data, dedup.ModeFixed, size, 1000*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return data.Bytes()
+}
+
+// Read loop with a buffer of the block size.
+func BenchmarkReaderStreamRead4K(t *testing.B) {
+	stream := readBlockStream(t)
+	t.ResetTimer()
+	t.SetBytes(10 << 20)
+	for i := 0; i < t.N; i++ {
+		r, err := dedup.NewStreamReader(bytes.NewReader(stream))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, r.MaxBlockSize())
+		for {
+			_, err := r.Read(buf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		r.Close()
+	}
+}
+
+// ReadBlock loop with a buffer of the block size.
+func BenchmarkReaderStreamReadBlock4K(t *testing.B) {
+	stream := readBlockStream(t)
+	t.ResetTimer()
+	t.SetBytes(10 << 20)
+	for i := 0; i < t.N; i++ {
+		r, err := dedup.NewStreamReader(bytes.NewReader(stream))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, r.MaxBlockSize())
+		for {
+			_, err := r.ReadBlock(buf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		r.Close()
+	}
+}
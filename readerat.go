@@ -0,0 +1,217 @@
+package dedup
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+)
+
+// A ReaderAt gives random access to the content of an indexed stream.
+// It is safe for concurrent use.
+type ReaderAt interface {
+	io.ReaderAt
+
+	// Size returns the size of the decoded content.
+	Size() int64
+}
+
+type readerAt struct {
+	idx    reader
+	in     io.ReaderAt
+	starts []int64 // Decoded offset of each block. Index 0 is the first block.
+	size   int64
+	cache  *blockCache
+
+	lastMu sync.Mutex
+	last   lastBlock // The most recently decoded block.
+}
+
+// NewReaderAt returns a reader that gives random access to the supplied index and data stream.
+//
+// This is compatible content from the NewWriter function.
+// The function will decode the index before returning.
+// Blocks are read from the data stream as they are needed,
+// so the data stream must be safe for concurrent use if ReadAt
+// is called concurrently.
+//
+// Use WithBlockCache to keep recently used blocks in memory.
+func NewReaderAt(index io.Reader, blocks io.ReaderAt, opts ...ReaderOption) (ReaderAt, error) {
+	var o readerOptions
+	if err := o.apply(opts); err != nil {
+		return nil, err
+	}
+	if o.codec != nil {
+		return nil, errors.New("dedup: compressed blocks not supported by ReaderAt")
+	}
+	index, err := o.decrypt(index, !o.plainIndex)
+	if err != nil {
+		return nil, err
+	}
+	if blocks, err = o.decryptReaderAt(blocks); err != nil {
+		return nil, err
+	}
+	f := &readerAt{in: blocks}
+	idx := bufio.NewReader(index)
+	format, err := binary.ReadUvarint(idx)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case 1, 3:
+		err = f.idx.readFormat1(idx, format == 3)
+	default:
+		err = ErrUnknownFormat
+	}
+	if err == nil {
+		err = f.idx.checkOutput(o.maxOutput)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f.idx.shardCount() != 1 {
+		return nil, ErrShardCount
+	}
+	// Skip the empty block 0.
+	blks := f.idx.blocks[1:]
+	f.starts = make([]int64, len(blks))
+	for i, b := range blks {
+		f.starts[i] = f.size
+		f.size += int64(b.size())
+	}
+	if o.blockCache > 0 {
+		f.cache = newBlockCache(o.blockCache)
+	}
+	return f, nil
+}
+
+// Size returns the size of the decoded content.
+func (f *readerAt) Size() int64 {
+	return f.size
+}
+
+// ReadAt reads len(p) bytes of decoded content starting at offset off.
+func (f *readerAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("dedup: negative offset")
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	// Find the block containing off.
+	i := sort.Search(len(f.starts), func(i int) bool { return f.starts[i] > off }) - 1
+	blks := f.idx.blocks[1:]
+	for n < len(p) && i < len(blks) {
+		data, err := f.block(blks[i])
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[off+int64(n)-f.starts[i]:])
+		i++
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// block returns the decoded content of b.
+// The returned data must not be modified.
+func (f *readerAt) block(b *rblock) ([]byte, error) {
+	if f.cache != nil {
+		if data, ok := f.cache.get(b); ok {
+			return data, nil
+		}
+	}
+	var base []byte
+	if b.base != nil {
+		f.lastMu.Lock()
+		if f.last.b == b.base {
+			base = f.last.data
+		}
+		f.lastMu.Unlock()
+	}
+	if b.base != nil && base == nil {
+		var err error
+		base, err = f.block(b.base)
+		if err != nil {
+			return nil, err
+		}
+	}
+	data := make([]byte, b.readData)
+	n, err := f.in.ReadAt(data, b.offset)
+	if n == len(data) {
+		err = nil
+	} else if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b.base != nil {
+		data, err = applyDelta(base, data, b.prefix, b.suffix)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if f.cache != nil {
+		f.cache.add(b, data)
+	}
+	f.lastMu.Lock()
+	f.last.b, f.last.data = b, data
+	f.lastMu.Unlock()
+	return data, nil
+}
+
+// blockCache is a least recently used cache of decoded blocks.
+type blockCache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[*rblock]*list.Element
+	lru     *list.List // Most recently used first.
+}
+
+type cacheEntry struct {
+	b    *rblock
+	data []byte
+}
+
+func newBlockCache(n int) *blockCache {
+	return &blockCache{
+		max:     n,
+		entries: make(map[*rblock]*list.Element, n),
+		lru:     list.New(),
+	}
+}
+
+// get returns the data of b, if it is in the cache.
+func (c *blockCache) get(b *rblock) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[b]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).data, true
+}
+
+// add will add the data of b to the cache,
+// and evict the least recently used block if the cache is full.
+func (c *blockCache) add(b *rblock, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[b]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[b] = c.lru.PushFront(&cacheEntry{b: b, data: data})
+	for c.lru.Len() > c.max {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*cacheEntry).b)
+	}
+}
@@ -0,0 +1,102 @@
+package dedup_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+// Returns an index and data stream of the versioned documents, along with the input.
+func getIndexedStream(t testing.TB) (idx, data, input []byte) {
+	const size = 4 << 10
+	b := getVersionedDocuments(1<<20, 8, 50)
+	var ib, db bytes.Buffer
+	w, err := dedup.NewWriter(&ib, &db, dedup.ModeDynamic, size, 0, dedup.WithDeltaEncoding(0.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ib.Bytes(), db.Bytes(), b
+}
+
+func TestReaderAt(t *testing.T) {
+	idx, data, b := getIndexedStream(t)
+	for _, opts := range [][]dedup.ReaderOption{nil, {dedup.WithBlockCache(16)}} {
+		r, err := dedup.NewReaderAt(bytes.NewReader(idx), bytes.NewReader(data), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Size() != int64(len(b)) {
+			t.Fatalf("expected size %d, got %d", len(b), r.Size())
+		}
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				rng := rand.New(rand.NewSource(int64(g)))
+				buf := make([]byte, 100<<10)
+				for i := 0; i < 100; i++ {
+					off := rng.Int63n(int64(len(b)))
+					n, err := r.ReadAt(buf[:rng.Intn(len(buf))+1], off)
+					if err != nil && err != io.EOF {
+						t.Error(err)
+						return
+					}
+					if !bytes.Equal(buf[:n], b[off:off+int64(n)]) {
+						t.Errorf("mismatch at offset %d", off)
+						return
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+
+		// Read past the end.
+		buf := make([]byte, 100)
+		n, err := r.ReadAt(buf, int64(len(b)-50))
+		if n != 50 || err != io.EOF {
+			t.Fatalf("expected 50 bytes and io.EOF, got %d, %v", n, err)
+		}
+		_, err = r.ReadAt(buf, int64(len(b)))
+		if err != io.EOF {
+			t.Fatal("expected io.EOF, got", err)
+		}
+	}
+}
+
+func benchmarkReaderAt(t *testing.B, opts ...dedup.ReaderOption) {
+	idx, data, b := getIndexedStream(t)
+	r, err := dedup.NewReaderAt(bytes.NewReader(idx), bytes.NewReader(data), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(0))
+	buf := make([]byte, 64<<10)
+	t.ResetTimer()
+	t.SetBytes(int64(len(buf)))
+	for i := 0; i < t.N; i++ {
+		_, err := r.ReadAt(buf, rng.Int63n(int64(len(b)-len(buf))))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Random 64K ranges of versioned documents.
+func BenchmarkReaderAt(t *testing.B) {
+	benchmarkReaderAt(t)
+}
+
+// Random 64K ranges of versioned documents, with 1024 blocks cached.
+func BenchmarkReaderAtCache(t *testing.B) {
+	benchmarkReaderAt(t, dedup.WithBlockCache(1024))
+}
@@ -0,0 +1,72 @@
+package dedup
+
+import (
+	"bufio"
+	"io"
+)
+
+// Rechunk will decode a stream and encode the content again
+// with a new mode, maximum block size and maximum memory.
+//
+// If blocks is nil, index is read as a single stream written by NewStreamWriter,
+// otherwise as the index and block stream written by NewWriter.
+// Similarly, if outBlocks is nil, a single stream is written to outIndex,
+// otherwise the output is written as an index and a block stream.
+// The options are applied to the new writer.
+//
+// The content is passed through as it is decoded, so memory use is bounded
+// by the memory needed to decode the input and the memory of the new writer.
+// The size of the input and output streams is returned.
+func Rechunk(index, blocks io.Reader, outIndex, outBlocks io.Writer, mode Mode, maxSize, maxMemory uint, opts ...Option) (before, after int64, err error) {
+	in := &countingReader{r: bufio.NewReader(index)}
+	var inBlocks *countingReader
+	var r Reader
+	if blocks == nil {
+		r, err = NewStreamReader(in)
+	} else {
+		inBlocks = &countingReader{r: bufio.NewReader(blocks)}
+		r, err = NewReader(in, inBlocks)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer r.Close()
+
+	out := &countingWriter{w: outIndex}
+	var outB *countingWriter
+	var w Writer
+	if outBlocks == nil {
+		w, err = NewStreamWriter(out, mode, maxSize, maxMemory, opts...)
+	} else {
+		outB = &countingWriter{w: outBlocks}
+		w, err = NewWriter(out, outB, mode, maxSize, maxMemory, opts...)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := Pack(w, r); err != nil {
+		return 0, 0, err
+	}
+	// Close waits for the block reader to exit.
+	r.Close()
+	before, after = in.n, out.n
+	if inBlocks != nil {
+		before += inBlocks.n
+	}
+	if outB != nil {
+		after += outB.n
+	}
+	return before, after, nil
+}
+
+// countingWriter keeps track of the number of bytes written.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,76 @@
+package dedup_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestRechunk(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(4<<20 + 100).Bytes()
+	// Create some duplicates
+	copy(b[2<<20:], b[:1<<20])
+
+	var idx, data bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Indexed to single stream with smaller dynamic blocks.
+	var stream bytes.Buffer
+	before, after, err := dedup.Rechunk(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()), &stream, nil, dedup.ModeDynamic, size/4, 10<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != int64(idx.Len()+data.Len()) || after != int64(stream.Len()) {
+		t.Fatalf("unexpected sizes %d -> %d", before, after)
+	}
+	t.Logf("Rechunked %d -> %d bytes", before, after)
+	r, err := dedup.NewStreamReader(bytes.NewReader(stream.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, out) {
+		t.Fatal("Output mismatch")
+	}
+	r.Close()
+
+	// And back to an indexed stream.
+	var idx2, data2 bytes.Buffer
+	before, after, err = dedup.Rechunk(&stream, nil, &idx2, &data2, dedup.ModeFixed, size*2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after != int64(idx2.Len()+data2.Len()) {
+		t.Fatalf("expected output size %d, got %d", idx2.Len()+data2.Len(), after)
+	}
+	r, err = dedup.NewReader(&idx2, &data2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, out) {
+		t.Fatal("Output mismatch")
+	}
+	r.Close()
+
+	// Invalid parameters for the new writer.
+	_, _, err = dedup.Rechunk(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()), &stream, nil, dedup.ModeFixed, size, 0)
+	if err != dedup.ErrMaxMemoryTooSmall {
+		t.Fatal("expected ErrMaxMemoryTooSmall, got", err)
+	}
+}
@@ -0,0 +1,79 @@
+package dedup
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+// BlockSizeResult contains the result of deduplicating a sample
+// with a single maximum block size.
+type BlockSizeResult struct {
+	MaxSize    uint  // Maximum block size.
+	Stats      Stats // Block statistics.
+	IndexBytes int64 // Size of the index stream.
+	BlockBytes int64 // Size of the block stream.
+
+	// Saved is the size of the sample minus the size of the index and block streams.
+	// It is negative if the output is bigger than the sample.
+	Saved int64
+}
+
+// RecommendReport contains the results of RecommendBlockSize.
+type RecommendReport struct {
+	// Results contains a result for each candidate, in the order of the candidates.
+	Results []BlockSizeResult
+
+	// Best is the candidate that saved the most.
+	// If several candidates saved the same, the first is used.
+	Best uint
+}
+
+// RecommendBlockSize will deduplicate sample with each of the candidate
+// maximum block sizes and report the savings of each.
+// The candidate saving the most, including the size of the index, is recommended.
+//
+// The sample is read into memory, and deduplicated as by NewWriter
+// with no memory limit and the supplied options. The output is discarded.
+// The sample should be representative of the data that will be deduplicated,
+// and should be large enough to contain typical repetitions.
+func RecommendBlockSize(sample io.Reader, mode Mode, candidates []uint, opts ...Option) (RecommendReport, error) {
+	var rep RecommendReport
+	if len(candidates) == 0 {
+		return rep, ErrInvalidOption
+	}
+	for _, size := range candidates {
+		if err := validateParams(mode, size, 0); err != nil {
+			return rep, err
+		}
+	}
+	b, err := ioutil.ReadAll(sample)
+	if err != nil {
+		return rep, err
+	}
+	best := 0
+	for i, size := range candidates {
+		idx := &countingWriter{w: ioutil.Discard}
+		blks := &countingWriter{w: ioutil.Discard}
+		w, err := NewWriter(idx, blks, mode, size, 0, opts...)
+		if err != nil {
+			return rep, err
+		}
+		if _, err := Pack(w, bytes.NewReader(b)); err != nil {
+			return rep, err
+		}
+		res := BlockSizeResult{
+			MaxSize:    size,
+			Stats:      w.Stats(),
+			IndexBytes: idx.n,
+			BlockBytes: blks.n,
+			Saved:      int64(len(b)) - idx.n - blks.n,
+		}
+		rep.Results = append(rep.Results, res)
+		if res.Saved > rep.Results[best].Saved {
+			best = i
+		}
+	}
+	rep.Best = rep.Results[best].MaxSize
+	return rep, nil
+}
@@ -0,0 +1,57 @@
+package dedup_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestRecommendBlockSize(t *testing.T) {
+	// Repeated 8K records, misaligned to the block size.
+	rec := getBufferSize(8<<10 + 100).Bytes()
+	var sample bytes.Buffer
+	for i := 0; i < 64; i++ {
+		sample.Write(rec)
+	}
+	candidates := []uint{1 << 10, 4 << 10, 64 << 10, 1 << 20}
+	rep, err := dedup.RecommendBlockSize(bytes.NewReader(sample.Bytes()), dedup.ModeDynamic, candidates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Results) != len(candidates) {
+		t.Fatalf("expected %d results, got %d", len(candidates), len(rep.Results))
+	}
+	var best dedup.BlockSizeResult
+	for i, r := range rep.Results {
+		if r.MaxSize != candidates[i] {
+			t.Fatalf("result %d: expected size %d, got %d", i, candidates[i], r.MaxSize)
+		}
+		if r.Stats.Bytes != int64(sample.Len()) {
+			t.Fatalf("size %d: expected %d bytes, got %d", r.MaxSize, sample.Len(), r.Stats.Bytes)
+		}
+		if r.Saved != int64(sample.Len())-r.IndexBytes-r.BlockBytes {
+			t.Fatalf("size %d: inconsistent savings", r.MaxSize)
+		}
+		if r.MaxSize == rep.Best {
+			best = r
+		}
+		t.Logf("size %d: saved %d, index %d bytes", r.MaxSize, r.Saved, r.IndexBytes)
+	}
+	for _, r := range rep.Results {
+		if r.Saved > best.Saved {
+			t.Fatalf("size %d saved more than recommended size %d", r.MaxSize, rep.Best)
+		}
+	}
+	// Blocks larger than the records cannot be deduplicated.
+	if rep.Best == 1<<20 {
+		t.Fatal("unexpected recommendation", rep.Best)
+	}
+
+	if _, err := dedup.RecommendBlockSize(&sample, dedup.ModeFixed, nil); err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+	if _, err := dedup.RecommendBlockSize(&sample, dedup.ModeFixed, []uint{100}); err != dedup.ErrSizeTooSmall {
+		t.Fatal("expected ErrSizeTooSmall, got", err)
+	}
+}
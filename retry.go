@@ -0,0 +1,66 @@
+package dedup
+
+import (
+	"io"
+	"time"
+)
+
+// RetryPolicy controls how writes to the outputs of a writer are retried,
+// when set with WithWriteRetry.
+type RetryPolicy struct {
+	// Retries is the maximum number of times a failed write is retried.
+	Retries int
+
+	// Backoff is the time to wait before the first retry.
+	// The wait is doubled for each following retry of the same write.
+	Backoff time.Duration
+
+	// Retryable returns whether a write that failed with err should be retried.
+	// It must not be nil.
+	Retryable func(err error) bool
+}
+
+// retryWriter retries failed writes to w according to a policy.
+type retryWriter struct {
+	w io.Writer
+	p RetryPolicy
+}
+
+// Write will write b to the underlying writer.
+// If a write fails with a retryable error, the remaining bytes
+// are written again after waiting.
+func (r *retryWriter) Write(b []byte) (int, error) {
+	written := 0
+	wait := r.p.Backoff
+	for i := 0; ; i++ {
+		n, err := r.w.Write(b[written:])
+		written += n
+		if err == nil {
+			if written != len(b) {
+				return written, io.ErrShortWrite
+			}
+			return written, nil
+		}
+		if i >= r.p.Retries || !r.p.Retryable(err) {
+			return written, err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// Sync will sync the underlying writer, if it supports it.
+func (r *retryWriter) Sync() error {
+	if s, ok := r.w.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// retryOutput returns out with the retry policy of the writer applied.
+func (w *writer) retryOutput(out io.Writer) io.Writer {
+	if w.retry == nil || out == nil {
+		return out
+	}
+	return &retryWriter{w: out, p: *w.retry}
+}
@@ -0,0 +1,94 @@
+package dedup_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/klauspost/dedup"
+)
+
+var errTransient = errors.New("transient error")
+
+// flakyWriter fails every n'th write with errTransient,
+// after writing half of the data.
+type flakyWriter struct {
+	buf    bytes.Buffer
+	n      int
+	writes int
+	fails  int
+}
+
+func (f *flakyWriter) Write(b []byte) (int, error) {
+	f.writes++
+	if f.writes%f.n == 0 {
+		f.fails++
+		half := len(b) / 2
+		f.buf.Write(b[:half])
+		return half, errTransient
+	}
+	return f.buf.Write(b)
+}
+
+func TestWriteRetry(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(1<<20 + 100).Bytes()
+	// Create some duplicates
+	copy(b[512<<10:], b[:256<<10])
+
+	policy := dedup.RetryPolicy{
+		Retries:   2,
+		Backoff:   time.Microsecond,
+		Retryable: func(err error) bool { return err == errTransient },
+	}
+	for _, verify := range []bool{false, true} {
+		idx, data := &flakyWriter{n: 7}, &flakyWriter{n: 5}
+		w, err := dedup.NewWriter(idx, data, dedup.ModeFixed, size, 0, dedup.WithSelfVerify(verify), dedup.WithWriteRetry(policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+			t.Fatal(err)
+		}
+		if idx.fails == 0 || data.fails == 0 {
+			t.Fatal("expected failed writes")
+		}
+		r, err := dedup.NewReader(&idx.buf, &data.buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, out) {
+			t.Fatal("Output mismatch")
+		}
+		r.Close()
+	}
+
+	// Each write fails, so retries are exhausted.
+	stream := &flakyWriter{n: 1}
+	_, err := dedup.NewStreamWriter(stream, dedup.ModeFixed, size, 100*size, dedup.WithWriteRetry(policy))
+	if err != errTransient {
+		t.Fatal("expected errTransient, got", err)
+	}
+	if stream.fails != 3 {
+		t.Fatal("expected 3 attempts, got", stream.fails)
+	}
+
+	// Other errors are not retried.
+	policy.Retryable = func(err error) bool { return false }
+	_, err = dedup.NewWriter(&flakyWriter{n: 1}, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.WithWriteRetry(policy))
+	if err != errTransient {
+		t.Fatal("expected errTransient, got", err)
+	}
+
+	policy.Retryable = nil
+	_, err = dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.WithWriteRetry(policy))
+	if err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+}
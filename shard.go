@@ -0,0 +1,114 @@
+package dedup
+
+import (
+	hasher "crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ErrShardCount is returned if the number of block streams
+// doesn't match the number of shards of an index.
+var ErrShardCount = errors.New("dedup: number of block streams does not match shards")
+
+// NewShardedWriter will create a deduplicator that writes unique blocks
+// to one of several block streams.
+//
+// The block stream is selected by the hash of the block, so identical content
+// is always stored in the same shard, and blocks are evenly distributed.
+// The index records the shard of each block, and is otherwise
+// identical to the index written by NewWriter.
+//
+// Use NewShardedReader with the block streams in the same order to decode the content.
+// If a single shard is used, the output can also be read by NewReader.
+//
+// WithSelfVerify, WithFinalizer, WithBlockPositions and WithCompressedBlockSink are not supported.
+// The returned writer must be closed to flush the remaining data.
+func NewShardedWriter(index io.Writer, shards []io.Writer, mode Mode, maxSize, maxMemory uint, opts ...Option) (Writer, error) {
+	if len(shards) == 0 {
+		return nil, ErrShardCount
+	}
+	return newIndexWriter(index, nil, shards, mode, maxSize, maxMemory, opts)
+}
+
+// setShards will set the block streams of a sharded writer.
+func (w *writer) setShards(shards []io.Writer) error {
+	if w.verify != nil {
+		return errors.New("dedup: self verification not supported by sharded writer")
+	}
+	if w.final != nil {
+		return errors.New("dedup: finalizer not supported by sharded writer")
+	}
+	if w.pos != nil {
+		return errors.New("dedup: block positions not supported by sharded writer")
+	}
+	if w.sink != nil {
+		return errors.New("dedup: compressed block sink not supported by sharded writer")
+	}
+	w.shards = make([]io.Writer, len(shards))
+	for i, s := range shards {
+		w.shards[i] = w.retryOutput(s)
+	}
+	w.flags |= flagSharded
+	return nil
+}
+
+// shardOf returns the shard of a block with hash h,
+// selected by the top bits of the hash.
+func shardOf(h [hasher.Size]byte, shards int) int {
+	return int(uint64(binary.BigEndian.Uint32(h[:4])) * uint64(shards) >> 32)
+}
+
+// blockOut returns the output for the data of a block with hash h,
+// and the shard number to store in the index.
+// If the writer isn't sharded, the shard is -1.
+func (w *writer) blockOut(h [hasher.Size]byte) (io.Writer, int) {
+	if w.shards == nil {
+		return w.blks, -1
+	}
+	s := shardOf(h, len(w.shards))
+	return w.shards[s], s
+}
+
+// tailOut returns the output for the remaining data when the writer is closed.
+func (w *writer) tailOut() (io.Writer, int) {
+	if w.shards == nil {
+		return w.blks, -1
+	}
+	return w.blockOut(w.tailHash())
+}
+
+// tailHash returns the hash of the remaining data.
+func (w *writer) tailHash() [hasher.Size]byte {
+	h := w.newHash()
+	if w.flags&flagLengthHash != 0 {
+		var length [8]byte
+		binary.LittleEndian.PutUint64(length[:], uint64(w.off))
+		h.Write(length[:])
+	}
+	h.Write(w.cur[:w.off])
+	var sum [hasher.Size]byte
+	sumHash(h, &sum)
+	return sum
+}
+
+// putShard will write the shard of a block to the index,
+// unless it is negative.
+func (w *writer) putShard(shard int) error {
+	if shard < 0 {
+		return nil
+	}
+	return w.putUint64(uint64(shard))
+}
+
+// NewShardedReader returns a reader that will decode the supplied index and
+// the block streams written by NewShardedWriter.
+//
+// The block streams must be supplied in the same order as they were given to the writer.
+// Each block stream is read sequentially.
+// The function will decode the index before returning.
+//
+// When you are done with the Reader, use Close to release resources.
+func NewShardedReader(index io.Reader, shards []io.Reader, opts ...ReaderOption) (IndexedReader, error) {
+	return newIndexReader(index, shards, opts)
+}
@@ -0,0 +1,106 @@
+package dedup_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestShardedWriter(t *testing.T) {
+	const size = 4 << 10
+	const nShards = 4
+	b := getBufferSize(4<<20 + 65).Bytes()
+	// Create some duplicates
+	copy(b[2<<20:], b[:1<<20])
+
+	for _, opts := range [][]dedup.Option{nil, {dedup.WithDeltaEncoding(0.5)}} {
+		var idx bytes.Buffer
+		shards := make([]bytes.Buffer, nShards)
+		outs := make([]io.Writer, nShards)
+		for i := range shards {
+			outs[i] = &shards[i]
+		}
+		w, err := dedup.NewShardedWriter(&idx, outs, dedup.ModeDynamic, size, 0, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(w, bytes.NewBuffer(b))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Blocks should be evenly distributed.
+		total := 0
+		for i := range shards {
+			total += shards[i].Len()
+		}
+		if int64(total) != w.Stats().NewBytes {
+			t.Fatalf("expected %d bytes in shards, got %d", w.Stats().NewBytes, total)
+		}
+		for i := range shards {
+			if n := shards[i].Len(); n < total/nShards*3/4 || n > total/nShards*5/4 {
+				t.Errorf("uneven distribution, shard %d has %d of %d bytes", i, n, total)
+			}
+		}
+
+		var dump bytes.Buffer
+		if err := dedup.DumpIndex(bytes.NewReader(idx.Bytes()), &dump); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(dump.String(), "shards 4") || !strings.Contains(dump.String(), ", shard 3") {
+			t.Fatal("expected shards in dump")
+		}
+
+		_, err = dedup.NewReader(bytes.NewReader(idx.Bytes()), &shards[0])
+		if err != dedup.ErrShardCount {
+			t.Fatal("expected ErrShardCount, got", err)
+		}
+		ins := make([]io.Reader, nShards)
+		for i := range shards {
+			ins[i] = &shards[i]
+		}
+		r, err := dedup.NewShardedReader(&idx, ins)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, out) {
+			t.Fatal("Output mismatch")
+		}
+		r.Close()
+	}
+
+	// A single shard can be read by NewReader.
+	var idx, data bytes.Buffer
+	w, err := dedup.NewShardedWriter(&idx, []io.Writer{&data}, dedup.ModeFixed, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := dedup.NewReader(&idx, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, out) {
+		t.Fatal("Output mismatch")
+	}
+
+	_, err = dedup.NewShardedWriter(&idx, nil, dedup.ModeFixed, size, 0)
+	if err != dedup.ErrShardCount {
+		t.Fatal("expected ErrShardCount, got", err)
+	}
+}
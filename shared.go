@@ -0,0 +1,93 @@
+package dedup
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// A SharedReader serves concurrent reads from a single decoded stream.
+type SharedReader interface {
+	io.ReaderAt
+
+	// Close will close the underlying reader.
+	io.Closer
+}
+
+// ErrEvicted is returned by a SharedReader if the requested data
+// is no longer in the shared buffer.
+var ErrEvicted = errors.New("dedup: offset no longer in shared buffer")
+
+// sharedReadSize is the maximum size of each read from the underlying reader.
+const sharedReadSize = 64 << 10
+
+type sharedReader struct {
+	mu    sync.Mutex
+	src   Reader
+	buf   []byte // Decoded data. Cap is the window size.
+	start int64  // Offset of buf[0] in the decoded data.
+	err   error  // Error from src, io.EOF when done.
+}
+
+// NewSharedReader returns a reader that decodes r once and serves
+// concurrent ReadAt calls from a shared buffer.
+//
+// The content is decoded sequentially as it is requested,
+// and the most recent window bytes are kept in memory.
+// Reads of data before the window will return ErrEvicted,
+// so readers should read at roughly the same position,
+// for instance when many clients fetch the same object at the same time.
+//
+// Reads that require decoding will block other readers while decoding.
+func NewSharedReader(r Reader, window int) (SharedReader, error) {
+	if window < MinBlockSize {
+		return nil, ErrInvalidOption
+	}
+	return &sharedReader{src: r, buf: make([]byte, 0, window)}, nil
+}
+
+// ReadAt reads len(p) bytes of decoded content starting at offset off.
+func (s *sharedReader) ReadAt(p []byte, off int64) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos < s.start {
+			return n, ErrEvicted
+		}
+		if end := s.start + int64(len(s.buf)); pos < end {
+			n += copy(p[n:], s.buf[pos-s.start:])
+			continue
+		}
+		if s.err != nil {
+			return n, s.err
+		}
+		s.fill()
+	}
+	return n, nil
+}
+
+// fill will decode more data into the buffer,
+// dropping the oldest data if the buffer is full.
+// Must be called with the lock held.
+func (s *sharedReader) fill() {
+	want := sharedReadSize
+	if want > cap(s.buf) {
+		want = cap(s.buf)
+	}
+	if drop := len(s.buf) + want - cap(s.buf); drop > 0 {
+		copy(s.buf, s.buf[drop:])
+		s.buf = s.buf[:len(s.buf)-drop]
+		s.start += int64(drop)
+	}
+	n, err := s.src.Read(s.buf[len(s.buf) : len(s.buf)+want])
+	s.buf = s.buf[:len(s.buf)+n]
+	if err != nil {
+		s.err = err
+	}
+}
+
+// Close will close the underlying reader.
+func (s *sharedReader) Close() error {
+	return s.src.Close()
+}
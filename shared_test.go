@@ -0,0 +1,94 @@
+package dedup_test
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestSharedReader(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(4<<20 + 100).Bytes()
+	copy(b[2<<20:], b[:1<<20])
+
+	data := bytes.Buffer{}
+	w, err := dedup.NewStreamWriter(&data, dedup.ModeDynamic, size, 100*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := dedup.NewStreamReader(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := dedup.NewSharedReader(r, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Readers proceed in lockstep, so all data stays within the window.
+	const readers = 8
+	const chunk = 10000
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	cond := sync.NewCond(&mu)
+	done := make([]int, readers)
+	for g := 0; g < readers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			buf := make([]byte, chunk)
+			for i := 0; ; i++ {
+				// Wait until all readers are close.
+				mu.Lock()
+				for {
+					min := i
+					for _, v := range done {
+						if v < min {
+							min = v
+						}
+					}
+					if i-min < 10 {
+						break
+					}
+					cond.Wait()
+				}
+				mu.Unlock()
+				off := int64(i * chunk)
+				n, err := s.ReadAt(buf, off)
+				if !bytes.Equal(buf[:n], b[off:off+int64(n)]) {
+					t.Errorf("reader %d: mismatch at offset %d", g, off)
+				}
+				mu.Lock()
+				done[g] = i + 1
+				cond.Broadcast()
+				mu.Unlock()
+				if err == io.EOF {
+					if off+int64(n) != int64(len(b)) {
+						t.Errorf("reader %d: unexpected EOF at %d", g, off+int64(n))
+					}
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// The start has been evicted.
+	_, err = s.ReadAt(make([]byte, 10), 0)
+	if err != dedup.ErrEvicted {
+		t.Fatal("expected ErrEvicted, got", err)
+	}
+}
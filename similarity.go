@@ -0,0 +1,140 @@
+package dedup
+
+import (
+	"sort"
+	"sync"
+)
+
+// Similarity locates previous blocks with content similar to a block.
+//
+// When set with WithSimilarity, the writer adds each new block to it,
+// after checking if a similar block has been added before.
+// Blocks that are exact duplicates of previous blocks are not added.
+// This can be used to analyze how much near-duplicate content exists in the input.
+type Similarity interface {
+	// Similar returns the numbers of blocks similar to data,
+	// with the most similar blocks first.
+	Similar(data []byte) []int
+
+	// Add will add block number n with the supplied content.
+	// The data must not be retained.
+	Add(n int, data []byte)
+}
+
+// NewMinHashSimilarity returns a Similarity that compares MinHash sketches
+// of the content of blocks.
+//
+// Each block is split into sub-chunks of 64 bytes, and a sketch of 8 values
+// is kept for each block. Blocks are similar if at least the threshold fraction
+// of the sketch values match, so a threshold of 1 only returns blocks with the
+// same sub-chunk set. The threshold must be above 0 and at most 1.
+// Up to maxBlocks of the most recently added blocks are kept.
+//
+// The returned Similarity can be queried while and after it is used by a writer.
+func NewMinHashSimilarity(maxBlocks int, threshold float64) (Similarity, error) {
+	if maxBlocks <= 0 || !(threshold > 0 && threshold <= 1) {
+		return nil, ErrInvalidOption
+	}
+	m := &minHashSimilarity{
+		max:      maxBlocks,
+		minScore: int(threshold*sketchSize + 0.5),
+		sketches: make(map[int]sketch),
+	}
+	if m.minScore < 1 {
+		m.minScore = 1
+	}
+	for i := range m.index {
+		m.index[i] = make(map[uint64][]int)
+	}
+	return m, nil
+}
+
+type minHashSimilarity struct {
+	mu       sync.Mutex
+	max      int
+	minScore int
+	sketches map[int]sketch               // Block number -> sketch
+	index    [sketchSize]map[uint64][]int // Sketch value -> block numbers
+	order    []int                        // Block numbers in the order they were added
+}
+
+// Similar returns the blocks with at least the threshold of matching sketch values,
+// ordered by the number of matching values, and the most recent block first.
+func (m *minHashSimilarity) Similar(data []byte) []int {
+	s := newSketch(data)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	scores := make(map[int]int)
+	for i, v := range s {
+		for _, n := range m.index[i][v] {
+			scores[n]++
+		}
+	}
+	var res []int
+	for n, score := range scores {
+		if score >= m.minScore {
+			res = append(res, n)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if scores[res[i]] != scores[res[j]] {
+			return scores[res[i]] > scores[res[j]]
+		}
+		return res[i] > res[j]
+	})
+	return res
+}
+
+// Add will add the sketch of a block and evict the oldest block if needed.
+func (m *minHashSimilarity) Add(n int, data []byte) {
+	s := newSketch(data)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sketches[n]; ok {
+		return
+	}
+	m.sketches[n] = s
+	for i, v := range s {
+		m.index[i][v] = append(m.index[i][v], n)
+	}
+	m.order = append(m.order, n)
+	for len(m.sketches) > m.max {
+		old := m.order[0]
+		m.order = m.order[1:]
+		m.remove(old)
+	}
+}
+
+// remove will remove block n from the index.
+func (m *minHashSimilarity) remove(n int) {
+	s, ok := m.sketches[n]
+	if !ok {
+		return
+	}
+	for i, v := range s {
+		blocks := m.index[i][v]
+		for j, b := range blocks {
+			if b == n {
+				blocks = append(blocks[:j], blocks[j+1:]...)
+				break
+			}
+		}
+		if len(blocks) == 0 {
+			delete(m.index[i], v)
+		} else {
+			m.index[i][v] = blocks
+		}
+	}
+	delete(m.sketches, n)
+}
+
+// addSimilar will count block b if it is similar to a previous block,
+// and add it to the Similarity set by WithSimilarity.
+func (w *writer) addSimilar(b *block) {
+	if len(w.similar.Similar(b.data)) > 0 {
+		w.mu.Lock()
+		w.stats.SimilarBlocks++
+		w.mu.Unlock()
+	}
+	w.similar.Add(b.N, b.data)
+}
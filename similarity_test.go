@@ -0,0 +1,74 @@
+package dedup_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestMinHashSimilarity(t *testing.T) {
+	const size = 4 << 10
+	const blocks = 32
+	b := getBufferSize(blocks * size).Bytes()
+	// Append a copy with a single byte changed in each block.
+	changed := append([]byte{}, b...)
+	for i := 0; i < blocks; i++ {
+		changed[i*size+100]++
+	}
+	in := append(b, changed...)
+
+	for _, stream := range []bool{false, true} {
+		s, err := dedup.NewMinHashSimilarity(1000, 0.5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var idx, data bytes.Buffer
+		var w dedup.Writer
+		opt := dedup.WithSimilarity(s)
+		if stream {
+			w, err = dedup.NewStreamWriter(&idx, dedup.ModeFixed, size, 100*size, opt)
+		} else {
+			w, err = dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0, opt)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(in)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Stats().SimilarBlocks; got != blocks {
+			t.Fatalf("stream %v: expected %d similar blocks, got %d", stream, blocks, got)
+		}
+		// The identical block must be first, followed by the original.
+		got := s.Similar(changed[:size])
+		if len(got) != 2 || got[0] != blocks+1 || got[1] != 1 {
+			t.Fatalf("stream %v: expected blocks [%d 1], got %v", stream, blocks+1, got)
+		}
+		if got := s.Similar(getBufferSize(size + 1).Bytes()[1:]); len(got) != 0 {
+			t.Fatal("expected no similar blocks, got", got)
+		}
+	}
+
+	// Only the most recent block is kept.
+	s, err := dedup.NewMinHashSimilarity(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(1, b[:size])
+	s.Add(2, b[size:2*size])
+	if got := s.Similar(b[:size]); len(got) != 0 {
+		t.Fatal("expected evicted block, got", got)
+	}
+	if got := s.Similar(b[size : 2*size]); len(got) != 1 || got[0] != 2 {
+		t.Fatal("expected block 2, got", got)
+	}
+
+	if _, err := dedup.NewMinHashSimilarity(10, 0); err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+	if _, err := dedup.NewMinHashSimilarity(0, 1); err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+}
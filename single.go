@@ -0,0 +1,44 @@
+package dedup
+
+// startWriter will start processing blocks with fn.
+// fn returns false when writing has failed, after which
+// the remaining blocks are discarded.
+// With WithSingleThread blocks are processed by send,
+// otherwise a goroutine is started to process them.
+func (w *writer) startWriter(fn func(b *block) bool) {
+	if w.single {
+		w.process = fn
+		return
+	}
+	go func() {
+		defer w.writerDone()
+		for b := w.next(); b != nil && fn(b); b = w.next() {
+		}
+	}()
+}
+
+// writerDone is called when no more blocks will be processed.
+// It closes the fragment channel, unless it is shared,
+// and signals that the writer has exited.
+func (w *writer) writerDone() {
+	if w.frags != nil && !w.shared {
+		close(w.frags)
+	}
+	close(w.exited)
+}
+
+// processBlock will process b in the calling goroutine.
+// If writing has failed, b is discarded.
+func (w *writer) processBlock(b *block) {
+	if w.process == nil {
+		if !b.fileEnd {
+			<-b.hashDone
+			w.release(b)
+		}
+		return
+	}
+	if !w.process(b) {
+		w.process = nil
+		w.writerDone()
+	}
+}
@@ -0,0 +1,136 @@
+package dedup_test
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestSingleThread(t *testing.T) {
+	const size = 8 << 10
+	b := getBufferSize(2 << 20).Bytes()
+	b = append(b, b[:512<<10]...)
+	modes := []dedup.Mode{dedup.ModeFixed, dedup.ModeDynamic, dedup.ModeDynamicEntropy, dedup.ModeAdaptive, dedup.ModeDynamicFastCDC}
+	for _, mode := range modes {
+		var idx, data, idxST, dataST bytes.Buffer
+		w, err := dedup.NewWriter(&idx, &data, mode, size, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+			t.Fatal(err)
+		}
+		before := runtime.NumGoroutine()
+		w, err = dedup.NewWriter(&idxST, &dataST, mode, size, 0, dedup.WithSingleThread())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		if n := runtime.NumGoroutine(); n > before {
+			t.Fatal("mode", mode, "started", n-before, "goroutines")
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(idx.Bytes(), idxST.Bytes()) || !bytes.Equal(data.Bytes(), dataST.Bytes()) {
+			t.Fatal("mode", mode, "output mismatch")
+		}
+
+		var stream, streamST bytes.Buffer
+		for _, opts := range [][]dedup.Option{nil, {dedup.WithSingleThread()}} {
+			out := &stream
+			if opts != nil {
+				out = &streamST
+			}
+			w, err := dedup.NewStreamWriter(out, mode, size, 32*size, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(stream.Bytes(), streamST.Bytes()) {
+			t.Fatal("mode", mode, "stream output mismatch")
+		}
+	}
+
+	// Fragments and unique blocks are reported in the same order.
+	split := func(opts ...dedup.Option) []dedup.Fragment {
+		ch := make(chan dedup.Fragment, len(b)/(size/64)+2)
+		w, err := dedup.NewSplitter(ch, dedup.ModeDynamic, size, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+			t.Fatal(err)
+		}
+		var frags []dedup.Fragment
+		for f := range ch {
+			frags = append(frags, f)
+		}
+		return frags
+	}
+	want, got := split(), split(dedup.WithSingleThread())
+	if len(want) != len(got) {
+		t.Fatal("got", len(got), "fragments, expected", len(want))
+	}
+	for i := range want {
+		if want[i].Hash != got[i].Hash || want[i].New != got[i].New || want[i].N != got[i].N {
+			t.Fatalf("fragment %d mismatch", i)
+		}
+	}
+	unique := func(opts ...dedup.Option) ([]byte, [][dedup.HashSize]byte) {
+		var data bytes.Buffer
+		var hashes [][dedup.HashSize]byte
+		w, err := dedup.NewBlocksOnlyWriter(&data, dedup.ModeFixed, size, func(hash [dedup.HashSize]byte, size int) error {
+			hashes = append(hashes, hash)
+			return nil
+		}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+			t.Fatal(err)
+		}
+		return data.Bytes(), hashes
+	}
+	wantData, wantHashes := unique()
+	gotData, gotHashes := unique(dedup.WithSingleThread())
+	if !bytes.Equal(wantData, gotData) || len(wantHashes) != len(gotHashes) {
+		t.Fatal("blocks only output mismatch")
+	}
+	for i := range wantHashes {
+		if wantHashes[i] != gotHashes[i] {
+			t.Fatalf("block %d mismatch", i)
+		}
+	}
+}
+
+func TestSingleThreadError(t *testing.T) {
+	const size = 8 << 10
+	b := getBufferSize(1 << 20).Bytes()
+	var idx bytes.Buffer
+	data := &failWriter{limit: len(b) / 2}
+	w, err := dedup.NewWriter(&idx, data, dedup.ModeFixed, size, 0, dedup.WithSingleThread())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The failing block is written by Write, so the next call fails.
+	if _, err := w.Write(b); err != nil && err != errFailWriter {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(b[:100]); err != errFailWriter {
+		t.Fatal("expected errFailWriter, got", err)
+	}
+	if err := w.Close(); err != errFailWriter {
+		t.Fatal("expected errFailWriter, got", err)
+	}
+	if data.Len() != len(b)/2 {
+		t.Fatal("wrote", data.Len(), "bytes after error")
+	}
+}
@@ -0,0 +1,105 @@
+package dedup
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// A SpillBuffer keeps written data in memory until a threshold is reached,
+// after which all data is moved to a temporary file.
+//
+// It can be used as the output of a writer, when the output is usually small
+// but may occasionally be too large to keep in memory.
+// The content can be read with ReadAt, for instance by NewReaderAt,
+// or with Reader. It must not be read while it is being written.
+// Close must be called to remove the temporary file.
+type SpillBuffer struct {
+	mem   []byte
+	file  *os.File
+	size  int64
+	limit int64 // 0 means no limit.
+}
+
+// NewSpillBuffer returns a buffer that moves the content to a temporary file
+// when it exceeds threshold bytes. If threshold is 0, all content is kept in memory.
+func NewSpillBuffer(threshold int64) (*SpillBuffer, error) {
+	if threshold < 0 {
+		return nil, ErrInvalidOption
+	}
+	return &SpillBuffer{limit: threshold}, nil
+}
+
+// Write will append b to the buffer.
+func (s *SpillBuffer) Write(b []byte) (int, error) {
+	if s.file == nil && s.limit > 0 && s.size+int64(len(b)) > s.limit {
+		f, err := ioutil.TempFile("", "dedup-")
+		if err != nil {
+			return 0, err
+		}
+		if _, err := f.Write(s.mem); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return 0, err
+		}
+		s.file, s.mem = f, nil
+	}
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.Write(b)
+	} else {
+		s.mem = append(s.mem, b...)
+		n = len(b)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+// ReadAt reads len(p) bytes of the content starting at offset off.
+func (s *SpillBuffer) ReadAt(p []byte, off int64) (int, error) {
+	if s.file != nil {
+		return s.file.ReadAt(p, off)
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	if off >= int64(len(s.mem)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.mem[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Reader returns a reader for the content written so far.
+func (s *SpillBuffer) Reader() io.Reader {
+	return io.NewSectionReader(s, 0, s.size)
+}
+
+// Size returns the number of bytes written to the buffer.
+func (s *SpillBuffer) Size() int64 {
+	return s.size
+}
+
+// Spilled returns true if the content has been moved to a temporary file.
+func (s *SpillBuffer) Spilled() bool {
+	return s.file != nil
+}
+
+// Close will release the memory and remove the temporary file, if any.
+// The buffer is empty afterwards.
+func (s *SpillBuffer) Close() error {
+	s.mem, s.size = nil, 0
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	if rerr := os.Remove(s.file.Name()); err == nil {
+		err = rerr
+	}
+	s.file = nil
+	return err
+}
@@ -0,0 +1,73 @@
+package dedup_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestSpillBuffer(t *testing.T) {
+	const size = 4 << 10
+	const threshold = 64 << 10
+	for _, n := range []int{16 << 10, 256 << 10} {
+		b := getBufferSize(n).Bytes()
+		// Create some duplicates
+		copy(b[n/2:], b[:n/4])
+		blocks, err := dedup.NewSpillBuffer(threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var idx bytes.Buffer
+		w, err := dedup.NewWriter(&idx, blocks, dedup.ModeDynamic, size, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+			t.Fatal(err)
+		}
+		if blocks.Spilled() != (blocks.Size() > threshold) {
+			t.Fatalf("%d bytes, spilled: %v", blocks.Size(), blocks.Spilled())
+		}
+		if n > threshold && !blocks.Spilled() {
+			t.Fatal("expected buffer to spill")
+		}
+
+		// Decode with ReadAt.
+		r, err := dedup.NewReaderAt(bytes.NewReader(idx.Bytes()), blocks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, r.Size())
+		if _, err := r.ReadAt(got, 0); err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, b) {
+			t.Fatal("content mismatch")
+		}
+
+		// Decode with Reader.
+		sr, err := dedup.NewReader(bytes.NewReader(idx.Bytes()), blocks.Reader())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err = ioutil.ReadAll(sr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, b) {
+			t.Fatal("content mismatch")
+		}
+		if err := blocks.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if blocks.Spilled() || blocks.Size() != 0 {
+			t.Fatal("buffer not released")
+		}
+	}
+	if _, err := dedup.NewSpillBuffer(-1); err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+}
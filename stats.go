@@ -0,0 +1,228 @@
+package dedup
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// Stats contains statistics on the blocks processed by a Writer.
+//
+// For writers the final block is included when the writer has been closed.
+type Stats struct {
+	Blocks    int   // Number of blocks processed.
+	NewBlocks int   // Number of blocks that had not been seen before.
+	Bytes     int64 // Total size of processed blocks.
+	NewBytes  int64 // Total size of new blocks.
+
+	// SimilarBlocks is the number of new blocks that were similar
+	// to a previous block. Only counted when WithSimilarity is used.
+	SimilarBlocks int
+
+	// Stalls is the number of times a fragment could not be sent
+	// immediately because the fragment channel was full.
+	// A high number indicates that the consumer of the fragments
+	// is the bottleneck. Only used by NewSplitter.
+	Stalls int
+
+	// LongestDupRun is the number of blocks in the longest run of consecutive
+	// duplicate blocks, and LongestDupBytes is the size of the run.
+	// The run starts at block LongestDupStart. A long run indicates
+	// a large repeated region, like a copy of a file.
+	// If several runs have the same length, the first is reported.
+	LongestDupRun   int
+	LongestDupBytes int64
+	LongestDupStart int
+}
+
+// Ratio returns the fraction of the input that was new.
+// A lower value means more data was deduplicated.
+// If no data has been processed 1 is returned.
+func (s Stats) Ratio() float64 {
+	if s.Bytes == 0 {
+		return 1
+	}
+	return float64(s.NewBytes) / float64(s.Bytes)
+}
+
+// DuplicateBlocks returns the number of blocks that had been seen before.
+func (s Stats) DuplicateBlocks() int {
+	return s.Blocks - s.NewBlocks
+}
+
+// DuplicateBytes returns the total size of blocks that had been seen before.
+// The size of the block stream is available from CloseResult
+// when the writer has been closed.
+func (s Stats) DuplicateBytes() int64 {
+	return s.Bytes - s.NewBytes
+}
+
+// CloseResult summarizes a stream, when the writer has been closed.
+// The statistics include all blocks, and the output sizes include
+// everything written by Close.
+type CloseResult struct {
+	Stats
+
+	IndexBytes int64         // Bytes written to the index, or the single stream.
+	BlockBytes int64         // Bytes written to the block streams.
+	Duration   time.Duration // Time from the creation of the writer until Close completed.
+}
+
+// OutputBytes returns the total size of the output.
+func (c CloseResult) OutputBytes() int64 {
+	return c.IndexBytes + c.BlockBytes
+}
+
+// ErrNotClosed is returned by CloseResult if the writer
+// has not been closed successfully.
+var ErrNotClosed = errors.New("dedup: writer not closed")
+
+// outputCounter counts the bytes written to an output.
+type outputCounter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *outputCounter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	*c.n += int64(n)
+	return n, err
+}
+
+// Sync will sync the output, if it supports it.
+func (c *outputCounter) Sync() error {
+	if s, ok := c.w.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// startResult will start the time of the writer
+// and count the bytes written to its outputs.
+// Outputs are counted after encryption, which must be applied afterwards.
+func (w *writer) startResult() {
+	w.started = time.Now()
+	if w.idx != nil {
+		w.idx = &outputCounter{w: w.idx, n: &w.outBytes[0]}
+	}
+	if w.blks != nil {
+		w.blks = &outputCounter{w: w.blks, n: &w.outBytes[1]}
+	}
+	for i := range w.shards {
+		w.shards[i] = &outputCounter{w: w.shards[i], n: &w.outBytes[1]}
+	}
+}
+
+// CloseResult returns the summary of the stream when the writer has been closed.
+func (w *writer) CloseResult() (CloseResult, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.done == nil {
+		return CloseResult{}, ErrNotClosed
+	}
+	return *w.done, nil
+}
+
+// RunKind is the kind of the blocks in a run reported by WithRunObserver.
+type RunKind uint8
+
+const (
+	// RunNew is a run of blocks that had not been seen before.
+	RunNew RunKind = iota
+
+	// RunDuplicate is a run of blocks that had been seen before.
+	RunDuplicate
+)
+
+// String returns a description of the run kind.
+func (k RunKind) String() string {
+	switch k {
+	case RunNew:
+		return "new"
+	case RunDuplicate:
+		return "duplicate"
+	}
+	return "unknown"
+}
+
+// runTracker accumulates consecutive blocks of the same kind.
+type runTracker struct {
+	fn   func(kind RunKind, length int)
+	kind RunKind
+	n    int
+}
+
+// add will add a block to the current run,
+// and report the current run if the kind changes.
+func (r *runTracker) add(duplicate bool) {
+	kind := RunNew
+	if duplicate {
+		kind = RunDuplicate
+	}
+	if r.n > 0 && kind != r.kind {
+		r.fn(r.kind, r.n)
+		r.n = 0
+	}
+	r.kind = kind
+	r.n++
+}
+
+// end will report the current run, if any.
+func (r *runTracker) end() {
+	if r.n > 0 {
+		r.fn(r.kind, r.n)
+		r.n = 0
+	}
+}
+
+// StatsSnapshot is the statistics of a writer at a point in time,
+// as sent by WithStatsInterval.
+type StatsSnapshot struct {
+	Stats
+
+	// Time is the time the snapshot was taken.
+	Time time.Time
+
+	// Throughput is the number of bytes processed per second
+	// since the previous snapshot, or since the writer was created.
+	Throughput float64
+
+	// Dropped is the number of snapshots that have been dropped
+	// because the channel was full.
+	Dropped int
+}
+
+// statsInterval sends snapshots of the statistics
+// each time a number of bytes has been processed.
+type statsInterval struct {
+	every     int64
+	next      int64
+	ch        chan<- StatsSnapshot
+	last      time.Time
+	lastBytes int64
+	dropped   int
+}
+
+// add will send a snapshot if the next interval has been reached.
+func (s *statsInterval) add(st Stats) {
+	if st.Bytes < s.next {
+		return
+	}
+	s.next = st.Bytes - st.Bytes%s.every + s.every
+	s.send(st)
+}
+
+// send will send a snapshot of st without blocking.
+func (s *statsInterval) send(st Stats) {
+	now := time.Now()
+	snap := StatsSnapshot{Stats: st, Time: now, Dropped: s.dropped}
+	if d := now.Sub(s.last).Seconds(); d > 0 {
+		snap.Throughput = float64(st.Bytes-s.lastBytes) / d
+	}
+	select {
+	case s.ch <- snap:
+		s.last, s.lastBytes = now, st.Bytes
+	default:
+		s.dropped++
+	}
+}
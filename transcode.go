@@ -0,0 +1,233 @@
+package dedup
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// TwoStreamToSingle will convert an index and block stream written by NewWriter
+// to a single stream, as written by NewStreamWriter.
+//
+// The blocks are repackaged without decoding, hashing or chunking the content,
+// so the block boundaries and hashes are unchanged, and the content is only copied once.
+// Backreferences are made to the latest occurrence of each block,
+// and the maximum backreference length of the stream is set to the longest
+// distance needed, so the stream can be decoded with the same blocks.
+//
+// Columns, fixed index records and size histograms are not stored in single streams,
+// so they are removed. Sharded streams cannot be converted.
+func TwoStreamToSingle(index, blocks io.Reader, out io.Writer) error {
+	idx := bufio.NewReader(index)
+	format, err := binary.ReadUvarint(idx)
+	if err != nil {
+		return err
+	}
+	if format != 1 && format != 3 {
+		return ErrUnknownFormat
+	}
+	f := &reader{}
+	if err := f.readFormat1(idx, format == 3); err != nil {
+		return err
+	}
+	if f.shards != 0 {
+		return errors.New("dedup: sharded streams cannot be converted to a single stream")
+	}
+
+	// Find the distance of each reference to the latest occurrence of the block.
+	dist := make([]uint64, len(f.blocks))
+	latest := make(map[*rblock]int)
+	maxLength := uint64(1)
+	for i := 1; i < len(f.blocks); i++ {
+		b := f.blocks[i]
+		switch {
+		case i == len(f.blocks)-1 || (b.first == i && b.base == nil):
+			// New or last block
+		case b.first == i:
+			dist[i] = uint64(i - latest[b.base])
+		default:
+			dist[i] = uint64(i - latest[b])
+		}
+		if dist[i] > maxLength {
+			maxLength = dist[i]
+		}
+		latest[b] = i
+	}
+
+	flags := f.flags &^ (flagColumnar | flagFixedRecords | flagSizeHistogram | flagByteWindow)
+	dst := bufio.NewWriter(out)
+	t := transcoder{dst: dst, src: bufio.NewReader(blocks), size: f.size, flags: flags}
+	if flags != 0 {
+		t.put(4, uint64(f.size), maxLength, flags)
+	} else {
+		t.put(2, uint64(f.size), maxLength)
+	}
+	t.putConfig(f.config)
+	for i := 1; i < len(f.blocks) && t.err == nil; i++ {
+		b := f.blocks[i]
+		switch {
+		case i == len(f.blocks)-1:
+			t.put(math.MaxUint64, t.lengthValue(b.readData))
+			t.copyData(b.readData)
+			// No stream follows.
+			t.put(0)
+		case b.first == i && b.base == nil:
+			t.put(0, t.lengthValue(b.readData))
+			t.copyData(b.readData)
+		case b.first == i:
+			t.put(deltaMarker, dist[i], uint64(b.prefix), uint64(b.suffix), t.lengthValue(b.readData))
+			t.copyData(b.readData)
+		default:
+			t.put(dist[i])
+		}
+	}
+	if t.err != nil {
+		return t.err
+	}
+	return dst.Flush()
+}
+
+// SingleToTwoStream will convert a single stream written by NewStreamWriter
+// to an index and block stream, as written by NewWriter.
+//
+// The blocks are repackaged without decoding, hashing or chunking the content,
+// so the block boundaries and hashes are unchanged, and the content is only copied once.
+// The maximum backreference length is not stored in the index.
+//
+// Concatenated streams cannot be converted, since an index
+// can only contain a single stream.
+func SingleToTwoStream(in io.Reader, index, blocks io.Writer) error {
+	br := bufio.NewReader(in)
+	format, err := binary.ReadUvarint(br)
+	if err != nil {
+		return err
+	}
+	if format != 2 && format != 4 {
+		return ErrUnknownFormat
+	}
+	f := &streamReader{}
+	if err := f.readFormat2(br, format == 4); err != nil {
+		return err
+	}
+
+	flags := f.flags &^ flagByteWindow
+	idx := bufio.NewWriter(index)
+	data := bufio.NewWriter(blocks)
+	t := transcoder{dst: idx, src: br, data: data, size: f.size, flags: flags}
+	if flags != 0 {
+		t.put(3, uint64(f.size), flags)
+	} else {
+		t.put(1, uint64(f.size))
+	}
+	t.putConfig(f.config)
+	for i := uint64(1); t.err == nil; i++ {
+		offset := t.get()
+		switch {
+		case offset == 0 || offset == math.MaxUint64:
+			v := t.get()
+			n, ok := f.blockSize(v)
+			if t.err == nil && !ok {
+				return errors.New("dedup: invalid block size")
+			}
+			t.put(offset, v)
+			t.copyData(n)
+			if offset != math.MaxUint64 {
+				continue
+			}
+			// Continuation
+			c := t.get()
+			if _, err := br.Peek(1); t.err == nil && (c != 0 || err != io.EOF) {
+				return errors.New("dedup: concatenated streams cannot be converted")
+			}
+			t.put(0)
+			if t.err != nil {
+				return t.err
+			}
+			if err := idx.Flush(); err != nil {
+				return err
+			}
+			return data.Flush()
+		case offset == deltaMarker && f.flags&flagDelta != 0:
+			v := [4]uint64{t.get(), t.get(), t.get(), t.get()}
+			n, ok := f.blockSize(v[3])
+			if t.err == nil && (!ok || v[0] == 0 || v[0] >= i) {
+				return errors.New("dedup: invalid delta block")
+			}
+			t.put(deltaMarker, v[0], v[1], v[2], v[3])
+			t.copyData(n)
+		default:
+			if t.err == nil && offset >= i {
+				return errors.New("dedup: invalid block offset")
+			}
+			t.put(offset)
+		}
+	}
+	return t.err
+}
+
+// transcoder copies index values and block data between formats.
+// The first error is kept, and later operations do nothing.
+type transcoder struct {
+	dst   *bufio.Writer // Output of index values.
+	data  *bufio.Writer // Output of block data. If nil, dst is used.
+	src   *bufio.Reader // Input of block data, and index values if read.
+	size  int
+	flags uint64
+	err   error
+	tmp   [binary.MaxVarintLen64]byte
+}
+
+// put will write values to the index output.
+func (t *transcoder) put(v ...uint64) {
+	for _, x := range v {
+		if t.err != nil {
+			return
+		}
+		n := binary.PutUvarint(t.tmp[:], x)
+		_, t.err = t.dst.Write(t.tmp[:n])
+	}
+}
+
+// get will read a value from the input.
+func (t *transcoder) get() uint64 {
+	if t.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(t.src)
+	t.err = unexpectedEOF(err)
+	return v
+}
+
+// putConfig will write the embedded configuration, if the stream has one.
+func (t *transcoder) putConfig(config []byte) {
+	if t.flags&flagConfig == 0 {
+		return
+	}
+	t.put(uint64(len(config)))
+	if t.err == nil {
+		_, t.err = t.dst.Write(config)
+	}
+}
+
+// copyData will copy n bytes of block data from the input to the output.
+func (t *transcoder) copyData(n int) {
+	if t.err != nil {
+		return
+	}
+	dst := t.data
+	if dst == nil {
+		dst = t.dst
+	}
+	_, err := io.CopyN(dst, t.src, int64(n))
+	t.err = unexpectedEOF(err)
+}
+
+// lengthValue returns the value stored for a block of n bytes.
+func (t *transcoder) lengthValue(n int) uint64 {
+	if t.flags&flagExplicitLengths != 0 {
+		return uint64(n)
+	}
+	return uint64(t.size - n)
+}
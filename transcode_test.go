@@ -0,0 +1,119 @@
+package dedup_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/dedup"
+)
+
+func TestTranscode(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(512<<10 + 100).Bytes()
+	// Create some duplicates and similar blocks.
+	copy(b[256<<10:], b[:128<<10])
+	for i := 256 << 10; i < 384<<10; i += 1000 {
+		b[i]++
+	}
+	tests := map[string][]dedup.Option{
+		"default":   nil,
+		"delta":     {dedup.WithDeltaEncoding(0.2)},
+		"explicit":  {dedup.WithExplicitLengths(true), dedup.WithEmbeddedConfig(true)},
+		"records":   {dedup.WithFixedIndexRecords(true)},
+		"histogram": {dedup.WithSizeHistogram(true), dedup.WithLengthInHash(true)},
+	}
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			var idx, data bytes.Buffer
+			w, err := dedup.NewWriter(&idx, &data, dedup.ModeDynamic, size, 0, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+				t.Fatal(err)
+			}
+			var stream bytes.Buffer
+			if err := dedup.TwoStreamToSingle(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()), &stream); err != nil {
+				t.Fatal(err)
+			}
+			r, err := dedup.NewStreamReader(bytes.NewReader(stream.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, b) {
+				t.Fatal("stream content mismatch")
+			}
+
+			// Convert back.
+			var idx2, data2 bytes.Buffer
+			if err := dedup.SingleToTwoStream(bytes.NewReader(stream.Bytes()), &idx2, &data2); err != nil {
+				t.Fatal(err)
+			}
+			r2, err := dedup.NewReader(&idx2, &data2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = ioutil.ReadAll(r2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, b) {
+				t.Fatal("index content mismatch")
+			}
+			r1, err := dedup.NewReader(bytes.NewReader(idx.Bytes()), bytes.NewReader(data.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, sizes := r1.BlockSizes(), r2.BlockSizes()
+			if len(want) != len(sizes) {
+				t.Fatalf("got %d blocks, want %d", len(sizes), len(want))
+			}
+			for i := range want {
+				if want[i] != sizes[i] {
+					t.Fatalf("block %d: got size %d, want %d", i, sizes[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTranscodeStream(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(256<<10 + 100).Bytes()
+	// Create some duplicates
+	copy(b[128<<10:], b[:64<<10])
+	var stream bytes.Buffer
+	w, err := dedup.NewStreamWriter(&stream, dedup.ModeFixed, size, 32*size, dedup.WithByteWindow(128<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	var idx, data bytes.Buffer
+	if err := dedup.SingleToTwoStream(bytes.NewReader(stream.Bytes()), &idx, &data); err != nil {
+		t.Fatal(err)
+	}
+	r, err := dedup.NewReader(&idx, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, b) {
+		t.Fatal("content mismatch")
+	}
+
+	// Concatenated streams cannot be converted.
+	concat := append(append([]byte{}, stream.Bytes()...), stream.Bytes()...)
+	if err := dedup.SingleToTwoStream(bytes.NewReader(concat), ioutil.Discard, ioutil.Discard); err == nil {
+		t.Fatal("expected error converting concatenated streams")
+	}
+}
@@ -0,0 +1,86 @@
+package dedup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// selfVerifier keeps a copy of the input and output of a writer,
+// so the output can be verified when the writer is closed.
+type selfVerifier struct {
+	input bytes.Buffer
+	idx   bytes.Buffer
+	blks  *bytes.Buffer // nil for single streams
+	key   []byte        // Decryption key, if the output is encrypted.
+	plain bool          // The index is not encrypted.
+}
+
+// newSelfVerifier will create a verifier and insert it
+// between the writer and its outputs.
+func newSelfVerifier(w *writer) *selfVerifier {
+	v := &selfVerifier{}
+	if w.idx != nil {
+		w.idx = &teeWriter{w: w.idx, copy: &v.idx}
+	}
+	if w.blks != nil {
+		v.blks = &bytes.Buffer{}
+		w.blks = &teeWriter{w: w.blks, copy: v.blks}
+	}
+	return v
+}
+
+// teeWriter writes to w and keeps a copy of the bytes w accepted.
+// Unlike io.MultiWriter, the copy stays correct if a partial write is retried.
+type teeWriter struct {
+	w    io.Writer
+	copy *bytes.Buffer
+}
+
+func (t *teeWriter) Write(b []byte) (int, error) {
+	n, err := t.w.Write(b)
+	t.copy.Write(b[:n])
+	return n, err
+}
+
+// check will decode the output and compare it to the input.
+// If cont is set, the output is expected to be followed by another stream.
+func (v *selfVerifier) check(cont bool) error {
+	var r Reader
+	var err error
+	var opts []ReaderOption
+	if v.key != nil {
+		opts = append(opts, WithDecryption(v.key))
+		if v.plain {
+			opts = append(opts, WithPlaintextIndex())
+		}
+	}
+	if v.blks != nil {
+		r, err = NewReader(&v.idx, v.blks, opts...)
+	} else {
+		r, err = NewStreamReader(&v.idx, opts...)
+	}
+	if err != nil {
+		return fmt.Errorf("dedup: self verification failed: %v", err)
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if cont && err == io.ErrUnexpectedEOF {
+		// The following stream is not part of the output.
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("dedup: self verification failed: %v", err)
+	}
+	want := v.input.Bytes()
+	if len(got) != len(want) {
+		return fmt.Errorf("dedup: self verification failed: decoded %d bytes, expected %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return fmt.Errorf("dedup: self verification failed: mismatch at offset %d", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package dedup
+
+import "time"
+
+// byteWindow keeps track of the most recent blocks
+// that fit within a number of bytes.
+//
+// A block is in the window if the total size of the block
+// and all blocks after it is at most the size of the window.
+type byteWindow struct {
+	size   int64    // Window size in bytes.
+	first  int      // Block number of the first block in the window.
+	starts []int64  // Start offset of each block in the window.
+	data   [][]byte // Block data, if kept.
+	total  int64    // Total size of all added blocks.
+}
+
+func newByteWindow(size int64) *byteWindow {
+	return &byteWindow{size: size}
+}
+
+// add will add block n to the window and remove blocks that no longer fit.
+// Blocks must be added in order.
+// The data is kept, so it can be retrieved by get.
+func (b *byteWindow) add(n int, size int, data []byte) {
+	if len(b.starts) == 0 {
+		b.first = n
+	}
+	b.starts = append(b.starts, b.total)
+	b.data = append(b.data, data)
+	b.total += int64(size)
+	for len(b.starts) > 0 && b.total-b.starts[0] > b.size {
+		b.starts = b.starts[1:]
+		b.data[0] = nil
+		b.data = b.data[1:]
+		b.first++
+	}
+}
+
+// contains returns true if block n is within the window.
+func (b *byteWindow) contains(n int) bool {
+	return n >= b.first && n < b.first+len(b.starts)
+}
+
+// get returns the data of block n.
+// false is returned if the block is not within the window.
+func (b *byteWindow) get(n int) ([]byte, bool) {
+	if !b.contains(n) {
+		return nil, false
+	}
+	return b.data[n-b.first], true
+}
+
+// inWindow returns true if block match can be referenced from block n.
+func (w *writer) inWindow(match, n int) bool {
+	if w.maxBlocks > 0 && n-match > w.maxBlocks {
+		return false
+	}
+	if n-match < w.minDist {
+		return false
+	}
+	if w.window != nil && !w.window.contains(match) {
+		return false
+	}
+	return true
+}
+
+// purgeWindow will add block n to the byte window,
+// and remove index entries that have left the window once in a while.
+func (w *writer) purgeWindow(n, size int) {
+	if w.window == nil {
+		return
+	}
+	w.window.add(n, size, nil)
+	if n&65535 != 65535 {
+		return
+	}
+	start := time.Now()
+	evicted := 0
+	w.idxMu.Lock()
+	for k, v := range w.index {
+		if !w.window.contains(v) {
+			delete(w.index, k)
+			evicted++
+		}
+	}
+	w.idxMu.Unlock()
+	w.evicted(evicted, w.window.first, start)
+}
@@ -2,15 +2,17 @@ package dedup
 
 import (
 	"bytes"
+	"context"
 	hasher "crypto/sha1"
 	"encoding/binary"
 	"errors"
-	"fmt"
+	"hash"
 	"io"
 	"math"
 	"math/big"
 	"runtime"
 	"sync"
+	"time"
 
 	"github.com/klauspost/dedup/sort"
 )
@@ -18,9 +20,26 @@ import (
 type Writer interface {
 	io.WriteCloser
 
+	// CloseWithError will close the writer without completing the output,
+	// so a failed input is not mistaken for a complete stream.
+	// err is returned by following calls to the writer.
+	// If err is nil, CloseWithError behaves like Close.
+	CloseWithError(err error) error
+
 	// Split content, so a new block begins with next write.
+	// For splitters this also marks the end of a file,
+	// see WithFileDuplicates.
+	// If there is no content since the last split and WithEmptyMarkers
+	// is enabled, an empty marker block is written.
 	Split()
 
+	// ResetChunker will reset the state used to find content defined
+	// block boundaries, as if the following input was the start of the stream.
+	// Unlike Split, the current block is continued, so no block boundary is forced.
+	// Previous blocks are still used for deduplication, and block numbering continues.
+	// In ModeFixed there is no such state, so this has no effect.
+	ResetChunker()
+
 	// MemUse returns an approximate maximum memory use in bytes for
 	// encoder (Writer) and decoder (Reader) for the given number of bytes.
 	MemUse(bytes int) (encoder, decoder int64)
@@ -28,6 +47,93 @@ type Writer interface {
 	// Returns the current number of blocks.
 	// Blocks may still be processing.
 	Blocks() int
+
+	// DuplicateBlocks returns the number of blocks that have been
+	// found to be duplicates so far. Unlike Blocks, only blocks
+	// that have been processed are included.
+	DuplicateBlocks() int
+
+	// WriteChunk will write b as a single block, regardless of the mode.
+	// Any data written before will be split into a separate block first.
+	// The chunk cannot be bigger than the maximum block size,
+	// unless WithSplitLargeChunks is used.
+	WriteChunk(b []byte) error
+
+	// Header returns the header bytes that were written to the
+	// index stream or single stream when the writer was created.
+	// This can be used to calculate offsets when embedding streams.
+	// Splitters have no header and will return an empty slice.
+	Header() []byte
+
+	// ContentHash returns the hash of all input written to the writer,
+	// independent of block boundaries.
+	// The hash is only calculated if the writer was created with WithContentHash,
+	// otherwise a zero value is returned.
+	// Call it after Close to get the hash of the complete input.
+	ContentHash() [HashSize]byte
+
+	// MerkleRoot returns the root of a Merkle tree over the hashes of all blocks.
+	// The root is only calculated if the writer was created with WithMerkleTree,
+	// otherwise a zero value is returned.
+	// Call it after Close to get the root of the complete input.
+	MerkleRoot() [HashSize]byte
+
+	// InclusionProof returns a proof that the block with the given number is
+	// included in the tree returned by MerkleRoot.
+	// The first block is 1, unless WithBlockNumberBase is used.
+	// ErrNoMerkleProofs is returned unless the writer was created with
+	// WithMerkleTree(true).
+	InclusionProof(blockNum int) (MerkleProof, error)
+
+	// Sync will wait until all data written so far has been written to
+	// the output, and sync the output if it is a file.
+	// A block boundary is inserted as with Split.
+	Sync() error
+
+	// Pause will stop processing blocks, until Resume is called.
+	// Blocks that are being processed are completed.
+	// Data written while paused is buffered until the internal
+	// buffers are full, after which Write blocks until Resume is called.
+	// Sync waits until Resume is called. Close will resume the writer.
+	Pause()
+
+	// Resume will continue processing blocks after Pause.
+	// Calling Resume on a writer that isn't paused has no effect.
+	Resume()
+
+	// InputEntropy returns the estimated entropy of the input in bits per byte,
+	// from 0 to 8, based on the first 64KiB written.
+	// Input with an entropy close to 8, like compressed or encrypted data,
+	// is unlikely to contain duplicates. See WithAutoMode.
+	InputEntropy() float64
+
+	// ForEachIndexEntry will call fn with the hash and the number of the last
+	// block with that hash for each entry in the index, in no particular order.
+	// Iteration stops if fn returns false.
+	//
+	// The index is live, so blocks being processed may not be included,
+	// and entries are removed when they can no longer be referenced.
+	// Splitters report 0 as the block number.
+	// The writer is blocked while fn is running, and fn must not call the writer.
+	ForEachIndexEntry(fn func(hash [HashSize]byte, blockNum int) bool)
+
+	// ExportIndex will write the index to out, so it can be
+	// imported by a later writer with WithImportIndex.
+	ExportIndex(out io.Writer) error
+
+	// Stats returns statistics on the blocks that have been processed so far.
+	// It can be called while data is being written.
+	Stats() Stats
+
+	// CloseResult returns a summary of the completed stream, with the final
+	// statistics, the size of the output and the time used.
+	// ErrNotClosed is returned until Close has completed without errors.
+	CloseResult() (CloseResult, error)
+
+	// MaxBackrefBlocks returns the maximum backreference distance in blocks,
+	// as derived from the maximum memory given to the writer.
+	// 0 is returned if there is no limit.
+	MaxBackrefBlocks() int
 }
 
 // Size of the underlying hash in bytes for those interested.
@@ -36,6 +142,9 @@ const HashSize = hasher.Size
 // The smallest "maximum" block size allowed.
 const MinBlockSize = 512
 
+// The largest "maximum" block size allowed.
+const MaxBlockSize = 1 << 30
+
 // ErrMaxMemoryTooSmall is returned if the encoder isn't allowed to store
 // even 1 block.
 var ErrMaxMemoryTooSmall = errors.New("there must be at be space for 1 block")
@@ -67,6 +176,27 @@ const (
 	// The size given indicates the maximum block size. Average size is usually maxSize/4.
 	// Minimum block size is maxSize/64.
 	ModeDynamicEntropy = 2
+
+	// Adaptive block size.
+	//
+	// This mode splits content like ModeDynamic, but adjusts the average
+	// block size based on how well recent blocks have been deduplicated.
+	// When few blocks are duplicates, the average block size is increased to
+	// reduce the index overhead, and when many blocks are duplicates, the average
+	// block size is decreased to find smaller matches.
+	// The average block size will be between maxSize/64 and maxSize/4.
+	// Minimum block size is maxSize/64.
+	// Adjustments only depend on the input, so the output is reproducible.
+	ModeAdaptive = 3
+
+	// Dynamic block size using FastCDC.
+	//
+	// This mode splits content like ModeDynamic, but uses a gear based rolling hash,
+	// which is considerably faster, with normalized chunking,
+	// which gives less variation in block sizes.
+	// The size given indicates the maximum block size. Average size is usually maxSize/4.
+	// Minimum block size is maxSize/64.
+	ModeDynamicFastCDC = 4
 )
 
 // Fragment is a file fragment.
@@ -76,6 +206,36 @@ type Fragment struct {
 	Payload []byte         // Data of the fragment.
 	New     bool           // Will be true, if the data hasn't been encountered before.
 	N       uint           // Sequencially incrementing number for each segment.
+	Source  int            // Source identifier set by WithSharedChannel.
+
+	Cut      CutReason // Reason the fragment ended.
+	Boundary uint32    // Rolling hash value at the end of the fragment. Always 0 in ModeFixed.
+}
+
+// CutReason indicates why a fragment ended.
+type CutReason uint8
+
+const (
+	// CutContent indicates a content defined boundary.
+	CutContent CutReason = iota
+
+	// CutMaxSize indicates that the maximum block size was reached.
+	// All fragments in ModeFixed, except the last, are cut for this reason.
+	CutMaxSize
+
+	// CutSplit indicates that Split or WriteChunk was called.
+	CutSplit
+
+	// CutEOF indicates that the writer was closed.
+	CutEOF
+)
+
+// splitReason returns the reason for a block ended by split.
+func (w *writer) splitReason() CutReason {
+	if w.closing {
+		return CutEOF
+	}
+	return CutSplit
 }
 
 type writer struct {
@@ -94,25 +254,211 @@ type writer struct {
 	vari64    []byte                             // Temporary buffer for writing varints
 	err       error                              // Error state
 	mu        sync.Mutex                         // Mutex for error state
-	nblocks   int                                // Current block number. First block is 1.
+	nblocks   int                                // Current block number. First block is base.
+	base      int                                // Number of the first block.
 	writer    func(*writer, []byte) (int, error) // Writes are forwarded here.
 	flush     func(*writer) error                // Called from Close *before* the writer is closed.
 	close     func(*writer) error                // Called from Close *after* the writer is closed.
 	split     func(*writer)                      // Called when Split is called.
+	reset     func()                             // Called when ResetChunker is called.
+	flags     uint64                             // Format flags
+	delta     *deltaEncoder                      // Delta encoder, if enabled.
+	verify    *selfVerifier                      // Output verification, if enabled.
+	shared    bool                               // Fragment channel is shared and should not be closed.
+	source    int                                // Source identifier of fragments.
+	limit     int                                // Maximum number of blocks. 0 is unlimited.
+	maxUnique int                                // Maximum number of unique blocks. 0 is unlimited.
+	adapt     *adaptiveState                     // Hit rate of adaptive mode.
+	header    []byte                             // Header written on creation.
+	stats     Stats                              // Statistics, protected by mu.
+	timeout   time.Duration                      // Fragment send timeout.
+	window    *byteWindow                        // Backreference window in bytes, if set.
+	chunkSize int                                // Maximum size of each part of a Write.
+	meta      io.Writer                          // Block metadata output, if set.
+	pending   []pendingWrite                     // Output written on Close.
+	final     *finalizer                         // Receives buffered output on Close, if set.
+	content   hash.Hash                          // Hash of all input, if enabled.
+	closing   bool                               // Close has been called.
+	metaFn    func(blockNum int) []byte          // Returns metadata of a block.
+	cont      bool                               // Another stream follows this.
+	splitBig  bool                               // Split chunks bigger than maxSize.
+	pool      *BufferPool                        // Shared block buffers, if set.
+	noDedup   bool                               // Never reference previous blocks.
+	shards    []io.Writer                        // Block streams, if sharded.
+	idxMu     sync.Mutex                         // Protects changes to index.
+	minDist   int                                // Minimum backreference distance in blocks.
+	onEvict   func(int, int, time.Duration)      // Called after index entries are evicted.
+	cols      *columns                           // Columns of unique blocks, if enabled.
+	onFile    func([HashSize]byte, bool)         // Called at the end of each file by splitters.
+	dedupFn   func([HashSize]byte, int) bool     // Decides if a block may be a reference, if set.
+	similar   Similarity                         // Receives new blocks, if set.
+	expected  int64                              // Expected input size. 0 if unknown.
+	progress  func(fraction float64)             // Called when blocks are processed, if set.
+	processed int                                // Blocks written to output, protected by mu.
+	drained   *sync.Cond                         // Signaled when blocks are processed, on errors and on Resume.
+	merkle    *merkleTree                        // Merkle tree of block hashes, if enabled.
+	evictFrac float64                            // Fraction of maxBlocks evicted on overflow. 0 means 0.25.
+	bufmul    int                                // Block buffers per hashing goroutine. 0 means the default.
+	retry     *RetryPolicy                       // Retries failed output writes, if set.
+	paused    bool                               // Block processing is paused, protected by mu.
+	dlog      io.Writer                          // Receives deduplication decisions, if set.
+	dlogHdr   bool                               // The decision log header has been written.
+	crypt     *encryption                        // Output encryption, if enabled.
+	inc       *incHasher                         // Hashes blocks while they are written, if set.
+	ent       entropySampler                     // Entropy of the start of the input, protected by mu.
+	runs      *runTracker                        // Reports runs of new and duplicate blocks, if set.
+	config    *Config                            // Configuration embedded in the header, if set.
+	hashers   *HasherPool                        // Shared hashing goroutines, if set.
+	snaps     *statsInterval                     // Sends periodic statistics, if set.
+	sizes     *SizeHistogram                     // Histogram of block sizes, if set.
+	written   bool                               // Input has been written since the last Split.
+	pos       *blockPositions                    // Reports block offsets, if set.
+	pipes     int                                // Number of hashing pipelines, if more than one.
+	inputs    []chan *block                      // Input of each hashing pipeline, if pipes > 1.
+	fullTail  bool                               // Send the remaining data through the pipeline on Close.
+	started   time.Time                          // Creation time of the writer.
+	outBytes  [2]int64                           // Bytes written to the index and the block streams.
+	done      *CloseResult                       // Summary of the stream, when closed. Protected by mu.
+	sink      *blockSink                         // Receives compressed blocks, if set.
+	dupRun    int                                // Blocks in the current run of duplicates, protected by mu.
+	dupBytes  int64                              // Size of the current run of duplicates, protected by mu.
+	hashFn    func() hash.Hash                   // Creates block hashes. SHA-1 is used if nil.
+	ctx       context.Context                    // Stops the writer when cancelled, if set.
+	spare     *block                             // Discarded block used when the context is cancelled.
+	stopped   bool                               // The input channels have been closed.
+	imported  *importedIndex                     // Set if an index has been imported.
+	procs     int                                // Maximum number of hashing goroutines, 0 for GOMAXPROCS.
+	direct    hash.Hash                          // Hashes blocks in the goroutine writing them, if set.
+	single    bool                               // Process blocks in the goroutine writing them.
+	process   func(b *block) bool                // Processes blocks when single is set, nil when stopped.
 }
 
 // block contains information about a single block
 type block struct {
 	data     []byte
-	sha1Hash [hasher.Size]byte
+	hash     [hasher.Size]byte // Block hash, see sumHash.
 	hashDone chan error
 	N        int
+	cut      CutReason // Reason the block ended.
+	boundary uint32    // Rolling hash at the end of the block.
+	fileEnd  bool      // Marks the end of a file. Contains no data.
 }
 
+// ErrBlockLimitReached is returned by Write when the number of blocks
+// set by WithBlockLimit has been reached.
+// The writer can still be closed to produce a valid stream.
+var ErrBlockLimitReached = errors.New("dedup: block limit reached")
+
+// ErrFragmentTimeout is returned by a splitter if a fragment could not be
+// delivered within the timeout set by WithSendTimeout.
+var ErrFragmentTimeout = errors.New("dedup: timeout sending fragment")
+
+// ErrTooManyUniqueBlocks is returned when the input produces more unique
+// blocks than allowed by WithUniqueBlockLimit.
+// The output is incomplete when this error has been returned.
+var ErrTooManyUniqueBlocks = errors.New("dedup: too many unique blocks")
+
+// ErrChunkTooLarge is returned by WriteChunk if the chunk is bigger
+// than the maximum block size.
+var ErrChunkTooLarge = errors.New("dedup: chunk larger than maximum block size")
+
 // ErrSizeTooSmall is returned if the requested block size is smaller than
 // hash size.
 var ErrSizeTooSmall = errors.New("maximum block size too small. must be at least 512 bytes")
 
+// ErrSizeTooLarge is returned if the requested block size is larger than MaxBlockSize.
+var ErrSizeTooLarge = errors.New("maximum block size too large. must be at most 1GB")
+
+// ErrUnknownMode is returned if an unknown mode is requested.
+var ErrUnknownMode = errors.New("dedup: unknown mode")
+
+// ErrNilOutput is returned by the writer constructors if a required
+// output writer or channel is nil.
+var ErrNilOutput = errors.New("dedup: output is nil")
+
+// ValidateWriter will check the mode, sizes and options given to a writer
+// constructor and return the error the constructor would return.
+// No buffers are allocated and no goroutines are started,
+// so it can be used to check user supplied settings early.
+//
+// maxMemory is checked as by NewWriter, so 0 is accepted.
+// Restrictions on options that only apply to specific writers,
+// like delta encoding not being supported by NewSplitter,
+// are still checked by the constructor.
+func ValidateWriter(mode Mode, maxSize, maxMemory uint, opts ...Option) error {
+	if err := validateParams(mode, maxSize, maxMemory); err != nil {
+		return err
+	}
+	w := &writer{
+		maxSize:   int(maxSize),
+		maxBlocks: int(maxMemory / maxSize),
+		nblocks:   1,
+		base:      1,
+	}
+	return w.applyOptions(opts)
+}
+
+// setChunker will set the functions splitting the input into blocks
+// for the given mode.
+func (w *writer) setChunker(mode Mode, maxSize uint) error {
+	switch mode {
+	case ModeFixed:
+		fw := &fixedWriter{}
+		w.writer = fw.write
+		w.split = fw.split
+		w.reset = fw.reset
+	case ModeDynamic:
+		zw := newZpaqWriter(maxSize)
+		w.writer = zw.write
+		w.split = zw.split
+		w.reset = zw.reset
+	case ModeDynamicEntropy:
+		zw := newEntropyWriter(maxSize)
+		w.writer = zw.write
+		w.split = zw.split
+		w.reset = zw.reset
+	case ModeAdaptive:
+		zw := newAdaptiveWriter(w, maxSize)
+		w.writer = zw.write
+		w.split = zw.split
+		w.reset = zw.reset
+	case ModeDynamicFastCDC:
+		zw := newFastCDCWriter(maxSize)
+		w.writer = zw.write
+		w.split = zw.split
+		w.reset = zw.reset
+		/*	case ModeDynamicSignatures:
+				zw := newZpaqWriter(maxSize)
+				w.writer = zw.writeFile
+			case ModeSignaturesOnly:
+				w.writer = fileSplitOnly
+		*/
+	default:
+		return ErrUnknownMode
+	}
+	return nil
+}
+
+// validateParams will check the parameters shared by the writer constructors.
+// maxMemory is only checked if it is non-zero.
+func validateParams(mode Mode, maxSize, maxMemory uint) error {
+	switch mode {
+	case ModeFixed, ModeDynamic, ModeDynamicEntropy, ModeAdaptive, ModeDynamicFastCDC:
+	default:
+		return ErrUnknownMode
+	}
+	if maxSize < MinBlockSize {
+		return ErrSizeTooSmall
+	}
+	if maxSize > MaxBlockSize {
+		return ErrSizeTooLarge
+	}
+	if maxMemory != 0 && maxMemory < maxSize {
+		return ErrMaxMemoryTooSmall
+	}
+	return nil
+}
+
 // NewWriter will create a deduplicator that will split the contents written
 // to it into blocks and de-duplicate these.
 //
@@ -126,67 +472,92 @@ var ErrSizeTooSmall = errors.New("maximum block size too small. must be at least
 // This is very conservative, so you can set this at the absolute limit of memory available.
 // If you use dynamic blocks, also note that the average size is 1/4th of the maximum block size.
 // Set maxMemory to 0 to disable decoder memory limit.
+// Otherwise maxMemory must be at least maxSize.
 //
 // This function returns data that is compatible with the NewReader function.
 // The returned writer must be closed to flush the remaining data.
-func NewWriter(index io.Writer, blocks io.Writer, mode Mode, maxSize, maxMemory uint) (Writer, error) {
-	ncpu := runtime.GOMAXPROCS(0)
-	// For small block sizes we need to keep a pretty big buffer to keep input fed.
-	// Constant below appears to be sweet spot measured with 4K blocks.
-	var bufmul = 256 << 10 / int(maxSize)
-	if bufmul < 2 {
-		bufmul = 2
+func NewWriter(index io.Writer, blocks io.Writer, mode Mode, maxSize, maxMemory uint, opts ...Option) (Writer, error) {
+	return newIndexWriter(index, blocks, nil, mode, maxSize, maxMemory, opts)
+}
+
+// NewWriterHash will create a deduplicator like NewWriter,
+// which hashes blocks with the hash identified by h instead of SHA-1.
+// See WithBlockHash for details.
+func NewWriterHash(index, blocks io.Writer, mode Mode, maxSize, maxMemory uint, h HashID, opts ...Option) (Writer, error) {
+	return NewWriter(index, blocks, mode, maxSize, maxMemory, append([]Option{WithBlockHash(h)}, opts...)...)
+}
+
+// newIndexWriter will create a writer for NewWriter and NewShardedWriter.
+// If shards are given, blocks is ignored.
+func newIndexWriter(index io.Writer, blocks io.Writer, shards []io.Writer, mode Mode, maxSize, maxMemory uint, opts []Option) (Writer, error) {
+	if err := validateParams(mode, maxSize, maxMemory); err != nil {
+		return nil, err
+	}
+	if shards == nil && blocks == nil {
+		return nil, ErrNilOutput
 	}
+	for _, s := range shards {
+		if s == nil {
+			return nil, ErrNilOutput
+		}
+	}
+	ncpu := runtime.GOMAXPROCS(0)
 
 	w := &writer{
 		blks:      blocks,
 		idx:       index,
 		maxSize:   int(maxSize),
 		index:     make(map[[hasher.Size]byte]int),
-		input:     make(chan *block, ncpu*bufmul),
-		write:     make(chan *block, ncpu*bufmul),
 		exited:    make(chan struct{}, 0),
 		cur:       make([]byte, maxSize),
 		vari64:    make([]byte, binary.MaxVarintLen64),
-		buffers:   make(chan *block, ncpu*bufmul),
 		nblocks:   1,
+		base:      1,
 		maxBlocks: int(maxMemory / maxSize),
 	}
 
-	switch mode {
-	case ModeFixed:
-		fw := &fixedWriter{}
-		w.writer = fw.write
-		w.split = fw.split
-	case ModeDynamic:
-		zw := newZpaqWriter(maxSize)
-		w.writer = zw.write
-		w.split = zw.split
-	case ModeDynamicEntropy:
-		zw := newEntropyWriter(maxSize)
-		w.writer = zw.write
-		w.split = zw.split
-	default:
-		return nil, fmt.Errorf("dedup: unknown mode")
+	if err := w.setChunker(mode, maxSize); err != nil {
+		return nil, err
 	}
 
-	if w.maxSize < MinBlockSize {
-		return nil, ErrSizeTooSmall
+	if err := w.applyOptions(opts); err != nil {
+		return nil, err
+	}
+	if w.imported != nil {
+		return nil, errors.New("dedup: imported index not supported by index writer")
+	}
+	if shards != nil {
+		if err := w.setShards(shards); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.checkFixedRecords(); err != nil {
+		return nil, err
+	}
+	if w.idx == nil {
+		return nil, ErrNilOutput
 	}
+	w.startResult()
+	if err := w.encryptOutputs(false); err != nil {
+		return nil, err
+	}
+	w.setConfig(mode, maxMemory)
 
 	w.close = idxClose
-	w.putUint64(1)               // Format
-	w.putUint64(uint64(maxSize)) // Maximum block size
-
-	// Start one goroutine per core
-	for i := 0; i < ncpu; i++ {
-		go w.hasher()
+	format := uint64(1)
+	if w.flags != 0 {
+		format = 3 // Format with flags
 	}
-	// Insert the buffers we will use
-	for i := 0; i < ncpu*bufmul; i++ {
-		w.buffers <- &block{data: make([]byte, maxSize), hashDone: make(chan error, 1)}
+	if err := w.writeHeader(format, uint64(maxSize)); err != nil {
+		return nil, err
 	}
-	go w.blockWriter()
+
+	ncpu = w.concurrency(ncpu)
+	w.makeBuffers(ncpu)
+	// Start one goroutine per core
+	w.startHashers(ncpu)
+	w.watchContext()
+	w.startWriter(w.blockWriter())
 	return w, nil
 }
 
@@ -203,72 +574,88 @@ func NewWriter(index io.Writer, blocks io.Writer, mode Mode, maxSize, maxMemory
 // If you use dynamic blocks, also note that the average size is 1/4th of the maximum block size.
 //
 // The returned writer must be closed to flush the remaining data.
-func NewStreamWriter(out io.Writer, mode Mode, maxSize, maxMemory uint) (Writer, error) {
-	ncpu := runtime.GOMAXPROCS(0)
-	// For small block sizes we need to keep a pretty big buffer to keep input fed.
-	// Constant below appears to be sweet spot measured with 4K blocks.
-	var bufmul = 256 << 10 / int(maxSize)
-	if bufmul < 2 {
-		bufmul = 2
-	}
-	if maxMemory < maxSize {
+func NewStreamWriter(out io.Writer, mode Mode, maxSize, maxMemory uint, opts ...Option) (Writer, error) {
+	if maxMemory == 0 {
 		return nil, ErrMaxMemoryTooSmall
 	}
+	if err := validateParams(mode, maxSize, maxMemory); err != nil {
+		return nil, err
+	}
+	ncpu := runtime.GOMAXPROCS(0)
 	w := &writer{
 		idx:       out,
 		maxSize:   int(maxSize),
 		index:     make(map[[hasher.Size]byte]int),
-		input:     make(chan *block, ncpu*bufmul),
-		write:     make(chan *block, ncpu*bufmul),
 		exited:    make(chan struct{}, 0),
 		cur:       make([]byte, maxSize),
 		vari64:    make([]byte, binary.MaxVarintLen64),
-		buffers:   make(chan *block, ncpu*bufmul),
 		nblocks:   1,
+		base:      1,
 		maxBlocks: int(maxMemory / maxSize),
 	}
 
-	switch mode {
-	case ModeFixed:
-		fw := &fixedWriter{}
-		w.writer = fw.write
-	case ModeDynamic:
-		zw := newZpaqWriter(maxSize)
-		w.writer = zw.write
-	case ModeDynamicEntropy:
-		zw := newEntropyWriter(maxSize)
-		w.writer = zw.write
-		/*	case ModeDynamicSignatures:
-				zw := newZpaqWriter(maxSize)
-				w.writer = zw.writeFile
-			case ModeSignaturesOnly:
-				w.writer = fileSplitOnly
-		*/
-	default:
-		return nil, fmt.Errorf("dedup: unknown mode")
+	if err := w.setChunker(mode, maxSize); err != nil {
+		return nil, err
 	}
 
-	if w.maxSize < MinBlockSize {
-		return nil, ErrSizeTooSmall
+	if err := w.applyOptions(opts); err != nil {
+		return nil, err
+	}
+	if w.imported != nil {
+		return nil, errors.New("dedup: imported index not supported by stream writer")
+	}
+	if w.flags&flagFixedRecords != 0 {
+		return nil, errors.New("dedup: fixed index records not supported by stream writer")
+	}
+	if w.sizes != nil {
+		return nil, errors.New("dedup: size histogram not supported by stream writer")
+	}
+	if w.sink != nil {
+		return nil, errors.New("dedup: compressed block sink not supported by stream writer")
+	}
+	if w.pos != nil {
+		return nil, errors.New("dedup: block positions not supported by stream writer")
+	}
+	if w.idx == nil {
+		return nil, ErrNilOutput
+	}
+	w.startResult()
+	if err := w.encryptOutputs(true); err != nil {
+		return nil, err
 	}
 
 	w.close = streamClose
-	w.putUint64(2)                   // Format
-	w.putUint64(uint64(maxSize))     // Maximum block size
-	w.putUint64(uint64(w.maxBlocks)) // Maximum backreference length
-
-	// Start one goroutine per core
-	for i := 0; i < ncpu; i++ {
-		go w.hasher()
+	maxLength := uint64(w.maxBlocks)
+	if w.window != nil {
+		w.flags |= flagByteWindow
+		maxLength = uint64(w.window.size)
 	}
-	// Insert the buffers we will use
-	for i := 0; i < ncpu*bufmul; i++ {
-		w.buffers <- &block{data: make([]byte, maxSize), hashDone: make(chan error, 1)}
+	w.setConfig(mode, maxMemory)
+	format := uint64(2)
+	if w.flags != 0 {
+		format = 4 // Format with flags
 	}
-	go w.blockStreamWriter()
+	// Format, maximum block size and maximum backreference length
+	if err := w.writeHeader(format, uint64(maxSize), maxLength); err != nil {
+		return nil, err
+	}
+
+	ncpu = w.concurrency(ncpu)
+	w.makeBuffers(ncpu)
+	// Start one goroutine per core
+	w.startHashers(ncpu)
+	w.watchContext()
+	w.startWriter(w.blockStreamWriter())
 	return w, nil
 }
 
+// NewStreamWriterHash will create a deduplicator like NewStreamWriter,
+// which hashes blocks with the hash identified by h instead of SHA-1.
+// See WithBlockHash for details.
+func NewStreamWriterHash(out io.Writer, mode Mode, maxSize, maxMemory uint, h HashID, opts ...Option) (Writer, error) {
+	return NewStreamWriter(out, mode, maxSize, maxMemory, append([]Option{WithBlockHash(h)}, opts...)...)
+}
+
 // NewSplitter will return a writer you can write data to,
 // and the file will be split into separate fragments.
 //
@@ -276,239 +663,1089 @@ func NewStreamWriter(out io.Writer, mode Mode, maxSize, maxMemory uint) (Writer,
 // the data you have written. The channel must accept data while you
 // write to the spliter.
 //
-// For each fragment the SHA-1 hash of the data section is returned,
+// For each fragment the block hash of the data section is returned,
 // along with the raw data of this segment.
 //
 // When you call Close on the returned Writer, the final fragments
-// will be sent and the channel will be closed.
-func NewSplitter(fragments chan<- Fragment, mode Mode, maxSize uint) (Writer, error) {
-	ncpu := runtime.GOMAXPROCS(0)
-	// For small block sizes we need to keep a pretty big buffer to keep input fed.
-	// Constant below appears to be sweet spot measured with 4K blocks.
-	var bufmul = 256 << 10 / int(maxSize)
-	if bufmul < 2 {
-		bufmul = 2
+// will be sent and the channel will be closed, unless
+// the WithSharedChannel option is used.
+func NewSplitter(fragments chan<- Fragment, mode Mode, maxSize uint, opts ...Option) (Writer, error) {
+	if err := validateParams(mode, maxSize, 0); err != nil {
+		return nil, err
 	}
+	if fragments == nil {
+		return nil, ErrNilOutput
+	}
+	ncpu := runtime.GOMAXPROCS(0)
 
 	w := &writer{
 		frags:   fragments,
 		maxSize: int(maxSize),
 		index:   make(map[[hasher.Size]byte]int),
-		input:   make(chan *block, ncpu*bufmul),
-		write:   make(chan *block, ncpu*bufmul),
 		exited:  make(chan struct{}, 0),
 		cur:     make([]byte, maxSize),
 		vari64:  make([]byte, binary.MaxVarintLen64),
-		buffers: make(chan *block, ncpu*bufmul),
 		nblocks: 1,
+		base:    1,
 	}
 
-	switch mode {
-	case ModeFixed:
-		fw := &fixedWriter{}
-		w.writer = fw.write
-		w.split = fw.split
-	case ModeDynamic:
-		zw := newZpaqWriter(maxSize)
-		w.writer = zw.write
-		w.split = zw.split
-	case ModeDynamicEntropy:
-		zw := newEntropyWriter(maxSize)
-		w.writer = zw.write
-		w.split = zw.split
+	if err := w.setChunker(mode, maxSize); err != nil {
+		return nil, err
+	}
+
+	w.flush = func(w *writer) error {
+		// Errors are returned after the fragment channel is closed.
+		w.split(w)
+		w.endFile()
+		return nil
+	}
+
+	if err := w.applyOptions(opts); err != nil {
+		return nil, err
+	}
+	if err := w.checkImport(); err != nil {
+		return nil, err
+	}
+	if w.delta != nil {
+		return nil, errors.New("dedup: delta encoding not supported by splitter")
+	}
+	if w.verify != nil {
+		return nil, errors.New("dedup: self verification not supported by splitter")
+	}
+	if w.crypt != nil && w.crypt.key != nil {
+		return nil, errors.New("dedup: encryption not supported by splitter")
+	}
+	if w.config != nil {
+		return nil, errors.New("dedup: embedded configuration not supported by splitter")
+	}
+	if w.flags&flagEmptyMarkers != 0 {
+		return nil, errors.New("dedup: empty markers not supported by splitter")
+	}
+	if w.sizes != nil {
+		return nil, errors.New("dedup: size histogram not supported by splitter")
+	}
+	if w.sink != nil {
+		return nil, errors.New("dedup: compressed block sink not supported by splitter")
+	}
+	if w.pos != nil {
+		return nil, errors.New("dedup: block positions not supported by splitter")
+	}
+	w.startResult()
+
+	ncpu = w.concurrency(ncpu)
+	w.makeBuffers(ncpu)
+	// Start one goroutine per core
+	w.startHashers(ncpu)
+	w.watchContext()
+	w.startWriter(w.fragmentWriter())
+	return w, nil
+}
+
+// NewSplitterHash will return a splitter like NewSplitter,
+// which hashes fragments with the hash identified by h instead of SHA-1.
+// See WithBlockHash for details.
+func NewSplitterHash(fragments chan<- Fragment, mode Mode, maxSize uint, h HashID, opts ...Option) (Writer, error) {
+	return NewSplitter(fragments, mode, maxSize, append([]Option{WithBlockHash(h)}, opts...)...)
+}
+
+// NewBlocksOnlyWriter will create a deduplicator that only writes unique blocks.
+//
+// Each block that hasn't been seen before is written to the blocks stream,
+// and onBlock is called with the hash and size of the block.
+// Duplicate blocks are not written, and no index is produced,
+// so the caller must keep track of the blocks, for instance
+// in a content addressed store.
+// If onBlock returns an error, no more blocks are written and
+// the error is returned by Write and Close.
+//
+// Since there is no backreference limit, the hashes of all blocks are kept in memory.
+// The returned writer must be closed to flush the remaining data.
+func NewBlocksOnlyWriter(blocks io.Writer, mode Mode, maxSize uint, onBlock func(hash [HashSize]byte, size int) error, opts ...Option) (Writer, error) {
+	if err := validateParams(mode, maxSize, 0); err != nil {
+		return nil, err
+	}
+	if blocks == nil {
+		return nil, ErrNilOutput
+	}
+	ncpu := runtime.GOMAXPROCS(0)
+
+	w := &writer{
+		blks:    blocks,
+		maxSize: int(maxSize),
+		index:   make(map[[hasher.Size]byte]int),
+		exited:  make(chan struct{}, 0),
+		cur:     make([]byte, maxSize),
+		vari64:  make([]byte, binary.MaxVarintLen64),
+		nblocks: 1,
+		base:    1,
+	}
+
+	if err := w.setChunker(mode, maxSize); err != nil {
+		return nil, err
+	}
+
+	w.flush = func(w *writer) error {
+		w.split(w)
+		return nil
+	}
+
+	if err := w.applyOptions(opts); err != nil {
+		return nil, err
+	}
+	if err := w.checkImport(); err != nil {
+		return nil, err
+	}
+	if w.delta != nil {
+		return nil, errors.New("dedup: delta encoding not supported by blocks only writer")
+	}
+	if w.verify != nil {
+		return nil, errors.New("dedup: self verification not supported by blocks only writer")
+	}
+	if w.config != nil {
+		return nil, errors.New("dedup: embedded configuration not supported by blocks only writer")
+	}
+	if w.flags&flagEmptyMarkers != 0 {
+		return nil, errors.New("dedup: empty markers not supported by blocks only writer")
+	}
+	if w.sizes != nil {
+		return nil, errors.New("dedup: size histogram not supported by blocks only writer")
+	}
+	if w.sink != nil {
+		return nil, errors.New("dedup: compressed block sink not supported by blocks only writer")
+	}
+	w.startResult()
+	if err := w.encryptOutputs(false); err != nil {
+		return nil, err
+	}
+
+	ncpu = w.concurrency(ncpu)
+	w.makeBuffers(ncpu)
+	// Start one goroutine per core
+	w.startHashers(ncpu)
+	w.watchContext()
+	w.startWriter(w.uniqueWriter(onBlock))
+	return w, nil
+}
+
+// putUint64 will Write a uint64 value to index stream.
+func (w *writer) putUint64(v uint64) error {
+	n := binary.PutUvarint(w.vari64, v)
+	n2, err := w.idx.Write(w.vari64[:n])
+	if err != nil {
+		return err
+	}
+	if n2 != n {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// putLength will write the length of a block to the index stream.
+// Unless explicit lengths are enabled, the length is stored
+// as the difference to the maximum block size.
+func (w *writer) putLength(n int) error {
+	return w.putUint64(w.lengthValue(n))
+}
+
+// lengthValue returns the value stored for a block of length n.
+func (w *writer) lengthValue(n int) uint64 {
+	if w.flags&flagExplicitLengths != 0 {
+		return uint64(n)
+	}
+	return uint64(w.maxSize - n)
+}
+
+// appendUint64 will write a uint64 value to buf.
+func (w *writer) appendUint64(buf *bytes.Buffer, v uint64) {
+	n := binary.PutUvarint(w.vari64, v)
+	buf.Write(w.vari64[:n])
+}
+
+// writeHeader will write the header values to the index stream,
+// followed by the format flags if any are set.
+// The header is kept, so it can be returned by Header.
+func (w *writer) writeHeader(v ...uint64) error {
+	if w.flags != 0 {
+		v = append(v, w.flags)
+	}
+	if w.flags&flagSharded != 0 {
+		v = append(v, uint64(len(w.shards)))
+	}
+	for _, x := range v {
+		n := binary.PutUvarint(w.vari64, x)
+		w.header = append(w.header, w.vari64[:n]...)
+	}
+	if w.flags&flagConfig != 0 {
+		var err error
+		if w.header, err = w.appendConfig(w.header); err != nil {
+			return err
+		}
+	}
+	n, err := w.idx.Write(w.header)
+	if err != nil {
+		return err
+	}
+	if n != len(w.header) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// Header returns the header written when the writer was created.
+func (w *writer) Header() []byte {
+	return append([]byte{}, w.header...)
+}
+
+// Split content, so a new block begins with next write
+func (w *writer) Split() {
+	// The content may already have ended at a block boundary,
+	// so markers depend on the input since the last split.
+	if !w.written && w.flags&flagEmptyMarkers != 0 && !w.closing {
+		w.writeMarker()
+	} else {
+		w.split(w)
+	}
+	w.written = false
+	if !w.closing {
+		w.endFile()
+	}
+}
+
+// ResetChunker will reset the state of the chunker without ending the current block.
+func (w *writer) ResetChunker() {
+	w.reset()
+}
+
+// writeMarker will write an empty block, marking a split without content.
+func (w *writer) writeMarker() {
+	b := w.buffer()
+	b.data = b.data[:0]
+	b.cut, b.boundary = CutSplit, 0
+	w.mu.Lock()
+	b.N = w.nblocks
+	w.nblocks++
+	w.mu.Unlock()
+
+	w.hashBlock(b)
+	w.send(b)
+}
+
+// endFile will mark the end of a file after the blocks written so far,
+// if file duplicates are reported.
+func (w *writer) endFile() {
+	if w.onFile != nil && w.frags != nil {
+		w.send(&block{fileEnd: true})
+	}
+}
+
+func (w *writer) Blocks() int {
+	w.mu.Lock()
+	b := w.nblocks - w.base
+	w.mu.Unlock()
+	return b
+}
+
+func (w *writer) DuplicateBlocks() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stats.DuplicateBlocks()
+}
+
+func (w *writer) MaxBackrefBlocks() int {
+	return w.maxBlocks
+}
+
+// Write contents to the deduplicator.
+func (w *writer) Write(b []byte) (n int, err error) {
+	if w.chunkSize <= 0 || len(b) <= w.chunkSize {
+		return w.writeInput(b)
+	}
+	// Split the write and yield between each part.
+	for len(b) > 0 {
+		todo := b
+		if len(todo) > w.chunkSize {
+			todo = todo[:w.chunkSize]
+		}
+		n2, err := w.writeInput(todo)
+		n += n2
+		if err != nil {
+			return n, err
+		}
+		b = b[n2:]
+		runtime.Gosched()
+	}
+	return n, nil
+}
+
+// writeInput will check the state of the writer
+// and forward b to the writer.
+func (w *writer) writeInput(b []byte) (n int, err error) {
+	if rem := entropySample - w.ent.n; w.ent.auto > 0 && rem > 0 && len(b) > rem {
+		// Complete the entropy sample before the rest is split,
+		// since the mode may change.
+		n, err = w.writeInput(b[:rem])
+		if err != nil {
+			return n, err
+		}
+		n2, err := w.writeInput(b[rem:])
+		return n + n2, err
+	}
+	w.mu.Lock()
+	err = w.err
+	w.mu.Unlock()
+	if err == nil {
+		err = w.ctxErr()
+	}
+	if err != nil {
+		return 0, err
+	}
+	if w.blockLimitReached() {
+		return 0, ErrBlockLimitReached
+	}
+	n, err = w.writer(w, b)
+	if err == nil {
+		// Blocks are discarded when the context is cancelled.
+		err = w.ctxErr()
+	}
+	if n > 0 {
+		w.written = true
+	}
+	w.recordInput(b[:n])
+	w.sampleInput(b[:n])
+	return n, err
+}
+
+// recordInput will add accepted input to the self verification
+// and the content hash, if enabled.
+func (w *writer) recordInput(b []byte) {
+	if w.verify != nil {
+		w.verify.input.Write(b)
+	}
+	if w.content != nil {
+		w.content.Write(b)
+	}
+}
+
+// ContentHash returns the hash of all input written to the writer.
+func (w *writer) ContentHash() (h [HashSize]byte) {
+	if w.content != nil {
+		sumHash(w.content, &h)
+	}
+	return h
+}
+
+// WriteChunk will write b as a single block.
+// If WithSplitLargeChunks is set, chunks bigger than the maximum
+// block size are written as several blocks.
+func (w *writer) WriteChunk(b []byte) error {
+	if len(b) > w.maxSize {
+		if !w.splitBig {
+			return ErrChunkTooLarge
+		}
+		for len(b) > w.maxSize {
+			if err := w.WriteChunk(b[:w.maxSize]); err != nil {
+				return err
+			}
+			b = b[w.maxSize:]
+		}
+	}
+	w.mu.Lock()
+	err := w.err
+	w.mu.Unlock()
+	if err == nil {
+		err = w.ctxErr()
+	}
+	if err != nil {
+		return err
+	}
+	if w.blockLimitReached() {
+		return ErrBlockLimitReached
+	}
+	// Flush any pending data
+	w.split(w)
+	if len(b) == 0 {
+		return nil
+	}
+	w.written = true
+	w.recordInput(b)
+	blk := w.buffer()
+	blk.data = append(blk.data[:0], b...)
+	blk.cut, blk.boundary = CutSplit, 0
+	w.mu.Lock()
+	blk.N = w.nblocks
+	w.nblocks++
+	w.mu.Unlock()
+
+	w.hashBlock(blk)
+	w.send(blk)
+	return w.ctxErr()
+}
+
+// blockLimitReached returns true if the writer has
+// reached the number of blocks set by WithBlockLimit.
+// Must be called from the goroutine writing to the writer.
+func (w *writer) blockLimitReached() bool {
+	return w.limit > 0 && w.nblocks-w.base >= w.limit
+}
+
+// setErr will set the error state of the writer.
+func (w *writer) setErr(err error) {
+	if err == nil {
+		return
+	}
+	w.mu.Lock()
+	w.err = err
+	w.cond().Broadcast()
+	w.mu.Unlock()
+}
+
+// cond returns the condition signaled when blocks have been processed.
+// w.mu must be held.
+func (w *writer) cond() *sync.Cond {
+	if w.drained == nil {
+		w.drained = sync.NewCond(&w.mu)
+	}
+	return w.drained
+}
+
+// release will mark b as processed and return the buffer for re-use.
+func (w *writer) release(b *block) {
+	w.mu.Lock()
+	w.processed++
+	w.cond().Broadcast()
+	w.mu.Unlock()
+	if w.pool != nil {
+		w.pool.put(b.data)
+		b.data = nil
+	}
+	w.buffers <- b
+}
+
+// Pause will stop the goroutines processing blocks before their next block.
+func (w *writer) Pause() {
+	w.mu.Lock()
+	w.paused = true
+	w.mu.Unlock()
+}
+
+// Resume will restart the goroutines stopped by Pause.
+func (w *writer) Resume() {
+	w.mu.Lock()
+	if w.paused {
+		w.paused = false
+		w.cond().Broadcast()
+	}
+	w.mu.Unlock()
+}
+
+// waitResume will wait while the writer is paused.
+// It must be called by the goroutines processing blocks before each block.
+func (w *writer) waitResume() {
+	w.mu.Lock()
+	for w.paused && w.ctxErr() == nil {
+		w.cond().Wait()
+	}
+	w.mu.Unlock()
+}
+
+// Sync will split the current block and wait until all blocks
+// have been written to the output.
+// If the outputs implement Sync() error, like *os.File,
+// Sync is then called on them.
+// The block stream is synced before the index stream,
+// so a synced index never references blocks that are not synced.
+//
+// Sync must not be called concurrently with Write.
+// When the output is buffered by WithFinalizer, nothing is synced.
+func (w *writer) Sync() error {
+	select {
+	case <-w.exited:
 	default:
-		return nil, fmt.Errorf("dedup: unknown mode")
+		w.split(w)
+		w.mu.Lock()
+		for w.err == nil && w.processed < w.nblocks-w.base {
+			w.cond().Wait()
+		}
+		w.mu.Unlock()
+	}
+	w.mu.Lock()
+	err := w.err
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	outs := append(append([]io.Writer{w.blks}, w.shards...), w.idx)
+	if w.sink != nil {
+		outs = append(outs, w.sink.w)
+	}
+	for _, out := range outs {
+		if s, ok := out.(interface{ Sync() error }); ok {
+			if err := s.Sync(); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	w.flush = func(w *writer) error {
-		w.split(w)
-		return w.err
+// lookup returns the number of the last block with the hash h.
+// If deduplication is disabled, no block is ever found.
+func (w *writer) lookup(h [hasher.Size]byte) (int, bool) {
+	if w.noDedup {
+		return 0, false
 	}
+	n, ok := w.index[h]
+	return n, ok
+}
+
+// forceLiteral returns true if the predicate set by WithDedupPredicate
+// doesn't allow block b to be stored as a reference.
+func (w *writer) forceLiteral(b *block) bool {
+	return w.dedupFn != nil && !w.dedupFn(b.hash, b.N)
+}
+
+// setIndex will set the last block number of hash h.
+// The index must only be changed by the goroutine writing blocks.
+func (w *writer) setIndex(h [hasher.Size]byte, n int) {
+	w.idxMu.Lock()
+	w.index[h] = n
+	w.idxMu.Unlock()
+}
 
-	if w.maxSize < MinBlockSize {
-		return nil, ErrSizeTooSmall
+// bufferMultiplier returns the default number of block buffers
+// per hashing goroutine for blocks of up to maxSize bytes.
+func bufferMultiplier(maxSize int) int {
+	// For small block sizes we need to keep a pretty big buffer to keep input fed.
+	// Constant below appears to be sweet spot measured with 4K blocks.
+	n := 256 << 10 / maxSize
+	if n < 2 {
+		n = 2
 	}
+	return n
+}
 
-	// Start one goroutine per core
-	for i := 0; i < ncpu; i++ {
-		go w.hasher()
+// makeBuffers will create the channels of the writer and insert the block
+// buffers for n hashing goroutines, with the number of buffers per goroutine
+// set by WithBufferMultiplier or the default for the block size.
+// This must be called when all options have been applied,
+// but before the hashing goroutines are started.
+func (w *writer) makeBuffers(n int) {
+	bufmul := w.bufmul
+	if bufmul == 0 {
+		bufmul = bufferMultiplier(w.maxSize)
 	}
-	// Insert the buffers we will use
-	for i := 0; i < ncpu*bufmul; i++ {
-		w.buffers <- &block{data: make([]byte, maxSize), hashDone: make(chan error, 1)}
+	w.input = make(chan *block, n*bufmul)
+	w.write = make(chan *block, n*bufmul)
+	w.buffers = make(chan *block, n*bufmul)
+	for i := 0; i < n*bufmul; i++ {
+		w.buffers <- w.newBlock()
 	}
-	go w.fragmentWriter()
-	return w, nil
 }
 
-// putUint64 will Write a uint64 value to index stream.
-func (w *writer) putUint64(v uint64) error {
-	n := binary.PutUvarint(w.vari64, v)
-	n2, err := w.idx.Write(w.vari64[:n])
-	if err != nil {
-		return err
+// evictCount returns the number of oldest blocks to evict when the index overflows.
+// At least one block is always evicted, so the index never grows beyond
+// maxBlocks+1 entries, even if the fraction of maxBlocks rounds down to 0.
+func (w *writer) evictCount() int {
+	n := w.maxBlocks / 4
+	if w.evictFrac != 0 {
+		n = int(float64(w.maxBlocks) * w.evictFrac)
 	}
-	if n2 != n {
-		return io.ErrShortWrite
+	if n < 1 {
+		n = 1
 	}
-	return nil
+	return n
 }
 
-// Split content, so a new block begins with next write
-func (w *writer) Split() {
-	w.split(w)
+// evicted will report an eviction of index entries
+// that started at start, if an eviction observer is set.
+func (w *writer) evicted(n, cutoff int, start time.Time) {
+	if w.onEvict != nil {
+		w.onEvict(n, cutoff, time.Since(start))
+	}
 }
 
-func (w *writer) Blocks() int {
+// ForEachIndexEntry will call fn with the hash and last block number
+// of each entry in the index, until fn returns false.
+func (w *writer) ForEachIndexEntry(fn func(hash [HashSize]byte, blockNum int) bool) {
+	w.idxMu.Lock()
+	defer w.idxMu.Unlock()
+	for h, n := range w.index {
+		if !fn(h, n) {
+			return
+		}
+	}
+}
+
+// uniqueLimit returns true if a block must be discarded, because
+// the number of unique blocks set by WithUniqueBlockLimit has been exceeded.
+// When the limit is exceeded ErrTooManyUniqueBlocks is set as the writer error,
+// and all following blocks are discarded.
+func (w *writer) uniqueLimit(duplicate bool) bool {
+	if w.maxUnique == 0 {
+		return false
+	}
 	w.mu.Lock()
-	b := w.nblocks - 1
-	w.mu.Unlock()
-	return b
+	defer w.mu.Unlock()
+	if w.err == ErrTooManyUniqueBlocks {
+		return true
+	}
+	if duplicate || w.stats.NewBlocks < w.maxUnique {
+		return false
+	}
+	if w.err == nil {
+		w.err = ErrTooManyUniqueBlocks
+	}
+	return true
 }
 
-// Write contents to the deduplicator.
-func (w *writer) Write(b []byte) (n int, err error) {
+// countBlock will update the statistics with a processed block.
+func (w *writer) countBlock(size int, duplicate bool) {
 	w.mu.Lock()
-	err = w.err
+	w.stats.Blocks++
+	w.stats.Bytes += int64(size)
+	if !duplicate {
+		w.stats.NewBlocks++
+		w.stats.NewBytes += int64(size)
+		w.dupRun, w.dupBytes = 0, 0
+	} else {
+		w.dupRun++
+		w.dupBytes += int64(size)
+		if w.dupRun > w.stats.LongestDupRun {
+			w.stats.LongestDupRun = w.dupRun
+			w.stats.LongestDupBytes = w.dupBytes
+			w.stats.LongestDupStart = w.base + w.stats.Blocks - w.dupRun
+		}
+	}
+	if w.adapt != nil {
+		w.adapt.report(duplicate)
+	}
+	done := w.stats.Bytes
+	st := w.stats
 	w.mu.Unlock()
-	if err != nil {
-		return 0, err
+	if w.snaps != nil {
+		w.snaps.add(st)
+	}
+	if w.sizes != nil {
+		w.sizes.add(size)
+	}
+	if w.runs != nil {
+		w.runs.add(duplicate)
+	}
+	if w.progress != nil && w.expected > 0 {
+		f := float64(done) / float64(w.expected)
+		if f > 1 {
+			f = 1
+		}
+		w.progress(f)
 	}
-	return w.writer(w, b)
 }
 
-// setErr will set the error state of the writer.
-func (w *writer) setErr(err error) {
-	if err == nil {
-		return
-	}
+// Stats returns statistics on the blocks processed so far.
+func (w *writer) Stats() Stats {
 	w.mu.Lock()
-	w.err = err
+	s := w.stats
 	w.mu.Unlock()
+	return s
 }
 
 // idxClose will flush the remainder of an index based stream
 func idxClose(w *writer) (err error) {
-	// Insert length of remaining data into index
-	w.putUint64(uint64(math.MaxUint64))
-	w.putUint64(uint64(w.maxSize - w.off))
-	w.putUint64(0) // Stream continuation possibility, should be 0.
+	if w.off > 0 {
+		if w.uniqueLimit(false) {
+			return ErrTooManyUniqueBlocks
+		}
+		w.countBlock(w.off, false)
+		if w.merkle != nil || w.dlog != nil {
+			h := w.tailHash()
+			w.addLeaf(h)
+			if err := w.logDecision(w.nblocks, h, false, 0, 0, false); err != nil {
+				return err
+			}
+		}
+		if err := w.writeMeta(w.nblocks); err != nil {
+			return err
+		}
+	}
+	out, shard := w.tailOut()
+	if w.pos != nil && w.off > 0 {
+		w.pos.add(w.nblocks, w.tailHash(), w.off)
+	}
 
-	buf := bytes.NewBuffer(w.cur[0:w.off])
-	n, err := io.Copy(w.blks, buf)
-	if err != nil {
-		return err
+	// Insert length of remaining data into index.
+	// This is also written if there is no remaining data,
+	// since it marks the end of the stream.
+	var trailer bytes.Buffer
+	w.appendLast(&trailer, w.off, shard)
+	if w.sizes != nil {
+		w.appendHistogram(&trailer)
+	}
+
+	w.pending = append(w.pending,
+		pendingWrite{dst: w.idx, data: trailer.Bytes()},
+		pendingWrite{dst: out, data: w.cur[0:w.off]},
+	)
+	if w.sink != nil && w.off > 0 {
+		rec, err := w.sink.record(w.cur[0:w.off])
+		if err != nil {
+			return err
+		}
+		w.pending = append(w.pending, pendingWrite{dst: w.sink.w, data: rec})
 	}
-	if int(n) != w.off {
-		return errors.New("idxClose: r.cur short write")
+	if w.cols != nil {
+		if w.off > 0 {
+			w.cols.add(w.tailHash(), w.off)
+		}
+		w.pending = append(w.pending, pendingWrite{dst: out, data: w.cols.bytes()})
 	}
 	return nil
 }
 
 // streamClose will flush the remainder of an single stream
 func streamClose(w *writer) (err error) {
-	// Insert length of remaining data into index
-	w.putUint64(uint64(math.MaxUint64))
-	w.putUint64(uint64(w.maxSize - w.off))
-
-	buf := bytes.NewBuffer(w.cur[0:w.off])
-	n, err := io.Copy(w.idx, buf)
-	if err != nil {
-		return err
+	if w.off > 0 {
+		if w.uniqueLimit(false) {
+			return ErrTooManyUniqueBlocks
+		}
+		w.countBlock(w.off, false)
+		if w.merkle != nil || w.dlog != nil {
+			h := w.tailHash()
+			w.addLeaf(h)
+			if err := w.logDecision(w.nblocks, h, false, 0, 0, false); err != nil {
+				return err
+			}
+		}
+		if err := w.writeMeta(w.nblocks); err != nil {
+			return err
+		}
+	}
+	// Insert length of remaining data into index.
+	// This is also written if there is no remaining data,
+	// since it marks the end of the stream.
+	var trailer bytes.Buffer
+	w.appendUint64(&trailer, uint64(math.MaxUint64))
+	w.appendUint64(&trailer, w.lengthValue(w.off))
+	trailer.Write(w.cur[0:w.off])
+	if w.cont {
+		// Another stream follows.
+		w.appendUint64(&trailer, 1)
+	} else {
+		w.appendUint64(&trailer, 0) // Stream continuation possibility, should be 0.
 	}
-	if int(n) != w.off {
-		return errors.New("streamClose: r.cur short write")
+	w.pending = append(w.pending, pendingWrite{dst: w.idx, data: trailer.Bytes()})
+	return nil
+}
+
+// pendingWrite contains output that must be written
+// when the writer is closed.
+type pendingWrite struct {
+	dst  io.Writer
+	data []byte
+}
+
+// writePending will write the pending output.
+// If a write fails, the remaining output is kept,
+// so it can be retried.
+func (w *writer) writePending() error {
+	for len(w.pending) > 0 {
+		p := &w.pending[0]
+		n, err := p.dst.Write(p.data)
+		p.data = p.data[n:]
+		if err != nil {
+			return err
+		}
+		if len(p.data) > 0 {
+			return io.ErrShortWrite
+		}
+		w.pending = w.pending[1:]
 	}
-	w.putUint64(0) // Stream continuation possibility, should be 0.
 	return nil
 }
 
+// CloseWithError will set the error state of the writer
+// and close it without writing the end of the output.
+func (w *writer) CloseWithError(err error) error {
+	w.setErr(err)
+	return w.Close()
+}
+
 // Close and flush the remaining data to output.
+//
+// If writing the final data to the output fails, the error is returned,
+// and Close can be called again to retry writing the remaining data.
+// Other errors are permanent, and will be returned by all following calls.
 func (w *writer) Close() (err error) {
 	select {
 	case <-w.exited:
-		return w.err
+		w.stopInput()
+		return w.finish()
 	default:
 	}
+	if w.ctxErr() != nil {
+		// Don't wait for the goroutines, since the output may be stalled.
+		w.cancel()
+		w.stopInput()
+		return w.finish()
+	}
+	w.closing = true
+	w.Resume()
+	if w.fullTail && w.flush == nil && w.off > 0 {
+		// End the remaining data as a regular block,
+		// so it is hashed, deduplicated and indexed.
+		w.split(w)
+	}
 	if w.flush != nil {
 		err := w.flush(w)
 		if err != nil {
 			return err
 		}
 	}
-	close(w.input)
-	close(w.write)
+	w.stopInput()
 	<-w.exited
+	if w.ctxErr() != nil {
+		w.cancel()
+		return w.finish()
+	}
 
 	if w.close != nil {
 		err := w.close(w)
 		if err != nil {
+			w.setErr(err)
+			return err
+		}
+	}
+	if w.runs != nil {
+		w.runs.end()
+	}
+	if w.snaps != nil {
+		w.snaps.send(w.Stats())
+	}
+	return w.finish()
+}
+
+// finish will write the pending output of a closed writer,
+// end encrypted outputs and verify the output if requested.
+func (w *writer) finish() error {
+	if w.err == nil {
+		if err := w.writePending(); err != nil {
 			return err
 		}
+		w.setErr(w.closeEncryption())
+	}
+	if w.verify != nil && w.err == nil {
+		w.setErr(w.verify.check(w.cont))
+		w.verify = nil
+	}
+	if w.final != nil {
+		if w.err == nil {
+			w.setErr(w.final.finalize())
+		}
+		w.final.cleanup()
+		w.final = nil
+	}
+	if w.err == nil {
+		w.mu.Lock()
+		if w.done == nil {
+			w.done = &CloseResult{
+				Stats:      w.stats,
+				IndexBytes: w.outBytes[0],
+				BlockBytes: w.outBytes[1],
+				Duration:   time.Since(w.started),
+			}
+		}
+		w.mu.Unlock()
 	}
 	return w.err
 }
 
 // hasher will hash incoming blocks
 // and signal the writer when done.
-func (w *writer) hasher() {
-	h := hasher.New()
-	for b := range w.input {
-		buf := bytes.NewBuffer(b.data)
-		h.Reset()
-		n, err := io.Copy(h, buf)
-		if err != nil {
-			w.setErr(err)
+func (w *writer) hasher(input chan *block) {
+	h := w.newHash()
+	for b := range input {
+		w.waitResume()
+		sumBlock(h, b, w.flags&flagLengthHash != 0)
+		b.hashDone <- nil
+	}
+}
+
+// sumBlock will calculate the hash of b using h.
+// If length is set, the length of the block is hashed before the data.
+func sumBlock(h hash.Hash, b *block, length bool) {
+	h.Reset()
+	if length {
+		var l [8]byte
+		binary.LittleEndian.PutUint64(l[:], uint64(len(b.data)))
+		h.Write(l[:])
+	}
+	h.Write(b.data)
+	sumHash(h, &b.hash)
+}
+
+// incHasher keeps the hash of the part of the current block
+// that has been hashed, when WithIncrementalHash is used.
+type incHasher struct {
+	h hash.Hash
+	n int // Number of bytes of w.cur that have been hashed.
+}
+
+// incremental returns true if blocks are hashed while they are written.
+// The length hash is written before the content, so it is hashed by the hashers.
+func (w *writer) incremental() bool {
+	return w.inc != nil && w.flags&flagLengthHash == 0
+}
+
+// hashCur will add the current block up to end to the hash,
+// if blocks are hashed incrementally.
+func (w *writer) hashCur(end int) {
+	if !w.incremental() || end <= w.inc.n {
+		return
+	}
+	w.inc.h.Write(w.cur[w.inc.n:end])
+	w.inc.n = end
+}
+
+// hashBlock will hash b, which has just been cut from the current block.
+// If blocks are hashed incrementally the rest of the block is hashed
+// directly, otherwise b is sent to the hashers or the shared hasher pool.
+func (w *writer) hashBlock(b *block) {
+	if w.ctxErr() != nil {
+		// The block is discarded by send.
+		return
+	}
+	if !w.incremental() {
+		if w.direct != nil {
+			sumBlock(w.direct, b, w.flags&flagLengthHash != 0)
+			b.hashDone <- nil
 			return
 		}
-		if int(n) != len(b.data) {
-			w.setErr(errors.New("short copy in hasher"))
+		if w.hashers != nil {
+			w.hashers.jobs <- hashJob{b: b, length: w.flags&flagLengthHash != 0, newHash: w.hashFn}
 			return
 		}
-		_ = h.Sum(b.sha1Hash[:0])
-		b.hashDone <- nil
+		if w.inputs != nil {
+			w.inputs[b.N%len(w.inputs)] <- b
+			return
+		}
+		w.input <- b
+		return
+	}
+	if w.inc.n < len(b.data) {
+		w.inc.h.Write(b.data[w.inc.n:])
 	}
+	sumHash(w.inc.h, &b.hash)
+	w.inc.h.Reset()
+	w.inc.n = 0
+	b.hashDone <- nil
 }
 
-// blockWriter will write hashed blocks to the output
-// and recycle the buffers.
-func (w *writer) blockWriter() {
-	defer close(w.exited)
-
+// blockWriter returns a function that will write a hashed block
+// to the output and recycle the buffer.
+// The function returns false when writing has failed.
+func (w *writer) blockWriter() func(b *block) bool {
 	sortA := make([]int, w.maxBlocks+1)
 
-	for b := range w.write {
+	return func(b *block) bool {
+		w.waitResume()
 		_ = <-b.hashDone
-		match, ok := w.index[b.sha1Hash]
+		match, ok := w.lookup(b.hash)
+		// Matches that are too close are kept in the index,
+		// so later blocks can reference them.
+		near := ok && b.N-match < w.minDist
+		if ok && w.window != nil && !w.window.contains(match) {
+			ok = false
+		}
+		if near {
+			ok = false
+		}
+		forced := ok && w.forceLiteral(b)
+		if forced {
+			ok = false
+		}
+		if w.uniqueLimit(ok) {
+			w.release(b)
+			return true
+		}
+		w.countBlock(len(b.data), ok)
+		w.addLeaf(b.hash)
+		if !ok && w.similar != nil {
+			w.addSimilar(b)
+		}
+		out, shard := w.blockOut(b.hash)
+		deltaBase := 0
+		if !ok && w.delta != nil && !w.noDedup && !forced {
+			var err error
+			deltaBase, err = w.writeDelta(b, out, shard)
+			if err != nil {
+				w.setErr(err)
+				return false
+			}
+		}
 		if !ok {
+			if err := w.writeMeta(b.N); err != nil {
+				w.setErr(err)
+				return false
+			}
+		}
+		switch {
+		case deltaBase > 0:
+			// Already written as a delta of a similar block.
+		case !ok:
 			buf := bytes.NewBuffer(b.data)
-			n, err := io.Copy(w.blks, buf)
+			n, err := io.Copy(out, buf)
 			if err != nil {
 				w.setErr(err)
-				return
+				return false
 			}
 			if int(n) != len(b.data) {
 				// This should not be possible with io.copy without an error,
 				// but we test anyway.
 				w.setErr(errors.New("error: short write on copy"))
-				return
+				return false
+			}
+			if err := w.putNew(int(n), shard); err != nil {
+				w.setErr(err)
+				return false
 			}
-			w.putUint64(0)
-			w.putUint64(uint64(w.maxSize) - uint64(n))
-		} else {
+			if w.pos != nil {
+				w.pos.add(b.N, b.hash, int(n))
+			}
+			if w.sink != nil && n > 0 {
+				if err := w.sink.add(b.data); err != nil {
+					w.setErr(err)
+					return false
+				}
+			}
+			if w.cols != nil {
+				w.cols.add(b.hash, int(n))
+			}
+		default:
 			offset := b.N - match
 			if offset <= 0 {
 				// should be impossible, indicated an internal error
 				w.setErr(errors.New("internal error: negative offset"))
-				return
+				return false
 			}
-			w.putUint64(uint64(offset))
+			if err := w.putRef(offset); err != nil {
+				w.setErr(err)
+				return false
+			}
+			if w.delta != nil {
+				w.delta.touch(match, b.N)
+			}
+		}
+		if err := w.logDecision(b.N, b.hash, ok, match, deltaBase, !near); err != nil {
+			w.setErr(err)
+			return false
 		}
 		// Update hash to latest match
-		w.index[b.sha1Hash] = b.N
+		if !near {
+			w.setIndex(b.hash, b.N)
+		}
+		w.purgeWindow(b.N, len(b.data))
 
 		// Purge the entries with the oldest matches
 		if w.maxBlocks > 0 && len(w.index) > w.maxBlocks {
+			start := time.Now()
 			ar := sortA[0:len(w.index)]
 			i := 0
 			for _, v := range w.index {
@@ -516,98 +1753,263 @@ func (w *writer) blockWriter() {
 				i++
 			}
 			sort.Asc(ar)
-			// Cut the oldest quarter blocks
-			// since this isn't free
-			cutoff := ar[w.maxBlocks/4]
+			// Cut the oldest quarter blocks, unless
+			// another fraction is set, since this isn't free
+			cutoff := ar[w.evictCount()]
+			evicted := 0
+			w.idxMu.Lock()
 			for k, v := range w.index {
 				if v < cutoff {
 					delete(w.index, k)
+					evicted++
 				}
 			}
+			w.idxMu.Unlock()
+			w.evicted(evicted, cutoff, start)
 		}
 
 		// Done, reinsert buffer
-		w.buffers <- b
+		w.release(b)
+		return true
 	}
 }
 
-// blockStreamWriter will write blocks and indexes to the output stream
-// and recycle the buffers.
-func (w *writer) blockStreamWriter() {
-	defer close(w.exited)
-	for b := range w.write {
+// blockStreamWriter returns a function that will write a block and its index
+// to the output stream and recycle the buffer.
+// The function returns false when writing has failed.
+func (w *writer) blockStreamWriter() func(b *block) bool {
+	return func(b *block) bool {
+		w.waitResume()
 		_ = <-b.hashDone
-		match, ok := w.index[b.sha1Hash]
-		if w.maxBlocks > 0 && (b.N-match) > w.maxBlocks {
+		match, ok := w.lookup(b.hash)
+		// Matches that are too close are kept in the index,
+		// so later blocks can reference them.
+		near := ok && b.N-match < w.minDist
+		if ok && !w.inWindow(match, b.N) {
+			ok = false
+		}
+		forced := ok && w.forceLiteral(b)
+		if forced {
 			ok = false
 		}
+		if w.uniqueLimit(ok) {
+			w.release(b)
+			return true
+		}
+		w.countBlock(len(b.data), ok)
+		w.addLeaf(b.hash)
+		if !ok && w.similar != nil {
+			w.addSimilar(b)
+		}
+		deltaBase := 0
+		if !ok && w.delta != nil && !w.noDedup && !forced {
+			var err error
+			deltaBase, err = w.writeDelta(b, w.idx, -1)
+			if err != nil {
+				w.setErr(err)
+				return false
+			}
+		}
 		if !ok {
-			w.putUint64(0)
-			w.putUint64(uint64(w.maxSize) - uint64(len(b.data)))
+			if err := w.writeMeta(b.N); err != nil {
+				w.setErr(err)
+				return false
+			}
+		}
+		switch {
+		case deltaBase > 0:
+			// Already written as a delta of a similar block.
+		case !ok:
+			if err := w.putNew(len(b.data), -1); err != nil {
+				w.setErr(err)
+				return false
+			}
 			buf := bytes.NewBuffer(b.data)
 			n, err := io.Copy(w.idx, buf)
 			if err != nil {
 				w.setErr(err)
-				return
+				return false
 			}
 			if int(n) != len(b.data) {
 				// This should not be possible with io.Copy without an error,
 				// but we test anyway.
 				w.setErr(errors.New("error: short write on copy"))
-				return
+				return false
 			}
-		} else {
+		default:
 			offset := b.N - match
 			if offset <= 0 {
 				// should be impossible, indicated an internal error
 				w.setErr(errors.New("internal error: negative offset"))
-				return
+				return false
+			}
+			if err := w.putRef(offset); err != nil {
+				w.setErr(err)
+				return false
+			}
+			if w.delta != nil {
+				w.delta.touch(match, b.N)
 			}
-			w.putUint64(uint64(offset))
+		}
+		if err := w.logDecision(b.N, b.hash, ok, match, deltaBase, !near); err != nil {
+			w.setErr(err)
+			return false
 		}
 		// Update hash to latest match
-		w.index[b.sha1Hash] = b.N
+		if !near {
+			w.setIndex(b.hash, b.N)
+		}
+		w.purgeWindow(b.N, len(b.data))
 
 		// Purge old entries once in a while
 		if w.maxBlocks > 0 && b.N&65535 == 65535 {
+			start := time.Now()
+			evicted := 0
+			w.idxMu.Lock()
 			for k, v := range w.index {
 				if (b.N - v) > w.maxBlocks {
 					delete(w.index, k)
+					evicted++
 				}
 			}
+			w.idxMu.Unlock()
+			w.evicted(evicted, b.N-w.maxBlocks, start)
 		}
 		// Done, reinsert buffer
-		w.buffers <- b
+		w.release(b)
+		return true
 	}
 }
 
-// fragmentWriter will write hashed blocks to the output channel
-// and recycle the buffers.
-func (w *writer) fragmentWriter() {
-	defer close(w.exited)
-	defer close(w.frags)
+// fragmentWriter returns a function that will write a hashed block
+// to the output channel and recycle the buffer.
+func (w *writer) fragmentWriter() func(b *block) bool {
 	n := uint(0)
-	for b := range w.write {
+	var file fileState
+	return func(b *block) bool {
+		w.waitResume()
+		if b.fileEnd {
+			file.end(w.onFile)
+			return true
+		}
 		_ = <-b.hashDone
 		var f Fragment
 		f.N = n
-		copy(f.Hash[:], b.sha1Hash[:])
-		_, ok := w.index[b.sha1Hash]
+		f.Source = w.source
+		f.Cut = b.cut
+		f.Boundary = b.boundary
+		copy(f.Hash[:], b.hash[:])
+		_, ok := w.lookup(b.hash)
+		if w.uniqueLimit(ok) {
+			w.release(b)
+			return true
+		}
+		w.countBlock(len(b.data), ok)
+		w.addLeaf(b.hash)
 		f.Payload = make([]byte, len(b.data))
 		copy(f.Payload, b.data)
+		if err := w.logDecision(b.N, b.hash, ok, 0, 0, !ok && !w.noDedup); err != nil {
+			w.setErr(err)
+		}
 		if !ok {
-			w.index[b.sha1Hash] = 0
+			if !w.noDedup {
+				w.setIndex(b.hash, 0)
+			}
 			f.New = !ok
 		}
-		w.frags <- f
+		if w.onFile != nil {
+			file.add(f.Hash, f.New)
+		}
+		w.sendFragment(f)
 		// Done, reinsert buffer
-		w.buffers <- b
+		w.release(b)
 		n++
+		return true
+	}
+}
+
+// sendFragment will send f on the fragment channel.
+// If the channel is full the stall is counted,
+// and if a send timeout is set, the fragment is dropped
+// and the writer will return ErrFragmentTimeout.
+// After a timeout all remaining fragments are dropped.
+func (w *writer) sendFragment(f Fragment) {
+	select {
+	case w.frags <- f:
+		return
+	default:
+	}
+	w.mu.Lock()
+	w.stats.Stalls++
+	failed := w.err != nil
+	w.mu.Unlock()
+	if failed {
+		return
+	}
+	if w.timeout <= 0 {
+		w.frags <- f
+		return
+	}
+	t := time.NewTimer(w.timeout)
+	defer t.Stop()
+	select {
+	case w.frags <- f:
+	case <-t.C:
+		w.setErr(ErrFragmentTimeout)
+	}
+}
+
+// uniqueWriter will write blocks that haven't been seen before
+// to the block stream and report them to onBlock.
+// When an error has occurred, remaining blocks are discarded.
+func (w *writer) uniqueWriter(onBlock func(hash [HashSize]byte, size int) error) func(b *block) bool {
+	return func(b *block) bool {
+		w.waitResume()
+		_ = <-b.hashDone
+		w.mu.Lock()
+		failed := w.err != nil
+		w.mu.Unlock()
+		if failed {
+			w.release(b)
+			return true
+		}
+		match, ok := w.lookup(b.hash)
+		if w.uniqueLimit(ok) {
+			w.release(b)
+			return true
+		}
+		w.countBlock(len(b.data), ok)
+		w.addLeaf(b.hash)
+		if err := w.logDecision(b.N, b.hash, ok, match, 0, !ok); err != nil {
+			w.setErr(err)
+			w.release(b)
+			return true
+		}
+		if !ok {
+			w.setIndex(b.hash, b.N)
+			n, err := w.blks.Write(b.data)
+			if err == nil && n != len(b.data) {
+				err = io.ErrShortWrite
+			}
+			if err == nil && w.pos != nil {
+				w.pos.add(b.N, b.hash, n)
+			}
+			if err == nil {
+				err = onBlock(b.hash, len(b.data))
+			}
+			w.setErr(err)
+		}
+		// Done, reinsert buffer
+		w.release(b)
+		return true
 	}
 }
 
 type fixedWriter struct{}
 
+// Fixed size blocks do not depend on the content.
+func (f *fixedWriter) reset() {}
+
 // Write blocks of similar size.
 func (f *fixedWriter) write(w *writer, b []byte) (n int, err error) {
 	written := 0
@@ -616,19 +2018,24 @@ func (f *fixedWriter) write(w *writer, b []byte) (n int, err error) {
 		b = b[n:]
 		w.off += n
 		written += n
+		w.hashCur(w.off)
 		// Filled the buffer? Send it off!
 		if w.off == w.maxSize {
-			b := <-w.buffers
+			b := w.buffer()
 			// Swap block with current
-			w.cur, b.data = b.data, w.cur
+			w.cur, b.data = b.data[:w.maxSize], w.cur
+			b.cut, b.boundary = CutMaxSize, 0
 			w.mu.Lock()
 			b.N = w.nblocks
 			w.nblocks++
 			w.mu.Unlock()
 
-			w.input <- b
-			w.write <- b
+			w.hashBlock(b)
+			w.send(b)
 			w.off = 0
+			if w.blockLimitReached() {
+				return written, ErrBlockLimitReached
+			}
 		}
 	}
 	return written, nil
@@ -639,16 +2046,17 @@ func (f *fixedWriter) split(w *writer) {
 	if w.off == 0 {
 		return
 	}
-	b := <-w.buffers
+	b := w.buffer()
 	// Swap block with current
 	w.cur, b.data = b.data[:w.maxSize], w.cur[:w.off]
+	b.cut, b.boundary = w.splitReason(), 0
 	w.mu.Lock()
 	b.N = w.nblocks
 	w.nblocks++
 	w.mu.Unlock()
 
-	w.input <- b
-	w.write <- b
+	w.hashBlock(b)
+	w.send(b)
 	w.off = 0
 }
 
@@ -685,7 +2093,8 @@ type zpaqWriter struct {
 	maxFragment int
 	minFragment int
 	maxHash     uint32
-	o1          [256]byte // order 1 context -> predicted byte
+	o1          [256]byte      // order 1 context -> predicted byte
+	adapt       *adaptiveState // Adjusts maxHash in adaptive mode.
 }
 
 // Split blocks. Typically block size will be maxSize / 4
@@ -716,36 +2125,82 @@ func (z *zpaqWriter) write(w *writer, b []byte) (int, error) {
 	c1 := z.c1
 	h := z.h
 	off := w.off
-	for _, c := range b {
-		if c == z.o1[c1] {
-			h = (h + uint32(c) + 1) * 314159265
-		} else {
-			h = (h + uint32(c) + 1) * 271828182
+	o1 := &z.o1
+	inLen := len(b)
+	for len(b) > 0 {
+		// Limit the input to the end of the maximum fragment,
+		// so only the hash must be checked for each byte.
+		in := b
+		if len(in) > z.maxFragment-off {
+			in = in[:z.maxFragment-off]
+		}
+		// Bytes before the minimum fragment size cannot end the block.
+		n := z.minFragment - off - 1
+		if n < 0 {
+			n = 0
+		} else if n > len(in) {
+			n = len(in)
+		}
+		for _, c := range in[:n] {
+			m := uint32(271828182)
+			if c == o1[c1] {
+				m = 314159265
+			}
+			h = (h + uint32(c) + 1) * m
+			o1[c1] = c
+			c1 = c
+		}
+		content := false
+		maxHash := z.maxHash
+		for _, c := range in[n:] {
+			m := uint32(271828182)
+			if c == o1[c1] {
+				m = 314159265
+			}
+			h = (h + uint32(c) + 1) * m
+			o1[c1] = c
+			c1 = c
+			n++
+			if h < maxHash {
+				content = true
+				break
+			}
 		}
-		z.o1[c1] = c
-		c1 = c
-		w.cur[off] = c
-		off++
+		copy(w.cur[off:], in[:n])
+		off += n
+		b = b[n:]
 
 		// At a break point? Send it off!
-		if (off >= z.minFragment && h < z.maxHash) || off >= z.maxFragment {
-			b := <-w.buffers
+		if content || off >= z.maxFragment {
+			blk := w.buffer()
 			// Swap block with current
-			w.cur, b.data = b.data[:w.maxSize], w.cur[:off]
-			b.N = w.nblocks
+			w.cur, blk.data = blk.data[:w.maxSize], w.cur[:off]
+			blk.cut, blk.boundary = CutMaxSize, h
+			if content {
+				blk.cut = CutContent
+			}
+			blk.N = w.nblocks
 
-			w.input <- b
-			w.write <- b
+			w.hashBlock(blk)
+			w.send(blk)
 			w.nblocks++
 			off = 0
 			h = 0
 			c1 = 0
+			if z.adapt != nil {
+				z.maxHash = z.adapt.update(w)
+			}
+			if w.blockLimitReached() {
+				w.off, z.h, z.c1 = 0, 0, 0
+				return inLen - len(b), ErrBlockLimitReached
+			}
 		}
 	}
 	w.off = off
 	z.h = h
 	z.c1 = c1
-	return len(b), nil
+	w.hashCur(off)
+	return inLen, nil
 }
 
 // Split content, so a new block begins with next write
@@ -753,19 +2208,30 @@ func (z *zpaqWriter) split(w *writer) {
 	if w.off == 0 {
 		return
 	}
-	b := <-w.buffers
+	b := w.buffer()
 	// Swap block with current
 	w.cur, b.data = b.data[:w.maxSize], w.cur[:w.off]
+	b.cut, b.boundary = w.splitReason(), z.h
 	w.mu.Lock()
 	b.N = w.nblocks
 	w.nblocks++
 	w.mu.Unlock()
 
-	w.input <- b
-	w.write <- b
+	w.hashBlock(b)
+	w.send(b)
 	w.off = 0
 	z.h = 0
 	z.c1 = 0
+	if z.adapt != nil {
+		z.maxHash = z.adapt.update(w)
+	}
+}
+
+// Reset the rolling hash and the order 1 model.
+func (z *zpaqWriter) reset() {
+	z.h = 0
+	z.c1 = 0
+	z.o1 = [256]byte{}
 }
 
 // Split blocks based on entropy distribution.
@@ -817,41 +2283,76 @@ func (e *entWriter) write(w *writer, b []byte) (int, error) {
 		if len(b2)+e.histLen > e.minFragment {
 			b2 = b2[:e.minFragment-e.histLen]
 		}
-		off := w.off
-		for i := range b2 {
-			v := b2[i]
+		// The current block may have been started by a previous write.
+		if len(b2) > e.maxFragment-w.off {
+			b2 = b2[:e.maxFragment-w.off]
+		}
+		for _, v := range b2 {
 			e.hist[v]++
-			w.cur[off+i] = v
 		}
+		copy(w.cur[w.off:], b2)
 		e.histLen += len(b2)
 		w.off += len(b2)
 		b = b[len(b2):]
 	}
-	if len(b) == 0 {
-		return inLen, nil
-	}
 
 	// Transfer to local variables ~30% faster.
 	h := e.h
 	off := w.off
-	for _, c := range b {
-		if e.hist[c] >= e.avgHist {
-			h = (h + uint32(c) + 1) * 314159265
-		} else {
-			h = (h + uint32(c) + 1) * 271828182
+	hist := &e.hist
+	avg := e.avgHist
+	for len(b) > 0 || off >= e.maxFragment {
+		// Limit the input to the end of the maximum fragment,
+		// so only the hash must be checked for each byte.
+		in := b
+		if len(in) > e.maxFragment-off {
+			in = in[:e.maxFragment-off]
+		}
+		// Bytes before the minimum fragment size cannot end the block.
+		n := e.minFragment - off - 1
+		if n < 0 {
+			n = 0
+		} else if n > len(in) {
+			n = len(in)
+		}
+		for _, c := range in[:n] {
+			m := uint32(271828182)
+			if hist[c] >= avg {
+				m = 314159265
+			}
+			h = (h + uint32(c) + 1) * m
+		}
+		content := false
+		maxHash := e.maxHash
+		for _, c := range in[n:] {
+			m := uint32(271828182)
+			if hist[c] >= avg {
+				m = 314159265
+			}
+			h = (h + uint32(c) + 1) * m
+			n++
+			if h < maxHash {
+				content = true
+				break
+			}
 		}
-		w.cur[off] = c
-		off++
+		copy(w.cur[off:], in[:n])
+		off += n
+		b = b[n:]
 
 		// At a break point? Send it off!
-		if (off >= e.minFragment && h < e.maxHash) || off >= e.maxFragment {
-			b := <-w.buffers
+		if content || off >= e.maxFragment {
+			blk := w.buffer()
 			// Swap block with current
-			w.cur, b.data = b.data[:w.maxSize], w.cur[:off]
-			b.N = w.nblocks
+			w.cur, blk.data = blk.data[:w.maxSize], w.cur[:off]
+			blk.cut, blk.boundary = CutMaxSize, h
+			if content {
+				blk.cut = CutContent
+			}
+			blk.N = w.nblocks
 
-			w.input <- b
-			w.write <- b
+			w.hashBlock(blk)
+			w.send(blk)
 			e.histLen = 0
 			for i := range e.hist {
 				e.hist[i] = 0
@@ -859,10 +2360,15 @@ func (e *entWriter) write(w *writer, b []byte) (int, error) {
 			w.nblocks++
 			off = 0
 			h = 0
+			if w.blockLimitReached() {
+				w.off, e.h = 0, 0
+				return inLen - len(b), ErrBlockLimitReached
+			}
 		}
 	}
 	w.off = off
 	e.h = h
+	w.hashCur(off)
 	return inLen, nil
 }
 
@@ -871,16 +2377,17 @@ func (e *entWriter) split(w *writer) {
 	if w.off == 0 {
 		return
 	}
-	b := <-w.buffers
+	b := w.buffer()
 	// Swap block with current
 	w.cur, b.data = b.data[:w.maxSize], w.cur[:w.off]
+	b.cut, b.boundary = w.splitReason(), e.h
 	w.mu.Lock()
 	b.N = w.nblocks
 	w.nblocks++
 	w.mu.Unlock()
 
-	w.input <- b
-	w.write <- b
+	w.hashBlock(b)
+	w.send(b)
 	w.off = 0
 	e.h = 0
 	e.histLen = 0
@@ -888,3 +2395,10 @@ func (e *entWriter) split(w *writer) {
 		e.hist[i] = 0
 	}
 }
+
+// Reset the rolling hash and the histogram.
+func (e *entWriter) reset() {
+	e.h = 0
+	e.histLen = 0
+	e.hist = [256]uint16{}
+}
@@ -2,14 +2,20 @@ package dedup_test
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/klauspost/dedup"
 )
@@ -372,6 +378,39 @@ func TestDynamicEntropyWriter(t *testing.T) {
 	}
 }
 
+// Writes larger than the minimum fragment size must not
+// overflow a block started by a previous write.
+func TestDynamicWriterLargeWrites(t *testing.T) {
+	const size = 1 << 10
+	b := getBufferSize(1 << 20).Bytes()
+	for _, mode := range []dedup.Mode{dedup.ModeDynamic, dedup.ModeDynamicEntropy, dedup.ModeAdaptive} {
+		var stream bytes.Buffer
+		w, err := dedup.NewStreamWriter(&stream, mode, size, 16*size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(b); i += 4 << 10 {
+			if _, err := w.Write(b[i : i+4<<10]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := dedup.NewStreamReader(&stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, out) {
+			t.Fatal("Output mismatch, mode", mode)
+		}
+	}
+}
+
 func TestFixedStreamWriter(t *testing.T) {
 	data := bytes.Buffer{}
 
@@ -683,6 +722,134 @@ func BenchmarkDynamicWriter4K(t *testing.B) {
 	}
 }
 
+// benchmarkTextFragments will split text, where the rolling hash
+// of the dynamic modes is hard to predict.
+func benchmarkTextFragments(t *testing.B, mode dedup.Mode) {
+	words := strings.Fields("the quick brown fox jumps over the lazy dog and then some")
+	rng := rand.New(rand.NewSource(1))
+	var b []byte
+	for len(b) < 10<<20 {
+		b = append(b, words[rng.Intn(len(words))]...)
+		b = append(b, ' ')
+	}
+	t.ResetTimer()
+	t.SetBytes(int64(len(b)))
+	for i := 0; i < t.N; i++ {
+		out := make(chan dedup.Fragment, 10)
+		go func() {
+			for range out {
+			}
+		}()
+		w, _ := dedup.NewSplitter(out, mode, 64<<10)
+		w.Write(b)
+		err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDynamicTextFragments64K(t *testing.B) {
+	benchmarkTextFragments(t, dedup.ModeDynamic)
+}
+
+func BenchmarkDynamicEntropyTextFragments64K(t *testing.B) {
+	benchmarkTextFragments(t, dedup.ModeDynamicEntropy)
+}
+
+func benchmarkEvictionFraction(t *testing.B, f float64) {
+	const size = 4 << 10
+	b := getVersionedDocuments(1<<20, 10, 50)
+	var saved, blocks int64
+	t.ResetTimer()
+	t.SetBytes(int64(len(b)))
+	for i := 0; i < t.N; i++ {
+		// Blocks average 1K, so this is memory for about 1.5 versions.
+		w, _ := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeDynamic, size, 6<<20, dedup.WithEvictionFraction(f))
+		io.Copy(w, bytes.NewBuffer(b))
+		err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := w.Stats()
+		saved = s.Bytes - s.NewBytes
+		blocks = int64(s.Blocks)
+	}
+	t.ReportMetric(float64(t.Elapsed().Nanoseconds())/float64(int64(t.N)*blocks), "ns/block")
+	t.ReportMetric(float64(saved)*100/float64(len(b)), "%saved")
+}
+
+// Versioned documents with 4K blocks, evicting 1/8 on overflow.
+func BenchmarkEvictionFraction8th(t *testing.B) {
+	benchmarkEvictionFraction(t, 0.125)
+}
+
+// Versioned documents with 4K blocks, evicting 1/4 on overflow.
+func BenchmarkEvictionFractionQuarter(t *testing.B) {
+	benchmarkEvictionFraction(t, 0.25)
+}
+
+// Versioned documents with 4K blocks, evicting 1/2 on overflow.
+func BenchmarkEvictionFractionHalf(t *testing.B) {
+	benchmarkEvictionFraction(t, 0.5)
+}
+
+func benchmarkIncrementalHash(t *testing.B, enabled bool) {
+	const totalinput = 64 << 20
+	const size = 1 << 20
+	b := getBufferSize(totalinput).Bytes()
+	t.ResetTimer()
+	t.SetBytes(totalinput)
+	for i := 0; i < t.N; i++ {
+		w, _ := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.WithIncrementalHash(enabled))
+		for in := b; len(in) > 0; in = in[64<<10:] {
+			w.Write(in[:64<<10])
+		}
+		err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 1MB blocks hashed by the hashers after the block is complete.
+func BenchmarkTwoPassHash1M(t *testing.B) {
+	benchmarkIncrementalHash(t, false)
+}
+
+// 1MB blocks hashed while writing.
+func BenchmarkIncrementalHash1M(t *testing.B) {
+	benchmarkIncrementalHash(t, true)
+}
+
+func benchmarkPipelineShards(t *testing.B, n int) {
+	const totalinput = 64 << 20
+	const size = 4 << 10
+	b := getBufferSize(totalinput).Bytes()
+	t.ResetTimer()
+	t.SetBytes(totalinput)
+	for i := 0; i < t.N; i++ {
+		w, _ := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.WithPipelineShards(n))
+		for in := b; len(in) > 0; in = in[64<<10:] {
+			w.Write(in[:64<<10])
+		}
+		err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 4K blocks with a single hashing pipeline.
+func BenchmarkPipelineShards1(t *testing.B) {
+	benchmarkPipelineShards(t, 1)
+}
+
+// 4K blocks with a hashing pipeline per two cores.
+func BenchmarkPipelineShardsHalf(t *testing.B) {
+	benchmarkPipelineShards(t, (runtime.GOMAXPROCS(0)+1)/2)
+}
+
 func BenchmarkFixedStreamWriter4K(t *testing.B) {
 	const totalinput = 10 << 20
 	input := getBufferSize(totalinput)
@@ -710,6 +877,2103 @@ func BenchmarkFixedStreamWriter4K(t *testing.B) {
 	}
 }
 
+func TestBlockNumberBase(t *testing.T) {
+	const totalinput = 1<<20 + 65
+	const size = 4 << 10
+	b := getBufferSize(totalinput).Bytes()
+	copy(b[totalinput/2:], b[:totalinput/4])
+
+	var outputs [2]bytes.Buffer
+	for i, base := range []int{1, 1 << 30} {
+		w, err := dedup.NewStreamWriter(&outputs[i], dedup.ModeFixed, size, 100*size, dedup.WithBlockNumberBase(base))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(w, bytes.NewBuffer(b))
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Blocks(); got != totalinput/size {
+			t.Fatalf("base %d: expected %d blocks, got %d", base, totalinput/size, got)
+		}
+	}
+	if !bytes.Equal(outputs[0].Bytes(), outputs[1].Bytes()) {
+		t.Fatal("output changed with block number base")
+	}
+
+	_, err := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.WithBlockNumberBase(0))
+	if err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+}
+
+func TestSelfVerify(t *testing.T) {
+	const totalinput = 1<<20 + 65
+	const size = 4 << 10
+	b := getBufferSize(totalinput).Bytes()
+	copy(b[totalinput/2:], b[:totalinput/4])
+
+	for _, mode := range []dedup.Mode{dedup.ModeFixed, dedup.ModeDynamic, dedup.ModeDynamicEntropy} {
+		idx := bytes.Buffer{}
+		data := bytes.Buffer{}
+		w, err := dedup.NewWriter(&idx, &data, mode, size, 0, dedup.WithSelfVerify(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(w, bytes.NewBuffer(b))
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stream := bytes.Buffer{}
+		w, err = dedup.NewStreamWriter(&stream, mode, size, 10*size, dedup.WithSelfVerify(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(w, bytes.NewBuffer(b))
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Output should be unaffected
+		r, err := dedup.NewStreamReader(&stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, out) {
+			t.Fatal("Output mismatch")
+		}
+	}
+}
+
+func TestMaxBackrefBlocks(t *testing.T) {
+	const size = 4 << 10
+	w, err := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 10*size+size/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := w.MaxBackrefBlocks(); got != 10 {
+		t.Fatal("expected 10 blocks, got", got)
+	}
+	w.Close()
+
+	w, err = dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := w.MaxBackrefBlocks(); got != 0 {
+		t.Fatal("expected 0 blocks, got", got)
+	}
+	w.Close()
+
+	w, err = dedup.NewStreamWriter(ioutil.Discard, dedup.ModeDynamic, size, 100*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := w.MaxBackrefBlocks(); got != 100 {
+		t.Fatal("expected 100 blocks, got", got)
+	}
+	w.Close()
+}
+
+func TestWriteChunk(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(size * 10).Bytes()
+
+	// Chunks of varying size, with the first chunk repeated.
+	chunks := [][]byte{b[:size], b[size : size+100], b[:size], b[2*size : 3*size-1], b[:size]}
+	var want []byte
+	idx := bytes.Buffer{}
+	data := bytes.Buffer{}
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeDynamic, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pending data should be written as a separate block.
+	w.Write(b[5*size : 5*size+10])
+	want = append(want, b[5*size:5*size+10]...)
+	for _, c := range chunks {
+		err = w.WriteChunk(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, c...)
+	}
+	err = w.WriteChunk(b[:size+1])
+	if err != dedup.ErrChunkTooLarge {
+		t.Fatal("expected ErrChunkTooLarge, got", err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Len() != 10+size+100+size-1 {
+		t.Fatal("unexpected data size", data.Len())
+	}
+
+	r, err := dedup.NewReader(&idx, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := r.BlockSizes()
+	wantSizes := []int{10, size, 100, size, size - 1, size, 0}
+	if len(sizes) != len(wantSizes) {
+		t.Fatal("unexpected block sizes", sizes)
+	}
+	for i := range sizes {
+		if sizes[i] != wantSizes[i] {
+			t.Fatal("unexpected block sizes", sizes)
+		}
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, out) {
+		t.Fatal("Output mismatch")
+	}
+}
+
+func TestWriteChunkSplitLarge(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(4*size + 100).Bytes()
+	for _, split := range []bool{false, true} {
+		idx := bytes.Buffer{}
+		data := bytes.Buffer{}
+		w, err := dedup.NewWriter(&idx, &data, dedup.ModeDynamic, size, 0, dedup.WithSplitLargeChunks(split))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []byte
+		for _, c := range [][]byte{b[:size+1], b[size+1 : 3*size+1], b[3*size+1:]} {
+			err = w.WriteChunk(c)
+			if !split {
+				if err != dedup.ErrChunkTooLarge {
+					t.Fatal("expected ErrChunkTooLarge, got", err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, c...)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := dedup.NewReader(&idx, &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantSizes := []int{0}
+		if split {
+			wantSizes = []int{size, 1, size, size, size, 99, 0}
+		}
+		if sizes := r.BlockSizes(); fmt.Sprint(sizes) != fmt.Sprint(wantSizes) {
+			t.Fatalf("split %v: unexpected block sizes %v, want %v", split, sizes, wantSizes)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(want, out) {
+			t.Fatal("Output mismatch")
+		}
+	}
+}
+
+func TestBlockLimit(t *testing.T) {
+	const size = 4 << 10
+	const limit = 10
+	b := getBufferSize(1 << 20).Bytes()
+
+	for _, mode := range []dedup.Mode{dedup.ModeFixed, dedup.ModeDynamic, dedup.ModeDynamicEntropy} {
+		data := bytes.Buffer{}
+		w, err := dedup.NewStreamWriter(&data, mode, size, 100*size, dedup.WithBlockLimit(limit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := w.Write(b)
+		if err != dedup.ErrBlockLimitReached {
+			t.Fatal("expected ErrBlockLimitReached, got", err)
+		}
+		if n <= 0 || n >= len(b) {
+			t.Fatal("unexpected write count", n)
+		}
+		_, err = w.Write(b[n:])
+		if err != dedup.ErrBlockLimitReached {
+			t.Fatal("expected ErrBlockLimitReached, got", err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Blocks() != limit {
+			t.Fatal("expected", limit, "blocks, got", w.Blocks())
+		}
+
+		r, err := dedup.NewStreamReader(&data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b[:n], out) {
+			t.Fatal("Output mismatch, mode", mode)
+		}
+	}
+}
+
+func TestUniqueBlockLimit(t *testing.T) {
+	const size = 4 << 10
+	const limit = 10
+	// Input consisting of limit unique blocks repeated.
+	dups := getBufferSize(limit * size).Bytes()
+	var repeated []byte
+	for i := 0; i < 20; i++ {
+		repeated = append(repeated, dups...)
+	}
+	unique := getBufferSize(1 << 20).Bytes()
+
+	writers := map[string]func(opts ...dedup.Option) (dedup.Writer, error){
+		"indexed": func(opts ...dedup.Option) (dedup.Writer, error) {
+			return dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, opts...)
+		},
+		"stream": func(opts ...dedup.Option) (dedup.Writer, error) {
+			return dedup.NewStreamWriter(ioutil.Discard, dedup.ModeFixed, size, 100*size, opts...)
+		},
+		"splitter": func(opts ...dedup.Option) (dedup.Writer, error) {
+			out := make(chan dedup.Fragment, 10)
+			go func() {
+				for range out {
+				}
+			}()
+			return dedup.NewSplitter(out, dedup.ModeFixed, size, opts...)
+		},
+	}
+	for name, fn := range writers {
+		w, err := fn(dedup.WithUniqueBlockLimit(limit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write(repeated)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if s := w.Stats(); s.NewBlocks != limit || s.Blocks != len(repeated)/size {
+			t.Fatalf("%s: unexpected stats %+v", name, s)
+		}
+
+		w, err = fn(dedup.WithUniqueBlockLimit(limit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(w, bytes.NewBuffer(unique))
+		if err == nil {
+			err = w.Close()
+		} else {
+			w.Close()
+		}
+		if err != dedup.ErrTooManyUniqueBlocks {
+			t.Fatalf("%s: expected ErrTooManyUniqueBlocks, got %v", name, err)
+		}
+		if s := w.Stats(); s.NewBlocks != limit {
+			t.Fatalf("%s: expected %d unique blocks, got %+v", name, limit, s)
+		}
+	}
+
+	_, err := dedup.NewStreamWriter(ioutil.Discard, dedup.ModeFixed, size, 100*size, dedup.WithUniqueBlockLimit(-1))
+	if err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+}
+
+func TestValidateWriter(t *testing.T) {
+	tests := []struct {
+		mode      dedup.Mode
+		size, mem uint
+		opts      []dedup.Option
+		want      error
+	}{
+		{mode: dedup.ModeFixed, size: 64 << 10, mem: 0},
+		{mode: dedup.ModeAdaptive, size: 64 << 10, mem: 64 << 10, opts: []dedup.Option{dedup.WithDeltaEncoding(0.5)}},
+		{mode: dedup.Mode(100), size: 64 << 10, want: dedup.ErrUnknownMode},
+		{mode: dedup.ModeFixed, size: 0, want: dedup.ErrSizeTooSmall},
+		{mode: dedup.ModeFixed, size: dedup.MinBlockSize - 1, want: dedup.ErrSizeTooSmall},
+		{mode: dedup.ModeFixed, size: dedup.MaxBlockSize + 1, want: dedup.ErrSizeTooLarge},
+		{mode: dedup.ModeFixed, size: 64 << 10, mem: 1, want: dedup.ErrMaxMemoryTooSmall},
+		{mode: dedup.ModeFixed, size: 64 << 10, opts: []dedup.Option{dedup.WithBlockLimit(-1)}, want: dedup.ErrInvalidOption},
+	}
+	for i, test := range tests {
+		err := dedup.ValidateWriter(test.mode, test.size, test.mem, test.opts...)
+		if err != test.want {
+			t.Errorf("test %d: got %v, want %v", i, err, test.want)
+		}
+		// Constructors must return the same error.
+		w, err := dedup.NewWriter(ioutil.Discard, ioutil.Discard, test.mode, test.size, test.mem, test.opts...)
+		if err != test.want {
+			t.Errorf("test %d: NewWriter returned %v, want %v", i, err, test.want)
+		}
+		if err == nil {
+			w.Close()
+		}
+	}
+	_, err := dedup.NewStreamWriter(ioutil.Discard, dedup.ModeFixed, 64<<10, 0)
+	if err != dedup.ErrMaxMemoryTooSmall {
+		t.Error("expected ErrMaxMemoryTooSmall, got", err)
+	}
+	_, err = dedup.NewSplitter(make(chan dedup.Fragment), dedup.ModeFixed, 0)
+	if err != dedup.ErrSizeTooSmall {
+		t.Error("expected ErrSizeTooSmall, got", err)
+	}
+}
+
+// syncBuffer records calls to Sync.
+type syncBuffer struct {
+	bytes.Buffer
+	name  string
+	syncs *[]string
+}
+
+func (s *syncBuffer) Sync() error {
+	*s.syncs = append(*s.syncs, s.name)
+	return nil
+}
+
+func TestWriterSync(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(2<<20 + 100).Bytes()
+	var syncs []string
+	idx := &syncBuffer{name: "index", syncs: &syncs}
+	data := &syncBuffer{name: "blocks", syncs: &syncs}
+	w, err := dedup.NewWriter(idx, data, dedup.ModeFixed, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := len(b) / 2
+	if _, err := w.Write(b[:half]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// All written data must have reached the output.
+	if data.Len() != half {
+		t.Fatalf("expected %d bytes in block stream, got %d", half, data.Len())
+	}
+	if s := w.Stats(); s.Bytes != int64(half) {
+		t.Fatalf("expected %d bytes processed, got %d", half, s.Bytes)
+	}
+	if len(syncs) != 2 || syncs[0] != "blocks" || syncs[1] != "index" {
+		t.Fatal("unexpected sync order", syncs)
+	}
+	if _, err := w.Write(b[half:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if len(syncs) != 4 {
+		t.Fatal("unexpected syncs", syncs)
+	}
+
+	r, err := dedup.NewReader(&idx.Buffer, &data.Buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, out) {
+		t.Fatal("Output mismatch")
+	}
+}
+
+func TestWriterExactMultiple(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(64 * size).Bytes()
+	for _, explicit := range []bool{false, true} {
+		opt := dedup.WithExplicitLengths(explicit)
+		for _, mode := range []dedup.Mode{dedup.ModeFixed, dedup.ModeDynamic} {
+			var idx, data, stream bytes.Buffer
+			w, err := dedup.NewWriter(&idx, &data, mode, size, 0, opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(b)
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			w, err = dedup.NewStreamWriter(&stream, mode, size, 64*size, opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(b)
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, in := range []*bytes.Buffer{&idx, &stream} {
+				// The last block must be empty, never a full block.
+				var dump bytes.Buffer
+				if err := dedup.DumpIndex(bytes.NewReader(in.Bytes()), &dump); err != nil {
+					t.Fatal(err)
+				}
+				want := "last block, size 0,"
+				if mode == dedup.ModeDynamic {
+					want = "last block, size "
+				}
+				if !strings.Contains(dump.String(), want) {
+					t.Fatalf("mode %d, explicit %v: no %q in dump:\n%s", mode, explicit, want, dump.String())
+				}
+				if strings.Contains(dump.String(), fmt.Sprintf("last block, size %d,", size)) {
+					t.Fatalf("mode %d, explicit %v: full last block", mode, explicit)
+				}
+			}
+
+			r, err := dedup.NewReader(&idx, &data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, out) {
+				t.Fatal("Output mismatch, mode", mode)
+			}
+			sizes := r.BlockSizes()
+			if mode == dedup.ModeFixed && (len(sizes) != 65 || sizes[64] != 0) {
+				t.Fatal("unexpected block sizes", sizes)
+			}
+			sr, err := dedup.NewStreamReader(&stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err = ioutil.ReadAll(sr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, out) {
+				t.Fatal("Stream output mismatch, mode", mode)
+			}
+		}
+	}
+}
+
+func TestWithoutDeduplication(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(1 << 20).Bytes()
+	// Second half is a copy of the first.
+	copy(b[512<<10:], b[:512<<10])
+
+	for _, mode := range []dedup.Mode{dedup.ModeFixed, dedup.ModeDynamic} {
+		var sizes [2]int
+		var blocks [2]int
+		for i, enabled := range []bool{true, false} {
+			var idx, data bytes.Buffer
+			w, err := dedup.NewWriter(&idx, &data, mode, size, 0, dedup.WithDeduplication(enabled), dedup.WithDeltaEncoding(0.5))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(b)
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			s := w.Stats()
+			if !enabled && (s.NewBlocks != s.Blocks || s.NewBytes != int64(len(b))) {
+				t.Fatalf("mode %d: expected all blocks to be new, got %+v", mode, s)
+			}
+			sizes[i] = data.Len()
+			blocks[i] = s.Blocks
+
+			r, err := dedup.NewReader(&idx, &data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, out) {
+				t.Fatal("Output mismatch, mode", mode)
+			}
+		}
+		if blocks[0] != blocks[1] {
+			t.Fatalf("mode %d: block count changed, %d != %d", mode, blocks[0], blocks[1])
+		}
+		if sizes[1] != len(b) || sizes[0] > len(b)*6/10 {
+			t.Fatalf("mode %d: unexpected data sizes %v", mode, sizes)
+		}
+	}
+}
+
+func TestForEachIndexEntry(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(2 << 20).Bytes()
+	// Second half is a copy of the first.
+	copy(b[1<<20:], b[:1<<20])
+
+	w, err := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Iterate while writing.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			w.ForEachIndexEntry(func(hash [dedup.HashSize]byte, blockNum int) bool {
+				return true
+			})
+		}
+	}()
+	io.Copy(w, bytes.NewBuffer(b))
+	<-done
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := 0
+	w.ForEachIndexEntry(func(hash [dedup.HashSize]byte, blockNum int) bool {
+		seen++
+		// All blocks are repeated in the second half.
+		if blockNum <= len(b)/size/2 || blockNum > len(b)/size {
+			t.Errorf("unexpected block number %d", blockNum)
+		}
+		return true
+	})
+	if seen != len(b)/size/2 {
+		t.Fatalf("expected %d entries, got %d", len(b)/size/2, seen)
+	}
+
+	// Stop iterating.
+	seen = 0
+	w.ForEachIndexEntry(func(hash [dedup.HashSize]byte, blockNum int) bool {
+		seen++
+		return false
+	})
+	if seen != 1 {
+		t.Fatal("expected iteration to stop, got", seen)
+	}
+}
+
+func TestMinReferenceDistance(t *testing.T) {
+	const size = 4 << 10
+	const dist = 4
+	blk := getBufferSize(size).Bytes()
+	var b []byte
+	for i := 0; i < 20; i++ {
+		b = append(b, blk...)
+	}
+	for _, stream := range []bool{false, true} {
+		for _, minDist := range []int{0, dist} {
+			var idx, data bytes.Buffer
+			var w dedup.Writer
+			var err error
+			opt := dedup.WithMinReferenceDistance(minDist)
+			if stream {
+				w, err = dedup.NewStreamWriter(&idx, dedup.ModeFixed, size, 100*size, opt)
+			} else {
+				w, err = dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0, opt)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(b)
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			want := 1
+			if minDist > 0 {
+				// Only every dist'th block can be a reference.
+				want = 20 - 20/dist + 1
+			}
+			if got := w.Stats().NewBlocks; got != want {
+				t.Fatalf("stream %v, distance %d: expected %d new blocks, got %d", stream, minDist, want, got)
+			}
+
+			var dump bytes.Buffer
+			if err := dedup.DumpIndex(bytes.NewReader(idx.Bytes()), &dump); err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range strings.Split(dump.String(), "\n") {
+				var pos, n, offset int
+				_, err := fmt.Sscanf(line, "%d: block %d: backreference offset %d", &pos, &n, &offset)
+				if err == nil && offset < minDist {
+					t.Fatalf("stream %v: reference distance %d < %d", stream, offset, minDist)
+				}
+			}
+
+			var r dedup.Reader
+			if stream {
+				r, err = dedup.NewStreamReader(&idx)
+			} else {
+				r, err = dedup.NewReader(&idx, &data)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, out) {
+				t.Fatal("Output mismatch")
+			}
+		}
+	}
+}
+
+func TestEvictionObserver(t *testing.T) {
+	const size = 1 << 10
+	b := getBufferSize(100*size + 10).Bytes()
+	var mu sync.Mutex
+	var evicted, calls, last int
+	obs := dedup.WithEvictionObserver(func(n, cutoff int, dur time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		if cutoff < last {
+			t.Errorf("cutoff went from %d to %d", last, cutoff)
+		}
+		evicted += n
+		last = cutoff
+		calls++
+	})
+	var idx, data bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 8*size, obs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	remain := 0
+	w.ForEachIndexEntry(func([dedup.HashSize]byte, int) bool {
+		remain++
+		return true
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if calls == 0 {
+		t.Fatal("observer was not called")
+	}
+	// The last block is written on Close and isn't added to the index.
+	want := w.Stats().NewBlocks - 1
+	if got := evicted + remain; got != want {
+		t.Fatalf("expected %d evicted and remaining entries, got %d (%d evicted)", want, got, evicted)
+	}
+}
+
+func TestDedupPredicate(t *testing.T) {
+	const size = 4 << 10
+	blk := getBufferSize(size).Bytes()
+	var b []byte
+	for i := 0; i < 20; i++ {
+		b = append(b, blk...)
+	}
+	// Even blocks must be stored.
+	opt := dedup.WithDedupPredicate(func(h [dedup.HashSize]byte, n int) bool {
+		if h != sha1.Sum(blk) {
+			t.Errorf("block %d: unexpected hash", n)
+		}
+		return n%2 == 1
+	})
+	for _, stream := range []bool{false, true} {
+		var idx, data bytes.Buffer
+		var w dedup.Writer
+		var err error
+		if stream {
+			w, err = dedup.NewStreamWriter(&idx, dedup.ModeFixed, size, 100*size, opt, dedup.WithDeltaEncoding(0.5))
+		} else {
+			w, err = dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0, opt)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(b)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Stats().NewBlocks; got != 11 {
+			t.Fatalf("stream %v: expected 11 new blocks, got %d", stream, got)
+		}
+		// Forced blocks must not be delta encoded.
+		if n := idx.Len() + data.Len(); n < 11*size {
+			t.Fatalf("stream %v: expected at least %d bytes of output, got %d", stream, 11*size, n)
+		}
+		var r dedup.Reader
+		if stream {
+			r, err = dedup.NewStreamReader(&idx)
+		} else {
+			r, err = dedup.NewReader(&idx, &data)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, out) {
+			t.Fatalf("stream %v: output mismatch", stream)
+		}
+		r.Close()
+	}
+}
+
+func TestProgressPercent(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(100*size + 10).Bytes()
+	for _, expected := range []int64{int64(len(b)), int64(len(b)) / 2, int64(len(b)) * 2, 0} {
+		var mu sync.Mutex
+		var got []float64
+		progress := dedup.WithProgressPercent(func(f float64) {
+			mu.Lock()
+			got = append(got, f)
+			mu.Unlock()
+		})
+		var idx, data bytes.Buffer
+		w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0, dedup.WithExpectedSize(expected), progress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(b)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		if expected == 0 {
+			if len(got) != 0 {
+				t.Fatal("unexpected progress without expected size:", got)
+			}
+			mu.Unlock()
+			continue
+		}
+		if len(got) != 101 {
+			t.Fatalf("expected 101 progress reports, got %d", len(got))
+		}
+		for i := 1; i < len(got); i++ {
+			if got[i] < got[i-1] || got[i] > 1 {
+				t.Fatalf("unexpected progress %v after %v", got[i], got[i-1])
+			}
+		}
+		want := float64(len(b)) / float64(expected)
+		if want > 1 {
+			want = 1
+		}
+		if last := got[len(got)-1]; last != want {
+			t.Errorf("expected final progress %v, got %v", want, last)
+		}
+		mu.Unlock()
+	}
+
+	_, err := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.WithExpectedSize(-1))
+	if err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+}
+
+func TestNilOutput(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := dedup.NewWriter(nil, &buf, dedup.ModeFixed, 1024, 0)
+	if err != dedup.ErrNilOutput {
+		t.Fatal("nil index: expected ErrNilOutput, got", err)
+	}
+	_, err = dedup.NewWriter(&buf, nil, dedup.ModeFixed, 1024, 0)
+	if err != dedup.ErrNilOutput {
+		t.Fatal("nil blocks: expected ErrNilOutput, got", err)
+	}
+	_, err = dedup.NewStreamWriter(nil, dedup.ModeFixed, 1024, 10*1024)
+	if err != dedup.ErrNilOutput {
+		t.Fatal("nil stream: expected ErrNilOutput, got", err)
+	}
+	_, err = dedup.NewShardedWriter(&buf, []io.Writer{&buf, nil}, dedup.ModeFixed, 1024, 0)
+	if err != dedup.ErrNilOutput {
+		t.Fatal("nil shard: expected ErrNilOutput, got", err)
+	}
+	_, err = dedup.NewSplitter(nil, dedup.ModeFixed, 1024)
+	if err != dedup.ErrNilOutput {
+		t.Fatal("nil channel: expected ErrNilOutput, got", err)
+	}
+	_, err = dedup.NewBlocksOnlyWriter(nil, dedup.ModeFixed, 1024, nil)
+	if err != dedup.ErrNilOutput {
+		t.Fatal("nil blocks only: expected ErrNilOutput, got", err)
+	}
+
+	// The index is not used with a finalizer.
+	fn := func(index, blocks io.Reader) error { return nil }
+	w, err := dedup.NewWriter(nil, &buf, dedup.ModeFixed, 1024, 0, dedup.WithFinalizer(fn, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClosedOutput(t *testing.T) {
+	f, err := ioutil.TempFile("", "dedup-closed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	var buf bytes.Buffer
+	_, err = dedup.NewWriter(f, &buf, dedup.ModeFixed, 1024, 0)
+	if !errors.Is(err, os.ErrClosed) {
+		t.Fatal("expected os.ErrClosed, got", err)
+	}
+
+	// Close the index after the header has been written.
+	for _, blocks := range []io.Writer{&buf, nil} {
+		idx, err := os.OpenFile(f.Name(), os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var w dedup.Writer
+		if blocks != nil {
+			w, err = dedup.NewWriter(idx, blocks, dedup.ModeFixed, 1024, 0)
+		} else {
+			w, err = dedup.NewStreamWriter(idx, dedup.ModeFixed, 1024, 10*1024)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx.Close()
+		_, err = w.Write(getBufferSize(100 * 1024).Bytes())
+		if err == nil {
+			err = w.Close()
+		}
+		if !errors.Is(err, os.ErrClosed) {
+			t.Fatal("expected os.ErrClosed, got", err)
+		}
+	}
+}
+
+func TestEvictionFraction(t *testing.T) {
+	const size = 1024
+	b := getBufferSize(size*1000 + 100).Bytes()
+	for _, f := range []float64{0.125, 0.5} {
+		var evictions, evicted int
+		var mu sync.Mutex
+		observe := func(n, cutoff int, dur time.Duration) {
+			mu.Lock()
+			evictions++
+			evicted += n
+			mu.Unlock()
+		}
+		var idx, data bytes.Buffer
+		w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 100*size, dedup.WithEvictionFraction(f), dedup.WithEvictionObserver(observe))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+			t.Fatal(err)
+		}
+		// All blocks are unique, so each eviction removes the fraction.
+		if want := int(100 * f); evictions == 0 || evicted != evictions*want {
+			t.Fatalf("fraction %v: %d evictions removed %d entries, expected %d each", f, evictions, evicted, want)
+		}
+		t.Logf("fraction %v: %d evictions", f, evictions)
+		r, err := dedup.NewReader(&idx, &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, out) {
+			t.Fatal("Output mismatch")
+		}
+	}
+	for _, f := range []float64{0, 1, -0.5} {
+		_, err := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.WithEvictionFraction(f))
+		if err != dedup.ErrInvalidOption {
+			t.Fatalf("fraction %v: expected ErrInvalidOption, got %v", f, err)
+		}
+	}
+}
+
+// TestEvictionFractionSmallIndex checks that a fraction that rounds down
+// to no blocks still evicts, when maxMemory only allows a few blocks.
+func TestEvictionFractionSmallIndex(t *testing.T) {
+	const size = 1024
+	b := getBufferSize(64 << 10).Bytes()
+	for _, f := range []float64{0.1, 0.125, 0.25} {
+		var idx, data bytes.Buffer
+		w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 5*size, dedup.WithEvictionFraction(f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+			t.Fatalf("fraction %v: %v", f, err)
+		}
+		r, err := dedup.NewReader(&idx, &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, out) {
+			t.Fatalf("fraction %v: output mismatch", f)
+		}
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	const size = 1024
+	b := getBufferSize(4<<20 + 100).Bytes()
+	// Create some duplicates
+	copy(b[2<<20:], b[:1<<20])
+
+	var idx, data bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeDynamic, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Pause()
+	written := make(chan error)
+	go func() {
+		_, err := io.Copy(w, bytes.NewBuffer(b))
+		written <- err
+	}()
+	// Blocks being processed when pausing may still be completed.
+	time.Sleep(50 * time.Millisecond)
+	blocks := w.Stats().Blocks
+	time.Sleep(50 * time.Millisecond)
+	if got := w.Stats().Blocks; got != blocks {
+		t.Fatalf("blocks processed while paused, %d -> %d", blocks, got)
+	}
+	select {
+	case <-written:
+		t.Fatal("all input consumed while paused")
+	default:
+	}
+	w.Resume()
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	// Close resumes a paused writer.
+	w.Pause()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := dedup.NewReader(&idx, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, out) {
+		t.Fatal("Output mismatch")
+	}
+}
+
+func TestPresets(t *testing.T) {
+	const size = 1024
+	b := getBufferSize(1<<20 + 100).Bytes()
+	// Create some duplicates
+	copy(b[512<<10:], b[:256<<10])
+	for _, p := range []dedup.Preset{dedup.PresetThroughput, dedup.PresetLatency} {
+		// Also test an index too small for the eviction fraction of the preset.
+		for _, maxMem := range []uint{200 * size, 5 * size} {
+			var idx, data bytes.Buffer
+			w, err := dedup.NewWriter(&idx, &data, dedup.ModeDynamic, size, maxMem, dedup.WithPreset(p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+				t.Fatal(err)
+			}
+			r, err := dedup.NewReader(&idx, &data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, out) {
+				t.Fatal("Output mismatch")
+			}
+		}
+	}
+	_, err := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.WithPreset(0))
+	if err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+	_, err = dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.WithBufferMultiplier(-1))
+	if err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+}
+
+func TestRunObserver(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(40 * size).Bytes()
+	// Blocks 16 to 31 are duplicates of the first 16 blocks.
+	copy(b[16*size:32*size], b[:16*size])
+
+	type run struct {
+		kind   dedup.RunKind
+		length int
+	}
+	var runs []run
+	var idx, data bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0, dedup.WithRunObserver(func(kind dedup.RunKind, length int) {
+		runs = append(runs, run{kind: kind, length: length})
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Add a partial last block.
+	w.Write(append(b, 1, 2, 3))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []run{{dedup.RunNew, 16}, {dedup.RunDuplicate, 16}, {dedup.RunNew, 9}}
+	if fmt.Sprint(runs) != fmt.Sprint(want) {
+		t.Fatalf("got runs %v, want %v", runs, want)
+	}
+}
+
+func TestIncrementalHash(t *testing.T) {
+	const size = 16 << 10
+	b := getBufferSize(1<<20 + 100).Bytes()
+	// Create some duplicates
+	copy(b[512<<10:], b[:256<<10])
+	modes := []dedup.Mode{dedup.ModeFixed, dedup.ModeDynamic, dedup.ModeDynamicEntropy}
+	for _, mode := range modes {
+		var idx, data, idx2, data2 bytes.Buffer
+		w, err := dedup.NewWriter(&idx, &data, mode, size, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w2, err := dedup.NewWriter(&idx2, &data2, mode, size, 0, dedup.WithIncrementalHash(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Write in odd sizes, with a chunk in the middle.
+		for i, in := 0, b; len(in) > 0; i++ {
+			n := 1000 + i*7
+			if n > len(in) {
+				n = len(in)
+			}
+			if i == 100 {
+				n = 100
+				w.WriteChunk(in[:n])
+				w2.WriteChunk(in[:n])
+			} else {
+				w.Write(in[:n])
+				w2.Write(in[:n])
+			}
+			in = in[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w2.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(idx.Bytes(), idx2.Bytes()) || !bytes.Equal(data.Bytes(), data2.Bytes()) {
+			t.Fatalf("mode %d: output mismatch", mode)
+		}
+	}
+}
+
+func TestEmptyMarkers(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(64 << 10).Bytes()
+	// Messages, some empty and some duplicated.
+	var msgs [][]byte
+	for i := 0; i < 40; i++ {
+		switch i % 4 {
+		case 0:
+			msgs = append(msgs, nil)
+		case 1:
+			msgs = append(msgs, b[:100+i])
+		default:
+			msgs = append(msgs, b[i*1000:i*1000+i*100])
+		}
+	}
+	// A message ending at a block boundary, followed by an empty message.
+	msgs = append(msgs, b[:size], nil)
+	write := func(w dedup.Writer) {
+		for _, m := range msgs {
+			w.Write(m)
+			if len(m) > 0 {
+				w.Split()
+			}
+			w.Split()
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// check will read the messages from r.
+	check := func(r dedup.Reader) {
+		defer r.Close()
+		buf := make([]byte, r.MaxBlockSize())
+		var got [][]byte
+		var cur []byte
+		for {
+			n, err := r.ReadBlock(buf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n == 0 {
+				got = append(got, cur)
+				cur = nil
+				continue
+			}
+			cur = append(cur, buf[:n]...)
+		}
+		if len(cur) > 0 || len(got) != len(msgs) {
+			t.Fatalf("got %d messages, expected %d", len(got), len(msgs))
+		}
+		for i := range msgs {
+			if !bytes.Equal(msgs[i], got[i]) {
+				t.Fatal("message mismatch", i)
+			}
+		}
+	}
+	for _, mode := range []dedup.Mode{dedup.ModeFixed, dedup.ModeDynamic} {
+		var stream bytes.Buffer
+		w, err := dedup.NewStreamWriter(&stream, mode, size, 4*size, dedup.WithEmptyMarkers(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(w)
+		if w.Stats().NewBlocks == w.Stats().Blocks {
+			t.Fatal("expected duplicates")
+		}
+		r, err := dedup.NewStreamReader(bytes.NewReader(stream.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(r)
+
+		// Read must return the content without markers.
+		r, err = dedup.NewStreamReader(bytes.NewReader(stream.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bytes.Join(msgs, nil), out) {
+			t.Fatal("Output mismatch")
+		}
+
+		var idx, data bytes.Buffer
+		w, err = dedup.NewWriter(&idx, &data, mode, size, 0, dedup.WithEmptyMarkers(true), dedup.WithDeltaEncoding(0.5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(w)
+		ir, err := dedup.NewReader(&idx, &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(ir)
+	}
+
+	_, err := dedup.NewSplitter(make(chan dedup.Fragment), dedup.ModeFixed, size, dedup.WithEmptyMarkers(true))
+	if err == nil {
+		t.Fatal("expected error from splitter")
+	}
+}
+
+func TestLongestDuplicateRun(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(32*size + 100).Bytes()
+	// Blocks 10-11 and 17-24 are copies of blocks 1-2 and 1-8.
+	copy(b[9*size:], b[:2*size])
+	copy(b[16*size:], b[:8*size])
+	var idx, data bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0, dedup.WithBlockNumberBase(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	st := w.Stats()
+	if st.LongestDupRun != 8 || st.LongestDupBytes != 8*size || st.LongestDupStart != 16+5 {
+		t.Fatalf("got run of %d blocks, %d bytes at block %d", st.LongestDupRun, st.LongestDupBytes, st.LongestDupStart)
+	}
+}
+
+func TestStatsInterval(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(1 << 20).Bytes()
+	// Create some duplicates
+	copy(b[512<<10:], b[:256<<10])
+	ch := make(chan dedup.StatsSnapshot, 100)
+	w, err := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.WithStatsInterval(100<<10, ch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	var snaps []dedup.StatsSnapshot
+	for s := range ch {
+		snaps = append(snaps, s)
+	}
+	// 10 intervals and the final snapshot.
+	if len(snaps) != 11 {
+		t.Fatal("expected 11 snapshots, got", len(snaps))
+	}
+	for i, s := range snaps[:10] {
+		if s.Bytes < int64(i+1)*100<<10 || s.Bytes >= int64(i+1)*100<<10+size {
+			t.Fatalf("snapshot %d at %d bytes", i, s.Bytes)
+		}
+		if s.Dropped != 0 || s.Time.IsZero() {
+			t.Fatalf("unexpected snapshot %+v", s)
+		}
+	}
+	last := snaps[len(snaps)-1]
+	if last.Stats != w.Stats() || last.Ratio() > 0.8 {
+		t.Fatalf("unexpected final snapshot %+v", last)
+	}
+
+	// A full channel must not block the writer.
+	ch = make(chan dedup.StatsSnapshot, 1)
+	w, err = dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.WithStatsInterval(size, ch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-ch; s.Blocks != 1 || s.Dropped != 0 {
+		t.Fatalf("unexpected snapshot %+v", s)
+	}
+
+	if _, err := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.WithStatsInterval(0, ch)); err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+}
+
+func TestResetChunker(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(512 << 10).Bytes()
+	first, second := b[:200<<10+123], b[200<<10+123:]
+
+	// hashes returns the fragment hashes of the input written by fn.
+	hashes := func(mode dedup.Mode, fn func(w dedup.Writer)) [][dedup.HashSize]byte {
+		out := make(chan dedup.Fragment, 10)
+		w, err := dedup.NewSplitter(out, mode, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res [][dedup.HashSize]byte
+		done := make(chan struct{})
+		go func() {
+			for f := range out {
+				res = append(res, f.Hash)
+			}
+			close(done)
+		}()
+		fn(w)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		return res
+	}
+	for _, mode := range []dedup.Mode{dedup.ModeFixed, dedup.ModeDynamic, dedup.ModeDynamicEntropy} {
+		want := hashes(mode, func(w dedup.Writer) {
+			w.Write(second)
+		})
+		got := hashes(mode, func(w dedup.Writer) {
+			w.Write(first)
+			w.Split()
+			w.ResetChunker()
+			w.Write(second)
+		})
+		nfirst := len(got) - len(want)
+		if nfirst <= 0 {
+			t.Fatal("too few fragments, mode", mode)
+		}
+		for i := range want {
+			if got[nfirst+i] != want[i] {
+				t.Fatalf("fragment %d differs after reset, mode %v", i, mode)
+			}
+		}
+
+		// Resetting must not end the current block.
+		// The input is smaller than the minimum fragment size,
+		// so it cannot contain a content defined boundary.
+		reset := hashes(mode, func(w dedup.Writer) {
+			w.Write(b[:20])
+			w.ResetChunker()
+			w.Write(b[20:40])
+		})
+		if len(reset) != 1 {
+			t.Fatal("expected 1 fragment, got", len(reset), "mode", mode)
+		}
+	}
+}
+
+func TestFixedWriterExactMultiple(t *testing.T) {
+	const size = 4 << 10
+	const blocks = 16
+	b := getBufferSize(blocks * size).Bytes()
+	// Create some duplicates
+	copy(b[8*size:], b[:4*size])
+
+	chunkings := []int{1, size / 2, size, size + 1, 3*size - 1, len(b)}
+	for _, inc := range []bool{false, true} {
+		var wantIdx, wantData, wantStream []byte
+		for _, chunk := range chunkings {
+			var idx, data, stream bytes.Buffer
+			w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0, dedup.WithIncrementalHash(inc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sw, err := dedup.NewStreamWriter(&stream, dedup.ModeFixed, size, blocks*size, dedup.WithIncrementalHash(inc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range []dedup.Writer{w, sw} {
+				for i := 0; i < len(b); i += chunk {
+					end := i + chunk
+					if end > len(b) {
+						end = len(b)
+					}
+					if n, err := w.Write(b[i:end]); err != nil || n != end-i {
+						t.Fatal("write failed", n, err)
+					}
+				}
+				// Splitting at a block boundary must not add a block.
+				w.Split()
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if s := w.Stats(); s.Blocks != blocks || s.Bytes != int64(len(b)) {
+					t.Fatalf("chunk %d: unexpected stats %+v", chunk, s)
+				}
+			}
+			if wantIdx == nil {
+				wantIdx, wantData, wantStream = idx.Bytes(), data.Bytes(), stream.Bytes()
+			} else if !bytes.Equal(wantIdx, idx.Bytes()) || !bytes.Equal(wantData, data.Bytes()) || !bytes.Equal(wantStream, stream.Bytes()) {
+				t.Fatalf("chunk %d: output differs", chunk)
+			}
+
+			r, err := dedup.NewReader(&idx, &data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes := r.BlockSizes()
+			if len(sizes) != blocks+1 || sizes[blocks] != 0 {
+				t.Fatalf("chunk %d: unexpected block sizes %v", chunk, sizes)
+			}
+			for _, n := range sizes[:blocks] {
+				if n != size {
+					t.Fatalf("chunk %d: unexpected block sizes %v", chunk, sizes)
+				}
+			}
+			out, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Close()
+			if !bytes.Equal(b, out) {
+				t.Fatalf("chunk %d: output mismatch", chunk)
+			}
+			sr, err := dedup.NewStreamReader(&stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err = ioutil.ReadAll(sr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sr.Close()
+			if !bytes.Equal(b, out) {
+				t.Fatalf("chunk %d: stream output mismatch", chunk)
+			}
+		}
+	}
+}
+
+func TestBlockPositions(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(512<<10 + 100).Bytes()
+	// Create some duplicates
+	copy(b[256<<10:], b[:128<<10])
+	type pos struct {
+		n      int
+		hash   [dedup.HashSize]byte
+		offset int64
+		length int
+	}
+	check := func(t *testing.T, data []byte, got []pos) {
+		var want int64
+		for _, p := range got {
+			if p.offset != want {
+				t.Fatalf("block %d: got offset %d, want %d", p.n, p.offset, want)
+			}
+			if p.offset+int64(p.length) > int64(len(data)) {
+				t.Fatalf("block %d: outside block stream", p.n)
+			}
+			if sha1.Sum(data[p.offset:p.offset+int64(p.length)]) != p.hash {
+				t.Fatalf("block %d: hash mismatch", p.n)
+			}
+			want += int64(p.length)
+		}
+		if want != int64(len(data)) {
+			t.Fatalf("got %d bytes, block stream is %d bytes", want, len(data))
+		}
+	}
+	for _, mode := range []dedup.Mode{dedup.ModeFixed, dedup.ModeDynamic} {
+		t.Run(fmt.Sprint(mode), func(t *testing.T) {
+			var got []pos
+			var idx, data bytes.Buffer
+			w, err := dedup.NewWriter(&idx, &data, mode, size, 0,
+				dedup.WithBlockPositions(func(n int, h [dedup.HashSize]byte, offset int64, length int) {
+					got = append(got, pos{n: n, hash: h, offset: offset, length: length})
+				}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) == 0 || len(got) >= w.Stats().Blocks {
+				t.Fatal("unexpected number of positions:", len(got))
+			}
+			check(t, data.Bytes(), got)
+
+			got = nil
+			data.Reset()
+			w, err = dedup.NewBlocksOnlyWriter(&data, mode, size, func([dedup.HashSize]byte, int) error { return nil },
+				dedup.WithBlockPositions(func(n int, h [dedup.HashSize]byte, offset int64, length int) {
+					got = append(got, pos{n: n, hash: h, offset: offset, length: length})
+				}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+				t.Fatal(err)
+			}
+			check(t, data.Bytes(), got)
+		})
+	}
+
+	// Not supported by writers without a separate block stream.
+	fn := dedup.WithBlockPositions(func(int, [dedup.HashSize]byte, int64, int) {})
+	if _, err := dedup.NewStreamWriter(ioutil.Discard, dedup.ModeFixed, size, 0, fn); err == nil {
+		t.Fatal("expected error from stream writer")
+	}
+	if _, err := dedup.NewShardedWriter(ioutil.Discard, []io.Writer{ioutil.Discard}, dedup.ModeFixed, size, 0, fn); err == nil {
+		t.Fatal("expected error from sharded writer")
+	}
+}
+
+func TestPipelineShards(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(1<<20 + 100).Bytes()
+	// Create some duplicates
+	copy(b[512<<10:], b[:256<<10])
+	for _, mode := range []dedup.Mode{dedup.ModeFixed, dedup.ModeDynamic} {
+		var wantIdx, wantData []byte
+		for _, n := range []int{1, 2, 3, 64} {
+			var idx, data bytes.Buffer
+			w, err := dedup.NewWriter(&idx, &data, mode, size, 0, dedup.WithPipelineShards(n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+				t.Fatal(err)
+			}
+			if n == 1 {
+				wantIdx, wantData = idx.Bytes(), data.Bytes()
+				continue
+			}
+			if !bytes.Equal(idx.Bytes(), wantIdx) || !bytes.Equal(data.Bytes(), wantData) {
+				t.Fatalf("mode %d, %d pipelines: output mismatch", mode, n)
+			}
+		}
+	}
+	if _, err := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.WithPipelineShards(0)); err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+}
+
+func TestHashedTail(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(16 << 10).Bytes()
+	tail := b[:100]
+	for _, hashed := range []bool{false, true} {
+		var idx, data bytes.Buffer
+		w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0, dedup.WithHashedTail(hashed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(tail)
+		w.Split()
+		w.Write(b[100:])
+		w.Split()
+		w.Write(tail)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		want := sha1.Sum(tail)
+		found := 0
+		w.ForEachIndexEntry(func(h [dedup.HashSize]byte, n int) bool {
+			if h == want {
+				found = n
+			}
+			return true
+		})
+		// The tail is the last block when it is hashed.
+		if wantN := map[bool]int{false: 1, true: w.Blocks()}[hashed]; found != wantN {
+			t.Fatalf("hashed %v: tail entry is block %d, want %d", hashed, found, wantN)
+		}
+		// A hashed tail is deduplicated.
+		if wantSize := map[bool]int{false: len(b) + len(tail), true: len(b)}[hashed]; data.Len() != wantSize {
+			t.Fatalf("hashed %v: got %d bytes of block data, want %d", hashed, data.Len(), wantSize)
+		}
+		r, err := dedup.NewReader(&idx, &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, append(append([]byte{}, b...), tail...)) {
+			t.Fatal("content mismatch")
+		}
+	}
+}
+
+func TestCloseResult(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(256<<10 + 100).Bytes()
+	// Create some duplicates
+	copy(b[128<<10:], b[:64<<10])
+	var idx, data, stream bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeDynamic, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw, err := dedup.NewStreamWriter(&stream, dedup.ModeDynamic, size, 64*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []dedup.Writer{w, sw} {
+		w.Write(b)
+		if _, err := w.CloseResult(); err != dedup.ErrNotClosed {
+			t.Fatal("expected ErrNotClosed, got", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := w.CloseResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Stats != w.Stats() || res.Bytes != int64(len(b)) || res.NewBlocks == res.Blocks {
+		t.Fatalf("unexpected stats: %+v", res.Stats)
+	}
+	if res.IndexBytes != int64(idx.Len()) || res.BlockBytes != int64(data.Len()) {
+		t.Fatalf("got %d/%d output bytes, want %d/%d", res.IndexBytes, res.BlockBytes, idx.Len(), data.Len())
+	}
+	if res.Duration <= 0 {
+		t.Fatal("no duration")
+	}
+	res, err = sw.CloseResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.OutputBytes() != int64(stream.Len()) || res.BlockBytes != 0 {
+		t.Fatalf("got %d/%d output bytes, want %d/0", res.IndexBytes, res.BlockBytes, stream.Len())
+	}
+}
+
+func TestDuplicateBlocks(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(64 * size).Bytes()
+	copy(b[32*size:], b[:32*size])
+	var idx, data bytes.Buffer
+	w, err := dedup.NewWriter(&idx, &data, dedup.ModeFixed, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{0, 32} {
+		if _, err := w.Write(b[i*32*size : (i+1)*32*size]); err != nil {
+			t.Fatal(err)
+		}
+		// The count is available when the blocks have been processed.
+		if err := w.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if got := w.DuplicateBlocks(); got != want {
+			t.Fatal("expected", want, "duplicates, got", got)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if w.DuplicateBlocks() != w.Stats().DuplicateBlocks() {
+		t.Fatal("duplicate count mismatch")
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	const size = 4 << 10
+	b := getBufferSize(512 << 10).Bytes()
+	copy(b[256<<10:], b[:128<<10])
+	for _, lengthHash := range []bool{false, true} {
+		var wantIdx, wantData bytes.Buffer
+		w, err := dedup.NewWriter(&wantIdx, &wantData, dedup.ModeDynamic, size, 0, dedup.WithLengthInHash(lengthHash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range []int{1, 2, 1000} {
+			var idx, data bytes.Buffer
+			w, err := dedup.NewWriter(&idx, &data, dedup.ModeDynamic, size, 0, dedup.WithLengthInHash(lengthHash), dedup.WithConcurrency(n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := dedup.Pack(w, bytes.NewBuffer(b)); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(wantIdx.Bytes(), idx.Bytes()) || !bytes.Equal(wantData.Bytes(), data.Bytes()) {
+				t.Fatal("output mismatch with concurrency", n)
+			}
+		}
+	}
+	_, err := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.WithConcurrency(-1))
+	if err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+}
+
+func TestWriterHeader(t *testing.T) {
+	const size = 64 << 10
+	idx := bytes.Buffer{}
+	w, err := dedup.NewWriter(&idx, ioutil.Discard, dedup.ModeFixed, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := w.Header()
+	if !bytes.Equal(h, idx.Bytes()) {
+		t.Fatalf("header mismatch, got %x, index %x", h, idx.Bytes())
+	}
+	// Format 1, 64K as varint.
+	if len(h) != 4 {
+		t.Fatal("unexpected header length", len(h))
+	}
+	w.Close()
+
+	stream := bytes.Buffer{}
+	w, err = dedup.NewStreamWriter(&stream, dedup.ModeFixed, size, 1000*size, dedup.WithDeltaEncoding(0.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = w.Header()
+	if !bytes.Equal(h, stream.Bytes()) {
+		t.Fatalf("header mismatch, got %x, stream %x", h, stream.Bytes())
+	}
+	w.Close()
+
+	w, err = dedup.NewSplitter(make(chan dedup.Fragment), dedup.ModeFixed, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(w.Header()) != 0 {
+		t.Fatal("expected no header on splitter")
+	}
+	go w.Close()
+}
+
+func TestBlocksOnlyWriter(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(10 << 20).Bytes()
+	// Second half is a copy of the first.
+	copy(b[5<<20:], b[:5<<20])
+
+	data := bytes.Buffer{}
+	store := make(map[[dedup.HashSize]byte][]byte)
+	offset := 0
+	w, err := dedup.NewBlocksOnlyWriter(&data, dedup.ModeFixed, size, func(hash [dedup.HashSize]byte, n int) error {
+		store[hash] = data.Bytes()[offset : offset+n]
+		offset += n
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Len() != 5<<20 {
+		t.Fatalf("expected %d bytes written, got %d", 5<<20, data.Len())
+	}
+	if len(store) != (5<<20)/size {
+		t.Fatalf("expected %d unique blocks, got %d", (5<<20)/size, len(store))
+	}
+	for hash, v := range store {
+		if sha1.Sum(v) != hash {
+			t.Fatal("hash mismatch")
+		}
+	}
+
+	// Errors from the callback should be returned.
+	errTest := errors.New("test error")
+	w, err = dedup.NewBlocksOnlyWriter(ioutil.Discard, dedup.ModeFixed, size, func(hash [dedup.HashSize]byte, n int) error {
+		return errTest
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != errTest {
+		t.Fatal("expected test error, got", err)
+	}
+}
+
+func TestLengthInHash(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(1 << 20).Bytes()
+
+	out := make(chan dedup.Fragment, 100)
+	w, err := dedup.NewSplitter(out, dedup.ModeFixed, size, dedup.WithLengthInHash(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for f := range out {
+		h := sha1.New()
+		var length [8]byte
+		binary.LittleEndian.PutUint64(length[:], uint64(len(f.Payload)))
+		h.Write(length[:])
+		h.Write(f.Payload)
+		if !bytes.Equal(h.Sum(nil), f.Hash[:]) {
+			t.Fatal("hash mismatch on fragment", f.N)
+		}
+	}
+
+	idx := bytes.Buffer{}
+	data := bytes.Buffer{}
+	w, err = dedup.NewWriter(&idx, &data, dedup.ModeDynamic, size, 0, dedup.WithLengthInHash(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := dedup.NewReader(&idx, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, got) {
+		t.Fatal("output mismatch")
+	}
+}
+
+func TestByteWindow(t *testing.T) {
+	const size = 64 << 10
+	const window = 20 * size
+	b := getBufferSize(4 << 20).Bytes()
+	// Repeat data at two distances, one inside and one outside the window.
+	copy(b[1<<20:], b[:256<<10])
+	copy(b[3<<20:], b[:256<<10])
+	b = append(b, getVersionedDocuments(256<<10, 4, 10)...)
+
+	data := bytes.Buffer{}
+	w, err := dedup.NewStreamWriter(&data, dedup.ModeDynamic, size, size, dedup.WithByteWindow(window), dedup.WithDeltaEncoding(0.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("Input size:", len(b), "Output size:", data.Len())
+	if data.Len() >= len(b) {
+		t.Fatal("no deduplication")
+	}
+	r, err := dedup.NewStreamReader(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.MaxBackrefBlocks() != 0 {
+		t.Fatal("expected no block limit, got", r.MaxBackrefBlocks())
+	}
+	if r.MaxMem() != window+size {
+		t.Fatalf("expected max mem %d, got %d", window+size, r.MaxMem())
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if !bytes.Equal(b, got) {
+		t.Fatal("stream output mismatch")
+	}
+
+	idx := bytes.Buffer{}
+	data.Reset()
+	w, err = dedup.NewWriter(&idx, &data, dedup.ModeDynamic, size, 0, dedup.WithByteWindow(window))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir, err := dedup.NewReader(&idx, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = ioutil.ReadAll(ir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir.Close()
+	if !bytes.Equal(b, got) {
+		t.Fatal("indexed output mismatch")
+	}
+
+	_, err = dedup.NewStreamWriter(&data, dedup.ModeDynamic, size, size, dedup.WithByteWindow(size-1))
+	if err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+}
+
+func TestWriteChunkSize(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(10 << 20).Bytes()
+	b = append(b, b[:1<<20]...)
+
+	var want []byte
+	for i, opts := range [][]dedup.Option{nil, {dedup.WithWriteChunkSize(100 << 10)}, {dedup.WithWriteChunkSize(1000)}} {
+		idx := bytes.Buffer{}
+		data := bytes.Buffer{}
+		w, err := dedup.NewWriter(&idx, &data, dedup.ModeDynamic, size, 0, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Write everything in a single call.
+		n, err := w.Write(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(b) {
+			t.Fatalf("expected %d bytes written, got %d", len(b), n)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Splitting writes should not affect the output.
+		got := append(idx.Bytes(), data.Bytes()...)
+		if i == 0 {
+			want = got
+			continue
+		}
+		if !bytes.Equal(want, got) {
+			t.Fatal("output mismatch with options", i)
+		}
+	}
+
+	_, err := dedup.NewWriter(ioutil.Discard, ioutil.Discard, dedup.ModeFixed, size, 0, dedup.WithWriteChunkSize(-1))
+	if err != dedup.ErrInvalidOption {
+		t.Fatal("expected ErrInvalidOption, got", err)
+	}
+}
+
+// failWriter will fail all writes after limit bytes have been written.
+type failWriter struct {
+	bytes.Buffer
+	limit int
+}
+
+var errFailWriter = errors.New("write failed")
+
+func (f *failWriter) Write(b []byte) (int, error) {
+	if f.Len()+len(b) > f.limit {
+		n, _ := f.Buffer.Write(b[:f.limit-f.Len()])
+		return n, errFailWriter
+	}
+	return f.Buffer.Write(b)
+}
+
+func TestCloseRetry(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(1<<20 + 100).Bytes()
+
+	// Reference output.
+	want := bytes.Buffer{}
+	w, err := dedup.NewStreamWriter(&want, dedup.ModeFixed, size, 10*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail inside the final block.
+	out := &failWriter{limit: want.Len() - 10}
+	w, err = dedup.NewStreamWriter(out, dedup.ModeFixed, size, 10*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != errFailWriter {
+		t.Fatal("expected errFailWriter, got", err)
+	}
+	err = w.Close()
+	if err != errFailWriter {
+		t.Fatal("expected errFailWriter on retry, got", err)
+	}
+	// Fix the output and retry.
+	out.limit = want.Len()
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want.Bytes(), out.Bytes()) {
+		t.Fatal("output mismatch after retry")
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal("expected nil on repeated close, got", err)
+	}
+
+	// Indexed writer, failing on the final block data.
+	idx := bytes.Buffer{}
+	data := &failWriter{limit: len(b) - 10}
+	w, err = dedup.NewWriter(&idx, data, dedup.ModeFixed, size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	err = w.Close()
+	if err != errFailWriter {
+		t.Fatal("expected errFailWriter, got", err)
+	}
+	data.limit = len(b)
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := dedup.NewReader(&idx, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, got) {
+		t.Fatal("indexed output mismatch after retry")
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	const size = 64 << 10
+	b := getBufferSize(1<<20 + 100).Bytes()
+	want := sha1.Sum(b)
+
+	for _, mode := range []dedup.Mode{dedup.ModeFixed, dedup.ModeDynamic} {
+		w, err := dedup.NewWriter(ioutil.Discard, ioutil.Discard, mode, size, 0, dedup.WithContentHash(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(w, bytes.NewBuffer(b[:1000]))
+		err = w.WriteChunk(b[1000:2000])
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(w, bytes.NewBuffer(b[2000:]))
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.ContentHash(); got != want {
+			t.Fatalf("mode %d: content hash mismatch, got %x, want %x", mode, got, want)
+		}
+	}
+
+	// The standalone hash must match.
+	h := dedup.NewContentHash()
+	io.Copy(h, bytes.NewBuffer(b))
+	if h.Size() != dedup.HashSize || !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Fatalf("content hash mismatch, got %x, want %x", h.Sum(nil), want)
+	}
+
+	w, err := dedup.NewStreamWriter(ioutil.Discard, dedup.ModeFixed, size, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(w, bytes.NewBuffer(b))
+	w.Close()
+	if got := w.ContentHash(); got != [dedup.HashSize]byte{} {
+		t.Fatal("expected zero hash when disabled, got", got)
+	}
+}
+
 // This doesn't actually test anything, but prints probabilities to log
 func TestBirthdayProblem(t *testing.T) {
 	t.Log("Hash size is", dedup.HashSize*8, "bits")